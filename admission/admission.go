@@ -0,0 +1,363 @@
+package admission
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/agl/ed25519"
+	"github.com/incentivized-mesh-infrastructure/scrooge/types"
+)
+
+// PinMode is what trust-on-first-use pins a neighbor's key to.
+type PinMode string
+
+const (
+	PinNone    PinMode = "off"
+	PinAddress PinMode = "address" // The address the key was first seen at
+	// PinMAC pins to the MAC address behind the address the key was first
+	// seen at, so that it survives a change of IPv6 address. Until the MAC is
+	// in the neighbor table the key is pinned to the address.
+	PinMAC PinMode = "mac"
+)
+
+func ParsePinMode(s string) (PinMode, error) {
+	switch PinMode(s) {
+	case PinNone, PinAddress, PinMAC:
+		return PinMode(s), nil
+	}
+	return "", errors.New("unknown pin mode: " + s)
+}
+
+// Policy decides which keys may become neighbors.
+type Policy struct {
+	Allow        map[[ed25519.PublicKeySize]byte]bool // Only these keys are admitted, unless it is empty
+	Deny         map[[ed25519.PublicKeySize]byte]bool // These keys are never admitted
+	Pin          PinMode
+	MaxNeighbors int // Most confirmed neighbors at once, 0 for no cap
+}
+
+type Pin struct {
+	Address string
+	MAC     string
+}
+
+// Admission applies a Policy to every message, and keeps the pins of
+// confirmed neighbors in PinFile if it is set.
+type Admission struct {
+	PinFile   string
+	LookupMAC func(ip net.IP, iface string) (string, error)
+	policy    Policy
+	pins      map[string]Pin // By base64 encoded public key
+	macs      map[string]cachedMAC
+	mutex     sync.Mutex
+}
+
+// MACCacheTime is how long a MAC address looked up in the neighbor table is
+// used for, so that we don't run `ip neigh` for every message.
+const MACCacheTime = time.Minute
+
+// maxCachedMACs bounds the MAC cache, since anyone on the link can send from
+// as many addresses as they like.
+const maxCachedMACs = 1024
+
+type cachedMAC struct {
+	mac     string // Empty if it wasn't in the neighbor table
+	expires time.Time
+}
+
+// New loads the pins in pinFile, if it is set and exists.
+func New(policy Policy, pinFile string) (*Admission, error) {
+	admission := &Admission{
+		PinFile:   pinFile,
+		LookupMAC: NeighborMAC,
+		policy:    policy,
+		pins:      map[string]Pin{},
+	}
+
+	if pinFile == "" {
+		return admission, nil
+	}
+
+	b, err := ioutil.ReadFile(pinFile)
+	if os.IsNotExist(err) {
+		return admission, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &admission.pins)
+	if err != nil {
+		return nil, err
+	}
+
+	return admission, nil
+}
+
+// Reload replaces the policy. Pins are kept. Keys that the new policy
+// doesn't admit are turned away from their next message on.
+func (self *Admission) Reload(policy Policy) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.policy = policy
+}
+
+// Admit returns an error if the key shouldn't be a neighbor, given that its
+// message came from source and that we have neighbors confirmed neighbors
+// already. known says whether the key is one of them. It doesn't pin
+// anything, Pin does once the neighbor is confirmed.
+func (self *Admission) Admit(
+	publicKey [ed25519.PublicKeySize]byte,
+	source *net.UDPAddr,
+	neighbors int,
+	known bool,
+) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.policy.Deny[publicKey] {
+		return errors.New("neighbor denied")
+	}
+
+	if len(self.policy.Allow) != 0 && !self.policy.Allow[publicKey] {
+		return errors.New("neighbor not allowed")
+	}
+
+	if !known && self.policy.MaxNeighbors != 0 &&
+		neighbors >= self.policy.MaxNeighbors {
+		return errors.New("too many neighbors")
+	}
+
+	// A key without a pin may come from anywhere, so there is no MAC to
+	// look up for it
+	_, pinned := self.pins[base64.StdEncoding.EncodeToString(publicKey[:])]
+	if pinned && (self.policy.Pin == PinAddress || self.policy.Pin == PinMAC) {
+		_, err := self.checkPin(publicKey, source)
+		return err
+	}
+
+	return nil
+}
+
+// Pin pins a key to source if it isn't pinned yet, or to the MAC behind
+// source once that is known. It is only called for confirmed neighbors, so
+// a replayed or spoofed message can't pin someone else's key.
+func (self *Admission) Pin(
+	publicKey [ed25519.PublicKeySize]byte,
+	source *net.UDPAddr,
+) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.policy.Pin != PinAddress && self.policy.Pin != PinMAC {
+		return nil
+	}
+
+	pin, err := self.checkPin(publicKey, source)
+	if err != nil || pin == nil {
+		return err
+	}
+
+	self.pins[base64.StdEncoding.EncodeToString(publicKey[:])] = *pin
+	return self.save()
+}
+
+// checkPin returns an error if the key is pinned somewhere other than
+// source, and the pin it should have if that differs from the one it has.
+func (self *Admission) checkPin(
+	publicKey [ed25519.PublicKeySize]byte,
+	source *net.UDPAddr,
+) (*Pin, error) {
+	address := source.IP.String()
+
+	var mac string
+	if self.policy.Pin == PinMAC {
+		// Not knowing the MAC yet is fine, the address pin covers it
+		mac = self.lookupMAC(source)
+	}
+
+	pin, ok := self.pins[base64.StdEncoding.EncodeToString(publicKey[:])]
+	if ok {
+		switch {
+		case pin.MAC != "" && self.policy.Pin == PinMAC:
+			if pin.Address == address && (mac == "" || mac == pin.MAC) {
+				return nil, nil
+			}
+			// A new address is fine as long as it belongs to the same MAC
+			if mac != pin.MAC {
+				return nil, errors.New("neighbor key pinned to MAC " + pin.MAC)
+			}
+		case pin.Address != address:
+			return nil, errors.New("neighbor key pinned to " + pin.Address)
+		case mac == "":
+			return nil, nil
+		}
+	}
+
+	return &Pin{
+		Address: address,
+		MAC:     mac,
+	}, nil
+}
+
+// lookupMAC returns the MAC behind source, or nothing if it isn't in the
+// neighbor table, from the cache if it was looked up recently.
+func (self *Admission) lookupMAC(source *net.UDPAddr) string {
+	now := time.Now()
+	key := source.IP.String() + "%" + source.Zone
+
+	cached, ok := self.macs[key]
+	if ok && now.Before(cached.expires) {
+		return cached.mac
+	}
+
+	if len(self.macs) >= maxCachedMACs {
+		for key, cached := range self.macs {
+			if !now.Before(cached.expires) {
+				delete(self.macs, key)
+			}
+		}
+	}
+	if self.macs == nil || len(self.macs) >= maxCachedMACs {
+		self.macs = map[string]cachedMAC{}
+	}
+
+	mac, _ := self.LookupMAC(source.IP, source.Zone)
+	self.macs[key] = cachedMAC{
+		mac:     mac,
+		expires: now.Add(MACCacheTime),
+	}
+	return mac
+}
+
+func (self *Admission) save() error {
+	if self.PinFile == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(self.pins)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(self.PinFile), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmp := self.PinFile + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, self.PinFile)
+}
+
+// Pins returns a copy of every pin, by base64 encoded public key.
+func (self *Admission) Pins() map[string]Pin {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	pins := make(map[string]Pin, len(self.pins))
+	for key, pin := range self.pins {
+		pins[key] = pin
+	}
+	return pins
+}
+
+// Unpin forgets the pin of a key, so that it is pinned again wherever it is
+// seen next, after a neighbor's hardware has been replaced for example.
+func (self *Admission) Unpin(publicKey [ed25519.PublicKeySize]byte) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	delete(self.pins, base64.StdEncoding.EncodeToString(publicKey[:]))
+	return self.save()
+}
+
+// Move moves the pin of a neighbor that rotated its key from oldKey to
+// newKey, so that the new key is held to where the old one was.
+func (self *Admission) Move(
+	oldKey [ed25519.PublicKeySize]byte,
+	newKey [ed25519.PublicKeySize]byte,
+) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	pin, ok := self.pins[base64.StdEncoding.EncodeToString(oldKey[:])]
+	if !ok {
+		return nil
+	}
+
+	self.pins[base64.StdEncoding.EncodeToString(newKey[:])] = pin
+	delete(self.pins, base64.StdEncoding.EncodeToString(oldKey[:]))
+	return self.save()
+}
+
+// LoadKeys reads a file with one base64 encoded public key per line. Empty
+// lines and lines starting with # are skipped.
+func LoadKeys(path string) (map[[ed25519.PublicKeySize]byte]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keys := map[[ed25519.PublicKeySize]byte]bool{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		b, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return nil, errors.New("bad public key in " + path + ": " + line)
+		}
+
+		keys[types.BytesToPublicKey(b)] = true
+	}
+
+	return keys, scanner.Err()
+}
+
+// NeighborMAC looks ip up in the kernel's neighbor table.
+func NeighborMAC(ip net.IP, iface string) (string, error) {
+	args := []string{"neigh", "show", "to", ip.String()}
+	if iface != "" {
+		args = append(args, "dev", iface)
+	}
+
+	out, err := exec.Command("ip", args...).Output()
+	if err != nil {
+		return "", err
+	}
+
+	return ParseNeighborMAC(string(out))
+}
+
+var lladdrRegexp = regexp.MustCompile(`lladdr ([0-9a-f:]+)`)
+
+// ParseNeighborMAC parses the output of `ip neigh show to <ip>`.
+func ParseNeighborMAC(s string) (string, error) {
+	match := lladdrRegexp.FindStringSubmatch(s)
+	if match == nil {
+		return "", errors.New("no MAC address in neighbor table")
+	}
+	return match[1], nil
+}
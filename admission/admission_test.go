@@ -0,0 +1,296 @@
+package admission
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/agl/ed25519"
+)
+
+var (
+	pubkey1 = [ed25519.PublicKeySize]byte{44, 176, 80, 246, 247, 71, 5, 229, 108, 111, 158, 77, 18, 116, 98, 28, 84, 59, 215, 93, 182, 34, 240, 5, 147, 229, 211, 253, 44, 221, 237, 85}
+	pubkey2 = [ed25519.PublicKeySize]byte{175, 110, 12, 95, 82, 169, 239, 110, 41, 163, 183, 93, 77, 197, 35, 41, 35, 203, 94, 200, 216, 6, 41, 129, 170, 12, 8, 97, 215, 28, 123, 162}
+	b64key1 = "LLBQ9vdHBeVsb55NEnRiHFQ71122IvAFk+XT/Szd7VU="
+	addr1   = &net.UDPAddr{IP: net.ParseIP("fe80::1"), Zone: "foo0"}
+	addr2   = &net.UDPAddr{IP: net.ParseIP("fe80::2"), Zone: "foo0"}
+)
+
+func TestAdmit(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    Policy
+		neighbors int
+		known     bool
+		admitted  bool
+	}{
+		{"open", Policy{}, 0, false, true},
+		{"denied", Policy{Deny: map[[ed25519.PublicKeySize]byte]bool{pubkey1: true}}, 0, false, false},
+		{"denied when known", Policy{Deny: map[[ed25519.PublicKeySize]byte]bool{pubkey1: true}}, 1, true, false},
+		{"allowed", Policy{Allow: map[[ed25519.PublicKeySize]byte]bool{pubkey1: true}}, 0, false, true},
+		{"not allowed", Policy{Allow: map[[ed25519.PublicKeySize]byte]bool{pubkey2: true}}, 0, false, false},
+		{"under cap", Policy{MaxNeighbors: 2}, 1, false, true},
+		{"at cap", Policy{MaxNeighbors: 2}, 2, false, false},
+		{"at cap when known", Policy{MaxNeighbors: 2}, 2, true, true},
+	}
+
+	for _, test := range tests {
+		admission, err := New(test.policy, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = admission.Admit(pubkey1, addr1, test.neighbors, test.known)
+		if (err == nil) != test.admitted {
+			t.Errorf("%v: wrong result: %v", test.name, err)
+		}
+	}
+}
+
+func TestPinAddress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scrooge-admission")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pinFile := filepath.Join(dir, "pins.json")
+
+	admission, err := New(Policy{Pin: PinAddress}, pinFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Admitting a key doesn't pin it, only confirming it does
+	err = admission.Admit(pubkey1, addr2, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(admission.Pins()) != 0 {
+		t.Fatal("key pinned before it was confirmed: ", admission.Pins())
+	}
+
+	err = admission.Pin(pubkey1, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = admission.Admit(pubkey1, addr2, 1, true)
+	if err == nil {
+		t.Fatal("pinned key admitted from another address")
+	}
+	err = admission.Pin(pubkey1, addr2)
+	if err == nil {
+		t.Fatal("pinned key pinned to another address")
+	}
+
+	// Pins survive a restart
+	admission, err = New(Policy{Pin: PinAddress}, pinFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = admission.Admit(pubkey1, addr2, 1, true)
+	if err == nil {
+		t.Fatal("pin lost on restart")
+	}
+
+	err = admission.Unpin(pubkey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = admission.Admit(pubkey1, addr2, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scrooge-admission")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pinFile := filepath.Join(dir, "pins.json")
+
+	admission, err := New(Policy{Pin: PinAddress}, pinFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = admission.Pin(pubkey1, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = admission.Move(pubkey1, pubkey2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new key is held to where the old one was, even after a restart
+	admission, err = New(Policy{Pin: PinAddress}, pinFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := admission.Pins()[b64key1]; ok {
+		t.Fatal("old key still pinned: ", admission.Pins())
+	}
+	err = admission.Admit(pubkey2, addr2, 1, true)
+	if err == nil {
+		t.Fatal("pin not moved to the new key")
+	}
+	err = admission.Admit(pubkey2, addr1, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPinMAC(t *testing.T) {
+	macs := map[string]string{}
+	lookups := 0
+
+	admission, err := New(Policy{Pin: PinMAC}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admission.LookupMAC = func(ip net.IP, iface string) (string, error) {
+		lookups++
+		mac, ok := macs[ip.String()]
+		if !ok {
+			return "", errors.New("no MAC address in neighbor table")
+		}
+		return mac, nil
+	}
+	// Pin and check, looking the MAC up again
+	pin := func(source *net.UDPAddr) error {
+		admission.macs = nil
+		err := admission.Admit(pubkey1, source, 1, true)
+		if err != nil {
+			return err
+		}
+		return admission.Pin(pubkey1, source)
+	}
+
+	// Pinned to the address until the MAC is known
+	err = pin(addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pin(addr2)
+	if err == nil {
+		t.Fatal("key admitted from another address before its MAC was known")
+	}
+
+	macs["fe80::1"] = "02:00:00:00:00:01"
+	err = pin(addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admission.Pins()[b64key1].MAC != "02:00:00:00:00:01" {
+		t.Fatal("MAC not pinned: ", admission.Pins())
+	}
+
+	// The same MAC may move to another address, another MAC may not
+	macs["fe80::2"] = "02:00:00:00:00:01"
+	err = pin(addr2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	macs["fe80::1"] = "02:00:00:00:00:02"
+	err = pin(addr1)
+	if err == nil {
+		t.Fatal("key admitted from another MAC")
+	}
+
+	// Lookups are cached
+	lookups = 0
+	for i := 0; i < 3; i++ {
+		admission.Admit(pubkey1, addr2, 1, true)
+	}
+	if lookups != 1 {
+		t.Fatal("MAC looked up for every message: ", lookups)
+	}
+
+	// Keys without a pin are admitted without a lookup
+	lookups = 0
+	admission.macs = nil
+	err = admission.Admit(pubkey2, addr1, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lookups != 0 {
+		t.Fatal("MAC looked up for a key without a pin: ", lookups)
+	}
+}
+
+func TestReload(t *testing.T) {
+	admission, err := New(Policy{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = admission.Admit(pubkey1, addr1, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admission.Reload(Policy{Deny: map[[ed25519.PublicKeySize]byte]bool{pubkey1: true}})
+
+	err = admission.Admit(pubkey1, addr1, 1, true)
+	if err == nil {
+		t.Fatal("key admitted after being denied")
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	file, err := ioutil.TempFile("", "scrooge-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString("# neighbors\nLLBQ9vdHBeVsb55NEnRiHFQ71122IvAFk+XT/Szd7VU=\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	keys, err := LoadKeys(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !keys[pubkey1] {
+		t.Fatal("wrong keys: ", keys)
+	}
+
+	err = ioutil.WriteFile(file.Name(), []byte("flerp\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadKeys(file.Name())
+	if err == nil {
+		t.Fatal("no error for bad key")
+	}
+}
+
+func TestParseNeighborMAC(t *testing.T) {
+	mac, err := ParseNeighborMAC("fe80::1 dev eth0 lladdr 02:fc:00:00:00:01 router REACHABLE\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mac != "02:fc:00:00:00:01" {
+		t.Fatal("wrong MAC: ", mac)
+	}
+
+	_, err = ParseNeighborMAC("fe80::1 dev eth0 FAILED\n")
+	if err == nil {
+		t.Fatal("no error without lladdr")
+	}
+}
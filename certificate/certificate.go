@@ -0,0 +1,270 @@
+package certificate
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/agl/ed25519"
+)
+
+// Certificate is an authority's word that a public key belongs to a vetted
+// node, until Expiry. Attributes are whatever else the authority wants to
+// say about the node, like its owner or location.
+type Certificate struct {
+	PublicKey  [ed25519.PublicKeySize]byte
+	Expiry     time.Time
+	Attributes url.Values
+	Signature  [ed25519.SignatureSize]byte
+}
+
+// scrooge_certificate <publicKey> <expiry unix seconds> <url encoded attributes>
+func (self *Certificate) signed() string {
+	return fmt.Sprintf(
+		"scrooge_certificate %v %v %v",
+		base64.StdEncoding.EncodeToString(self.PublicKey[:]),
+		self.Expiry.Unix(),
+		self.Attributes.Encode(),
+	)
+}
+
+// Issue signs a certificate for publicKey with the authority's private key.
+func Issue(
+	publicKey [ed25519.PublicKeySize]byte,
+	expiry time.Time,
+	attributes url.Values,
+	authorityPrivateKey [ed25519.PrivateKeySize]byte,
+) *Certificate {
+	cert := &Certificate{
+		PublicKey:  publicKey,
+		Expiry:     time.Unix(expiry.Unix(), 0),
+		Attributes: attributes,
+	}
+	cert.Signature = *ed25519.Sign(&authorityPrivateKey, []byte(cert.signed()))
+	return cert
+}
+
+// String returns the certificate as a single base64 token, which is how it
+// is sent in hellos and kept in files.
+func (self *Certificate) String() string {
+	return base64.StdEncoding.EncodeToString([]byte(
+		self.signed() + " " +
+			base64.StdEncoding.EncodeToString(self.Signature[:]),
+	))
+}
+
+// Parse parses a certificate made by String. It doesn't check the signature,
+// Authority.Verify does.
+func Parse(s string) (*Certificate, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Split(string(b), " ")
+	if len(fields) != 5 || fields[0] != "scrooge_certificate" {
+		return nil, errors.New("malformed certificate")
+	}
+
+	cert := &Certificate{}
+
+	publicKey, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return nil, errors.New("malformed certificate public key")
+	}
+	copy(cert.PublicKey[:], publicKey)
+
+	expiry, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	cert.Expiry = time.Unix(expiry, 0)
+
+	cert.Attributes, err = url.ParseQuery(fields[3])
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(fields[4])
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return nil, errors.New("malformed certificate signature")
+	}
+	copy(cert.Signature[:], signature)
+
+	return cert, nil
+}
+
+// CRL lists the public keys whose certificates an authority has revoked.
+// A newer CRL replaces an older one, so it has to list every revoked key
+// whose certificate hasn't expired yet.
+type CRL struct {
+	Issued    time.Time
+	Revoked   map[[ed25519.PublicKeySize]byte]bool
+	Signature [ed25519.SignatureSize]byte
+}
+
+// scrooge_crl <issued unix seconds> <comma separated revoked publicKeys>
+func (self *CRL) signed() string {
+	keys := make([]string, 0, len(self.Revoked))
+	for publicKey := range self.Revoked {
+		keys = append(keys, base64.StdEncoding.EncodeToString(publicKey[:]))
+	}
+	// Map order is random, the signature can't be
+	sort.Strings(keys)
+
+	return fmt.Sprintf(
+		"scrooge_crl %v %v",
+		self.Issued.Unix(),
+		strings.Join(keys, ","),
+	)
+}
+
+// IssueCRL signs a CRL revoking publicKeys with the authority's private key.
+func IssueCRL(
+	issued time.Time,
+	publicKeys [][ed25519.PublicKeySize]byte,
+	authorityPrivateKey [ed25519.PrivateKeySize]byte,
+) *CRL {
+	crl := &CRL{
+		Issued:  time.Unix(issued.Unix(), 0),
+		Revoked: map[[ed25519.PublicKeySize]byte]bool{},
+	}
+	for _, publicKey := range publicKeys {
+		crl.Revoked[publicKey] = true
+	}
+	crl.Signature = *ed25519.Sign(&authorityPrivateKey, []byte(crl.signed()))
+	return crl
+}
+
+// String returns the CRL as a single line, which is how it is kept in files.
+func (self *CRL) String() string {
+	return self.signed() + " " + base64.StdEncoding.EncodeToString(self.Signature[:])
+}
+
+// ParseCRL parses a CRL made by String. It doesn't check the signature,
+// Authority.UpdateCRL does.
+func ParseCRL(s string) (*CRL, error) {
+	fields := strings.Split(strings.TrimSpace(s), " ")
+	if len(fields) != 4 || fields[0] != "scrooge_crl" {
+		return nil, errors.New("malformed CRL")
+	}
+
+	crl := &CRL{
+		Revoked: map[[ed25519.PublicKeySize]byte]bool{},
+	}
+
+	issued, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	crl.Issued = time.Unix(issued, 0)
+
+	if fields[2] != "" {
+		for _, key := range strings.Split(fields[2], ",") {
+			b, err := base64.StdEncoding.DecodeString(key)
+			if err != nil || len(b) != ed25519.PublicKeySize {
+				return nil, errors.New("malformed CRL public key: " + key)
+			}
+			var publicKey [ed25519.PublicKeySize]byte
+			copy(publicKey[:], b)
+			crl.Revoked[publicKey] = true
+		}
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(fields[3])
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return nil, errors.New("malformed CRL signature")
+	}
+	copy(crl.Signature[:], signature)
+
+	return crl, nil
+}
+
+// Authority checks certificates and CRLs against the public key of the
+// authority that signs them.
+type Authority struct {
+	PublicKey [ed25519.PublicKeySize]byte
+	crl       *CRL
+	mutex     sync.Mutex
+}
+
+// UpdateCRL replaces the CRL, as long as CheckCRL accepts crl.
+func (self *Authority) UpdateCRL(crl *CRL) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	err := self.checkCRL(crl)
+	if err != nil {
+		return err
+	}
+
+	self.crl = crl
+	return nil
+}
+
+// CheckCRL returns an error unless crl is signed by the authority and was
+// issued after the one we have, so an old CRL can't be replayed to lift
+// revocations. The CRL we have is accepted again, so that it can be loaded
+// again with the rest of the settings.
+func (self *Authority) CheckCRL(crl *CRL) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.checkCRL(crl)
+}
+
+func (self *Authority) checkCRL(crl *CRL) error {
+	if !ed25519.Verify(&self.PublicKey, []byte(crl.signed()), &crl.Signature) {
+		return errors.New("CRL not signed by authority")
+	}
+
+	if self.crl == nil || crl.Signature == self.crl.Signature {
+		return nil
+	}
+
+	// Issued only has seconds, so a CRL from the same second as ours may
+	// be an older one
+	if !crl.Issued.After(self.crl.Issued) {
+		return errors.New("CRL not newer than the current one")
+	}
+	return nil
+}
+
+// Verify returns an error unless cert is signed by the authority for
+// publicKey, hasn't expired and hasn't been revoked.
+func (self *Authority) Verify(
+	cert *Certificate,
+	publicKey [ed25519.PublicKeySize]byte,
+	now time.Time,
+) error {
+	if cert == nil {
+		return errors.New("no certificate")
+	}
+
+	if cert.PublicKey != publicKey {
+		return errors.New("certificate for another key")
+	}
+
+	if !ed25519.Verify(&self.PublicKey, []byte(cert.signed()), &cert.Signature) {
+		return errors.New("certificate not signed by authority")
+	}
+
+	if !now.Before(cert.Expiry) {
+		return errors.New("certificate expired")
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.crl != nil && self.crl.Revoked[publicKey] {
+		return errors.New("certificate revoked")
+	}
+
+	return nil
+}
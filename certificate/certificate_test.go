@@ -0,0 +1,152 @@
+package certificate
+
+import (
+	"crypto/rand"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/agl/ed25519"
+)
+
+var now = time.Date(2018, 1, 11, 0, 0, 0, 0, time.UTC)
+
+func generateKey(t *testing.T) (*[ed25519.PublicKeySize]byte, *[ed25519.PrivateKeySize]byte) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return publicKey, privateKey
+}
+
+func TestParse(t *testing.T) {
+	_, authorityKey := generateKey(t)
+	nodeKey, _ := generateKey(t)
+
+	cert := Issue(
+		*nodeKey,
+		now.Add(time.Hour),
+		url.Values{"owner": {"Rooftop Co-op"}, "site": {"rooftop 3"}},
+		*authorityKey,
+	)
+
+	parsed, err := Parse(cert.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.PublicKey != cert.PublicKey ||
+		!parsed.Expiry.Equal(cert.Expiry) ||
+		parsed.Attributes.Get("owner") != "Rooftop Co-op" ||
+		parsed.Signature != cert.Signature {
+		t.Fatalf("certificate incorrect: %+v", parsed)
+	}
+
+	_, err = Parse("flerp")
+	if err == nil {
+		t.Fatal("no error for malformed certificate")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	authorityPublicKey, authorityKey := generateKey(t)
+	_, otherAuthorityKey := generateKey(t)
+	nodeKey, _ := generateKey(t)
+	otherNodeKey, _ := generateKey(t)
+
+	authority := &Authority{PublicKey: *authorityPublicKey}
+
+	tampered := Issue(*nodeKey, now.Add(time.Hour), nil, *authorityKey)
+	tampered.Expiry = now.Add(24 * time.Hour)
+
+	tests := []struct {
+		name  string
+		cert  *Certificate
+		valid bool
+	}{
+		{"valid", Issue(*nodeKey, now.Add(time.Hour), nil, *authorityKey), true},
+		{"none", nil, false},
+		{"expired", Issue(*nodeKey, now.Add(-time.Hour), nil, *authorityKey), false},
+		{"other key", Issue(*otherNodeKey, now.Add(time.Hour), nil, *authorityKey), false},
+		{"other authority", Issue(*nodeKey, now.Add(time.Hour), nil, *otherAuthorityKey), false},
+		{"tampered", tampered, false},
+	}
+
+	for _, test := range tests {
+		err := authority.Verify(test.cert, *nodeKey, now)
+		if (err == nil) != test.valid {
+			t.Errorf("%v: wrong result: %v", test.name, err)
+		}
+	}
+}
+
+func TestCRL(t *testing.T) {
+	authorityPublicKey, authorityKey := generateKey(t)
+	_, otherAuthorityKey := generateKey(t)
+	nodeKey, _ := generateKey(t)
+
+	authority := &Authority{PublicKey: *authorityPublicKey}
+	cert := Issue(*nodeKey, now.Add(time.Hour), nil, *authorityKey)
+
+	crl, err := ParseCRL(IssueCRL(now, [][ed25519.PublicKeySize]byte{*nodeKey}, *authorityKey).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = authority.UpdateCRL(crl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = authority.Verify(cert, *nodeKey, now)
+	if err == nil {
+		t.Fatal("revoked certificate accepted")
+	}
+
+	// An older CRL without the revocation can't be replayed
+	err = authority.UpdateCRL(IssueCRL(now.Add(-time.Hour), nil, *authorityKey))
+	if err == nil {
+		t.Fatal("older CRL accepted")
+	}
+
+	// Nor can one from the same second
+	err = authority.UpdateCRL(IssueCRL(now, nil, *authorityKey))
+	if err == nil {
+		t.Fatal("CRL from the same second accepted")
+	}
+
+	// The current one can be loaded again
+	err = authority.UpdateCRL(crl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = authority.UpdateCRL(IssueCRL(now.Add(time.Hour), nil, *otherAuthorityKey))
+	if err == nil {
+		t.Fatal("CRL from another authority accepted")
+	}
+
+	emptyCRL, err := ParseCRL(IssueCRL(now.Add(time.Hour), nil, *authorityKey).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Checking a CRL doesn't replace the one we have
+	err = authority.CheckCRL(emptyCRL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authority.Verify(cert, *nodeKey, now) == nil {
+		t.Fatal("CRL replaced by checking another")
+	}
+
+	err = authority.UpdateCRL(emptyCRL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = authority.Verify(cert, *nodeKey, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
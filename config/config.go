@@ -0,0 +1,573 @@
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/agl/ed25519"
+	"github.com/incentivized-mesh-infrastructure/scrooge/admission"
+	"github.com/incentivized-mesh-infrastructure/scrooge/logging"
+	"github.com/incentivized-mesh-infrastructure/scrooge/network"
+	"github.com/incentivized-mesh-infrastructure/scrooge/replay"
+	"github.com/incentivized-mesh-infrastructure/scrooge/throttle"
+)
+
+// Config is everything a node can be configured with. Every setting is also
+// a flag of the same name, which wins over the config file. Settings tagged
+// restart only take effect when scrooge is started, the rest are applied
+// again when the file is reloaded.
+type Config struct {
+	Port              int         `toml:"port" restart:"true"`
+	Transport         string      `toml:"transport" restart:"true"` // For interfaces that don't set their own
+	Interfaces        []Interface `toml:"interface" restart:"true"`
+	HelloInterval     Duration    `toml:"helloInterval" restart:"true"`
+	StateFile         string      `toml:"stateFile" restart:"true"`
+	StateSaveInterval Duration    `toml:"stateSaveInterval" restart:"true"`
+	SealMessages      bool        `toml:"sealMessages"`
+	ManagementSocket  string      `toml:"managementSocket" restart:"true"`
+	MetricsAddress    string      `toml:"metricsAddress" restart:"true"`
+
+	Keys         Keys         `toml:"keys"`
+	Seqnum       Seqnum       `toml:"seqnum"`
+	Tunnels      Tunnels      `toml:"tunnels"`
+	RateLimits   RateLimits   `toml:"rateLimits"`
+	Admission    Admission    `toml:"admission"`
+	Certificates Certificates `toml:"certificates"`
+	Pricing      Pricing      `toml:"pricing"`
+	Throttle     Throttle     `toml:"throttle"`
+	Log          Log          `toml:"log"`
+}
+
+type Interface struct {
+	Name      string `toml:"name"`
+	Transport string `toml:"transport"` // The config's transport if empty
+}
+
+type Keys struct {
+	Keystore       string `toml:"keystore" restart:"true"`
+	PassphraseFile string `toml:"passphraseFile" restart:"true"`
+}
+
+type Seqnum struct {
+	Mode          string   `toml:"seqnumMode" restart:"true"`
+	AcceptedModes List     `toml:"acceptedSeqnumModes"`
+	ClockSkew     Duration `toml:"clockSkew"`
+}
+
+type Tunnels struct {
+	FirstPort      int      `toml:"firstTunnelPort"`
+	KeyLifetime    Duration `toml:"tunnelKeyLifetime"`
+	EndpointPolicy string   `toml:"tunnelEndpointPolicy"`
+}
+
+type RateLimits struct {
+	SourceRate   float64 `toml:"sourceRate"`
+	SourceBurst  float64 `toml:"sourceBurst"`
+	KeyRate      float64 `toml:"keyRate"`
+	KeyBurst     float64 `toml:"keyBurst"`
+	ConfirmRate  float64 `toml:"confirmRate"`
+	ConfirmBurst float64 `toml:"confirmBurst"`
+}
+
+type Admission struct {
+	Allowlist    string `toml:"allowlist"`
+	Denylist     string `toml:"denylist"`
+	PinNeighbors string `toml:"pinNeighbors"`
+	PinFile      string `toml:"pinFile" restart:"true"`
+	MaxNeighbors int    `toml:"maxNeighbors"`
+}
+
+type Certificates struct {
+	AuthorityPublicKey string `toml:"authorityPublicKey" restart:"true"`
+	Certificate        string `toml:"certificate" restart:"true"`
+	CRL                string `toml:"crl"`
+}
+
+type Pricing struct {
+	Price               uint64   `toml:"price"`
+	MaxPrice            uint64   `toml:"maxPrice"`
+	LedgerJournal       string   `toml:"ledgerJournal" restart:"true"`
+	MeterInterval       Duration `toml:"meterInterval" restart:"true"`
+	PaymentThreshold    uint64   `toml:"paymentThreshold"`
+	PaymentInterval     Duration `toml:"paymentInterval"`
+	NeighborSpendingCap uint64   `toml:"neighborSpendingCap"`
+	GlobalSpendingCap   uint64   `toml:"globalSpendingCap"`
+	SpendingCapPeriod   Duration `toml:"spendingCapPeriod"`
+	SettlementInterval  Duration `toml:"settlementInterval" restart:"true"`
+}
+
+type Throttle struct {
+	FreeCredit       uint64   `toml:"freeCredit"`
+	GracePeriod      Duration `toml:"gracePeriod"`
+	SoftThrottleDebt uint64   `toml:"softThrottleDebt"`
+	HardCutoffDebt   uint64   `toml:"hardCutoffDebt"`
+	ForgivenessRate  uint64   `toml:"forgivenessRate"`
+}
+
+type Log struct {
+	Level           string `toml:"logLevel"`
+	SubsystemLevels List   `toml:"subsystemLogLevels"` // Like neighbor=debug
+	Format          string `toml:"logFormat"`
+	Redact          bool   `toml:"redactLogs"`
+}
+
+// Default returns the config scrooge runs with if nothing is set.
+func Default() *Config {
+	return &Config{
+		Port:              8481,
+		Transport:         string(network.IPv6),
+		HelloInterval:     Duration(30 * time.Second),
+		StateFile:         "/var/lib/scrooge/state.json",
+		StateSaveInterval: Duration(time.Minute),
+		ManagementSocket:  "/run/scrooge.sock",
+		Keys: Keys{
+			Keystore: "/var/lib/scrooge/keys",
+		},
+		Seqnum: Seqnum{
+			Mode:          string(replay.Counter),
+			AcceptedModes: List{string(replay.Counter), string(replay.Time), string(replay.Epoch)},
+			ClockSkew:     Duration(30 * time.Second),
+		},
+		Tunnels: Tunnels{
+			FirstPort:      51820,
+			KeyLifetime:    Duration(24 * time.Hour),
+			EndpointPolicy: "warn",
+		},
+		RateLimits: RateLimits{
+			SourceRate:   10,
+			SourceBurst:  20,
+			KeyRate:      5,
+			KeyBurst:     10,
+			ConfirmRate:  20,
+			ConfirmBurst: 20,
+		},
+		Admission: Admission{
+			PinNeighbors: string(admission.PinNone),
+			PinFile:      "/var/lib/scrooge/pins.json",
+			MaxNeighbors: 256,
+		},
+		Pricing: Pricing{
+			MaxPrice:            100,
+			MeterInterval:       Duration(10 * time.Second),
+			PaymentThreshold:    1000000,
+			PaymentInterval:     Duration(10 * time.Minute),
+			NeighborSpendingCap: 100000000,
+			GlobalSpendingCap:   1000000000,
+			SpendingCapPeriod:   Duration(24 * time.Hour),
+			SettlementInterval:  Duration(time.Hour),
+		},
+		Throttle: Throttle{
+			FreeCredit:       1000000,
+			GracePeriod:      Duration(time.Hour),
+			SoftThrottleDebt: 10000000,
+			HardCutoffDebt:   100000000,
+		},
+		Log: Log{
+			Level:  "info",
+			Format: "text",
+			Redact: true,
+		},
+	}
+}
+
+// Load reads the config file at path over the defaults. Settings it doesn't
+// know and values that don't make sense are errors, so that a typo can't
+// silently leave a setting at its default.
+func Load(path string) (*Config, error) {
+	config := Default()
+
+	meta, err := toml.DecodeFile(path, config)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+
+	undecoded := meta.Undecoded()
+	if len(undecoded) > 0 {
+		var problems []string
+		unknown := map[string]bool{}
+		for _, key := range undecoded {
+			// Everything in an unknown table is unknown too
+			if len(key) > 1 && unknown[key[:len(key)-1].String()] {
+				unknown[key.String()] = true
+				continue
+			}
+			unknown[key.String()] = true
+			problems = append(problems, unknownSetting(key))
+		}
+		return nil, fmt.Errorf("%v: %v", path, strings.Join(problems, "; "))
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return config, nil
+}
+
+// unknownSetting explains that key is not a setting, and lists the ones
+// that could have been meant.
+func unknownSetting(key toml.Key) string {
+	parent := reflect.TypeOf(Config{})
+	for _, name := range key[:len(key)-1] {
+		field, ok := fieldByKey(parent, name)
+		if !ok {
+			break
+		}
+		parent = field.Type
+		if parent.Kind() == reflect.Slice {
+			parent = parent.Elem()
+		}
+	}
+	if parent.Kind() != reflect.Struct {
+		return "unknown setting " + key.String()
+	}
+
+	var known []string
+	for i := 0; i < parent.NumField(); i++ {
+		known = append(known, parent.Field(i).Tag.Get("toml"))
+	}
+	sort.Strings(known)
+
+	return fmt.Sprintf(
+		"unknown setting %v, settings here are %v",
+		key,
+		strings.Join(known, ", "),
+	)
+}
+
+func fieldByKey(t reflect.Type, key string) (reflect.StructField, bool) {
+	if t.Kind() != reflect.Struct {
+		return reflect.StructField{}, false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("toml") == key {
+			return t.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// Validate checks every setting, and returns all the problems it finds at
+// once.
+func (self *Config) Validate() error {
+	var problems []string
+	check := func(setting string, err error) {
+		if err != nil {
+			problems = append(problems, setting+": "+err.Error())
+		}
+	}
+	positive := func(setting string, d Duration) {
+		if d <= 0 {
+			check(setting, errors.New("has to be longer than 0"))
+		}
+	}
+	rate := func(setting string, rate float64, burst float64) {
+		if rate < 0 {
+			check(setting, errors.New("can't be negative"))
+		}
+		if rate > 0 && burst < 1 {
+			check(setting, errors.New("needs a burst of at least 1"))
+		}
+	}
+
+	if self.Port <= 0 || self.Port > 65535 {
+		check("port", fmt.Errorf("%v is not a UDP port", self.Port))
+	}
+	_, err := network.ParseTransport(self.Transport)
+	check("transport", err)
+	seen := map[string]bool{}
+	for i, iface := range self.Interfaces {
+		setting := fmt.Sprintf("interface[%v]", i)
+		if iface.Name == "" {
+			check(setting+".name", errors.New("not set"))
+		}
+		if seen[iface.Name] {
+			check(setting+".name", errors.New(iface.Name+" is listed more than once"))
+		}
+		seen[iface.Name] = true
+		if iface.Transport != "" {
+			_, err = network.ParseTransport(iface.Transport)
+			check(setting+".transport", err)
+		}
+	}
+	positive("helloInterval", self.HelloInterval)
+	positive("stateSaveInterval", self.StateSaveInterval)
+	if self.StateFile == "" {
+		check("stateFile", errors.New("not set"))
+	}
+	if self.MetricsAddress != "" {
+		_, _, err = net.SplitHostPort(self.MetricsAddress)
+		check("metricsAddress", err)
+	}
+
+	if self.Keys.Keystore == "" {
+		check("keys.keystore", errors.New("not set"))
+	}
+
+	_, err = replay.ParseMode(self.Seqnum.Mode)
+	check("seqnum.seqnumMode", err)
+	if len(self.Seqnum.AcceptedModes) == 0 {
+		check("seqnum.acceptedSeqnumModes", errors.New("no modes, no neighbor would be accepted"))
+	}
+	for _, mode := range self.Seqnum.AcceptedModes {
+		_, err = replay.ParseMode(mode)
+		check("seqnum.acceptedSeqnumModes", err)
+	}
+	positive("seqnum.clockSkew", self.Seqnum.ClockSkew)
+
+	if self.Tunnels.FirstPort <= 0 || self.Tunnels.FirstPort > 65535 {
+		check("tunnels.firstTunnelPort", fmt.Errorf("%v is not a UDP port", self.Tunnels.FirstPort))
+	}
+	if self.Tunnels.KeyLifetime < 0 {
+		check("tunnels.tunnelKeyLifetime", errors.New("can't be negative"))
+	}
+	if self.Tunnels.EndpointPolicy != "warn" && self.Tunnels.EndpointPolicy != "reject" {
+		check("tunnels.tunnelEndpointPolicy", errors.New("has to be warn or reject, not "+self.Tunnels.EndpointPolicy))
+	}
+
+	rate("rateLimits.sourceRate", self.RateLimits.SourceRate, self.RateLimits.SourceBurst)
+	rate("rateLimits.keyRate", self.RateLimits.KeyRate, self.RateLimits.KeyBurst)
+	rate("rateLimits.confirmRate", self.RateLimits.ConfirmRate, self.RateLimits.ConfirmBurst)
+
+	_, err = admission.ParsePinMode(self.Admission.PinNeighbors)
+	check("admission.pinNeighbors", err)
+	if self.Admission.MaxNeighbors < 0 {
+		check("admission.maxNeighbors", errors.New("can't be negative"))
+	}
+
+	if self.Certificates.AuthorityPublicKey != "" {
+		b, err := base64.StdEncoding.DecodeString(self.Certificates.AuthorityPublicKey)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			check("certificates.authorityPublicKey", errors.New("not a base64 ed25519 public key"))
+		}
+	} else if self.Certificates.CRL != "" {
+		check("certificates.crl", errors.New("needs an authorityPublicKey to check it"))
+	}
+
+	positive("pricing.meterInterval", self.Pricing.MeterInterval)
+	positive("pricing.paymentInterval", self.Pricing.PaymentInterval)
+	positive("pricing.spendingCapPeriod", self.Pricing.SpendingCapPeriod)
+	positive("pricing.settlementInterval", self.Pricing.SettlementInterval)
+
+	policy := self.ThrottlePolicy()
+	check("throttle", policy.Validate())
+
+	_, err = logging.ParseLevel(self.Log.Level)
+	check("log.logLevel", err)
+	_, err = logging.ParseLevels(self.Log.SubsystemLevels)
+	check("log.subsystemLogLevels", err)
+	if self.Log.Format != "text" && self.Log.Format != "json" {
+		check("log.logFormat", errors.New("has to be text or json"))
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// ThrottlePolicy returns the throttle settings as a throttle.Policy.
+func (self *Config) ThrottlePolicy() throttle.Policy {
+	return throttle.Policy{
+		FreeCredit:      self.Throttle.FreeCredit,
+		GracePeriod:     time.Duration(self.Throttle.GracePeriod),
+		SoftDebt:        self.Throttle.SoftThrottleDebt,
+		HardDebt:        self.Throttle.HardCutoffDebt,
+		ForgivenessRate: self.Throttle.ForgivenessRate,
+	}
+}
+
+// LogOptions returns the log settings as logging.Options.
+func (self *Config) LogOptions() (logging.Options, error) {
+	level, err := logging.ParseLevel(self.Log.Level)
+	if err != nil {
+		return logging.Options{}, err
+	}
+
+	levels, err := logging.ParseLevels(self.Log.SubsystemLevels)
+	if err != nil {
+		return logging.Options{}, err
+	}
+
+	return logging.Options{
+		Level:  level,
+		Levels: levels,
+		JSON:   self.Log.Format == "json",
+		Redact: self.Log.Redact,
+	}, nil
+}
+
+// InterfaceTransport returns the transport iface uses.
+func (self *Config) InterfaceTransport(iface Interface) string {
+	if iface.Transport == "" {
+		return self.Transport
+	}
+	return iface.Transport
+}
+
+// RestartNeeded returns the settings that differ between old and new but
+// only take effect on a restart.
+func RestartNeeded(old *Config, new *Config) []string {
+	return restartNeeded("", reflect.ValueOf(*old), reflect.ValueOf(*new))
+}
+
+func restartNeeded(prefix string, old reflect.Value, new reflect.Value) []string {
+	var settings []string
+	for i := 0; i < old.NumField(); i++ {
+		field := old.Type().Field(i)
+		name := prefix + field.Tag.Get("toml")
+
+		if field.Type.Kind() == reflect.Struct {
+			settings = append(settings, restartNeeded(name+".", old.Field(i), new.Field(i))...)
+			continue
+		}
+
+		if field.Tag.Get("restart") == "true" &&
+			!reflect.DeepEqual(old.Field(i).Interface(), new.Field(i).Interface()) {
+			settings = append(settings, name)
+		}
+	}
+	return settings
+}
+
+// Flags makes every setting a flag on flags, which sets it in self.
+func (self *Config) Flags(flags *flag.FlagSet) {
+	flags.IntVar(&self.Port, "port", self.Port, "UDP port to send and receive scrooge messages on")
+	flags.Var((*interfaceList)(&self.Interfaces), "interface", "Comma separated network interfaces to operate on")
+	flags.StringVar(&self.Transport, "transport", self.Transport, "How to reach neighbors on the interfaces: ipv6, ipv4-multicast or ipv4-broadcast")
+	flags.Var(&self.HelloInterval, "helloInterval", "How often to send hellos to neighbors")
+	flags.StringVar(&self.StateFile, "stateFile", self.StateFile, "File to keep neighbors, seqnums, tunnels and balances in across restarts")
+	flags.Var(&self.StateSaveInterval, "stateSaveInterval", "How often to save neighbors, tunnels and balances to the state file")
+	flags.BoolVar(&self.SealMessages, "sealMessages", self.SealMessages, "Encrypt messages addressed to one neighbor so that only it can read them")
+	flags.StringVar(&self.ManagementSocket, "managementSocket", self.ManagementSocket, "Unix socket to serve the management API on, none if empty")
+	flags.StringVar(&self.MetricsAddress, "metricsAddress", self.MetricsAddress, "TCP address like [::1]:9481 to serve Prometheus metrics on at /metrics, none if empty")
+
+	flags.StringVar(&self.Keys.Keystore, "keystore", self.Keys.Keystore, "Directory to keep private keys in")
+	flags.StringVar(&self.Keys.PassphraseFile, "passphraseFile", self.Keys.PassphraseFile, "File with the passphrase keys in the keystore are encrypted with, if $SCROOGE_PASSPHRASE is not set")
+
+	flags.StringVar(&self.Seqnum.Mode, "seqnumMode", self.Seqnum.Mode, "How to pick seqnums: counter, time or epoch. Counter carries on above any seqnum already used; moving to time or epoch is refused if it would not")
+	flags.Var(&self.Seqnum.AcceptedModes, "acceptedSeqnumModes", "Comma separated seqnum modes to accept from neighbors")
+	flags.Var(&self.Seqnum.ClockSkew, "clockSkew", "How far a neighbor's time seqnums may be from our clock")
+
+	flags.IntVar(&self.Tunnels.FirstPort, "firstTunnelPort", self.Tunnels.FirstPort, "Tunnels with neighbors listen on the first free port from here up")
+	flags.Var(&self.Tunnels.KeyLifetime, "tunnelKeyLifetime", "How often to rotate the keys of each tunnel, 0 to never rotate them")
+	flags.StringVar(&self.Tunnels.EndpointPolicy, "tunnelEndpointPolicy", self.Tunnels.EndpointPolicy, "What to do when a neighbor's tunnel endpoint isn't the address its message came from: warn or reject")
+
+	flags.Float64Var(&self.RateLimits.SourceRate, "sourceRate", self.RateLimits.SourceRate, "Messages per second we take from one source address, 0 for no limit")
+	flags.Float64Var(&self.RateLimits.SourceBurst, "sourceBurst", self.RateLimits.SourceBurst, "Messages we take from one source address at once")
+	flags.Float64Var(&self.RateLimits.KeyRate, "keyRate", self.RateLimits.KeyRate, "Messages per second we take from one public key at one address, 0 for no limit")
+	flags.Float64Var(&self.RateLimits.KeyBurst, "keyBurst", self.RateLimits.KeyBurst, "Messages we take from one public key at once")
+	flags.Float64Var(&self.RateLimits.ConfirmRate, "confirmRate", self.RateLimits.ConfirmRate, "Hello confirms per second we send to all neighbors together, 0 for no limit")
+	flags.Float64Var(&self.RateLimits.ConfirmBurst, "confirmBurst", self.RateLimits.ConfirmBurst, "Hello confirms we send at once")
+
+	flags.StringVar(&self.Admission.Allowlist, "allowlist", self.Admission.Allowlist, "File of base64 public keys, one per line, that may be neighbors. Anyone may if it is not set")
+	flags.StringVar(&self.Admission.Denylist, "denylist", self.Admission.Denylist, "File of base64 public keys, one per line, that may never be neighbors")
+	flags.StringVar(&self.Admission.PinNeighbors, "pinNeighbors", self.Admission.PinNeighbors, "Pin each neighbor's key to where it first confirms our hello: off, address or mac")
+	flags.StringVar(&self.Admission.PinFile, "pinFile", self.Admission.PinFile, "File to keep neighbor pins in across restarts")
+	flags.IntVar(&self.Admission.MaxNeighbors, "maxNeighbors", self.Admission.MaxNeighbors, "Most confirmed neighbors at once, 0 for no cap")
+
+	flags.StringVar(&self.Certificates.AuthorityPublicKey, "authorityPublicKey", self.Certificates.AuthorityPublicKey, "Only build tunnels with neighbors holding a certificate signed by this base64 public key")
+	flags.StringVar(&self.Certificates.Certificate, "certificate", self.Certificates.Certificate, "File with our certificate from the authority, sent in our hellos")
+	flags.StringVar(&self.Certificates.CRL, "crl", self.Certificates.CRL, "File with the authority's latest CRL, read again on SIGHUP")
+
+	flags.Uint64Var(&self.Pricing.Price, "price", self.Pricing.Price, "What we charge neighbors per byte they route through us")
+	flags.Uint64Var(&self.Pricing.MaxPrice, "maxPrice", self.Pricing.MaxPrice, "Most we pay a neighbor per byte, tunnels with neighbors asking more are refused, 0 for no cap")
+	flags.StringVar(&self.Pricing.LedgerJournal, "ledgerJournal", self.Pricing.LedgerJournal, "File to append every ledger entry to")
+	flags.Var(&self.Pricing.MeterInterval, "meterInterval", "How often to read tunnel usage")
+	flags.Uint64Var(&self.Pricing.PaymentThreshold, "paymentThreshold", self.Pricing.PaymentThreshold, "Pay a neighbor as soon as we owe it this much")
+	flags.Var(&self.Pricing.PaymentInterval, "paymentInterval", "Pay whatever we owe a neighbor at least this often")
+	flags.Uint64Var(&self.Pricing.NeighborSpendingCap, "neighborSpendingCap", self.Pricing.NeighborSpendingCap, "Most we pay a single neighbor per spending cap period, 0 for no cap")
+	flags.Uint64Var(&self.Pricing.GlobalSpendingCap, "globalSpendingCap", self.Pricing.GlobalSpendingCap, "Most we pay all neighbors together per spending cap period, 0 for no cap")
+	flags.Var(&self.Pricing.SpendingCapPeriod, "spendingCapPeriod", "Period over which the spending caps apply")
+	flags.Var(&self.Pricing.SettlementInterval, "settlementInterval", "How often to settle payment channels with neighbors")
+
+	flags.Uint64Var(&self.Throttle.FreeCredit, "freeCredit", self.Throttle.FreeCredit, "Debt a neighbor may run up without being throttled")
+	flags.Var(&self.Throttle.GracePeriod, "gracePeriod", "How long a neighbor may owe more than its free credit before being throttled")
+	flags.Uint64Var(&self.Throttle.SoftThrottleDebt, "softThrottleDebt", self.Throttle.SoftThrottleDebt, "Debt at which a neighbor is slowed down")
+	flags.Uint64Var(&self.Throttle.HardCutoffDebt, "hardCutoffDebt", self.Throttle.HardCutoffDebt, "Debt at which a neighbor is cut off")
+	flags.Uint64Var(&self.Throttle.ForgivenessRate, "forgivenessRate", self.Throttle.ForgivenessRate, "Debt forgiven per hour a neighbor has owed us")
+
+	flags.StringVar(&self.Log.Level, "logLevel", self.Log.Level, "Least important messages to log: debug, info, warn or error")
+	flags.Var(&self.Log.SubsystemLevels, "subsystemLogLevels", "Comma separated log levels of subsystems, like neighbor=debug,wireguard=warn. Subsystems are "+strings.Join(logging.Subsystems, ", "))
+	flags.StringVar(&self.Log.Format, "logFormat", self.Log.Format, "How to write logs: text, or json for log shippers")
+	flags.BoolVar(&self.Log.Redact, "redactLogs", self.Log.Redact, "Leave signatures out of logs and shorten public keys")
+}
+
+// Duration is a time.Duration written like 30s or 1h30m, in the config file
+// and as a flag.
+type Duration time.Duration
+
+func (self *Duration) UnmarshalText(text []byte) error {
+	d, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*self = Duration(d)
+	return nil
+}
+
+func (self Duration) MarshalText() ([]byte, error) {
+	return []byte(self.String()), nil
+}
+
+func (self Duration) String() string {
+	return time.Duration(self).String()
+}
+
+func (self *Duration) Set(s string) error {
+	return self.UnmarshalText([]byte(s))
+}
+
+// List is an array in the config file, and comma separated as a flag.
+type List []string
+
+func (self *List) String() string {
+	if self == nil {
+		return ""
+	}
+	return strings.Join(*self, ",")
+}
+
+func (self *List) Set(s string) error {
+	*self = strings.Split(s, ",")
+	return nil
+}
+
+// interfaceList sets interfaces from a comma separated flag. Interfaces the
+// config file already has keep their transport, the others use the
+// config's.
+type interfaceList []Interface
+
+func (self *interfaceList) String() string {
+	if self == nil {
+		return ""
+	}
+	var names []string
+	for _, iface := range *self {
+		names = append(names, iface.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (self *interfaceList) Set(s string) error {
+	var interfaces interfaceList
+	for _, name := range strings.Split(s, ",") {
+		iface := Interface{Name: name}
+		for _, existing := range *self {
+			if existing.Name == name {
+				iface = existing
+			}
+		}
+		interfaces = append(interfaces, iface)
+	}
+	*self = interfaces
+	return nil
+}
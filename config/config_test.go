@@ -0,0 +1,178 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, s string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "scrooge.toml")
+	err = ioutil.WriteFile(path, []byte(s), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, `
+port = 9481
+helloInterval = "10s"
+
+[[interface]]
+name = "eth0"
+
+[[interface]]
+name = "wlan0"
+transport = "ipv4-broadcast"
+
+[seqnum]
+acceptedSeqnumModes = ["time"]
+
+[pricing]
+price = 3
+
+[throttle]
+gracePeriod = "2h"
+`)
+
+	config, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Port != 9481 || time.Duration(config.HelloInterval) != 10*time.Second {
+		t.Fatal("settings not loaded: ", config.Port, config.HelloInterval)
+	}
+	if len(config.Interfaces) != 2 ||
+		config.InterfaceTransport(config.Interfaces[0]) != "ipv6" ||
+		config.InterfaceTransport(config.Interfaces[1]) != "ipv4-broadcast" {
+		t.Fatal("wrong interfaces: ", config.Interfaces)
+	}
+	if len(config.Seqnum.AcceptedModes) != 1 || config.Seqnum.AcceptedModes[0] != "time" {
+		t.Fatal("list not replaced: ", config.Seqnum.AcceptedModes)
+	}
+	if config.Pricing.Price != 3 || config.ThrottlePolicy().GracePeriod != 2*time.Hour {
+		t.Fatal("wrong pricing or throttle: ", config.Pricing, config.Throttle)
+	}
+
+	// Everything not in the file keeps its default
+	if config.Admission.MaxNeighbors != 256 || config.Throttle.FreeCredit != 1000000 {
+		t.Fatal("defaults lost: ", config.Admission, config.Throttle)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{"prot = 1", "unknown setting prot, settings here are"},
+		{"[pricing]\nprce = 1", "unknown setting pricing.prce"},
+		{"[pricng]\nprice = 1", "unknown setting pricng,"},
+		{"[[interface]]\nname = \"eth0\"\nmtu = 1", "unknown setting interface.mtu, settings here are name, transport"},
+		{"port = 70000", "port: 70000 is not a UDP port"},
+		{"metricsAddress = \"9481\"", "metricsAddress: address 9481: missing port in address"},
+		{"helloInterval = \"soon\"", "invalid duration"},
+		{"[[interface]]\ntransport = \"ipx\"", "interface[0].name: not set; interface[0].transport: unknown transport: ipx"},
+		{"[seqnum]\nacceptedSeqnumModes = []", "seqnum.acceptedSeqnumModes: no modes"},
+		{"[certificates]\ncrl = \"crl\"", "certificates.crl: needs an authorityPublicKey"},
+		{"[throttle]\nsoftThrottleDebt = 1", "throttle:"},
+		{"[rateLimits]\nkeyBurst = 0", "rateLimits.keyRate: needs a burst of at least 1"},
+		{"[log]\nsubsystemLogLevels = [\"neighbor=loud\"]\nlogFormat = \"xml\"", "log.subsystemLogLevels: unknown log level: loud; log.logFormat: has to be text or json"},
+	}
+
+	for _, test := range tests {
+		_, err := Load(writeConfig(t, test.config))
+		if err == nil {
+			t.Errorf("%q: no error", test.config)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: error %q, should contain %q", test.config, err, test.err)
+		}
+	}
+}
+
+func TestRestartNeeded(t *testing.T) {
+	old := Default()
+	new := Default()
+	new.Port = 9481
+	new.Interfaces = []Interface{{Name: "eth0"}}
+	new.Pricing.Price = 5
+	new.Pricing.MeterInterval = Duration(time.Minute)
+	new.RateLimits.KeyRate = 1
+
+	settings := RestartNeeded(old, new)
+	if strings.Join(settings, " ") != "port interface pricing.meterInterval" {
+		t.Fatal("wrong settings: ", settings)
+	}
+}
+
+func TestFlags(t *testing.T) {
+	config := Default()
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	config.Flags(flags)
+
+	err := flags.Parse([]string{
+		"-interface", "eth0,wlan0",
+		"-helloInterval", "1m",
+		"-acceptedSeqnumModes", "counter,epoch",
+		"-price", "7",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Interfaces) != 2 || config.Interfaces[1].Name != "wlan0" {
+		t.Fatal("wrong interfaces: ", config.Interfaces)
+	}
+	if time.Duration(config.HelloInterval) != time.Minute ||
+		len(config.Seqnum.AcceptedModes) != 2 ||
+		config.Pricing.Price != 7 {
+		t.Fatal("flags not set: ", config.HelloInterval, config.Seqnum, config.Pricing)
+	}
+
+	err = config.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInterfaceFlagKeepsTransport(t *testing.T) {
+	path := writeConfig(t, `
+[[interface]]
+name = "wlan0"
+transport = "ipv4-broadcast"
+`)
+
+	config, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	config.Flags(flags)
+
+	// Like a reload does with the interfaces from the command line
+	err = flags.Set("interface", "eth0,wlan0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Interfaces) != 2 ||
+		config.InterfaceTransport(config.Interfaces[0]) != "ipv6" ||
+		config.InterfaceTransport(config.Interfaces[1]) != "ipv4-broadcast" {
+		t.Fatal("wrong interfaces: ", config.Interfaces)
+	}
+}
@@ -0,0 +1,187 @@
+package events
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Type is what happened.
+type Type string
+
+const (
+	NeighborAdded     Type = "neighbor_added"     // A key we didn't know was let in as a neighbor
+	NeighborConfirmed Type = "neighbor_confirmed" // A neighbor confirmed one of our hellos for the first time
+	NeighborRemoved   Type = "neighbor_removed"   // A neighbor was forgotten
+	NeighborRotated   Type = "neighbor_rotated"   // A neighbor moved to NewPublicKey
+	TunnelUp          Type = "tunnel_up"          // A tunnel to a neighbor was set up, to Endpoint
+	TunnelRekeyed     Type = "tunnel_rekeyed"     // A neighbor moved its end of a tunnel to a new key
+	PaymentReceived   Type = "payment_received"   // A neighbor paid us Amount
+	PaymentSent       Type = "payment_sent"       // We paid a neighbor Amount
+	ChannelClosed     Type = "channel_closed"     // We stopped accepting vouchers from a neighbor
+	// A neighbor's debt crossed one of the throttle thresholds, so it is now
+	// throttled at Level
+	BalanceThreshold Type = "balance_threshold"
+	// Dropped events didn't fit in the buffer of a subscriber. It is only
+	// written to event streams, never published.
+	Overflow Type = "overflow"
+)
+
+// Types are the types of every event that is published.
+var Types = []Type{
+	NeighborAdded,
+	NeighborConfirmed,
+	NeighborRemoved,
+	NeighborRotated,
+	TunnelUp,
+	TunnelRekeyed,
+	PaymentReceived,
+	PaymentSent,
+	ChannelClosed,
+	BalanceThreshold,
+}
+
+// Event is something that happened to a neighbor. Only the fields its type
+// mentions are set.
+type Event struct {
+	Type         Type
+	Time         time.Time
+	Neighbor     string `json:",omitempty"` // Base64 public key
+	NewPublicKey string `json:",omitempty"`
+	Endpoint     string `json:",omitempty"`
+	Amount       uint64 `json:",omitempty"`
+	Debt         int64  `json:",omitempty"` // What the neighbor owes us, negative if we owe it
+	Level        string `json:",omitempty"`
+	Dropped      uint64 `json:",omitempty"`
+}
+
+// DefaultBuffer is how many events a subscriber can fall behind by if it
+// doesn't ask for a buffer of its own.
+const DefaultBuffer = 64
+
+// Bus hands every event published on it to every subscriber that wants
+// it. Publishing never waits for subscribers, so a slow one can't hold up
+// the node. Each subscriber has a buffer of its own, and when it is full
+// the oldest event in it is dropped to make room for the new one and
+// counted in Dropped. Subscribers that fall behind miss what is oldest
+// rather than what is newest.
+type Bus struct {
+	subscribers map[*Subscription]bool
+	mutex       sync.Mutex
+}
+
+func New() *Bus {
+	return &Bus{
+		subscribers: map[*Subscription]bool{},
+	}
+}
+
+// Subscription gets the events published after it was made, until it is
+// unsubscribed.
+type Subscription struct {
+	events  chan Event
+	types   map[Type]bool // Every type if empty
+	dropped uint64
+	bus     *Bus
+}
+
+// Subscribe returns a subscription to events of types, or to every event if
+// there are none, that can fall behind by buffer events.
+func (self *Bus) Subscribe(buffer int, types ...Type) *Subscription {
+	if buffer < 1 {
+		buffer = DefaultBuffer
+	}
+
+	subscription := &Subscription{
+		events: make(chan Event, buffer),
+		types:  map[Type]bool{},
+		bus:    self,
+	}
+	for _, t := range types {
+		subscription.types[t] = true
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.subscribers[subscription] = true
+	return subscription
+}
+
+// Unsubscribe stops a subscription and closes its channel once the events
+// already in it have been read.
+func (self *Bus) Unsubscribe(subscription *Subscription) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if !self.subscribers[subscription] {
+		return
+	}
+	delete(self.subscribers, subscription)
+	close(subscription.events)
+}
+
+// Publish hands event to every subscriber that wants it, dropping the
+// oldest event of those that are full. Events without a time get the
+// current one.
+func (self *Bus) Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for subscription := range self.subscribers {
+		if len(subscription.types) > 0 && !subscription.types[event.Type] {
+			continue
+		}
+
+		// Only Publish sends, and only while holding the mutex, so once an
+		// event has been taken out there is room
+		select {
+		case subscription.events <- event:
+			continue
+		default:
+		}
+
+		select {
+		case <-subscription.events:
+			subscription.dropped++
+		default:
+		}
+		subscription.events <- event
+	}
+}
+
+// Events returns the channel events come in on, which is closed when the
+// subscription is unsubscribed.
+func (self *Subscription) Events() <-chan Event {
+	return self.events
+}
+
+// Dropped returns how many events were dropped because the subscription's
+// buffer was full.
+func (self *Subscription) Dropped() uint64 {
+	self.bus.mutex.Lock()
+	defer self.bus.mutex.Unlock()
+
+	return self.dropped
+}
+
+// ParseTypes parses event type names, returning an error for any that
+// aren't published.
+func ParseTypes(names []string) ([]Type, error) {
+	types := make([]Type, 0, len(names))
+	for _, name := range names {
+		known := false
+		for _, t := range Types {
+			known = known || string(t) == name
+		}
+		if !known {
+			return nil, errors.New("unknown event type: " + name)
+		}
+		types = append(types, Type(name))
+	}
+	return types, nil
+}
@@ -0,0 +1,73 @@
+package events
+
+import (
+	"testing"
+)
+
+func TestSubscribe(t *testing.T) {
+	bus := New()
+	all := bus.Subscribe(10)
+	payments := bus.Subscribe(10, PaymentReceived, PaymentSent)
+
+	bus.Publish(Event{Type: NeighborAdded, Neighbor: "a"})
+	bus.Publish(Event{Type: PaymentReceived, Neighbor: "a", Amount: 5})
+
+	if len(all.Events()) != 2 || len(payments.Events()) != 1 {
+		t.Fatalf("wrong events: %v to all, %v to payments", len(all.Events()), len(payments.Events()))
+	}
+
+	event := <-payments.Events()
+	if event.Type != PaymentReceived || event.Amount != 5 || event.Time.IsZero() {
+		t.Fatalf("wrong event: %+v", event)
+	}
+
+	bus.Unsubscribe(payments)
+	bus.Unsubscribe(payments)
+	bus.Publish(Event{Type: PaymentSent})
+
+	_, ok := <-payments.Events()
+	if ok {
+		t.Fatal("event after unsubscribing")
+	}
+	if len(all.Events()) != 3 {
+		t.Fatal("other subscriber unsubscribed")
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	bus := New()
+	subscription := bus.Subscribe(2)
+
+	for amount := uint64(1); amount <= 5; amount++ {
+		bus.Publish(Event{Type: PaymentSent, Amount: amount})
+	}
+
+	if subscription.Dropped() != 3 {
+		t.Fatal("wrong number of drops: ", subscription.Dropped())
+	}
+
+	// The newest are kept
+	for _, amount := range []uint64{4, 5} {
+		event := <-subscription.Events()
+		if event.Amount != amount {
+			t.Fatalf("got %v, should be %v", event.Amount, amount)
+		}
+	}
+}
+
+func TestParseTypes(t *testing.T) {
+	types, err := ParseTypes([]string{"tunnel_up", "payment_sent"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(types) != 2 || types[0] != TunnelUp || types[1] != PaymentSent {
+		t.Fatalf("wrong types: %v", types)
+	}
+
+	for _, bad := range []string{"overflow", "tunnel_down"} {
+		_, err = ParseTypes([]string{bad})
+		if err == nil {
+			t.Errorf("%v: no error", bad)
+		}
+	}
+}
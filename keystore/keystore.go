@@ -0,0 +1,295 @@
+package keystore
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Names of the keys scrooge keeps
+const (
+	Identity     = "identity"      // ed25519 private key we sign messages with
+	NextIdentity = "next-identity" // ed25519 private key to rotate to
+	Tunnel       = "tunnel"        // WireGuard private key shared by every tunnel, if there is one
+	Authority    = "authority"     // ed25519 private key of a certificate authority
+)
+
+// encryptedPrefix starts every key file encrypted with a passphrase, followed
+// by the scrypt salt and the sealed key.
+const encryptedPrefix = "scrooge-encrypted-key"
+
+// scrypt parameters, as recommended for interactive logins in 2017
+const (
+	scryptN = 32768
+	scryptR = 8
+	scryptP = 1
+)
+
+// Keystore keeps private keys out of the process list. Each key is looked
+// for, in order:
+//
+// - as a systemd credential, in $CREDENTIALS_DIRECTORY/<name>
+// - in the environment, as SCROOGE_<NAME>_KEY
+// - in Dir/<name>.key, which only its owner may read or write
+//
+// Keys are base64 encoded, and files in Dir may be encrypted with
+// Passphrase.
+type Keystore struct {
+	Dir        string
+	Passphrase string
+}
+
+func New(dir string, passphrase string) *Keystore {
+	return &Keystore{
+		Dir:        dir,
+		Passphrase: passphrase,
+	}
+}
+
+// Load returns the key called name, or an error that os.IsNotExist
+// recognizes if there is no such key anywhere.
+func (self *Keystore) Load(name string) (string, error) {
+	b, err := readCredential(name)
+	if err == nil {
+		return strings.TrimSpace(string(b)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	key := os.Getenv(EnvName(name))
+	if key != "" {
+		return key, nil
+	}
+
+	b, err = readPrivate(self.path(name))
+	if err != nil {
+		return "", err
+	}
+
+	contents := strings.TrimSpace(string(b))
+	if !strings.HasPrefix(contents, encryptedPrefix+" ") {
+		return contents, nil
+	}
+
+	return self.decrypt(contents)
+}
+
+// FromFile returns whether Load reads the key called name from its file,
+// rather than from a credential or the environment.
+func (self *Keystore) FromFile(name string) bool {
+	_, err := readCredential(name)
+	return os.IsNotExist(err) &&
+		os.Getenv(EnvName(name)) == "" &&
+		self.Exists(name)
+}
+
+// Exists returns whether there is a key file called name.
+func (self *Keystore) Exists(name string) bool {
+	_, err := os.Stat(self.path(name))
+	return err == nil
+}
+
+// Store writes the key called name to its file, encrypted if there is a
+// passphrase. The file is replaced atomically if it exists, and is on disk
+// once Store returns, so a key can be used as soon as it is stored.
+func (self *Keystore) Store(name string, key string) error {
+	contents := key
+	if self.Passphrase != "" {
+		var err error
+		contents, err = self.encrypt(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := os.MkdirAll(self.Dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	path := self.path(name)
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write([]byte(contents + "\n"))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+
+	// Make sure the rename itself is on disk
+	dir, err := os.Open(self.Dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// Remove deletes the key file called name.
+func (self *Keystore) Remove(name string) error {
+	return os.Remove(self.path(name))
+}
+
+// EnvName is the environment variable the key called name may be given in.
+func EnvName(name string) string {
+	return "SCROOGE_" +
+		strings.ToUpper(strings.Replace(name, "-", "_", -1)) +
+		"_KEY"
+}
+
+// Passphrase returns the keystore passphrase from the systemd credential
+// called passphrase, the SCROOGE_PASSPHRASE environment variable or file,
+// in that order. It is empty if there is none.
+func Passphrase(file string) (string, error) {
+	b, err := readCredential("passphrase")
+	if err == nil {
+		return strings.TrimSpace(string(b)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	passphrase := os.Getenv("SCROOGE_PASSPHRASE")
+	if passphrase != "" || file == "" {
+		return passphrase, nil
+	}
+
+	b, err = readPrivate(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// readPrivate reads a file holding a secret, as long as nobody else can read
+// or write it.
+func readPrivate(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, errors.New(
+			path + " can be read or written by others, it should be mode 0600")
+	}
+
+	return ioutil.ReadFile(path)
+}
+
+// readCredential reads a credential systemd passed us with LoadCredential=.
+func readCredential(name string) ([]byte, error) {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.ReadFile(filepath.Join(dir, name))
+}
+
+func (self *Keystore) path(name string) string {
+	return filepath.Join(self.Dir, name+".key")
+}
+
+func (self *Keystore) secretKey(salt []byte) (*[32]byte, error) {
+	b, err := scrypt.Key(
+		[]byte(self.Passphrase),
+		salt,
+		scryptN,
+		scryptR,
+		scryptP,
+		32,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var key [32]byte
+	copy(key[:], b)
+	return &key, nil
+}
+
+func (self *Keystore) encrypt(key string) (string, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	secretKey, err := self.secretKey(salt)
+	if err != nil {
+		return "", err
+	}
+
+	var nonce [24]byte
+	_, err = rand.Read(nonce[:])
+	if err != nil {
+		return "", err
+	}
+
+	sealed := secretbox.Seal(nonce[:], []byte(key), &nonce, secretKey)
+
+	return encryptedPrefix + " " +
+		base64.StdEncoding.EncodeToString(salt) + " " +
+		base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (self *Keystore) decrypt(contents string) (string, error) {
+	if self.Passphrase == "" {
+		return "", errors.New("key is encrypted and there is no passphrase")
+	}
+
+	fields := strings.Split(contents, " ")
+	if len(fields) != 3 {
+		return "", errors.New("malformed encrypted key")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < 24+secretbox.Overhead {
+		return "", errors.New("malformed encrypted key")
+	}
+
+	secretKey, err := self.secretKey(salt)
+	if err != nil {
+		return "", err
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], sealed[:24])
+
+	key, ok := secretbox.Open(nil, sealed[24:], &nonce, secretKey)
+	if !ok {
+		return "", errors.New("wrong passphrase")
+	}
+	return string(key), nil
+}
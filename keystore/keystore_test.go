@@ -0,0 +1,210 @@
+package keystore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const key1 = "cEWVkEjpGbx810PI1e2Ff9f95oYayhnWJBPpV9Spd+IssFD290cF5Wxvnk0SdGIcVDvXXbYi8AWT5dP9LN3tVQ=="
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "scrooge-keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestStoreLoad(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	keystore := New(filepath.Join(dir, "keys"), "")
+
+	err := keystore.Store(Identity, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "keys", "identity.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatal("key file mode incorrect: ", info.Mode())
+	}
+
+	key, err := keystore.Load(Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != key1 {
+		t.Fatal("key incorrect: ", key)
+	}
+
+	_, err = keystore.Load(Tunnel)
+	if !os.IsNotExist(err) {
+		t.Fatal("wrong error for missing key: ", err)
+	}
+}
+
+func TestLoadReadableByOthers(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	keystore := New(dir, "")
+
+	err := ioutil.WriteFile(filepath.Join(dir, "identity.key"), []byte(key1), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = keystore.Load(Identity)
+	if err == nil {
+		t.Fatal("no error for key file readable by others")
+	}
+}
+
+func TestPassphraseReadableByOthers(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "passphrase")
+	err := ioutil.WriteFile(path, []byte("hunter2\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Passphrase(path)
+	if err == nil {
+		t.Fatal("no error for passphrase file readable by others")
+	}
+
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	passphrase, err := Passphrase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if passphrase != "hunter2" {
+		t.Fatal("passphrase incorrect: ", passphrase)
+	}
+}
+
+func TestEncrypted(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	keystore := New(dir, "correct horse battery staple")
+
+	err := keystore.Store(Identity, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "identity.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), key1) {
+		t.Fatal("key stored in the clear")
+	}
+
+	key, err := keystore.Load(Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != key1 {
+		t.Fatal("key incorrect: ", key)
+	}
+
+	for _, passphrase := range []string{"", "wrong"} {
+		_, err = New(dir, passphrase).Load(Identity)
+		if err == nil {
+			t.Fatalf("no error for passphrase %q", passphrase)
+		}
+	}
+}
+
+func TestLoadEnvironment(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	os.Setenv("SCROOGE_NEXT_IDENTITY_KEY", key1)
+	defer os.Unsetenv("SCROOGE_NEXT_IDENTITY_KEY")
+
+	key, err := New(dir, "").Load(NextIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != key1 {
+		t.Fatal("key incorrect: ", key)
+	}
+}
+
+func TestLoadCredential(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	err := ioutil.WriteFile(filepath.Join(dir, "tunnel"), []byte(key1+"\n"), 0400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "passphrase"), []byte("hunter2\n"), 0400)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("CREDENTIALS_DIRECTORY", dir)
+	defer os.Unsetenv("CREDENTIALS_DIRECTORY")
+
+	// Credentials come before the environment
+	os.Setenv("SCROOGE_TUNNEL_KEY", "derp")
+	defer os.Unsetenv("SCROOGE_TUNNEL_KEY")
+
+	key, err := New(filepath.Join(dir, "keys"), "").Load(Tunnel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != key1 {
+		t.Fatal("key incorrect: ", key)
+	}
+
+	passphrase, err := Passphrase("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if passphrase != "hunter2" {
+		t.Fatal("passphrase incorrect: ", passphrase)
+	}
+}
+
+func TestFromFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	keystore := New(dir, "")
+	if keystore.FromFile(Identity) {
+		t.Fatal("missing key is from a file")
+	}
+
+	err := keystore.Store(Identity, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keystore.FromFile(Identity) {
+		t.Fatal("stored key is not from a file")
+	}
+
+	os.Setenv("SCROOGE_IDENTITY_KEY", key1)
+	defer os.Unsetenv("SCROOGE_IDENTITY_KEY")
+	if keystore.FromFile(Identity) {
+		t.Fatal("key in the environment is from a file")
+	}
+}
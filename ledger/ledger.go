@@ -0,0 +1,222 @@
+package ledger
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/agl/ed25519"
+	"github.com/incentivized-mesh-infrastructure/scrooge/types"
+)
+
+const (
+	PaymentSent     = "payment_sent"     // We paid the neighbor
+	PaymentReceived = "payment_received" // The neighbor paid us
+	UsageBilled     = "usage_billed"     // We charged the neighbor for routing its traffic
+	KeyRotated      = "key_rotated"      // The neighbor moved to NewPublicKey
+	CreditGranted   = "credit_granted"   // An operator let the neighbor off some of its debt
+	CreditRevoked   = "credit_revoked"   // An operator took back credit granted before
+)
+
+type Entry struct {
+	Time         time.Time
+	PublicKey    string // base64 encoded public key of the neighbor
+	Type         string
+	Amount       uint64
+	NewPublicKey string `json:",omitempty"` // base64 encoded new public key of the neighbor, for KeyRotated
+}
+
+// Ledger keeps the balance with every neighbor. Every entry is also written
+// to Journal, one JSON object per line, if it is set.
+type Ledger struct {
+	Balances map[[ed25519.PublicKeySize]byte]*types.Balance
+	Journal  io.Writer
+	moved    map[[ed25519.PublicKeySize]byte][ed25519.PublicKeySize]byte // Keys moved since we started, to the key they moved to
+	mutex    sync.Mutex
+}
+
+func New(journal io.Writer) *Ledger {
+	return &Ledger{
+		Balances: map[[ed25519.PublicKeySize]byte]*types.Balance{},
+		Journal:  journal,
+	}
+}
+
+func (self *Ledger) Record(
+	publicKey [ed25519.PublicKeySize]byte,
+	entryType string,
+	amount uint64,
+	now time.Time,
+) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	balance := self.Balances[publicKey]
+	if balance == nil {
+		balance = &types.Balance{}
+		self.Balances[publicKey] = balance
+	}
+
+	switch entryType {
+	case PaymentSent:
+		balance.Paid = add(balance.Paid, amount)
+	case PaymentReceived:
+		balance.Received = add(balance.Received, amount)
+	case UsageBilled:
+		balance.Billed = add(balance.Billed, amount)
+	case CreditGranted:
+		balance.Credit = add(balance.Credit, amount)
+	case CreditRevoked:
+		if amount > balance.Credit {
+			return errors.New("can't revoke more credit than was granted")
+		}
+		balance.Credit = balance.Credit - amount
+	default:
+		return errors.New("unknown ledger entry type: " + entryType)
+	}
+
+	if balance.Debt() <= 0 {
+		balance.DebtSince = time.Time{}
+	} else if balance.DebtSince.IsZero() {
+		balance.DebtSince = now
+	}
+
+	if self.Journal == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(Entry{
+		Time:      now,
+		PublicKey: base64.StdEncoding.EncodeToString(publicKey[:]),
+		Type:      entryType,
+		Amount:    amount,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = self.Journal.Write(append(b, '\n'))
+	return err
+}
+
+// Move moves the balance with a neighbor that rotated its key from oldKey
+// to newKey. Anything already recorded for newKey is added to it.
+func (self *Ledger) Move(
+	oldKey [ed25519.PublicKeySize]byte,
+	newKey [ed25519.PublicKeySize]byte,
+	now time.Time,
+) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.moved == nil {
+		self.moved = map[[ed25519.PublicKeySize]byte][ed25519.PublicKeySize]byte{}
+	}
+	self.moved[oldKey] = newKey
+
+	old := self.Balances[oldKey]
+	if old != nil {
+		balance := self.Balances[newKey]
+		if balance == nil {
+			balance = &types.Balance{}
+			self.Balances[newKey] = balance
+		}
+
+		balance.Paid = add(balance.Paid, old.Paid)
+		balance.Received = add(balance.Received, old.Received)
+		balance.Billed = add(balance.Billed, old.Billed)
+		balance.Credit = add(balance.Credit, old.Credit)
+
+		// The neighbor has owed us since the earlier of the two
+		if !old.DebtSince.IsZero() &&
+			(balance.DebtSince.IsZero() || old.DebtSince.Before(balance.DebtSince)) {
+			balance.DebtSince = old.DebtSince
+		}
+		if balance.Debt() <= 0 {
+			balance.DebtSince = time.Time{}
+		} else if balance.DebtSince.IsZero() {
+			balance.DebtSince = now
+		}
+
+		delete(self.Balances, oldKey)
+	}
+
+	if self.Journal == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(Entry{
+		Time:         now,
+		PublicKey:    base64.StdEncoding.EncodeToString(oldKey[:]),
+		Type:         KeyRotated,
+		NewPublicKey: base64.StdEncoding.EncodeToString(newKey[:]),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = self.Journal.Write(append(b, '\n'))
+	return err
+}
+
+// MovedTo returns the key a neighbor that rotated away from publicKey uses
+// now, following every rotation since, and whether it has rotated at all
+// since we started.
+func (self *Ledger) MovedTo(
+	publicKey [ed25519.PublicKeySize]byte,
+) ([ed25519.PublicKeySize]byte, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	moved := false
+	// Keys are never moved to again once retired, but don't loop if they
+	// somehow were
+	for i := 0; i < len(self.moved); i++ {
+		newKey, ok := self.moved[publicKey]
+		if !ok {
+			break
+		}
+		publicKey = newKey
+		moved = true
+	}
+	return publicKey, moved
+}
+
+// Balance returns a copy of the balance with a neighbor.
+func (self *Ledger) Balance(publicKey [ed25519.PublicKeySize]byte) types.Balance {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	balance := self.Balances[publicKey]
+	if balance == nil {
+		return types.Balance{}
+	}
+	return *balance
+}
+
+// AllBalances returns a copy of the balance with every neighbor.
+func (self *Ledger) AllBalances() map[[ed25519.PublicKeySize]byte]types.Balance {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	balances := make(map[[ed25519.PublicKeySize]byte]types.Balance, len(self.Balances))
+	for publicKey, balance := range self.Balances {
+		balances[publicKey] = *balance
+	}
+	return balances
+}
+
+// add returns a+b, or the most a uint64 holds if that overflows. Amounts
+// come from neighbors' vouchers, so they can be anything.
+func add(a uint64, b uint64) uint64 {
+	sum, carry := bits.Add64(a, b, 0)
+	if carry != 0 {
+		return math.MaxUint64
+	}
+	return sum
+}
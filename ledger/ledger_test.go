@@ -0,0 +1,194 @@
+package ledger
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agl/ed25519"
+)
+
+var (
+	pubkey1 = [ed25519.PublicKeySize]byte{44, 176, 80, 246, 247, 71, 5, 229, 108, 111, 158, 77, 18, 116, 98, 28, 84, 59, 215, 93, 182, 34, 240, 5, 147, 229, 211, 253, 44, 221, 237, 85}
+	now     = time.Date(2018, 1, 11, 0, 0, 0, 0, time.UTC)
+)
+
+func TestRecord(t *testing.T) {
+	journal := &bytes.Buffer{}
+	l := New(journal)
+
+	err := l.Record(pubkey1, UsageBilled, 100, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = l.Record(pubkey1, PaymentSent, 30, now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	balance := l.Balance(pubkey1)
+	if balance.Billed != 100 || balance.Paid != 30 {
+		t.Fatalf("balance incorrect: %+v", balance)
+	}
+	if balance.Debt() != 100 {
+		t.Fatal("balance.Debt() incorrect: ", balance.Debt())
+	}
+	if !balance.DebtSince.Equal(now) {
+		t.Fatal("balance.DebtSince incorrect: ", balance.DebtSince)
+	}
+
+	err = l.Record(pubkey1, PaymentReceived, 150, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	balance = l.Balance(pubkey1)
+	if balance.Debt() != -50 {
+		t.Fatal("balance.Debt() incorrect: ", balance.Debt())
+	}
+	if !balance.DebtSince.IsZero() {
+		t.Fatal("balance.DebtSince not cleared")
+	}
+
+	lines := strings.Split(strings.TrimSpace(journal.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatal("wrong number of journal entries: ", len(lines))
+	}
+
+	var entry Entry
+	err = json.Unmarshal([]byte(lines[1]), &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Type != PaymentSent || entry.Amount != 30 ||
+		entry.PublicKey != "LLBQ9vdHBeVsb55NEnRiHFQ71122IvAFk+XT/Szd7VU=" {
+		t.Fatalf("journal entry incorrect: %+v", entry)
+	}
+}
+
+func TestRecordNearMax(t *testing.T) {
+	l := New(nil)
+
+	// A voucher for nearly everything, then one more on top of it
+	err := l.Record(pubkey1, PaymentReceived, math.MaxUint64-1, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Record(pubkey1, PaymentReceived, 10, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	balance := l.Balance(pubkey1)
+	if balance.Received != math.MaxUint64 {
+		t.Fatal("received wrapped around: ", balance.Received)
+	}
+	if balance.Debt() != -math.MaxInt64 {
+		t.Fatal("credit did not stop at the largest: ", balance.Debt())
+	}
+
+	var pubkey2 [ed25519.PublicKeySize]byte
+	err = l.Record(pubkey2, UsageBilled, math.MaxUint64-1, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if debt := l.Balance(pubkey2).Debt(); debt != math.MaxInt64 {
+		t.Fatal("debt did not stop at the largest: ", debt)
+	}
+	if l.Balance(pubkey2).DebtSince.IsZero() {
+		t.Fatal("debt not recorded")
+	}
+}
+
+func TestCredit(t *testing.T) {
+	l := New(nil)
+
+	err := l.Record(pubkey1, UsageBilled, 100, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = l.Record(pubkey1, CreditGranted, 100, now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	balance := l.Balance(pubkey1)
+	if balance.Debt() != 0 || !balance.DebtSince.IsZero() {
+		t.Fatalf("credit not applied: %+v", balance)
+	}
+
+	err = l.Record(pubkey1, CreditRevoked, 150, now.Add(time.Hour))
+	if err == nil {
+		t.Fatal("revoked more credit than was granted")
+	}
+
+	err = l.Record(pubkey1, CreditRevoked, 40, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	balance = l.Balance(pubkey1)
+	if balance.Debt() != 40 || !balance.DebtSince.Equal(now.Add(time.Hour)) {
+		t.Fatalf("credit not revoked: %+v", balance)
+	}
+}
+
+func TestRecordUnknownType(t *testing.T) {
+	l := New(nil)
+
+	err := l.Record(pubkey1, "gift", 100, now)
+	if err == nil {
+		t.Fatal("no error for unknown entry type")
+	}
+}
+
+func TestMove(t *testing.T) {
+	journal := &bytes.Buffer{}
+	l := New(journal)
+
+	pubkey2 := [ed25519.PublicKeySize]byte{1}
+
+	err := l.Record(pubkey1, UsageBilled, 100, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = l.Record(pubkey2, PaymentReceived, 30, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = l.Move(pubkey1, pubkey2, now.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := l.AllBalances()[pubkey1]; ok {
+		t.Fatal("balance of old key not removed")
+	}
+
+	balance := l.Balance(pubkey2)
+	if balance.Billed != 100 || balance.Received != 30 {
+		t.Fatalf("balance incorrect: %+v", balance)
+	}
+	if !balance.DebtSince.Equal(now) {
+		t.Fatal("balance.DebtSince incorrect: ", balance.DebtSince)
+	}
+
+	lines := strings.Split(strings.TrimSpace(journal.String()), "\n")
+	var entry Entry
+	err = json.Unmarshal([]byte(lines[len(lines)-1]), &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Type != KeyRotated ||
+		entry.PublicKey != "LLBQ9vdHBeVsb55NEnRiHFQ71122IvAFk+XT/Szd7VU=" ||
+		entry.NewPublicKey != "AQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=" {
+		t.Fatalf("journal entry incorrect: %+v", entry)
+	}
+}
@@ -0,0 +1,196 @@
+package logging
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Subsystems are the parts of scrooge that log, each of which can have a
+// level of its own.
+var Subsystems = []string{
+	"node",      // Starting, stopping and reloading
+	"neighbor",  // Messages to and from neighbors
+	"scheduler", // Metering and paying neighbors
+	"payment",   // Settling vouchers
+	"throttle",  // Throttle decisions
+	"wireguard", // Commands run on tunnels
+}
+
+// Options are how loggers write.
+type Options struct {
+	Level  slog.Level            // For subsystems without a level of their own
+	Levels map[string]slog.Level // By subsystem
+	JSON   bool                  // One JSON object per line, rather than key=value text
+	// Redact leaves signatures out of what is logged, and shortens public
+	// keys to their first 8 characters
+	Redact bool
+}
+
+var (
+	handler slog.Handler = slog.NewTextHandler(os.Stderr, nil)
+	options              = Options{Level: slog.LevelInfo}
+	mutex   sync.RWMutex
+)
+
+// Configure sets where and how every logger writes from now on, including
+// loggers made before it was called.
+func Configure(out io.Writer, newOptions Options) {
+	handlerOptions := &slog.HandlerOptions{
+		// Levels are checked per subsystem before records get here
+		Level: slog.LevelDebug,
+	}
+	if newOptions.Redact {
+		handlerOptions.ReplaceAttr = redact
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if newOptions.JSON {
+		handler = slog.NewJSONHandler(out, handlerOptions)
+	} else {
+		handler = slog.NewTextHandler(out, handlerOptions)
+	}
+	options = newOptions
+}
+
+// Logger returns the logger of a subsystem, which adds the subsystem to
+// everything it logs.
+func Logger(subsystem string) *slog.Logger {
+	return slog.New(&subsystemHandler{subsystem: subsystem})
+}
+
+// ParseLevel parses debug, info, warn or error.
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	if err != nil {
+		return level, errors.New("unknown log level: " + s)
+	}
+	return level, nil
+}
+
+// ParseLevels parses subsystem levels written like neighbor=debug.
+func ParseLevels(levels []string) (map[string]slog.Level, error) {
+	parsed := map[string]slog.Level{}
+	for _, s := range levels {
+		subsystem, levelName, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, errors.New("subsystem level has to look like neighbor=debug: " + s)
+		}
+
+		known := false
+		for _, name := range Subsystems {
+			known = known || name == subsystem
+		}
+		if !known {
+			return nil, errors.New("unknown subsystem " + subsystem + ", subsystems are " + strings.Join(Subsystems, ", "))
+		}
+
+		level, err := ParseLevel(levelName)
+		if err != nil {
+			return nil, err
+		}
+		parsed[subsystem] = level
+	}
+	return parsed, nil
+}
+
+// subsystemHandler hands records to whatever handler is configured when
+// they are logged, so loggers can be made before logging is configured.
+type subsystemHandler struct {
+	subsystem string
+	with      []func(slog.Handler) slog.Handler // WithAttrs and WithGroup, in order
+}
+
+func (self *subsystemHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	minimum, ok := options.Levels[self.subsystem]
+	if !ok {
+		minimum = options.Level
+	}
+	return level >= minimum
+}
+
+func (self *subsystemHandler) Handle(ctx context.Context, record slog.Record) error {
+	mutex.RLock()
+	h := handler
+	mutex.RUnlock()
+
+	h = h.WithAttrs([]slog.Attr{slog.String("subsystem", self.subsystem)})
+	for _, with := range self.with {
+		h = with(h)
+	}
+	return h.Handle(ctx, record)
+}
+
+func (self *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return self.extend(func(h slog.Handler) slog.Handler {
+		return h.WithAttrs(attrs)
+	})
+}
+
+func (self *subsystemHandler) WithGroup(name string) slog.Handler {
+	return self.extend(func(h slog.Handler) slog.Handler {
+		return h.WithGroup(name)
+	})
+}
+
+func (self *subsystemHandler) extend(with func(slog.Handler) slog.Handler) slog.Handler {
+	withs := make([]func(slog.Handler) slog.Handler, len(self.with), len(self.with)+1)
+	copy(withs, self.with)
+	return &subsystemHandler{
+		subsystem: self.subsystem,
+		with:      append(withs, with),
+	}
+}
+
+// redact goes through every word of strings and errors. Anything that is
+// base64 for 64 bytes is a signature (or an ed25519 private key) and is
+// left out, and anything that is base64 for 32 bytes is a key and is
+// shortened. Nothing else we log is either.
+func redact(groups []string, attr slog.Attr) slog.Attr {
+	switch value := attr.Value.Any().(type) {
+	case string:
+		return slog.String(attr.Key, redactWords(value))
+	case error:
+		return slog.String(attr.Key, redactWords(value.Error()))
+	}
+	return attr
+}
+
+func redactWords(s string) string {
+	words := strings.Split(s, " ")
+	for i, word := range words {
+		words[i] = redactWord(word)
+	}
+	return strings.Join(words, " ")
+}
+
+func redactWord(word string) string {
+	// Keys and signatures are 44 and 88 characters, with padding
+	if len(word) != 44 && len(word) != 88 {
+		return word
+	}
+
+	b, err := base64.StdEncoding.DecodeString(word)
+	if err != nil {
+		return word
+	}
+
+	switch len(b) {
+	case 64:
+		return "[redacted]"
+	case 32:
+		return word[:8] + "…"
+	}
+	return word
+}
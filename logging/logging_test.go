@@ -0,0 +1,103 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+const (
+	publicKey = "LLBQ9vdHBeVsb55NEnRiHFQ71122IvAFk+XT/Szd7VU="
+	signature = "uvOCUOlMnDbK41nwZ4FaTwTOeuSl/O+9sUC0NHLggRzxSpv3yLyVeijIKJ5nWO2KQL+uQEjFaKiKCKfbYbW+Bw=="
+)
+
+func TestLevels(t *testing.T) {
+	var out bytes.Buffer
+	Configure(&out, Options{
+		Level:  slog.LevelInfo,
+		Levels: map[string]slog.Level{"neighbor": slog.LevelDebug, "wireguard": slog.LevelError},
+	})
+
+	Logger("neighbor").Debug("neighbor debug")
+	Logger("node").Debug("node debug")
+	Logger("node").Info("node info")
+	Logger("wireguard").Warn("wireguard warn")
+
+	logged := out.String()
+	for _, expected := range []string{"neighbor debug", "node info", "subsystem=node"} {
+		if !strings.Contains(logged, expected) {
+			t.Errorf("%q not logged:\n%v", expected, logged)
+		}
+	}
+	for _, unexpected := range []string{"node debug", "wireguard warn"} {
+		if strings.Contains(logged, unexpected) {
+			t.Errorf("%q logged:\n%v", unexpected, logged)
+		}
+	}
+}
+
+func TestLoggerBeforeConfigure(t *testing.T) {
+	logger := Logger("payment").With("neighbor", "a")
+
+	var out bytes.Buffer
+	Configure(&out, Options{Level: slog.LevelInfo, JSON: true})
+
+	logger.Info("settled", "amount", 5)
+
+	var record map[string]interface{}
+	err := json.Unmarshal(out.Bytes(), &record)
+	if err != nil {
+		t.Fatal(err, out.String())
+	}
+	if record["subsystem"] != "payment" || record["neighbor"] != "a" || record["amount"] != 5.0 {
+		t.Fatalf("wrong record: %v", record)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	message := "scrooge_voucher " + publicKey + " " + publicKey + " 1000 12 " + signature
+
+	var out bytes.Buffer
+	Configure(&out, Options{Level: slog.LevelInfo, Redact: true})
+	Logger("neighbor").Info(
+		"received",
+		"neighbor", publicKey,
+		"message", message,
+		"err", errors.New("bad public key: "+publicKey),
+	)
+
+	logged := out.String()
+	if strings.Contains(logged, signature) || strings.Contains(logged, publicKey) {
+		t.Fatalf("not redacted:\n%v", logged)
+	}
+	if !strings.Contains(logged, "scrooge_voucher LLBQ9vdH… LLBQ9vdH… 1000 12 [redacted]") {
+		t.Fatalf("wrong redaction:\n%v", logged)
+	}
+
+	out.Reset()
+	Configure(&out, Options{Level: slog.LevelInfo})
+	Logger("neighbor").Info("received", "message", message)
+	if !strings.Contains(out.String(), signature) {
+		t.Fatalf("redacted without Redact:\n%v", out.String())
+	}
+}
+
+func TestParseLevels(t *testing.T) {
+	levels, err := ParseLevels([]string{"neighbor=debug", "wireguard=WARN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if levels["neighbor"] != slog.LevelDebug || levels["wireguard"] != slog.LevelWarn {
+		t.Fatalf("wrong levels: %v", levels)
+	}
+
+	for _, bad := range []string{"neighbor", "neighbour=debug", "neighbor=loud"} {
+		_, err = ParseLevels([]string{bad})
+		if err == nil {
+			t.Errorf("%v: no error", bad)
+		}
+	}
+}
@@ -1,111 +1,441 @@
 package main
 
 import (
+	"bufio"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
-	"net"
+	"io"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
 
 	"github.com/agl/ed25519"
-	"github.com/incentivized-mesh-infrastructure/scrooge/neighborAPI"
-	"github.com/incentivized-mesh-infrastructure/scrooge/network"
+	"github.com/incentivized-mesh-infrastructure/scrooge/certificate"
+	"github.com/incentivized-mesh-infrastructure/scrooge/config"
+	"github.com/incentivized-mesh-infrastructure/scrooge/keystore"
+	"github.com/incentivized-mesh-infrastructure/scrooge/serialization"
 	"github.com/incentivized-mesh-infrastructure/scrooge/types"
 	"github.com/incentivized-mesh-infrastructure/scrooge/wireguard"
 )
 
+// version is set when building releases, with
+// -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
+const usage = `Usage: scrooge <command> [flags] [arguments]
+
+Commands:
+  run          run the node
+  keygen       generate a key into the keystore and print its public key
+  pubkey       print the public key of a private key
+  verify-msg   check the signature of a captured message
+  issue-cert   sign a certificate for a node with the authority key
+  issue-crl    sign a CRL with the authority key
+  version      print the version
+
+Run scrooge <command> -h for the flags of a command.
+`
+
+var commands = map[string]func(args []string) error{
+	"run":        runCommand,
+	"keygen":     keygenCommand,
+	"pubkey":     pubkeyCommand,
+	"verify-msg": verifyMsgCommand,
+	"issue-cert": issueCertCommand,
+	"issue-crl":  issueCRLCommand,
+	"version":    versionCommand,
+}
+
 func main() {
-	genkeys := flag.Bool("genkeys", false, "Generate encryption keys and quit")
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
 
-	ifi := flag.String("interface", "", "Physical network interface to operate on.")
+	name := os.Args[1]
+	switch {
+	case name == "help" || name == "-h" || name == "-help" || name == "--help":
+		fmt.Print(usage)
+		return
+	case strings.HasPrefix(name, "-"):
+		// Flags used to come before everything, with -genkeys and friends
+		// picking what to do
+		fmt.Fprintln(os.Stderr, "scrooge: flags go after the command, like scrooge run "+strings.Join(os.Args[1:], " "))
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
 
-	publicKey := flag.String("publicKey", "", "PublicKey to sign messages to other nodes.")
-	privateKey := flag.String("privateKey", "", "PrivateKey to sign messages to other nodes.")
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "scrooge: unknown command:", name)
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
 
-	tunnelPublicKey := flag.String("tunnelPublicKey", "", "PublicKey of authenticated tunnel")
-	tunnelPrivateKey := flag.String("tunnelPrivateKey", "", "PrivateKey of authenticated tunnel")
+	err := command(os.Args[2:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "scrooge:", err)
+		os.Exit(1)
+	}
+}
 
-	flag.Parse()
+// setUsage makes flags print text, then its flags, for -h.
+func setUsage(flags *flag.FlagSet, text string) {
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), text)
+		flags.PrintDefaults()
+	}
+}
 
-	if *genkeys {
-		scroogePubkey, scroogePrivkey, err := ed25519.GenerateKey(rand.Reader)
-		if err != nil {
-			log.Fatalln(err)
-		}
+// keystoreFlags adds the flags that say where the keystore is to flags. The
+// function it returns opens the keystore once they are parsed.
+func keystoreFlags(flags *flag.FlagSet) func() (*keystore.Keystore, error) {
+	keys := config.Default().Keys
+	configFile := flags.String("config", "", "TOML file to take the keystore settings from. Flags given on the command line win over it")
+	flags.StringVar(&keys.Keystore, "keystore", keys.Keystore, "Directory to keep private keys in")
+	flags.StringVar(&keys.PassphraseFile, "passphraseFile", keys.PassphraseFile, "File with the passphrase keys in the keystore are encrypted with, if $SCROOGE_PASSPHRASE is not set")
+
+	return func() (*keystore.Keystore, error) {
+		if *configFile != "" {
+			settings, err := config.Load(*configFile)
+			if err != nil {
+				return nil, err
+			}
 
-		// fmt.Printf("%#v %#v", scroogePubkey, scroogePrivkey)
+			set := map[string]bool{}
+			flags.Visit(func(f *flag.Flag) {
+				set[f.Name] = true
+			})
+			if !set["keystore"] {
+				keys.Keystore = settings.Keys.Keystore
+			}
+			if !set["passphraseFile"] {
+				keys.PassphraseFile = settings.Keys.PassphraseFile
+			}
+		}
 
-		wireguardPubkey, wireguardPrivkey, err := wireguard.Genkeys()
+		passphrase, err := keystore.Passphrase(keys.PassphraseFile)
 		if err != nil {
-			log.Fatalln(err)
+			return nil, err
 		}
+		return keystore.New(keys.Keystore, passphrase), nil
+	}
+}
 
-		fmt.Printf(
-			`scrooge pubkey: %v
+const keygenUsage = `Usage: scrooge keygen [flags]
 
-scrooge privkey: %v
+Generates a key into the keystore and prints its public key. A key that is
+already there is never replaced.
 
-wireguard pubkey: %v
-wireguard privkey: %v
-`,
-			base64.StdEncoding.EncodeToString(scroogePubkey[:]),
-			base64.StdEncoding.EncodeToString(scroogePrivkey[:]),
-			wireguardPubkey,
-			wireguardPrivkey,
-		)
+Flags:
+`
 
-	} else {
+func keygenCommand(args []string) error {
+	flags := flag.NewFlagSet("scrooge keygen", flag.ExitOnError)
+	openKeystore := keystoreFlags(flags)
+	name := flags.String("name", keystore.Identity, "Key to generate: identity, next-identity, tunnel or authority")
+	setUsage(flags, keygenUsage)
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		return errors.New("keygen takes no arguments, only flags")
+	}
+
+	keys, err := openKeystore()
+	if err != nil {
+		return err
+	}
 
-		iface, err := net.InterfaceByName(*ifi)
+	publicKey, err := generateKey(keys, *name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%v public key: %v\n", *name, publicKey)
+	return nil
+}
+
+const pubkeyUsage = `Usage: scrooge pubkey [flags]
+
+Prints the public key of a base64 private key read from stdin, or of the key
+named by -name in the keystore. ed25519 identity keys and WireGuard tunnel
+keys are told apart by their length.
+
+Flags:
+`
+
+func pubkeyCommand(args []string) error {
+	flags := flag.NewFlagSet("scrooge pubkey", flag.ExitOnError)
+	openKeystore := keystoreFlags(flags)
+	name := flags.String("name", "", "Key in the keystore to print the public key of, instead of reading one from stdin")
+	setUsage(flags, pubkeyUsage)
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		return errors.New("pubkey takes no arguments, only flags")
+	}
+
+	var privateKey string
+	if *name != "" {
+		keys, err := openKeystore()
 		if err != nil {
-			log.Fatalln(err)
+			return err
 		}
 
-		pubKey, err := base64.StdEncoding.DecodeString(*publicKey)
+		privateKey, err = keys.Load(*name)
 		if err != nil {
-			log.Fatalln(err)
+			return err
 		}
-
-		privKey, err := base64.StdEncoding.DecodeString(*privateKey)
+	} else {
+		var err error
+		privateKey, err = readLine(os.Stdin)
 		if err != nil {
-			log.Fatalln(err)
+			return err
 		}
+	}
+
+	publicKey, err := derivePublicKey(privateKey)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(publicKey)
+	return nil
+}
+
+// derivePublicKey returns the public key of an ed25519 or WireGuard private
+// key.
+func derivePublicKey(privateKey string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil {
+		return "", errors.New("private key is not base64")
+	}
+
+	switch len(b) {
+	case ed25519.PrivateKeySize:
+		privKey := types.BytesToPrivateKey(b)
+		publicKey := publicKeyOf(&privKey)
+		return base64.StdEncoding.EncodeToString(publicKey[:]), nil
+	case 32:
+		return wireguard.PublicKey(privateKey)
+	default:
+		return "", errors.New("private key is neither an ed25519 nor a WireGuard key")
+	}
+}
+
+const verifyMsgUsage = `Usage: scrooge verify-msg [flags] [message]
+
+Checks the signature of a scrooge message, given as the argument or read
+from stdin, and prints who it is from and to. Exits with status 1 if the
+signature is not valid.
+
+Flags:
+`
 
-		network := network.Network{
-			MulticastPort: 8481,
+func verifyMsgCommand(args []string) error {
+	flags := flag.NewFlagSet("scrooge verify-msg", flag.ExitOnError)
+	from := flags.String("from", "", "Also check that the message is from this base64 public key")
+	setUsage(flags, verifyMsgUsage)
+	flags.Parse(args)
+
+	var s string
+	switch flags.NArg() {
+	case 0:
+		var err error
+		s, err = readLine(os.Stdin)
+		if err != nil {
+			return err
 		}
+	case 1:
+		s = flags.Arg(0)
+	default:
+		return errors.New("quote the message, it has to be a single argument")
+	}
 
-		neighborAPI := neighborAPI.NeighborAPI{
-			Neighbors: map[[ed25519.PublicKeySize]byte]*types.Neighbor{},
-			Network:   &network,
-			Account: &types.Account{
-				PublicKey:        types.BytesToPublicKey(pubKey),
-				PrivateKey:       types.BytesToPrivateKey(privKey),
-				TunnelPublicKey:  *tunnelPublicKey,
-				TunnelPrivateKey: *tunnelPrivateKey,
-				Seqnum:           0,
-			},
+	msg, err := serialization.VerifyMsg(strings.Split(strings.TrimSpace(s), " "))
+	if err != nil {
+		return err
+	}
+
+	source := base64.StdEncoding.EncodeToString(msg.SourcePublicKey[:])
+	if *from != "" && *from != source {
+		return errors.New("message is from " + source)
+	}
+
+	fmt.Println("signature valid")
+	fmt.Println("from:  ", source)
+	fmt.Println("to:    ", base64.StdEncoding.EncodeToString(msg.DestinationPublicKey[:]))
+	fmt.Println("seqnum:", msg.Seqnum)
+	return nil
+}
+
+const issueCertUsage = `Usage: scrooge issue-cert [flags] <publicKey>
+
+Signs a certificate for a node's base64 public key with the authority key
+from the keystore, and prints it.
+
+Flags:
+`
+
+func issueCertCommand(args []string) error {
+	flags := flag.NewFlagSet("scrooge issue-cert", flag.ExitOnError)
+	openKeystore := keystoreFlags(flags)
+	expiry := flags.Duration("expiry", 365*24*time.Hour, "How long the certificate is valid for")
+	attributes := flags.String("attributes", "", "Attributes of the certificate, URL query encoded like owner=alice&site=roof")
+	setUsage(flags, issueCertUsage)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: scrooge issue-cert [flags] <publicKey>")
+	}
+
+	keys, err := openKeystore()
+	if err != nil {
+		return err
+	}
+
+	authorityPrivateKey, err := keys.Load(keystore.Authority)
+	if err != nil {
+		return err
+	}
+
+	return printCertificate(flags.Arg(0), authorityPrivateKey, *expiry, *attributes)
+}
+
+const issueCRLUsage = `Usage: scrooge issue-crl [flags] [<publicKey>...]
+
+Signs a CRL revoking the certificates of the base64 public keys with the
+authority key from the keystore, and prints it. Every CRL replaces the one
+before it, so give every key that is still revoked. A CRL without keys lifts
+every revocation.
+
+Flags:
+`
+
+func issueCRLCommand(args []string) error {
+	flags := flag.NewFlagSet("scrooge issue-crl", flag.ExitOnError)
+	openKeystore := keystoreFlags(flags)
+	setUsage(flags, issueCRLUsage)
+	flags.Parse(args)
+
+	keys, err := openKeystore()
+	if err != nil {
+		return err
+	}
+
+	authorityPrivateKey, err := keys.Load(keystore.Authority)
+	if err != nil {
+		return err
+	}
+
+	return printCRL(flags.Args(), authorityPrivateKey)
+}
+
+func versionCommand(args []string) error {
+	flags := flag.NewFlagSet("scrooge version", flag.ExitOnError)
+	setUsage(flags, "Usage: scrooge version\n\nPrints the version of scrooge and the Go it was built with.\n")
+	flags.Parse(args)
+
+	fmt.Printf("scrooge %v (%v)\n", version, runtime.Version())
+	return nil
+}
+
+// readLine reads a single line, like a key or a message, from r.
+func readLine(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && !(err == io.EOF && line != "") {
+		return "", errors.New("nothing on stdin")
+	}
+	return strings.TrimSpace(line), nil
+}
+
+func printCertificate(
+	publicKey string,
+	authorityPrivateKey string,
+	expiry time.Duration,
+	attributes string,
+) error {
+	b, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return errors.New("bad public key")
+	}
+
+	privKey, err := base64.StdEncoding.DecodeString(authorityPrivateKey)
+	if err != nil || len(privKey) != ed25519.PrivateKeySize {
+		return errors.New("bad authority private key")
+	}
+
+	values, err := url.ParseQuery(attributes)
+	if err != nil {
+		return err
+	}
+
+	cert := certificate.Issue(
+		types.BytesToPublicKey(b),
+		time.Now().Add(expiry),
+		values,
+		types.BytesToPrivateKey(privKey),
+	)
+
+	fmt.Println(cert)
+	return nil
+}
+
+func printCRL(publicKeys []string, authorityPrivateKey string) error {
+	var revoked [][ed25519.PublicKeySize]byte
+	for _, publicKey := range publicKeys {
+		b, err := base64.StdEncoding.DecodeString(publicKey)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return errors.New("bad public key: " + publicKey)
 		}
+		revoked = append(revoked, types.BytesToPublicKey(b))
+	}
 
-		callback := func(err error) {
-			if err != nil {
-				log.Fatalln(err)
-			}
+	privKey, err := base64.StdEncoding.DecodeString(authorityPrivateKey)
+	if err != nil || len(privKey) != ed25519.PrivateKeySize {
+		return errors.New("bad authority private key")
+	}
+
+	crl := certificate.IssueCRL(
+		time.Now(),
+		revoked,
+		types.BytesToPrivateKey(privKey),
+	)
+
+	fmt.Println(crl)
+	return nil
+}
+
+// generateKey makes a new key called name in the keystore, and returns its
+// public key. It never replaces a key that is already there.
+func generateKey(keys *keystore.Keystore, name string) (string, error) {
+	if keys.Exists(name) {
+		return "", errors.New(name + " key already exists")
+	}
+
+	var publicKey, privateKey string
+	switch name {
+	case keystore.Identity, keystore.NextIdentity, keystore.Authority:
+		pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", err
 		}
-		go network.McastListen(
-			iface,
-			neighborAPI.Handlers,
-			callback,
-		)
-
-		err = neighborAPI.SendHelloMsg(
-			iface,
-			false,
-		)
+		publicKey = base64.StdEncoding.EncodeToString(pubKey[:])
+		privateKey = base64.StdEncoding.EncodeToString(privKey[:])
+	case keystore.Tunnel:
+		var err error
+		publicKey, privateKey, err = wireguard.NewKeys()
 		if err != nil {
-			log.Fatalln(err)
+			return "", err
 		}
-		select {}
+	default:
+		return "", errors.New("unknown key: " + name)
 	}
+
+	return publicKey, keys.Store(name, privateKey)
 }
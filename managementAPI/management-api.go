@@ -0,0 +1,471 @@
+package managementAPI
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/agl/ed25519"
+	"github.com/incentivized-mesh-infrastructure/scrooge/events"
+	"github.com/incentivized-mesh-infrastructure/scrooge/ledger"
+	"github.com/incentivized-mesh-infrastructure/scrooge/throttle"
+	"github.com/incentivized-mesh-infrastructure/scrooge/types"
+)
+
+// Server answers management requests from the local machine, as JSON over
+// HTTP on a Unix socket. Anything that can connect to the socket can run
+// the node, so it is only accessible to its owner.
+//
+//	GET  /neighbors  every neighbor, as types.NeighborStatus
+//	GET  /account    our account, as types.AccountStatus
+//	POST /hello      send a hello on every interface now
+//	POST /tunnel     rebuild the tunnel with a neighbor, types.NeighborRequest
+//	POST /kick       forget a neighbor, types.NeighborRequest
+//	POST /credit     let a neighbor off some debt, types.CreditRequest
+//	POST /pay        pay a neighbor within the spending caps, types.PaymentRequest
+//	GET  /events     stream events as they happen, as events.Event
+//
+// Errors are returned as {"Error": "..."} with a status other than 200.
+//
+// Events are streamed one JSON object per line until the client hangs up.
+// ?type=tunnel_up,payment_received only streams those types. A client that
+// reads too slowly misses the oldest events, and is sent an overflow event
+// with how many it missed.
+type Server struct {
+	NeighborAPI interface {
+		ListNeighbors() []types.Neighbor
+		AccountInfo() types.Account
+		SendHelloMsg(*net.Interface) error
+		RebuildTunnel([ed25519.PublicKeySize]byte, *net.Interface) error
+		RemoveNeighbor([ed25519.PublicKeySize]byte) error
+	}
+	Ledger interface {
+		Balance([ed25519.PublicKeySize]byte) types.Balance
+		Record([ed25519.PublicKeySize]byte, string, uint64, time.Time) error
+	}
+	// Payments makes the payments asked for with /pay, so that they count
+	// toward the spending caps and what we owe is paid only once
+	Payments interface {
+		Pay([ed25519.PublicKeySize]byte, *net.Interface, uint64, time.Time) error
+	}
+	// Throttle, if set, decides how hard neighbors are throttled
+	Throttle interface {
+		Decide(types.Balance, time.Time) throttle.Decision
+	}
+	// Tunnels, if set, tells whether tunnel interfaces are up. Otherwise no
+	// tunnel is reported up.
+	Tunnels interface {
+		Up(virtualInterface string) bool
+	}
+	// Events, if set, is where /events streams from
+	Events     *events.Bus
+	Interfaces []*net.Interface // Hellos go out on all of them
+	server     *http.Server
+	closed     bool
+	mutex      sync.Mutex
+}
+
+type errorResponse struct {
+	Error string
+}
+
+// Listen serves requests on a Unix socket at path until the server is
+// closed. A socket left behind by an earlier run is replaced.
+func (self *Server) Listen(path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// The socket is created with the umask's permissions, so it is never
+	// open to anyone else, not even until it is chmodded
+	umask := syscall.Umask(0077)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	self.mutex.Lock()
+	if self.closed {
+		self.mutex.Unlock()
+		listener.Close()
+		return errors.New("server closed")
+	}
+	server := &http.Server{Handler: self.Handler()}
+	self.server = server
+	self.mutex.Unlock()
+
+	err = server.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Close stops the server and closes the socket.
+func (self *Server) Close() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.closed = true
+	if self.server == nil {
+		return nil
+	}
+	return self.server.Close()
+}
+
+// Handler returns the handler for every endpoint.
+func (self *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/neighbors", self.get(self.neighbors))
+	mux.HandleFunc("/account", self.get(self.account))
+	mux.HandleFunc("/hello", self.post(self.hello))
+	mux.HandleFunc("/tunnel", self.post(self.tunnel))
+	mux.HandleFunc("/kick", self.post(self.kick))
+	mux.HandleFunc("/credit", self.post(self.credit))
+	mux.HandleFunc("/pay", self.post(self.pay))
+	mux.HandleFunc("/events", self.events)
+	return mux
+}
+
+func (self *Server) get(
+	handler func() (interface{}, error),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respond(w, http.StatusMethodNotAllowed, errorResponse{"use GET"})
+			return
+		}
+
+		response, err := handler()
+		if err != nil {
+			respond(w, http.StatusInternalServerError, errorResponse{err.Error()})
+			return
+		}
+		respond(w, http.StatusOK, response)
+	}
+}
+
+// post runs handler for POST requests, and responds with the status it
+// returns if it fails.
+func (self *Server) post(
+	handler func(r *http.Request) (int, error),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			respond(w, http.StatusMethodNotAllowed, errorResponse{"use POST"})
+			return
+		}
+
+		status, err := handler(r)
+		if err != nil {
+			respond(w, status, errorResponse{err.Error()})
+			return
+		}
+		respond(w, http.StatusOK, struct{}{})
+	}
+}
+
+func respond(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (self *Server) neighbors() (interface{}, error) {
+	neighbors := self.NeighborAPI.ListNeighbors()
+
+	statuses := make([]types.NeighborStatus, 0, len(neighbors))
+	for _, neighbor := range neighbors {
+		statuses = append(statuses, self.neighborStatus(neighbor))
+	}
+	return statuses, nil
+}
+
+func (self *Server) tunnelUp(virtualInterface string) bool {
+	return self.Tunnels != nil &&
+		virtualInterface != "" &&
+		self.Tunnels.Up(virtualInterface)
+}
+
+func (self *Server) neighborStatus(neighbor types.Neighbor) types.NeighborStatus {
+	balance := self.Ledger.Balance(neighbor.PublicKey)
+
+	status := types.NeighborStatus{
+		PublicKey:  base64.StdEncoding.EncodeToString(neighbor.PublicKey[:]),
+		Seqnum:     neighbor.Seqnum,
+		SeqnumMode: neighbor.SeqnumMode,
+		Confirmed:  neighbor.Confirmed,
+		LastSeen:   neighbor.LastSeen,
+		Price:      neighbor.BillingDetails.Price,
+		Tunnel: types.TunnelStatus{
+			Up:               self.tunnelUp(neighbor.Tunnel.VirtualInterface.Name),
+			VirtualInterface: neighbor.Tunnel.VirtualInterface.Name,
+			PublicKey:        neighbor.Tunnel.PublicKey,
+			LocalPublicKey:   neighbor.Tunnel.LocalPublicKey,
+			Endpoint:         neighbor.Tunnel.Endpoint,
+			ListenPort:       neighbor.Tunnel.ListenPort,
+			KeyCreated:       neighbor.Tunnel.LocalKeyCreated,
+			Rotating:         neighbor.Tunnel.NextPublicKey != "",
+		},
+		Balance: balance,
+		Debt:    balance.Debt(),
+		Channel: types.ChannelStatus{
+			Sent:     neighbor.Channel.Sent,
+			Received: neighbor.Channel.Received,
+			Settled:  neighbor.Channel.Settled,
+			Closed:   neighbor.Channel.Closed,
+		},
+	}
+	if neighbor.Address != nil {
+		status.Address = neighbor.Address.String()
+	}
+	if self.Throttle != nil {
+		decision := self.Throttle.Decide(balance, time.Now())
+		status.Throttle = types.ThrottleStatus{
+			Level:         decision.Level.String(),
+			EffectiveDebt: decision.EffectiveDebt,
+			Reason:        decision.Reason,
+		}
+	}
+	return status
+}
+
+func (self *Server) account() (interface{}, error) {
+	account := self.NeighborAPI.AccountInfo()
+
+	return types.AccountStatus{
+		PublicKey:       base64.StdEncoding.EncodeToString(account.PublicKey[:]),
+		TunnelPublicKey: account.TunnelPublicKey,
+		Seqnum:          account.Seqnum,
+		SeqnumMode:      account.SeqnumMode,
+		Price:           account.Price,
+		Certificate:     account.Certificate,
+		Neighbors:       len(self.NeighborAPI.ListNeighbors()),
+	}, nil
+}
+
+func (self *Server) hello(r *http.Request) (int, error) {
+	for _, iface := range self.Interfaces {
+		err := self.NeighborAPI.SendHelloMsg(iface)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// tunnel takes our end of the tunnel with the neighbor down and sends it a
+// tunnel message. It answers by setting its end up again and confirming,
+// and the confirm sets ours up.
+func (self *Server) tunnel(r *http.Request) (int, error) {
+	var request types.NeighborRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	publicKey, err := parsePublicKey(request.PublicKey)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	neighbor, err := self.findNeighbor(publicKey)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+
+	err = self.NeighborAPI.RebuildTunnel(publicKey, self.interfaceOf(neighbor))
+	if err != nil {
+		return http.StatusConflict, err
+	}
+	return http.StatusOK, nil
+}
+
+func (self *Server) kick(r *http.Request) (int, error) {
+	var request types.NeighborRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	publicKey, err := parsePublicKey(request.PublicKey)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	err = self.NeighborAPI.RemoveNeighbor(publicKey)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	return http.StatusOK, nil
+}
+
+func (self *Server) credit(r *http.Request) (int, error) {
+	var request types.CreditRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	publicKey, err := parsePublicKey(request.PublicKey)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	entryType := ledger.CreditGranted
+	amount := request.Amount
+	if amount < 0 {
+		entryType = ledger.CreditRevoked
+		amount = -amount
+	}
+
+	err = self.Ledger.Record(publicKey, entryType, uint64(amount), time.Now())
+	if err != nil {
+		return http.StatusConflict, err
+	}
+	return http.StatusOK, nil
+}
+
+// pay sends the neighbor a voucher for amount. It is taken off what the
+// scheduler owes the neighbor for routing our traffic, and refused if it
+// doesn't fit in the spending caps.
+func (self *Server) pay(r *http.Request) (int, error) {
+	var request types.PaymentRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	publicKey, err := parsePublicKey(request.PublicKey)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if request.Amount == 0 {
+		return http.StatusBadRequest, errors.New("nothing to pay")
+	}
+
+	neighbor, err := self.findNeighbor(publicKey)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+
+	err = self.Payments.Pay(publicKey, self.interfaceOf(neighbor), request.Amount, time.Now())
+	if err != nil {
+		return http.StatusConflict, err
+	}
+	return http.StatusOK, nil
+}
+
+func (self *Server) events(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respond(w, http.StatusMethodNotAllowed, errorResponse{"use GET"})
+		return
+	}
+
+	if self.Events == nil {
+		respond(w, http.StatusNotFound, errorResponse{"events are not published"})
+		return
+	}
+
+	var eventTypes []events.Type
+	if r.URL.Query().Get("type") != "" {
+		var err error
+		eventTypes, err = events.ParseTypes(strings.Split(r.URL.Query().Get("type"), ","))
+		if err != nil {
+			respond(w, http.StatusBadRequest, errorResponse{err.Error()})
+			return
+		}
+	}
+
+	subscription := self.Events.Subscribe(events.DefaultBuffer, eventTypes...)
+	defer self.Events.Unsubscribe(subscription)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	encoder := json.NewEncoder(w)
+	var dropped uint64
+	for {
+		var event events.Event
+		select {
+		case <-r.Context().Done():
+			return
+		case event = <-subscription.Events():
+		}
+
+		// Events are only dropped while the channel is full, so the
+		// overflow goes before the oldest event that is left
+		if subscription.Dropped() != dropped {
+			err := encoder.Encode(events.Event{
+				Type:    events.Overflow,
+				Time:    time.Now(),
+				Dropped: subscription.Dropped() - dropped,
+			})
+			if err != nil {
+				return
+			}
+			dropped = subscription.Dropped()
+		}
+
+		err := encoder.Encode(event)
+		if err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+func parsePublicKey(s string) ([ed25519.PublicKeySize]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return [ed25519.PublicKeySize]byte{}, errors.New("bad public key: " + s)
+	}
+	return types.BytesToPublicKey(b), nil
+}
+
+func (self *Server) findNeighbor(
+	publicKey [ed25519.PublicKeySize]byte,
+) (types.Neighbor, error) {
+	for _, neighbor := range self.NeighborAPI.ListNeighbors() {
+		if neighbor.PublicKey == publicKey {
+			return neighbor, nil
+		}
+	}
+	return types.Neighbor{}, errors.New("neighbor not found")
+}
+
+// interfaceOf returns the interface the neighbor's messages come in on,
+// which messages to it are only sent on if we don't have its address.
+func (self *Server) interfaceOf(neighbor types.Neighbor) *net.Interface {
+	for _, iface := range self.Interfaces {
+		if neighbor.Address != nil && neighbor.Address.Zone == iface.Name {
+			return iface
+		}
+	}
+	if len(self.Interfaces) == 0 {
+		return nil
+	}
+	return self.Interfaces[0]
+}
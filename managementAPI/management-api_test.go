@@ -0,0 +1,238 @@
+package managementAPI
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agl/ed25519"
+	"github.com/incentivized-mesh-infrastructure/scrooge/ledger"
+	"github.com/incentivized-mesh-infrastructure/scrooge/scheduler"
+	"github.com/incentivized-mesh-infrastructure/scrooge/throttle"
+	"github.com/incentivized-mesh-infrastructure/scrooge/types"
+)
+
+var (
+	pubkey1 = [ed25519.PublicKeySize]byte{44, 176, 80, 246, 247, 71, 5, 229, 108, 111, 158, 77, 18, 116, 98, 28, 84, 59, 215, 93, 182, 34, 240, 5, 147, 229, 211, 253, 44, 221, 237, 85}
+	b64key1 = "LLBQ9vdHBeVsb55NEnRiHFQ71122IvAFk+XT/Szd7VU="
+	eth0    = &net.Interface{Name: "eth0"}
+	wlan0   = &net.Interface{Name: "wlan0"}
+)
+
+type fakeNeighborAPI struct {
+	neighbors []types.Neighbor
+	hellos    []string
+	tunnels   []string
+	removed   [][ed25519.PublicKeySize]byte
+	paid      uint64
+}
+
+func (self *fakeNeighborAPI) ListNeighbors() []types.Neighbor {
+	return self.neighbors
+}
+
+func (self *fakeNeighborAPI) AccountInfo() types.Account {
+	return types.Account{PublicKey: pubkey1, Price: 3}
+}
+
+func (self *fakeNeighborAPI) SendHelloMsg(iface *net.Interface) error {
+	self.hellos = append(self.hellos, iface.Name)
+	return nil
+}
+
+func (self *fakeNeighborAPI) RebuildTunnel(
+	publicKey [ed25519.PublicKeySize]byte,
+	iface *net.Interface,
+) error {
+	self.tunnels = append(self.tunnels, iface.Name)
+	return nil
+}
+
+func (self *fakeNeighborAPI) RemoveNeighbor(publicKey [ed25519.PublicKeySize]byte) error {
+	if len(self.neighbors) == 0 {
+		return errors.New("neighbor not found")
+	}
+	self.removed = append(self.removed, publicKey)
+	return nil
+}
+
+func (self *fakeNeighborAPI) SendVoucherMsg(
+	publicKey [ed25519.PublicKeySize]byte,
+	iface *net.Interface,
+	amount uint64,
+) error {
+	self.paid = self.paid + amount
+	return nil
+}
+
+type fakeTunnels map[string]bool
+
+func (self fakeTunnels) Up(virtualInterface string) bool {
+	return self[virtualInterface]
+}
+
+func createServer() (*Server, *fakeNeighborAPI) {
+	fakeAPI := &fakeNeighborAPI{
+		neighbors: []types.Neighbor{{
+			PublicKey: pubkey1,
+			Confirmed: true,
+			LastSeen:  time.Now(),
+			Address:   &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 8481, Zone: "wlan0"},
+		}},
+	}
+	l := ledger.New(nil)
+	server := &Server{
+		NeighborAPI: fakeAPI,
+		Ledger:      l,
+		Payments:    &scheduler.Scheduler{NeighborAPI: fakeAPI, Ledger: l},
+		Interfaces:  []*net.Interface{eth0, wlan0},
+	}
+	return server, fakeAPI
+}
+
+func request(server *Server, method string, path string, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return recorder
+}
+
+func TestNeighbors(t *testing.T) {
+	server, _ := createServer()
+	server.Ledger.Record(pubkey1, ledger.UsageBilled, 100, time.Now())
+
+	response := request(server, http.MethodGet, "/neighbors", "")
+	if response.Code != http.StatusOK {
+		t.Fatal("wrong status: ", response.Code, response.Body)
+	}
+
+	var neighbors []types.NeighborStatus
+	err := json.Unmarshal(response.Body.Bytes(), &neighbors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(neighbors) != 1 ||
+		neighbors[0].PublicKey != b64key1 ||
+		neighbors[0].Address != "[fe80::1%wlan0]:8481" ||
+		neighbors[0].Debt != 100 ||
+		!neighbors[0].Confirmed {
+		t.Fatalf("wrong neighbors: %+v", neighbors)
+	}
+
+	// Private keys never leave the node
+	if strings.Contains(response.Body.String(), "Private") {
+		t.Fatal("private key in response: ", response.Body)
+	}
+}
+
+func TestTunnelUp(t *testing.T) {
+	server, fakeAPI := createServer()
+	fakeAPI.neighbors[0].Tunnel.VirtualInterface.Name = "scrooge51820"
+	tunnels := fakeTunnels{}
+	server.Tunnels = tunnels
+
+	for _, up := range []bool{false, true} {
+		tunnels["scrooge51820"] = up
+
+		var neighbors []types.NeighborStatus
+		response := request(server, http.MethodGet, "/neighbors", "")
+		err := json.Unmarshal(response.Body.Bytes(), &neighbors)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if neighbors[0].Tunnel.Up != up {
+			t.Fatalf("tunnel up is %v, should be %v", neighbors[0].Tunnel.Up, up)
+		}
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	server, _ := createServer()
+	server.Throttle = &throttle.Policy{SoftDebt: 50, HardDebt: 100}
+	server.Ledger.Record(pubkey1, ledger.UsageBilled, 70, time.Now())
+
+	response := request(server, http.MethodGet, "/neighbors", "")
+
+	var neighbors []types.NeighborStatus
+	err := json.Unmarshal(response.Body.Bytes(), &neighbors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if neighbors[0].Throttle.Level != "soft" || neighbors[0].Throttle.EffectiveDebt != 70 {
+		t.Fatalf("wrong throttle: %+v", neighbors[0].Throttle)
+	}
+}
+
+func TestPay(t *testing.T) {
+	server, fakeAPI := createServer()
+
+	response := request(server, http.MethodPost, "/pay", `{"PublicKey": "`+b64key1+`", "Amount": 25}`)
+	if response.Code != http.StatusOK {
+		t.Fatal("wrong status: ", response.Code, response.Body)
+	}
+	if fakeAPI.paid != 25 || server.Ledger.Balance(pubkey1).Paid != 25 {
+		t.Fatal("payment not sent and recorded: ", fakeAPI.paid, server.Ledger.Balance(pubkey1))
+	}
+
+	// Payments count toward the spending caps
+	payments := server.Payments.(*scheduler.Scheduler)
+	payments.CapPeriod = time.Hour
+	payments.GlobalCap = 40
+
+	response = request(server, http.MethodPost, "/pay", `{"PublicKey": "`+b64key1+`", "Amount": 25}`)
+	if response.Code != http.StatusConflict {
+		t.Fatal("payment over the cap not refused: ", response.Code, response.Body)
+	}
+	if fakeAPI.paid != 25 {
+		t.Fatal("payment over the cap sent: ", fakeAPI.paid)
+	}
+}
+
+func TestTunnelOnNeighborInterface(t *testing.T) {
+	server, fakeAPI := createServer()
+
+	response := request(server, http.MethodPost, "/tunnel", `{"PublicKey": "`+b64key1+`"}`)
+	if response.Code != http.StatusOK {
+		t.Fatal("wrong status: ", response.Code, response.Body)
+	}
+	if len(fakeAPI.tunnels) != 1 || fakeAPI.tunnels[0] != "wlan0" {
+		t.Fatal("tunnel message not sent on the neighbor's interface: ", fakeAPI.tunnels)
+	}
+}
+
+func TestBadRequests(t *testing.T) {
+	server, _ := createServer()
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{http.MethodPost, "/neighbors", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/kick", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/kick", "{", http.StatusBadRequest},
+		{http.MethodPost, "/kick", `{"PublicKey": "bm90IGEga2V5"}`, http.StatusBadRequest},
+		{http.MethodPost, "/credit", `{"PublicKey": "` + b64key1 + `", "Amount": -5}`, http.StatusConflict},
+		{http.MethodPost, "/pay", `{"PublicKey": "` + b64key1 + `"}`, http.StatusBadRequest},
+		{http.MethodGet, "/events", "", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		response := request(server, test.method, test.path, test.body)
+		if response.Code != test.status {
+			t.Errorf("%v %v %v: status %v, should be %v", test.method, test.path, test.body, response.Code, test.status)
+		}
+
+		var failure errorResponse
+		err := json.Unmarshal(response.Body.Bytes(), &failure)
+		if err != nil || failure.Error == "" {
+			t.Errorf("%v %v: no error in response %v", test.method, test.path, response.Body)
+		}
+	}
+}
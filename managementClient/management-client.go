@@ -0,0 +1,191 @@
+package managementClient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/incentivized-mesh-infrastructure/scrooge/events"
+	"github.com/incentivized-mesh-infrastructure/scrooge/types"
+)
+
+// Client talks to the management API of a scrooge running on this machine.
+type Client struct {
+	SocketPath string
+	http       *http.Client
+}
+
+func New(socketPath string) *Client {
+	return &Client{
+		SocketPath: socketPath,
+		http: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// Neighbors returns every neighbor the node knows.
+func (self *Client) Neighbors() ([]types.NeighborStatus, error) {
+	var neighbors []types.NeighborStatus
+	err := self.do(http.MethodGet, "/neighbors", nil, &neighbors)
+	return neighbors, err
+}
+
+// Account returns the node's account.
+func (self *Client) Account() (*types.AccountStatus, error) {
+	var account types.AccountStatus
+	err := self.do(http.MethodGet, "/account", nil, &account)
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// SendHello makes the node send a hello on every interface now.
+func (self *Client) SendHello() error {
+	return self.do(http.MethodPost, "/hello", struct{}{}, nil)
+}
+
+// RebuildTunnel makes the node take its end of the tunnel with a neighbor
+// down and send it a tunnel message, so that both ends are set up again.
+func (self *Client) RebuildTunnel(publicKey string) error {
+	return self.do(http.MethodPost, "/tunnel", types.NeighborRequest{PublicKey: publicKey}, nil)
+}
+
+// Kick makes the node forget a neighbor.
+func (self *Client) Kick(publicKey string) error {
+	return self.do(http.MethodPost, "/kick", types.NeighborRequest{PublicKey: publicKey}, nil)
+}
+
+// AdjustCredit lets a neighbor off amount of its debt, or takes back credit
+// given before if amount is negative.
+func (self *Client) AdjustCredit(publicKey string, amount int64) error {
+	return self.do(
+		http.MethodPost,
+		"/credit",
+		types.CreditRequest{PublicKey: publicKey, Amount: amount},
+		nil,
+	)
+}
+
+// Pay makes the node send a neighbor a voucher for amount.
+func (self *Client) Pay(publicKey string, amount uint64) error {
+	return self.do(
+		http.MethodPost,
+		"/pay",
+		types.PaymentRequest{PublicKey: publicKey, Amount: amount},
+		nil,
+	)
+}
+
+// Events streams the node's events of eventTypes, or every event if there
+// are none, to handle. It returns when the node closes the stream, or with
+// the error handle returns.
+func (self *Client) Events(
+	eventTypes []string,
+	handle func(events.Event) error,
+) error {
+	path := "/events"
+	if len(eventTypes) > 0 {
+		path = path + "?type=" + url.QueryEscape(strings.Join(eventTypes, ","))
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://scrooge"+path, nil)
+	if err != nil {
+		return err
+	}
+
+	// The stream lasts as long as it is read, so no timeout
+	streaming := *self.http
+	streaming.Timeout = 0
+	resp, err := streaming.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event events.Event
+		err = decoder.Decode(&event)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = handle(event)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// do sends request as the JSON body, if it isn't nil, and decodes the
+// response into response, if that isn't nil.
+func (self *Client) do(
+	method string,
+	path string,
+	request interface{},
+	response interface{},
+) error {
+	var body bytes.Buffer
+	if request != nil {
+		err := json.NewEncoder(&body).Encode(request)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The host is ignored, every request goes to the socket
+	req, err := http.NewRequest(method, "http://scrooge"+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := self.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// responseError returns the error in a failed response.
+func responseError(resp *http.Response) error {
+	var failure struct {
+		Error string
+	}
+	err := json.NewDecoder(resp.Body).Decode(&failure)
+	if err != nil || failure.Error == "" {
+		return errors.New("management API: " + resp.Status)
+	}
+	return errors.New(failure.Error)
+}
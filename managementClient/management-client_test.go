@@ -0,0 +1,214 @@
+package managementClient
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/agl/ed25519"
+	"github.com/incentivized-mesh-infrastructure/scrooge/events"
+	"github.com/incentivized-mesh-infrastructure/scrooge/ledger"
+	"github.com/incentivized-mesh-infrastructure/scrooge/managementAPI"
+	"github.com/incentivized-mesh-infrastructure/scrooge/neighborAPI"
+	"github.com/incentivized-mesh-infrastructure/scrooge/types"
+)
+
+var (
+	pubkey1 = [ed25519.PublicKeySize]byte{44, 176, 80, 246, 247, 71, 5, 229, 108, 111, 158, 77, 18, 116, 98, 28, 84, 59, 215, 93, 182, 34, 240, 5, 147, 229, 211, 253, 44, 221, 237, 85}
+	b64key1 = "LLBQ9vdHBeVsb55NEnRiHFQ71122IvAFk+XT/Szd7VU="
+	iface   = &net.Interface{Name: "foo0"}
+)
+
+type fakeNetwork struct {
+	multicast []string
+}
+
+func (self *fakeNetwork) SendUDP(addr *net.UDPAddr, s string) error {
+	return nil
+}
+
+func (self *fakeNetwork) SendMulticastUDP(iface *net.Interface, s string) error {
+	self.multicast = append(self.multicast, s)
+	return nil
+}
+
+// serve runs a management API for a NeighborAPI with one neighbor, and
+// returns a client for it.
+func serve(t *testing.T) (*Client, *neighborAPI.NeighborAPI, *fakeNetwork) {
+	dir, err := ioutil.TempDir("", "management")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bus := events.New()
+	fakeNet := &fakeNetwork{}
+	api := &neighborAPI.NeighborAPI{
+		Neighbors: map[[ed25519.PublicKeySize]byte]*types.Neighbor{
+			pubkey1: {PublicKey: pubkey1, Seqnum: 7},
+		},
+		Account: &types.Account{
+			PublicKey:  types.BytesToPublicKey(privateKey[32:]),
+			PrivateKey: *privateKey,
+			Price:      2,
+		},
+		Ledger:  ledger.New(nil),
+		Network: fakeNet,
+		Events:  bus,
+	}
+
+	server := &managementAPI.Server{
+		NeighborAPI: api,
+		Ledger:      api.Ledger,
+		Events:      bus,
+		Interfaces:  []*net.Interface{iface},
+	}
+
+	path := filepath.Join(dir, "scrooge.sock")
+	go server.Listen(path)
+	t.Cleanup(func() { server.Close() })
+
+	// Wait for the socket to be there. Only we may ever connect to it.
+	for i := 0; i < 100; i++ {
+		var info os.FileInfo
+		info, err = os.Stat(path)
+		if err == nil {
+			if info.Mode().Perm()&0077 != 0 {
+				t.Fatal("socket open to others: ", info.Mode())
+			}
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return New(path), api, fakeNet
+}
+
+func TestNeighborsAndAccount(t *testing.T) {
+	client, api, _ := serve(t)
+
+	neighbors, err := client.Neighbors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(neighbors) != 1 || neighbors[0].PublicKey != b64key1 || neighbors[0].Seqnum != 7 {
+		t.Fatalf("wrong neighbors: %+v", neighbors)
+	}
+
+	account, err := client.Account()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.PublicKey != base64.StdEncoding.EncodeToString(api.Account.PublicKey[:]) ||
+		account.Price != 2 ||
+		account.Neighbors != 1 {
+		t.Fatalf("wrong account: %+v", account)
+	}
+}
+
+func TestActions(t *testing.T) {
+	client, api, fakeNet := serve(t)
+
+	err := client.SendHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fakeNet.multicast) != 1 {
+		t.Fatal("no hello sent")
+	}
+
+	// Tunnels are only built with confirmed neighbors
+	err = client.RebuildTunnel(b64key1)
+	if err == nil || err.Error() != "neighbor not confirmed" {
+		t.Fatal("wrong error for unconfirmed neighbor: ", err)
+	}
+
+	err = client.AdjustCredit(b64key1, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.AdjustCredit(b64key1, -20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if api.Ledger.Balance(pubkey1).Credit != 30 {
+		t.Fatal("wrong credit: ", api.Ledger.Balance(pubkey1).Credit)
+	}
+
+	err = client.Kick(b64key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(api.ListNeighbors()) != 0 {
+		t.Fatal("neighbor not kicked")
+	}
+
+	err = client.Kick(b64key1)
+	if err == nil || err.Error() != "neighbor not found" {
+		t.Fatal("wrong error kicking unknown neighbor: ", err)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	client, api, _ := serve(t)
+
+	received := make(chan events.Event, 1)
+	stop := errors.New("stop")
+	streamed := make(chan error, 1)
+	go func() {
+		streamed <- client.Events([]string{"neighbor_removed"}, func(event events.Event) error {
+			received <- event
+			return stop
+		})
+	}()
+
+	// Events published before the stream subscribes are not sent, so the
+	// neighbor is kicked until one gets through
+	var event events.Event
+	for event.Type == "" {
+		api.Update(func() {
+			api.Neighbors[pubkey1] = &types.Neighbor{PublicKey: pubkey1}
+		})
+		err := client.Kick(b64key1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The handler hands the event over before the stream ends, so an
+		// ended stream only fails the test if there is no event
+		select {
+		case event = <-received:
+		case err = <-streamed:
+			select {
+			case event = <-received:
+				streamed <- err
+			default:
+				t.Fatal("stream ended: ", err)
+			}
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	if event.Type != events.NeighborRemoved || event.Neighbor != b64key1 || event.Time.IsZero() {
+		t.Fatalf("wrong event: %+v", event)
+	}
+	if <-streamed != stop {
+		t.Fatal("handler error not returned")
+	}
+
+	err := client.Events([]string{"neighbor_lost"}, nil)
+	if err == nil || err.Error() != "unknown event type: neighbor_lost" {
+		t.Fatal("wrong error for unknown type: ", err)
+	}
+}
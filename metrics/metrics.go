@@ -0,0 +1,171 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type description struct {
+	kind string // counter or gauge
+	help string
+}
+
+// descriptions are the metrics scrooge exports. Anything else is written
+// without a type.
+var descriptions = map[string]description{
+	"scrooge_messages_received_total":        {"counter", "Messages received, by type. Sealed messages count once sealed and once for what was inside."},
+	"scrooge_messages_sent_total":            {"counter", "Messages sent, by type. Sealed messages count once sealed and once for what was inside."},
+	"scrooge_signature_failures_total":       {"counter", "Messages dropped because their signature was not valid."},
+	"scrooge_replay_rejections_total":        {"counter", "Messages dropped because their seqnum was replayed or out of the window, by stream."},
+	"scrooge_rate_limited_total":             {"counter", "Messages dropped by the rate limits, by limit."},
+	"scrooge_packets_received_total":         {"counter", "UDP packets received, by interface."},
+	"scrooge_packets_sent_total":             {"counter", "UDP packets sent, by interface."},
+	"scrooge_received_bytes_total":           {"counter", "Bytes of UDP packets received, by interface."},
+	"scrooge_sent_bytes_total":               {"counter", "Bytes of UDP packets sent, by interface."},
+	"scrooge_network_errors_total":           {"counter", "Errors receiving or sending UDP packets, by interface and operation."},
+	"scrooge_wireguard_commands_total":       {"counter", "wg and ip commands run, by command and result."},
+	"scrooge_tunnel_received_bytes_total":    {"counter", "Bytes received on a tunnel, by tunnel interface, as of the last time it was metered."},
+	"scrooge_tunnel_sent_bytes_total":        {"counter", "Bytes sent on a tunnel, by tunnel interface, as of the last time it was metered."},
+	"scrooge_neighbors":                      {"gauge", "Neighbors we know."},
+	"scrooge_neighbors_confirmed":            {"gauge", "Neighbors that have confirmed one of our hellos."},
+	"scrooge_tunnels_up":                     {"gauge", "Tunnels with neighbors that are up."},
+	"scrooge_neighbor_debt":                  {"gauge", "What a neighbor owes us, negative if we owe it, by neighbor."},
+	"scrooge_neighbor_throttle_level":        {"gauge", "How hard a neighbor is throttled, 0 for not at all, 1 for slowed down and 2 for cut off, by neighbor."},
+	"scrooge_payments_sent_total":            {"counter", "Vouchers sent to neighbors."},
+	"scrooge_payments_sent_amount_total":     {"counter", "What we have paid neighbors with vouchers."},
+	"scrooge_payments_received_total":        {"counter", "Vouchers received from neighbors."},
+	"scrooge_payments_received_amount_total": {"counter", "What neighbors have paid us with vouchers."},
+}
+
+// Metrics keeps counters and gauges, and writes them in the Prometheus text
+// format. Each series is a metric name with label pairs, like
+//
+//	Add("scrooge_messages_received_total", 1, "type", "scrooge_hello")
+type Metrics struct {
+	series     map[string]map[string]float64 // By name, then by labels
+	collectors []func(*Metrics)
+	mutex      sync.Mutex
+	scrape     sync.Mutex
+}
+
+func New() *Metrics {
+	return &Metrics{
+		series: map[string]map[string]float64{},
+	}
+}
+
+// Add adds value to a series.
+func (self *Metrics) Add(name string, value float64, labels ...string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.family(name)[formatLabels(labels)] += value
+}
+
+// Set sets a series to value.
+func (self *Metrics) Set(name string, value float64, labels ...string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.family(name)[formatLabels(labels)] = value
+}
+
+// Reset forgets every series of a metric, so that a collector can set the
+// ones that still exist, like those of neighbors we still know.
+func (self *Metrics) Reset(name string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.series[name] = map[string]float64{}
+}
+
+// OnScrape adds a collector, which sets the metrics that are read rather
+// than counted before they are written.
+func (self *Metrics) OnScrape(collector func(*Metrics)) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.collectors = append(self.collectors, collector)
+}
+
+func (self *Metrics) family(name string) map[string]float64 {
+	family := self.series[name]
+	if family == nil {
+		family = map[string]float64{}
+		self.series[name] = family
+	}
+	return family
+}
+
+// Write runs the collectors and writes every metric to w.
+func (self *Metrics) Write(w io.Writer) error {
+	// Collectors reset and set the same series, so two scrapes at once
+	// could see half of what the other collected
+	self.scrape.Lock()
+	defer self.scrape.Unlock()
+
+	self.mutex.Lock()
+	collectors := self.collectors
+	self.mutex.Unlock()
+
+	for _, collector := range collectors {
+		collector(self)
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	names := make([]string, 0, len(self.series))
+	for name := range self.series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := bufio.NewWriter(w)
+	for _, name := range names {
+		family := self.series[name]
+
+		description, ok := descriptions[name]
+		if ok {
+			out.WriteString("# HELP " + name + " " + description.help + "\n")
+			out.WriteString("# TYPE " + name + " " + description.kind + "\n")
+		}
+
+		labels := make([]string, 0, len(family))
+		for l := range family {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+
+		for _, l := range labels {
+			out.WriteString(name + l + " " + strconv.FormatFloat(family[l], 'g', -1, 64) + "\n")
+		}
+	}
+	return out.Flush()
+}
+
+// ServeHTTP answers a scrape.
+func (self *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	self.Write(w)
+}
+
+// formatLabels writes label pairs the way they follow the metric name.
+func formatLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+escaper.Replace(labels[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
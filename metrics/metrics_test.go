@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	metrics := New()
+	metrics.Add("scrooge_messages_received_total", 1, "type", "scrooge_hello")
+	metrics.Add("scrooge_messages_received_total", 2, "type", "scrooge_hello")
+	metrics.Add("scrooge_messages_received_total", 1, "type", "scrooge_voucher")
+	metrics.Set("scrooge_neighbors", 3)
+	metrics.Add("something_else", 1, "quoted", "a \"b\"\n\\c")
+
+	var b bytes.Buffer
+	err := metrics.Write(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP scrooge_messages_received_total Messages received, by type. Sealed messages count once sealed and once for what was inside.
+# TYPE scrooge_messages_received_total counter
+scrooge_messages_received_total{type="scrooge_hello"} 3
+scrooge_messages_received_total{type="scrooge_voucher"} 1
+# HELP scrooge_neighbors Neighbors we know.
+# TYPE scrooge_neighbors gauge
+scrooge_neighbors 3
+something_else{quoted="a \"b\"\n\\c"} 1
+`
+	if b.String() != expected {
+		t.Fatalf("wrong metrics:\n%v", b.String())
+	}
+}
+
+func TestCollectors(t *testing.T) {
+	metrics := New()
+
+	neighbors := []string{"a", "b"}
+	metrics.OnScrape(func(metrics *Metrics) {
+		metrics.Reset("scrooge_neighbor_debt")
+		for _, neighbor := range neighbors {
+			metrics.Set("scrooge_neighbor_debt", -5, "neighbor", neighbor)
+		}
+	})
+
+	var b bytes.Buffer
+	metrics.Write(&b)
+	if !strings.Contains(b.String(), `scrooge_neighbor_debt{neighbor="b"} -5`) {
+		t.Fatalf("collector not run:\n%v", b.String())
+	}
+
+	// Series of neighbors that are gone go with them
+	neighbors = []string{"a"}
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(recorder.Body.String(), `neighbor="b"`) {
+		t.Fatalf("series kept after reset:\n%v", recorder.Body.String())
+	}
+	if !strings.Contains(recorder.Body.String(), `scrooge_neighbor_debt{neighbor="a"} -5`) {
+		t.Fatalf("series missing:\n%v", recorder.Body.String())
+	}
+}
@@ -1,51 +1,414 @@
 package neighborAPI
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
-	"fmt"
-	"log"
+	"math"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/agl/ed25519"
+	"github.com/incentivized-mesh-infrastructure/scrooge/certificate"
+	"github.com/incentivized-mesh-infrastructure/scrooge/events"
+	"github.com/incentivized-mesh-infrastructure/scrooge/ledger"
+	"github.com/incentivized-mesh-infrastructure/scrooge/logging"
+	"github.com/incentivized-mesh-infrastructure/scrooge/ratelimit"
+	"github.com/incentivized-mesh-infrastructure/scrooge/replay"
 	"github.com/incentivized-mesh-infrastructure/scrooge/serialization"
 	"github.com/incentivized-mesh-infrastructure/scrooge/types"
 )
 
+var logger = logging.Logger("neighbor")
+
+// EndpointPolicy is what to do with a tunnel message whose endpoint host is
+// not the address the message came from. Tunnels are always built to the
+// address the message came from, so that nobody can point them at a third
+// party.
+type EndpointPolicy string
+
+const (
+	EndpointWarn   EndpointPolicy = "warn"
+	EndpointReject EndpointPolicy = "reject"
+)
+
+func ParseEndpointPolicy(s string) (EndpointPolicy, error) {
+	switch EndpointPolicy(s) {
+	case EndpointWarn, EndpointReject:
+		return EndpointPolicy(s), nil
+	}
+	return "", errors.New("unknown endpoint policy: " + s)
+}
+
 type NeighborAPI struct {
 	Neighbors map[[ed25519.PublicKeySize]byte]*types.Neighbor
+	Retired   map[[ed25519.PublicKeySize]byte]bool // Keys neighbors rotated away from, never accepted again
 	Account   *types.Account
+	Ledger    *ledger.Ledger
 	Network   interface {
 		SendUDP(*net.UDPAddr, string) error
 		SendMulticastUDP(*net.Interface, string) error
 	}
+	PaymentBackend interface {
+		Settle(*types.VoucherMessage) error
+	}
+	// Store, if set, has to reserve every seqnum before we send it, keep
+	// every key a neighbor rotated away from, and keep what we have paid
+	// each neighbor before the voucher goes out
+	Store interface {
+		ReserveSeqnum(uint64) error
+		RetireKey([ed25519.PublicKeySize]byte) error
+		RecordSent([ed25519.PublicKeySize]byte, uint64) error
+	}
+	// Authority, if set, has to have signed a valid certificate for every
+	// neighbor we build a tunnel with
+	Authority interface {
+		Verify(
+			cert *certificate.Certificate,
+			publicKey [ed25519.PublicKeySize]byte,
+			now time.Time,
+		) error
+	}
+	// Tunnels, if set, sets tunnels up once a neighbor has sent us its end,
+	// and changes their keys while they are up. Every tunnel gets keys of
+	// its own unless the account has a tunnel private key for all of them.
+	Tunnels interface {
+		NewKeys() (publicKey string, privateKey string, err error)
+		CreateTunnel(tunnel *types.Tunnel, privateKey string) error
+		SetPrivateKey(virtualInterface string, privateKey string) error
+		ReplacePeer(tunnel *types.Tunnel, oldPublicKey string) error
+		RemoveTunnel(virtualInterface string) error
+	}
+	// Admission, if set, decides which keys may be neighbors, and pins
+	// confirmed neighbors to where they were confirmed, moving the pin along
+	// when they rotate their key
+	Admission interface {
+		Admit(
+			publicKey [ed25519.PublicKeySize]byte,
+			source *net.UDPAddr,
+			neighbors int,
+			known bool,
+		) error
+		Pin(publicKey [ed25519.PublicKeySize]byte, source *net.UDPAddr) error
+		Move(oldKey [ed25519.PublicKeySize]byte, newKey [ed25519.PublicKeySize]byte) error
+	}
+	AcceptedSeqnumModes []replay.Mode  // Seqnum modes we accept from neighbors, any if empty
+	ClockSkew           time.Duration  // How far a time seqnum may be from our own clock
+	EndpointPolicy      EndpointPolicy // What to do when a tunnel endpoint isn't where the message came from
+	FirstTunnelPort     int            // Tunnels listen on the first free port from here up
+	TunnelKeyLifetime   time.Duration  // How long a tunnel keeps its keys, forever if 0
+	KickedFor           time.Duration  // How long a removed neighbor is refused, DefaultKickedFor if 0
+	MaxPrice            uint64         // Most a neighbor may charge per byte for a tunnel, any price if 0
+	// Seal encrypts every message addressed to one neighbor, so that others
+	// on the link only see who it is from and who it is for
+	Seal bool
+	// Metrics, if set, counts the messages we send, receive and drop, and
+	// the payments in them
+	Metrics interface {
+		Add(name string, value float64, labels ...string)
+	}
+	// Events, if set, is told when neighbors come and go, tunnels come up
+	// and payments are made
+	Events interface {
+		Publish(events.Event)
+	}
+	// Limits on what anyone on the link can make us do. They are checked
+	// before signatures, so flooding us costs nothing more than a map lookup.
+	SourceLimit  *ratelimit.Limiter // Messages per source address
+	KeyLimit     *ratelimit.Limiter // Messages per claimed public key from each source address
+	ConfirmLimit *ratelimit.Limiter // Hello confirms we send to anyone
+	// The nonce of our latest hello on each interface
+	helloNonces map[string][types.NonceSize]byte
+	kicked      map[[ed25519.PublicKeySize]byte]kicked
+	// The anti-replay window of each neighbor for each message stream
+	windows map[[ed25519.PublicKeySize]byte]map[string]*replay.Window
+	mutex   sync.Mutex
+}
+
+// streams are the message streams that have an anti-replay window each.
+var streams = []string{"hello", "tunnel", "voucher", "rotate"}
+
+// MaxUnconfirmed is how many neighbors that haven't confirmed one of our
+// hellos yet are kept. Past it the one we heard from least recently is
+// forgotten, unless we have a payment channel with it.
+const MaxUnconfirmed = 256
+
+// DefaultKickedFor is how long a removed neighbor is refused if KickedFor
+// isn't set.
+const DefaultKickedFor = 10 * time.Minute
+
+// kicked is what we keep of a removed neighbor, so that it can't come
+// straight back, can't replay its old messages when it does, and picks up
+// its payment channel where it left off.
+type kicked struct {
+	until   time.Time
+	seqnum  uint64
+	channel types.PaymentChannel
 }
 
 func (self *NeighborAPI) Handlers(
 	b []byte,
 	iface *net.Interface,
+	source *net.UDPAddr,
 ) error {
 	msg := strings.Split(string(b), " ")
 
-	log.Println("received: " + string(b))
+	now := time.Now()
+	if !self.SourceLimit.Allow(source.IP.String(), now) ||
+		len(msg) > 1 && !self.KeyLimit.Allow(source.IP.String()+" "+msg[1], now) {
+		return nil
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	attrs := msgAttrs(msg, iface)
+	logger.Debug("received", append(attrs, "source", source.String(), "message", string(b))...)
+
+	err := self.handle(msg, iface, source)
+	if errors.Is(err, serialization.ErrSignature) {
+		self.count("scrooge_signature_failures_total", 1)
+	}
+	if err != nil {
+		logger.Info("dropped message", append(attrs, "source", source.String(), "err", err)...)
+	}
+	return err
+}
+
+// msgAttrs are what we log about every message: its type, who it claims
+// to be from and the interface it came in or goes out on.
+func msgAttrs(msg []string, iface *net.Interface) []any {
+	attrs := []any{"type", msg[0]}
+	if len(msg) > 1 {
+		attrs = append(attrs, "neighbor", msg[1])
+	}
+	if iface != nil {
+		attrs = append(attrs, "interface", iface.Name)
+	}
+	return attrs
+}
+
+func (self *NeighborAPI) count(name string, value float64, labels ...string) {
+	if self.Metrics != nil {
+		self.Metrics.Add(name, value, labels...)
+	}
+}
+
+// publish publishes event about the neighbor with publicKey.
+func (self *NeighborAPI) publish(
+	event events.Event,
+	publicKey [ed25519.PublicKeySize]byte,
+) {
+	if self.Events != nil {
+		event.Neighbor = base64.StdEncoding.EncodeToString(publicKey[:])
+		self.Events.Publish(event)
+	}
+}
+
+func (self *NeighborAPI) handle(
+	msg []string,
+	iface *net.Interface,
+	source *net.UDPAddr,
+) error {
+	// Anyone can send us anything, so only types we know get a series
+	msgType := "unknown"
+	switch msg[0] {
+	case "scrooge_hello", "scrooge_hello_confirm", "scrooge_tunnel",
+		"scrooge_tunnel_confirm", "scrooge_voucher", "scrooge_rotate",
+		"scrooge_sealed":
+		msgType = msg[0]
+	}
+	self.count("scrooge_messages_received_total", 1, "type", msgType)
 
 	switch msg[0] {
 	case "scrooge_hello":
-		return self.helloMsgHandler(msg, iface, false)
+		return self.helloMsgHandler(msg, iface, source, false)
 	case "scrooge_hello_confirm":
-		return self.helloMsgHandler(msg, iface, true)
+		return self.helloMsgHandler(msg, iface, source, true)
 	case "scrooge_tunnel":
-		return self.tunnelMsgHandler(msg, iface, false)
+		return self.tunnelMsgHandler(msg, iface, source, false)
 	case "scrooge_tunnel_confirm":
-		return self.tunnelMsgHandler(msg, iface, true)
+		return self.tunnelMsgHandler(msg, iface, source, true)
+	case "scrooge_voucher":
+		return self.voucherMsgHandler(msg, source)
+	case "scrooge_rotate":
+		return self.keyRotationMsgHandler(msg, source)
+	case "scrooge_sealed":
+		return self.sealedMsgHandler(msg, iface, source)
 	}
 
 	return errors.New("unrecognized message type")
 }
 
+// keyRotationMsgHandler moves a neighbor that rotated its key over to the
+// new one, with its tunnel, channel and balance, and retires the old key.
+func (self *NeighborAPI) keyRotationMsgHandler(
+	msg []string,
+	source *net.UDPAddr,
+) error {
+	rotation, err := serialization.ParseKeyRotationMsg(msg)
+	if err != nil {
+		return err
+	}
+
+	if rotation.SourcePublicKey == self.Account.PublicKey ||
+		rotation.DestinationPublicKey != self.Account.PublicKey {
+		return nil
+	}
+
+	neighbor := self.Neighbors[rotation.SourcePublicKey]
+	if neighbor == nil {
+		return errors.New("neighbor not found")
+	}
+
+	// The rotation has to come from where the old key is pinned, since the
+	// new key takes over its pin
+	err = self.admit(
+		rotation.SourcePublicKey,
+		source,
+		self.confirmedNeighbors(),
+		true,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = self.checkSeqnum(
+		neighbor,
+		self.windowsOf(rotation.SourcePublicKey),
+		"rotate",
+		neighborSeqnumMode(neighbor),
+		rotation.Seqnum,
+	)
+	if err != nil {
+		return err
+	}
+
+	if self.Neighbors[rotation.NewPublicKey] != nil {
+		return errors.New("new key is already a neighbor")
+	}
+
+	// The new key has to be let in like any other, but it takes the place
+	// of the old one rather than adding a neighbor
+	err = self.admit(
+		rotation.NewPublicKey,
+		source,
+		self.confirmedNeighbors(),
+		neighbor.Confirmed,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = self.retireKey(rotation.SourcePublicKey)
+	if err != nil {
+		return err
+	}
+
+	// The balance and the pin are moved before the neighbor. Moving them
+	// only fails writing the journal or the pin file, once they have moved
+	// in memory, so the neighbor follows them either way and they are never
+	// split across keys.
+	moveErr := self.Ledger.Move(
+		rotation.SourcePublicKey,
+		rotation.NewPublicKey,
+		time.Now(),
+	)
+	if self.Admission != nil {
+		err = self.Admission.Move(rotation.SourcePublicKey, rotation.NewPublicKey)
+		if err != nil && moveErr == nil {
+			moveErr = err
+		}
+	}
+
+	delete(self.Neighbors, rotation.SourcePublicKey)
+	// The neighbor carries on with the same seqnums under its new key
+	self.windows[rotation.NewPublicKey] = self.windows[rotation.SourcePublicKey]
+	delete(self.windows, rotation.SourcePublicKey)
+	neighbor.PublicKey = rotation.NewPublicKey
+	neighbor.Address = source
+	// Certificates are for one key, so it needs a new one
+	neighbor.Certificate = ""
+	self.Neighbors[rotation.NewPublicKey] = neighbor
+
+	self.publish(events.Event{
+		Type:         events.NeighborRotated,
+		NewPublicKey: base64.StdEncoding.EncodeToString(rotation.NewPublicKey[:]),
+	}, rotation.SourcePublicKey)
+
+	logger.Info(
+		"neighbor rotated its key",
+		"neighbor", base64.StdEncoding.EncodeToString(rotation.SourcePublicKey[:]),
+		"newPublicKey", base64.StdEncoding.EncodeToString(rotation.NewPublicKey[:]),
+	)
+
+	return moveErr
+}
+
+func (self *NeighborAPI) retireKey(publicKey [ed25519.PublicKeySize]byte) error {
+	if self.Store != nil {
+		err := self.Store.RetireKey(publicKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	if self.Retired == nil {
+		self.Retired = map[[ed25519.PublicKeySize]byte]bool{}
+	}
+	self.Retired[publicKey] = true
+	return nil
+}
+
+// sealedMsgHandler opens a message sealed to us and handles what was inside
+// as if it had come in by itself. The inner message is checked like any
+// other, so the outer seqnum doesn't need a window of its own.
+func (self *NeighborAPI) sealedMsgHandler(
+	msg []string,
+	iface *net.Interface,
+	source *net.UDPAddr,
+) error {
+	if len(msg) > 2 &&
+		msg[2] != base64.StdEncoding.EncodeToString(self.Account.PublicKey[:]) {
+		return nil
+	}
+
+	sealedMessage, err := serialization.ParseSealedMsg(
+		msg,
+		self.Account.PrivateKey,
+	)
+	if err != nil {
+		return err
+	}
+
+	inner := strings.Split(sealedMessage.Inner, " ")
+	// Sealed messages are sealed so that nobody else reads them, logs
+	// included
+	logger.Debug("opened", msgAttrs(inner, iface)...)
+
+	if inner[0] == "scrooge_sealed" {
+		return errors.New("sealed message inside sealed message")
+	}
+
+	// Otherwise anyone could reseal a message they overheard from someone
+	// else and pass it off as their own
+	if len(inner) < 2 ||
+		inner[1] != base64.StdEncoding.EncodeToString(
+			sealedMessage.SourcePublicKey[:],
+		) {
+		return errors.New("sealed message source does not match")
+	}
+
+	return self.handle(inner, iface, source)
+}
+
 func (self *NeighborAPI) helloMsgHandler(
 	msg []string,
 	iface *net.Interface,
+	source *net.UDPAddr,
 	confirm bool,
 ) error {
 	helloMessage, err := serialization.ParseHelloMsg(msg, confirm)
@@ -57,37 +420,100 @@ func (self *NeighborAPI) helloMsgHandler(
 		return nil
 	}
 
+	// Confirms are only meant for the node whose hello they answer
 	if helloMessage.DestinationPublicKey != self.Account.PublicKey &&
-		helloMessage.DestinationPublicKey != [ed25519.PublicKeySize]byte{} {
+		(helloMessage.Confirm ||
+			helloMessage.DestinationPublicKey != [ed25519.PublicKeySize]byte{}) {
 		return nil
 	}
 
-	neighbor := self.Neighbors[helloMessage.SourcePublicKey]
-	if neighbor == nil {
-		neighbor = &types.Neighbor{
-			PublicKey: helloMessage.SourcePublicKey,
-		}
-		self.Neighbors[helloMessage.SourcePublicKey] = neighbor
+	mode, err := replay.ParseMode(helloMessage.SeqnumMode)
+	if err != nil {
+		return err
+	}
+
+	if !self.acceptsSeqnumMode(mode) {
+		return errors.New("seqnum mode not accepted: " + string(mode))
 	}
 
-	if neighbor.Seqnum >= helloMessage.Seqnum {
-		return errors.New("sequence number too low")
+	neighbor, err := self.admitNeighbor(
+		helloMessage.SourcePublicKey,
+		source,
+		"hello",
+		mode,
+		helloMessage.Seqnum,
+	)
+	if err != nil {
+		return err
 	}
 
-	neighbor.Seqnum = helloMessage.Seqnum
+	neighbor.SeqnumMode = string(mode)
+	neighbor.Address = source
+	// Sealing nodes leave their certificate out of their hellos and only
+	// send it in confirms, so keep the one we have
+	if helloMessage.Certificate != "" {
+		neighbor.Certificate = helloMessage.Certificate
+	}
 
 	if !helloMessage.Confirm {
-		err = self.SendHelloMsg(iface, true)
+		// Every hello we confirm is a message we send, so a flood of hellos
+		// from many keys would make us flood the link too.
+		if !self.ConfirmLimit.Allow("", time.Now()) {
+			return nil
+		}
+		return self.sendHelloConfirmMsg(
+			iface,
+			helloMessage.SourcePublicKey,
+			helloMessage.Nonce,
+		)
+	}
+
+	// A confirm echoing the nonce of our latest hello on the interface it
+	// came in on proves that the neighbor got it, so the link works both
+	// ways. There is no nonce to echo before our first hello.
+	nonce, ok := self.helloNonces[iface.Name]
+	if !ok || nonce == [types.NonceSize]byte{} || helloMessage.Nonce != nonce {
+		return errors.New("hello confirm nonce does not match")
+	}
+
+	return self.confirmNeighbor(neighbor, source)
+}
+
+// confirmNeighbor marks neighbor as confirmed by a confirm from source, and
+// pins it there. Until now it didn't count against MaxNeighbors, so that is
+// checked again.
+func (self *NeighborAPI) confirmNeighbor(
+	neighbor *types.Neighbor,
+	source *net.UDPAddr,
+) error {
+	if self.Admission != nil {
+		err := self.Admission.Admit(
+			neighbor.PublicKey,
+			source,
+			self.confirmedNeighbors(),
+			neighbor.Confirmed,
+		)
+		if err != nil {
+			return err
+		}
+
+		err = self.Admission.Pin(neighbor.PublicKey, source)
 		if err != nil {
 			return err
 		}
 	}
+
+	if !neighbor.Confirmed {
+		self.publish(events.Event{Type: events.NeighborConfirmed}, neighbor.PublicKey)
+	}
+	neighbor.Confirmed = true
 	return nil
 }
 
 func (self *NeighborAPI) tunnelMsgHandler(
 	msg []string,
 	iface *net.Interface,
+	source *net.UDPAddr,
 	confirm bool,
 ) error {
 	tunnelMessage, err := serialization.ParseTunnelMsg(msg, confirm)
@@ -100,91 +526,1338 @@ func (self *NeighborAPI) tunnelMsgHandler(
 		return nil
 	}
 
-	neighbor := self.Neighbors[tunnelMessage.SourcePublicKey]
-	if neighbor == nil {
-		neighbor = &types.Neighbor{
-			PublicKey: tunnelMessage.SourcePublicKey,
-		}
-		self.Neighbors[tunnelMessage.SourcePublicKey] = neighbor
+	neighbor, err := self.admitNeighbor(
+		tunnelMessage.SourcePublicKey,
+		source,
+		"tunnel",
+		"",
+		tunnelMessage.Seqnum,
+	)
+	if err != nil {
+		return err
+	}
+
+	neighbor.Address = source
+
+	if !neighbor.Confirmed {
+		return errors.New("neighbor not confirmed")
+	}
+
+	if self.MaxPrice != 0 && tunnelMessage.Price > self.MaxPrice {
+		return errors.New("tunnel price above our maximum")
+	}
+
+	err = self.checkCertificate(neighbor)
+	if err != nil {
+		return err
+	}
+
+	endpoint, err := self.tunnelEndpoint(
+		tunnelMessage.TunnelEndpoint,
+		iface,
+		source,
+	)
+	if err != nil {
+		return err
 	}
 
-	if neighbor.Seqnum >= tunnelMessage.Seqnum {
-		return errors.New(fmt.Sprint("sequence number too low"))
+	oldPublicKey := neighbor.Tunnel.PublicKey
+	neighbor.Tunnel.PublicKey = tunnelMessage.TunnelPublicKey
+	neighbor.Tunnel.Endpoint = endpoint
+	neighbor.BillingDetails.Price = tunnelMessage.Price
+
+	err = self.replacePeer(neighbor, oldPublicKey)
+	if err != nil {
+		return err
 	}
 
-	neighbor.Seqnum = tunnelMessage.Seqnum
+	if oldPublicKey != "" && oldPublicKey != neighbor.Tunnel.PublicKey {
+		self.publish(events.Event{Type: events.TunnelRekeyed}, neighbor.PublicKey)
+	}
 
 	if !tunnelMessage.Confirm {
-		err = self.SendHelloMsg(iface, true)
+		err = self.setUpTunnel(neighbor)
+		if err != nil {
+			return err
+		}
+		err = self.sendTunnelMsg(tunnelMessage.SourcePublicKey, iface, true)
 		if err != nil {
 			return err
 		}
+
+		// The confirm gave the neighbor the keys we are rotating to, if we
+		// are, and it uses them as soon as it gets it, so we do too
+		return self.switchTunnelKeys(neighbor)
 	}
-	return nil
-}
 
-func (self *NeighborAPI) SendHelloMsg(
-	iface *net.Interface,
-	confirm bool,
-) error {
-	self.Account.Seqnum = self.Account.Seqnum + 1
+	// The neighbor has the keys we are rotating to, so start using them.
+	// A confirm for a message with our old keys doesn't mean it does.
+	if tunnelMessage.ConfirmedPublicKey == neighbor.Tunnel.NextPublicKey {
+		err = self.switchTunnelKeys(neighbor)
+		if err != nil {
+			return err
+		}
+	}
+	return self.setUpTunnel(neighbor)
+}
 
-	msg := types.HelloMessage{
-		MessageMetadata: types.MessageMetadata{
-			Seqnum:          self.Account.Seqnum,
-			SourcePublicKey: self.Account.PublicKey,
-		},
-		Confirm: confirm,
+// setUpTunnel creates the tunnel interface for neighbor, with our private
+// key for it, unless it is up already. If it fails the tunnel stays down,
+// and the next tunnel message tries again.
+func (self *NeighborAPI) setUpTunnel(neighbor *types.Neighbor) error {
+	tunnel := &neighbor.Tunnel
+	if self.Tunnels == nil || tunnel.VirtualInterface.Name != "" {
+		return nil
 	}
 
-	s, err := serialization.FmtHelloMsg(msg, self.Account.PrivateKey)
+	_, err := self.tunnelPublicKey(neighbor)
 	if err != nil {
 		return err
 	}
 
-	err = self.Network.SendMulticastUDP(iface, s)
+	privateKey := tunnel.LocalPrivateKey
+	if self.Account.TunnelPrivateKey != "" {
+		privateKey = self.Account.TunnelPrivateKey
+	}
+
+	// Every tunnel listens on a port of its own, so the port names it
+	tunnel.VirtualInterface.Name = "scrooge" + strconv.Itoa(self.tunnelListenPort(neighbor))
+	err = self.Tunnels.CreateTunnel(tunnel, privateKey)
 	if err != nil {
+		tunnel.VirtualInterface.Name = ""
 		return err
 	}
 
-	log.Println("sent: " + s)
-
+	self.publish(events.Event{
+		Type:     events.TunnelUp,
+		Endpoint: tunnel.Endpoint,
+	}, neighbor.PublicKey)
 	return nil
 }
 
-func (self *NeighborAPI) SendTunnelMsg(
-	neighborPublicKey [ed25519.PublicKeySize]byte,
-	iface *net.Interface,
-	confirm bool,
+// replacePeer updates the tunnel with neighbor if it is up and the neighbor
+// has rotated its tunnel key.
+func (self *NeighborAPI) replacePeer(
+	neighbor *types.Neighbor,
+	oldPublicKey string,
 ) error {
-	self.Account.Seqnum = self.Account.Seqnum + 1
-	neighbor := self.Neighbors[neighborPublicKey]
+	tunnel := &neighbor.Tunnel
+	if self.Tunnels == nil ||
+		oldPublicKey == "" ||
+		oldPublicKey == tunnel.PublicKey ||
+		tunnel.VirtualInterface.Name == "" {
+		return nil
+	}
 
-	msg := types.TunnelMessage{
-		MessageMetadata: types.MessageMetadata{
-			SourcePublicKey:      self.Account.PublicKey,
-			DestinationPublicKey: neighborPublicKey,
-			Seqnum:               self.Account.Seqnum,
-		},
-		TunnelEndpoint:  neighbor.Tunnel.Endpoint,
-		TunnelPublicKey: neighbor.Tunnel.PublicKey,
-		Confirm:         confirm,
+	return self.Tunnels.ReplacePeer(tunnel, oldPublicKey)
+}
+
+// switchTunnelKeys moves the tunnel with neighbor to the keys we are
+// rotating to, if there are any. If the tunnel is up and the new private key
+// can't be set on it, we stay on the old keys, and RotateTunnelKeys sends
+// the new ones again.
+func (self *NeighborAPI) switchTunnelKeys(neighbor *types.Neighbor) error {
+	tunnel := &neighbor.Tunnel
+	if tunnel.NextPublicKey == "" {
+		return nil
 	}
 
-	s, err := serialization.FmtTunnelMsg(
-		msg,
-		self.Account.PrivateKey,
-	)
+	if tunnel.VirtualInterface.Name != "" {
+		err := self.Tunnels.SetPrivateKey(
+			tunnel.VirtualInterface.Name,
+			tunnel.NextPrivateKey,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	tunnel.LocalPublicKey = tunnel.NextPublicKey
+	tunnel.LocalPrivateKey = tunnel.NextPrivateKey
+	tunnel.LocalKeyCreated = time.Now()
+	tunnel.NextPublicKey = ""
+	tunnel.NextPrivateKey = ""
+	return nil
+}
+
+// tunnelPublicKey returns the key we advertise for our end of the tunnel
+// with neighbor, making the tunnel its own keys if it doesn't have any, or
+// lost its private key in a restart. While rotating it is the key we are
+// rotating to.
+func (self *NeighborAPI) tunnelPublicKey(
+	neighbor *types.Neighbor,
+) (string, error) {
+	if self.Tunnels == nil || self.Account.TunnelPrivateKey != "" {
+		return self.Account.TunnelPublicKey, nil
+	}
+
+	// Private keys don't survive a restart, and their public keys are no
+	// use without them
+	tunnel := &neighbor.Tunnel
+	if tunnel.NextPrivateKey == "" {
+		tunnel.NextPublicKey = ""
+	}
+	if tunnel.NextPublicKey != "" {
+		return tunnel.NextPublicKey, nil
+	}
+
+	if tunnel.LocalPrivateKey == "" {
+		publicKey, privateKey, err := self.Tunnels.NewKeys()
+		if err != nil {
+			return "", err
+		}
+		tunnel.LocalPublicKey = publicKey
+		tunnel.LocalPrivateKey = privateKey
+		tunnel.LocalKeyCreated = time.Now()
+	}
+
+	return tunnel.LocalPublicKey, nil
+}
+
+func (self *NeighborAPI) voucherMsgHandler(
+	msg []string,
+	source *net.UDPAddr,
+) error {
+	voucherMessage, err := serialization.ParseVoucherMsg(msg)
 	if err != nil {
 		return err
 	}
 
-	err = self.Network.SendMulticastUDP(iface, s)
+	if voucherMessage.SourcePublicKey == self.Account.PublicKey ||
+		voucherMessage.DestinationPublicKey != self.Account.PublicKey {
+		return nil
+	}
+
+	neighbor, err := self.admitNeighbor(
+		voucherMessage.SourcePublicKey,
+		source,
+		"voucher",
+		"",
+		voucherMessage.Seqnum,
+	)
 	if err != nil {
 		return err
 	}
 
-	log.Println("sent: " + s)
+	neighbor.Address = source
 
-	return nil
+	// A channel is kept even for a neighbor that never confirms, so only
+	// confirmed neighbors get one
+	if !neighbor.Confirmed {
+		return errors.New("neighbor not confirmed")
+	}
+
+	if neighbor.Channel.Closed {
+		return errors.New("payment channel closed")
+	}
+
+	// The replay window lets vouchers arrive out of order, and one signed
+	// before the voucher we hold is simply out of date
+	held := neighbor.Channel.Voucher
+	if held != nil && voucherMessage.Seqnum < held.Seqnum {
+		return nil
+	}
+
+	// Vouchers are cumulative, so a neighbor signing a newer one for less
+	// than it already has is trying to take money back. Redeem the best
+	// voucher we hold and refuse to accept any more.
+	if voucherMessage.Amount < neighbor.Channel.Received {
+		err = self.closeChannel(neighbor)
+		if err != nil {
+			return err
+		}
+		return errors.New("voucher amount decreased")
+	}
+
+	paid := voucherMessage.Amount - neighbor.Channel.Received
+	neighbor.Channel.Received = voucherMessage.Amount
+	neighbor.Channel.Voucher = voucherMessage
+
+	self.count("scrooge_payments_received_total", 1)
+	self.count("scrooge_payments_received_amount_total", float64(paid))
+	self.publish(events.Event{
+		Type:   events.PaymentReceived,
+		Amount: paid,
+	}, neighbor.PublicKey)
+
+	return self.Ledger.Record(
+		neighbor.PublicKey,
+		ledger.PaymentReceived,
+		paid,
+		time.Now(),
+	)
+}
+
+// ListNeighbors returns a copy of every neighbor record, safe to read while
+// messages keep coming in.
+func (self *NeighborAPI) ListNeighbors() []types.Neighbor {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	neighbors := make([]types.Neighbor, 0, len(self.Neighbors))
+	for _, neighbor := range self.Neighbors {
+		neighbors = append(neighbors, *neighbor)
+	}
+	return neighbors
+}
+
+// ListWindows returns a copy of the anti-replay windows of every neighbor,
+// by public key and then by message stream.
+func (self *NeighborAPI) ListWindows() map[[ed25519.PublicKeySize]byte]map[string]*replay.Window {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	listed := make(map[[ed25519.PublicKeySize]byte]map[string]*replay.Window, len(self.windows))
+	for publicKey, windows := range self.windows {
+		copied := make(map[string]*replay.Window, len(windows))
+		for stream, window := range windows {
+			copiedWindow := *window
+			copiedWindow.Recent = append([]uint64(nil), window.Recent...)
+			copied[stream] = &copiedWindow
+		}
+		listed[publicKey] = copied
+	}
+	return listed
+}
+
+// RestoreWindows takes back the anti-replay windows of a neighbor returned
+// by ListWindows before a restart.
+func (self *NeighborAPI) RestoreWindows(
+	publicKey [ed25519.PublicKeySize]byte,
+	windows map[string]*replay.Window,
+) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.windows == nil {
+		self.windows = map[[ed25519.PublicKeySize]byte]map[string]*replay.Window{}
+	}
+	self.windows[publicKey] = windows
+}
+
+// AccountInfo returns a copy of the account, with the private keys left
+// out.
+func (self *NeighborAPI) AccountInfo() types.Account {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	account := *self.Account
+	account.PrivateKey = [ed25519.PrivateKeySize]byte{}
+	account.TunnelPrivateKey = ""
+	return account
+}
+
+// RemoveNeighbor settles the payment channel with a neighbor, takes the
+// tunnel with it down and forgets the neighbor. Its balance and channel are
+// kept. It is refused for KickedFor, and after that comes back as a new
+// neighbor with its next hello unless admission keeps it out.
+func (self *NeighborAPI) RemoveNeighbor(
+	neighborPublicKey [ed25519.PublicKeySize]byte,
+) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	neighbor := self.Neighbors[neighborPublicKey]
+	if neighbor == nil {
+		return errors.New("neighbor not found")
+	}
+
+	err := self.settleChannel(neighbor)
+	if err != nil {
+		return err
+	}
+
+	err = self.takeTunnelDown(neighbor)
+	if err != nil {
+		return err
+	}
+
+	kickedFor := self.KickedFor
+	if kickedFor == 0 {
+		kickedFor = DefaultKickedFor
+	}
+	if self.kicked == nil {
+		self.kicked = map[[ed25519.PublicKeySize]byte]kicked{}
+	}
+	self.kicked[neighborPublicKey] = kicked{
+		until:   time.Now().Add(kickedFor),
+		seqnum:  neighbor.Seqnum,
+		channel: neighbor.Channel,
+	}
+
+	delete(self.Neighbors, neighborPublicKey)
+	delete(self.windows, neighborPublicKey)
+	self.publish(events.Event{Type: events.NeighborRemoved}, neighborPublicKey)
+	return nil
+}
+
+// RemovedNeighbors returns what is kept of every removed neighbor: its
+// public key, last seqnum and payment channel.
+func (self *NeighborAPI) RemovedNeighbors() []types.Neighbor {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	neighbors := make([]types.Neighbor, 0, len(self.kicked))
+	for publicKey, kicked := range self.kicked {
+		neighbors = append(neighbors, types.Neighbor{
+			PublicKey: publicKey,
+			Seqnum:    kicked.seqnum,
+			Channel:   kicked.channel,
+		})
+	}
+	return neighbors
+}
+
+// RestoreRemoved takes back a neighbor returned by RemovedNeighbors before
+// a restart. It isn't refused anymore, but its seqnum and payment channel
+// are picked up again if it comes back.
+func (self *NeighborAPI) RestoreRemoved(neighbor types.Neighbor) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.kicked == nil {
+		self.kicked = map[[ed25519.PublicKeySize]byte]kicked{}
+	}
+	self.kicked[neighbor.PublicKey] = kicked{
+		seqnum:  neighbor.Seqnum,
+		channel: neighbor.Channel,
+	}
+}
+
+// Update runs update while no message is being handled, so that it can
+// change settings like the price or the accepted seqnum modes of a running
+// NeighborAPI.
+func (self *NeighborAPI) Update(update func()) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	update()
+}
+
+// SettleChannels redeems the latest voucher on every channel with unsettled
+// funds through the payment backend. The channels stay open.
+func (self *NeighborAPI) SettleChannels() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	var firstErr error
+	for _, neighbor := range self.Neighbors {
+		err := self.settleChannel(neighbor)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// CloseChannel settles the channel with a neighbor and stops accepting
+// vouchers on it.
+func (self *NeighborAPI) CloseChannel(
+	neighborPublicKey [ed25519.PublicKeySize]byte,
+) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	neighbor := self.Neighbors[neighborPublicKey]
+	if neighbor == nil {
+		return errors.New("neighbor not found")
+	}
+
+	return self.closeChannel(neighbor)
+}
+
+func (self *NeighborAPI) closeChannel(neighbor *types.Neighbor) error {
+	err := self.settleChannel(neighbor)
+	if err != nil {
+		return err
+	}
+
+	if !neighbor.Channel.Closed {
+		self.publish(events.Event{Type: events.ChannelClosed}, neighbor.PublicKey)
+	}
+	neighbor.Channel.Closed = true
+	return nil
+}
+
+func (self *NeighborAPI) settleChannel(neighbor *types.Neighbor) error {
+	channel := &neighbor.Channel
+	if channel.Voucher == nil || channel.Settled >= channel.Received {
+		return nil
+	}
+
+	err := self.PaymentBackend.Settle(channel.Voucher)
+	if err != nil {
+		return err
+	}
+
+	channel.Settled = channel.Received
+	channel.LastSettled = time.Now()
+	return nil
+}
+
+// CheckCertificates takes the tunnels down with neighbors whose certificate
+// doesn't verify anymore, because it expired or was revoked. They have to
+// send a new tunnel message, with a valid certificate, to get them back.
+func (self *NeighborAPI) CheckCertificates() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	var firstErr error
+	for publicKey, neighbor := range self.Neighbors {
+		if neighbor.Tunnel.PublicKey == "" {
+			continue
+		}
+
+		err := self.checkCertificate(neighbor)
+		if err == nil {
+			continue
+		}
+		logger.Warn(
+			"certificate no longer valid, taking tunnel down",
+			"neighbor", base64.StdEncoding.EncodeToString(publicKey[:]),
+			"err", err,
+		)
+
+		err = self.takeTunnelDown(neighbor)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// CheckAdmission takes the tunnels down with neighbors that admission no
+// longer lets in, after it has been reloaded with a new policy. Their
+// messages are refused from then on, so the tunnels stay down.
+func (self *NeighborAPI) CheckAdmission() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.Admission == nil {
+		return nil
+	}
+
+	neighbors := self.confirmedNeighbors()
+
+	var firstErr error
+	for publicKey, neighbor := range self.Neighbors {
+		if neighbor.Tunnel.PublicKey == "" || neighbor.Address == nil {
+			continue
+		}
+
+		err := self.Admission.Admit(publicKey, neighbor.Address, neighbors, true)
+		if err == nil {
+			continue
+		}
+		logger.Warn(
+			"neighbor no longer admitted, taking tunnel down",
+			"neighbor", base64.StdEncoding.EncodeToString(publicKey[:]),
+			"err", err,
+		)
+
+		err = self.takeTunnelDown(neighbor)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// takeTunnelDown removes the tunnel interface with neighbor, if there is
+// one, and forgets the neighbor's end of the tunnel. Our keys and port for
+// it are kept for when it comes back.
+func (self *NeighborAPI) takeTunnelDown(neighbor *types.Neighbor) error {
+	tunnel := &neighbor.Tunnel
+	if self.Tunnels != nil && tunnel.VirtualInterface.Name != "" {
+		err := self.Tunnels.RemoveTunnel(tunnel.VirtualInterface.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	tunnel.VirtualInterface.Name = ""
+	tunnel.PublicKey = ""
+	tunnel.Endpoint = ""
+	return nil
+}
+
+// checkCertificate returns an error if we need a certificate from neighbor
+// and the one from its hellos isn't valid.
+func (self *NeighborAPI) checkCertificate(neighbor *types.Neighbor) error {
+	if self.Authority == nil {
+		return nil
+	}
+
+	var cert *certificate.Certificate
+	if neighbor.Certificate != "" {
+		var err error
+		cert, err = certificate.Parse(neighbor.Certificate)
+		if err != nil {
+			return err
+		}
+	}
+
+	return self.Authority.Verify(cert, neighbor.PublicKey, time.Now())
+}
+
+// admitNeighbor returns the neighbor with publicKey, as long as the
+// admission policy lets it in and seqnum isn't a replay on stream. mode is
+// the seqnum mode to check it in, the one from the neighbor's last hello if
+// it is empty. A new neighbor is only added once its first message has
+// passed both, so rejected messages don't take up room.
+func (self *NeighborAPI) admitNeighbor(
+	publicKey [ed25519.PublicKeySize]byte,
+	source *net.UDPAddr,
+	stream string,
+	mode replay.Mode,
+	seqnum uint64,
+) (*types.Neighbor, error) {
+	neighbor := self.Neighbors[publicKey]
+	known := neighbor != nil && neighbor.Confirmed
+
+	isNew := neighbor == nil
+	var windows map[string]*replay.Window
+	if isNew {
+		windows = map[string]*replay.Window{}
+		neighbor = &types.Neighbor{
+			PublicKey: publicKey,
+		}
+		// Messages from before it was removed are still replays, and its
+		// vouchers are still cumulative over the old channel
+		neighbor.Seqnum = self.kicked[publicKey].seqnum
+		neighbor.Channel = self.kicked[publicKey].channel
+	} else {
+		windows = self.windowsOf(publicKey)
+	}
+
+	if mode == "" {
+		mode = neighborSeqnumMode(neighbor)
+	}
+	// Replays are turned away before admission, which may have to look
+	// up the MAC behind source
+	err := self.checkSeqnum(neighbor, windows, stream, mode, seqnum)
+	if err != nil {
+		return nil, err
+	}
+
+	err = self.admit(publicKey, source, self.confirmedNeighbors(), known)
+	if err != nil {
+		return nil, err
+	}
+
+	if isNew {
+		delete(self.kicked, publicKey)
+		self.evictUnconfirmed()
+		self.Neighbors[publicKey] = neighbor
+		if self.windows == nil {
+			self.windows = map[[ed25519.PublicKeySize]byte]map[string]*replay.Window{}
+		}
+		self.windows[publicKey] = windows
+		self.publish(events.Event{Type: events.NeighborAdded}, publicKey)
+	}
+
+	return neighbor, nil
+}
+
+// confirmedNeighbors counts the neighbors that have confirmed one of our
+// hellos, which are the ones MaxNeighbors applies to.
+func (self *NeighborAPI) confirmedNeighbors() int {
+	confirmed := 0
+	for _, neighbor := range self.Neighbors {
+		if neighbor.Confirmed {
+			confirmed++
+		}
+	}
+	return confirmed
+}
+
+// evictUnconfirmed makes room for a new neighbor by forgetting the
+// unconfirmed neighbor we heard from least recently, once there are
+// MaxUnconfirmed of them. Neighbors with a payment channel are kept, so
+// their vouchers can still be redeemed.
+func (self *NeighborAPI) evictUnconfirmed() {
+	unconfirmed := 0
+	var oldest *types.Neighbor
+	for _, neighbor := range self.Neighbors {
+		if neighbor.Confirmed ||
+			neighbor.Channel.Received != 0 ||
+			neighbor.Channel.Sent != 0 {
+			continue
+		}
+		unconfirmed++
+		if oldest == nil || neighbor.LastSeen.Before(oldest.LastSeen) {
+			oldest = neighbor
+		}
+	}
+
+	if unconfirmed < MaxUnconfirmed {
+		return
+	}
+	delete(self.Neighbors, oldest.PublicKey)
+	delete(self.windows, oldest.PublicKey)
+	self.publish(events.Event{Type: events.NeighborRemoved}, oldest.PublicKey)
+}
+
+func (self *NeighborAPI) admit(
+	publicKey [ed25519.PublicKeySize]byte,
+	source *net.UDPAddr,
+	neighbors int,
+	known bool,
+) error {
+	if self.Retired[publicKey] {
+		return errors.New("neighbor key retired")
+	}
+	if time.Now().Before(self.kicked[publicKey].until) {
+		return errors.New("neighbor kicked")
+	}
+
+	if self.Admission == nil {
+		return nil
+	}
+	return self.Admission.Admit(publicKey, source, neighbors, known)
+}
+
+// tunnelEndpoint returns the WireGuard endpoint of a neighbor that sent a
+// tunnel message with the advertised endpoint from source. Only the port is
+// taken from the message. The host may be left out, otherwise it has to be
+// the source address.
+func (self *NeighborAPI) tunnelEndpoint(
+	advertised string,
+	iface *net.Interface,
+	source *net.UDPAddr,
+) (string, error) {
+	if source == nil {
+		return "", errors.New("tunnel message source unknown")
+	}
+
+	host, portString, err := net.SplitHostPort(advertised)
+	if err != nil {
+		return "", err
+	}
+
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil || port == 0 {
+		return "", errors.New("bad tunnel endpoint port: " + advertised)
+	}
+
+	if host != "" {
+		ip := net.ParseIP(strings.Split(host, "%")[0])
+		if ip == nil || (!ip.IsUnspecified() && !ip.Equal(source.IP)) {
+			if self.EndpointPolicy == EndpointReject {
+				return "", errors.New(
+					"tunnel endpoint " + advertised +
+						" does not match source " + source.IP.String())
+			}
+			logger.Warn(
+				"tunnel endpoint does not match source, using the source",
+				"endpoint", advertised,
+				"source", source.IP.String(),
+				"interface", iface.Name,
+			)
+		}
+	}
+
+	endpoint := net.UDPAddr{
+		IP:   source.IP,
+		Port: int(port),
+	}
+
+	// Link-local addresses mean nothing without the interface
+	if source.IP.To4() == nil && source.IP.IsLinkLocalUnicast() {
+		endpoint.Zone = source.Zone
+		if endpoint.Zone == "" {
+			endpoint.Zone = iface.Name
+		}
+	}
+
+	return endpoint.String(), nil
+}
+
+// tunnelListenPort returns the port our tunnel with neighbor listens on,
+// picking the first one no other tunnel uses if it doesn't have one yet.
+func (self *NeighborAPI) tunnelListenPort(neighbor *types.Neighbor) int {
+	if neighbor.Tunnel.ListenPort != 0 {
+		return neighbor.Tunnel.ListenPort
+	}
+
+	used := map[int]bool{}
+	for _, other := range self.Neighbors {
+		used[other.Tunnel.ListenPort] = true
+	}
+
+	port := self.FirstTunnelPort
+	for used[port] {
+		port++
+	}
+
+	neighbor.Tunnel.ListenPort = port
+	return port
+}
+
+func (self *NeighborAPI) acceptsSeqnumMode(mode replay.Mode) bool {
+	if len(self.AcceptedSeqnumModes) == 0 {
+		return true
+	}
+
+	for _, accepted := range self.AcceptedSeqnumModes {
+		if accepted == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// windowsOf returns the anti-replay windows of the neighbor with publicKey.
+func (self *NeighborAPI) windowsOf(
+	publicKey [ed25519.PublicKeySize]byte,
+) map[string]*replay.Window {
+	if self.windows == nil {
+		self.windows = map[[ed25519.PublicKeySize]byte]map[string]*replay.Window{}
+	}
+
+	windows := self.windows[publicKey]
+	if windows == nil {
+		windows = map[string]*replay.Window{}
+		self.windows[publicKey] = windows
+	}
+	return windows
+}
+
+// checkSeqnum checks a seqnum from a neighbor against windows, the
+// neighbor's anti-replay windows, on the stream it came in on. Each stream
+// has its own window, so a hello and a tunnel message that arrive out of
+// order are both accepted.
+func (self *NeighborAPI) checkSeqnum(
+	neighbor *types.Neighbor,
+	windows map[string]*replay.Window,
+	stream string,
+	mode replay.Mode,
+	seqnum uint64,
+) error {
+	// A neighbor with a seqnum but no windows, from a state file without
+	// them or because it was kicked, could be replayed anything up to that
+	// seqnum, so every stream starts above it
+	if len(windows) == 0 && neighbor.Seqnum != 0 {
+		for _, name := range streams {
+			windows[name] = &replay.Window{Floor: neighbor.Seqnum}
+		}
+	}
+
+	window := windows[stream]
+	if window == nil {
+		window = &replay.Window{}
+		windows[stream] = window
+	}
+
+	now := time.Now()
+	err := window.Update(mode, seqnum, now, self.ClockSkew)
+	if err != nil {
+		self.count("scrooge_replay_rejections_total", 1, "stream", stream)
+		return err
+	}
+
+	if seqnum > neighbor.Seqnum {
+		neighbor.Seqnum = seqnum
+	}
+	neighbor.LastSeen = now
+	return nil
+}
+
+// neighborSeqnumMode is the seqnum mode from the neighbor's last hello.
+// Neighbors we haven't had a hello from yet are assumed to use counters.
+func neighborSeqnumMode(neighbor *types.Neighbor) replay.Mode {
+	if neighbor.SeqnumMode == "" {
+		return replay.Counter
+	}
+	return replay.Mode(neighbor.SeqnumMode)
+}
+
+func (self *NeighborAPI) seqnumMode() replay.Mode {
+	if self.Account.SeqnumMode == "" {
+		return replay.Counter
+	}
+	return replay.Mode(self.Account.SeqnumMode)
+}
+
+// nextSeqnum returns the seqnum for the next message we send. Seqnums are
+// only used up once the store has reserved them, in every mode, so that
+// whatever mode we restart in carries on above them.
+func (self *NeighborAPI) nextSeqnum() (uint64, error) {
+	mode := self.seqnumMode()
+	seqnum := replay.Next(mode, self.Account.Seqnum, time.Now())
+
+	if self.Store != nil {
+		err := self.Store.ReserveSeqnum(seqnum)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	self.Account.Seqnum = seqnum
+	return seqnum, nil
+}
+
+// send delivers a message straight to the neighbor it is addressed to. It
+// goes to everyone on the link if it is addressed to everyone, or if we
+// don't know where the neighbor is yet. If we seal messages, anything
+// addressed to one neighbor is sealed to it first.
+func (self *NeighborAPI) send(
+	iface *net.Interface,
+	metadata types.MessageMetadata,
+	s string,
+) error {
+	var err error
+
+	msgTypes := []string{strings.SplitN(s, " ", 2)[0]}
+	attrs := []any{"type", msgTypes[0]}
+	if iface != nil {
+		attrs = append(attrs, "interface", iface.Name)
+	}
+
+	destination := metadata.DestinationPublicKey
+	if destination != [ed25519.PublicKeySize]byte{} {
+		attrs = append(attrs, "neighbor", base64.StdEncoding.EncodeToString(destination[:]))
+	}
+
+	if self.Seal && destination != [ed25519.PublicKeySize]byte{} {
+		logger.Debug("sealing", attrs...)
+		msgTypes = append(msgTypes, "scrooge_sealed")
+
+		s, err = serialization.FmtSealedMsg(
+			types.SealedMessage{
+				MessageMetadata: metadata,
+				Inner:           s,
+			},
+			self.Account.PrivateKey,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	neighbor := self.Neighbors[destination]
+	if neighbor != nil && neighbor.Address != nil {
+		err = self.Network.SendUDP(neighbor.Address, s)
+	} else {
+		err = self.Network.SendMulticastUDP(iface, s)
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.Debug("sent", append(attrs, "message", s)...)
+
+	for _, msgType := range msgTypes {
+		self.count("scrooge_messages_sent_total", 1, "type", msgType)
+	}
+	return nil
+}
+
+// SendHelloMsg multicasts a hello on iface with a new nonce for neighbors on
+// it to echo. Each interface has a nonce of its own, so hellos on one don't
+// invalidate confirms of hellos on another.
+func (self *NeighborAPI) SendHelloMsg(iface *net.Interface) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	var nonce [types.NonceSize]byte
+	_, err := rand.Read(nonce[:])
+	if err != nil {
+		return err
+	}
+
+	if self.helloNonces == nil {
+		self.helloNonces = map[string][types.NonceSize]byte{}
+	}
+	self.helloNonces[iface.Name] = nonce
+
+	return self.sendHelloMsg(
+		iface,
+		types.HelloMessage{
+			Nonce:   nonce,
+			Confirm: false,
+		},
+	)
+}
+
+// sendHelloConfirmMsg answers the hello of a neighbor, echoing its nonce.
+func (self *NeighborAPI) sendHelloConfirmMsg(
+	iface *net.Interface,
+	neighborPublicKey [ed25519.PublicKeySize]byte,
+	nonce [types.NonceSize]byte,
+) error {
+	return self.sendHelloMsg(
+		iface,
+		types.HelloMessage{
+			MessageMetadata: types.MessageMetadata{
+				DestinationPublicKey: neighborPublicKey,
+			},
+			Nonce:   nonce,
+			Confirm: true,
+		},
+	)
+}
+
+func (self *NeighborAPI) sendHelloMsg(
+	iface *net.Interface,
+	msg types.HelloMessage,
+) error {
+	seqnum, err := self.nextSeqnum()
+	if err != nil {
+		return err
+	}
+
+	msg.SourcePublicKey = self.Account.PublicKey
+	msg.Seqnum = seqnum
+	msg.SeqnumMode = string(self.seqnumMode())
+	// Hellos go to everyone, so when sealing they only say who we are
+	if !self.Seal || msg.Confirm {
+		msg.Certificate = self.Account.Certificate
+	}
+
+	s, err := serialization.FmtHelloMsg(msg, self.Account.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	return self.send(iface, msg.MessageMetadata, s)
+}
+
+func (self *NeighborAPI) SendTunnelMsg(
+	neighborPublicKey [ed25519.PublicKeySize]byte,
+	iface *net.Interface,
+	confirm bool,
+) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.sendTunnelMsg(neighborPublicKey, iface, confirm)
+}
+
+func (self *NeighborAPI) sendTunnelMsg(
+	neighborPublicKey [ed25519.PublicKeySize]byte,
+	iface *net.Interface,
+	confirm bool,
+) error {
+	neighbor := self.Neighbors[neighborPublicKey]
+	if neighbor == nil {
+		return errors.New("neighbor not found")
+	}
+
+	// Don't spend anything on a tunnel until we know the link works both ways
+	if !neighbor.Confirmed {
+		return errors.New("neighbor not confirmed")
+	}
+
+	err := self.checkCertificate(neighbor)
+	if err != nil {
+		return err
+	}
+
+	tunnelPublicKey, err := self.tunnelPublicKey(neighbor)
+	if err != nil {
+		return err
+	}
+
+	seqnum, err := self.nextSeqnum()
+	if err != nil {
+		return err
+	}
+
+	msg := types.TunnelMessage{
+		MessageMetadata: types.MessageMetadata{
+			SourcePublicKey:      self.Account.PublicKey,
+			DestinationPublicKey: neighborPublicKey,
+			Seqnum:               seqnum,
+		},
+		TunnelEndpoint:  ":" + strconv.Itoa(self.tunnelListenPort(neighbor)),
+		TunnelPublicKey: tunnelPublicKey,
+		Price:           self.Account.Price,
+		Confirm:         confirm,
+	}
+	if confirm {
+		msg.ConfirmedPublicKey = neighbor.Tunnel.PublicKey
+	}
+
+	s, err := serialization.FmtTunnelMsg(
+		msg,
+		self.Account.PrivateKey,
+	)
+	if err != nil {
+		return err
+	}
+
+	return self.send(iface, msg.MessageMetadata, s)
+}
+
+// RebuildTunnel takes our end of the tunnel with a neighbor down and sends
+// it a tunnel message. The neighbor confirms with its end, and the confirm
+// sets ours up again.
+func (self *NeighborAPI) RebuildTunnel(
+	neighborPublicKey [ed25519.PublicKeySize]byte,
+	iface *net.Interface,
+) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	neighbor := self.Neighbors[neighborPublicKey]
+	if neighbor == nil {
+		return errors.New("neighbor not found")
+	}
+
+	if !neighbor.Confirmed {
+		return errors.New("neighbor not confirmed")
+	}
+
+	err := self.takeTunnelDown(neighbor)
+	if err != nil {
+		return err
+	}
+	return self.sendTunnelMsg(neighborPublicKey, iface, false)
+}
+
+// RestoreTunnels sets the tunnels with neighbors restored from the state
+// file up again, since their interfaces may be gone, and sends each of them
+// a tunnel message so that their ends come back too. The state file has no
+// private keys, so the tunnels get new keys, which the message tells
+// neighbors about. Each message goes out on the interface the neighbor was
+// last seen on, or on every one of ifaces if we don't know where it is.
+func (self *NeighborAPI) RestoreTunnels(ifaces []*net.Interface) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	var firstErr error
+	for neighborPublicKey, neighbor := range self.Neighbors {
+		if !neighbor.Confirmed || neighbor.Tunnel.PublicKey == "" {
+			continue
+		}
+
+		err := self.setUpTunnel(neighbor)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		for _, iface := range interfacesOf(neighbor, ifaces) {
+			err = self.sendTunnelMsg(neighborPublicKey, iface, false)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// RotateTunnelKeys starts moving every tunnel whose keys are older than
+// TunnelKeyLifetime to new ones. The neighbor is sent the new public key in
+// a tunnel message and replaces its peer in place. We switch to the new
+// private key once it confirms that message, or once we have confirmed a
+// tunnel message of its own with the new key, so the tunnel only stops for
+// a round trip. Until then the message is sent again on every call, on the
+// interface the neighbor was last seen on, or on every one of ifaces if we
+// don't know where it is.
+func (self *NeighborAPI) RotateTunnelKeys(ifaces []*net.Interface) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.Tunnels == nil || self.TunnelKeyLifetime == 0 {
+		return nil
+	}
+
+	now := time.Now()
+
+	var firstErr error
+	for neighborPublicKey, neighbor := range self.Neighbors {
+		tunnel := &neighbor.Tunnel
+		if !neighbor.Confirmed ||
+			tunnel.LocalPublicKey == "" ||
+			now.Sub(tunnel.LocalKeyCreated) < self.TunnelKeyLifetime {
+			continue
+		}
+
+		if tunnel.NextPublicKey == "" {
+			publicKey, privateKey, err := self.Tunnels.NewKeys()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			tunnel.NextPublicKey = publicKey
+			tunnel.NextPrivateKey = privateKey
+		}
+
+		for _, iface := range interfacesOf(neighbor, ifaces) {
+			err := self.sendTunnelMsg(neighborPublicKey, iface, false)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// interfacesOf returns the interfaces to send neighbor a message on. Messages
+// to a neighbor whose address we have are unicast to it, so that is only
+// the one it was last seen on. Otherwise they are multicast, on every one of
+// ifaces, since it could be on any of them.
+func interfacesOf(
+	neighbor *types.Neighbor,
+	ifaces []*net.Interface,
+) []*net.Interface {
+	if neighbor.Address == nil || len(ifaces) == 0 {
+		return ifaces
+	}
+
+	for _, iface := range ifaces {
+		if iface.Name == neighbor.Address.Zone {
+			return []*net.Interface{iface}
+		}
+	}
+	return ifaces[:1]
+}
+
+// SendVoucherMsg pays a neighbor by signing it a voucher for everything we
+// have paid it so far plus amount.
+func (self *NeighborAPI) SendVoucherMsg(
+	neighborPublicKey [ed25519.PublicKeySize]byte,
+	iface *net.Interface,
+	amount uint64,
+) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	neighbor := self.Neighbors[neighborPublicKey]
+	if neighbor == nil {
+		return errors.New("neighbor not found")
+	}
+
+	if neighbor.Channel.Closed {
+		return errors.New("payment channel closed")
+	}
+
+	if amount > math.MaxUint64-neighbor.Channel.Sent {
+		return errors.New("voucher amount overflows")
+	}
+
+	seqnum, err := self.nextSeqnum()
+	if err != nil {
+		return err
+	}
+
+	msg := types.VoucherMessage{
+		MessageMetadata: types.MessageMetadata{
+			SourcePublicKey:      self.Account.PublicKey,
+			DestinationPublicKey: neighborPublicKey,
+			Seqnum:               seqnum,
+		},
+		Amount: neighbor.Channel.Sent + amount,
+	}
+
+	s, err := serialization.FmtVoucherMsg(msg, self.Account.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	// A voucher that fails to go out after this is paid again with the next
+	// one, but we never restart below what the neighbor holds
+	if self.Store != nil {
+		err = self.Store.RecordSent(neighborPublicKey, msg.Amount)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Only a voucher that went out counts as paid, or the amount would be
+	// paid again with the next one
+	err = self.send(iface, msg.MessageMetadata, s)
+	if err != nil {
+		return err
+	}
+	neighbor.Channel.Sent = msg.Amount
+
+	self.count("scrooge_payments_sent_total", 1)
+	self.count("scrooge_payments_sent_amount_total", float64(amount))
+	self.publish(events.Event{
+		Type:   events.PaymentSent,
+		Amount: amount,
+	}, neighborPublicKey)
+	return nil
+}
+
+// RotateKey moves us to a new identity key. Every neighbor we know is sent a
+// key rotation signed by both keys, on the interface it was last seen on or
+// on every one of ifaces if we don't know where it is, and from then on we
+// only use the new one, even if some of the rotations could not be sent.
+// Our certificate is dropped unless it is for the new key, since neighbors
+// would refuse it.
+func (self *NeighborAPI) RotateKey(
+	ifaces []*net.Interface,
+	newPublicKey [ed25519.PublicKeySize]byte,
+	newPrivateKey [ed25519.PrivateKeySize]byte,
+) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	var firstErr error
+	for neighborPublicKey, neighbor := range self.Neighbors {
+		for _, iface := range interfacesOf(neighbor, ifaces) {
+			err := self.sendKeyRotationMsg(
+				iface,
+				neighborPublicKey,
+				newPublicKey,
+				newPrivateKey,
+			)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	self.Account.PublicKey = newPublicKey
+	self.Account.PrivateKey = newPrivateKey
+
+	if self.Account.Certificate != "" {
+		cert, err := certificate.Parse(self.Account.Certificate)
+		if err != nil || cert.PublicKey != newPublicKey {
+			logger.Warn("our certificate is for the old key, sending hellos without one")
+			self.Account.Certificate = ""
+		}
+	}
+
+	return firstErr
+}
+
+func (self *NeighborAPI) sendKeyRotationMsg(
+	iface *net.Interface,
+	neighborPublicKey [ed25519.PublicKeySize]byte,
+	newPublicKey [ed25519.PublicKeySize]byte,
+	newPrivateKey [ed25519.PrivateKeySize]byte,
+) error {
+	seqnum, err := self.nextSeqnum()
+	if err != nil {
+		return err
+	}
+
+	msg := types.KeyRotationMessage{
+		MessageMetadata: types.MessageMetadata{
+			SourcePublicKey:      self.Account.PublicKey,
+			DestinationPublicKey: neighborPublicKey,
+			Seqnum:               seqnum,
+		},
+		NewPublicKey: newPublicKey,
+	}
+
+	s, err := serialization.FmtKeyRotationMsg(
+		msg,
+		self.Account.PrivateKey,
+		newPrivateKey,
+	)
+	if err != nil {
+		return err
+	}
+
+	return self.send(iface, msg.MessageMetadata, s)
 }
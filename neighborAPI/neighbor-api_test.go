@@ -1,10 +1,24 @@
 package neighborAPI
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
 	"net"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/agl/ed25519"
+	"github.com/incentivized-mesh-infrastructure/scrooge/admission"
+	"github.com/incentivized-mesh-infrastructure/scrooge/certificate"
+	"github.com/incentivized-mesh-infrastructure/scrooge/events"
+	"github.com/incentivized-mesh-infrastructure/scrooge/ledger"
+	"github.com/incentivized-mesh-infrastructure/scrooge/ratelimit"
+	"github.com/incentivized-mesh-infrastructure/scrooge/replay"
+	"github.com/incentivized-mesh-infrastructure/scrooge/serialization"
 	"github.com/incentivized-mesh-infrastructure/scrooge/types"
 )
 
@@ -12,15 +26,27 @@ var (
 	iface = &net.Interface{
 		Name: "foo0",
 	}
+	addr1 = &net.UDPAddr{
+		IP:   net.ParseIP("fe80::1"),
+		Port: 8481,
+		Zone: "foo0",
+	}
+	addr2 = &net.UDPAddr{
+		IP:   net.ParseIP("fe80::2"),
+		Port: 8481,
+		Zone: "foo0",
+	}
 	account1 = &types.Account{
-		PublicKey:  [ed25519.PublicKeySize]byte{0x3b, 0xee, 0xb8, 0xd0, 0x2, 0x7c, 0x31, 0x38, 0x1a, 0xc2, 0x28, 0xdc, 0xe1, 0x23, 0x2d, 0x62, 0x9c, 0xcd, 0x68, 0x1e, 0xde, 0x7d, 0x45, 0xbb, 0xc0, 0xec, 0x10, 0x87, 0x94, 0x8d, 0xfe, 0xa},
-		PrivateKey: [ed25519.PrivateKeySize]byte{0x45, 0xc2, 0x72, 0x9, 0x8d, 0xc7, 0x63, 0x2f, 0xff, 0xe1, 0x43, 0x1, 0x72, 0x90, 0x8a, 0x6c, 0x34, 0xa2, 0x11, 0x50, 0xf3, 0x2, 0x55, 0xa3, 0xae, 0x4d, 0x1d, 0x8f, 0x9e, 0x1f, 0xa6, 0x58, 0x3b, 0xee, 0xb8, 0xd0, 0x2, 0x7c, 0x31, 0x38, 0x1a, 0xc2, 0x28, 0xdc, 0xe1, 0x23, 0x2d, 0x62, 0x9c, 0xcd, 0x68, 0x1e, 0xde, 0x7d, 0x45, 0xbb, 0xc0, 0xec, 0x10, 0x87, 0x94, 0x8d, 0xfe, 0xa},
-		Seqnum:     16,
+		PublicKey:       [ed25519.PublicKeySize]byte{0x3b, 0xee, 0xb8, 0xd0, 0x2, 0x7c, 0x31, 0x38, 0x1a, 0xc2, 0x28, 0xdc, 0xe1, 0x23, 0x2d, 0x62, 0x9c, 0xcd, 0x68, 0x1e, 0xde, 0x7d, 0x45, 0xbb, 0xc0, 0xec, 0x10, 0x87, 0x94, 0x8d, 0xfe, 0xa},
+		PrivateKey:      [ed25519.PrivateKeySize]byte{0x45, 0xc2, 0x72, 0x9, 0x8d, 0xc7, 0x63, 0x2f, 0xff, 0xe1, 0x43, 0x1, 0x72, 0x90, 0x8a, 0x6c, 0x34, 0xa2, 0x11, 0x50, 0xf3, 0x2, 0x55, 0xa3, 0xae, 0x4d, 0x1d, 0x8f, 0x9e, 0x1f, 0xa6, 0x58, 0x3b, 0xee, 0xb8, 0xd0, 0x2, 0x7c, 0x31, 0x38, 0x1a, 0xc2, 0x28, 0xdc, 0xe1, 0x23, 0x2d, 0x62, 0x9c, 0xcd, 0x68, 0x1e, 0xde, 0x7d, 0x45, 0xbb, 0xc0, 0xec, 0x10, 0x87, 0x94, 0x8d, 0xfe, 0xa},
+		Seqnum:          16,
+		TunnelPublicKey: "derp",
 	}
 	account2 = &types.Account{
-		PublicKey:  [ed25519.PublicKeySize]byte{0x9b, 0xbe, 0x22, 0x49, 0xca, 0x84, 0x70, 0xb4, 0xda, 0x9a, 0xed, 0x36, 0xd2, 0xec, 0x62, 0x75, 0x28, 0x7d, 0xac, 0x3d, 0x1, 0x5e, 0x3d, 0xf7, 0xa1, 0x2f, 0xd1, 0xc6, 0xcb, 0x96, 0xa5, 0x86},
-		PrivateKey: [ed25519.PrivateKeySize]byte{0xf6, 0x4, 0x2e, 0x29, 0xbe, 0x99, 0xde, 0x68, 0xfc, 0x1b, 0x41, 0x58, 0xe0, 0xc9, 0xab, 0xc6, 0x81, 0xa5, 0x2a, 0x79, 0x76, 0x5a, 0xae, 0x59, 0x79, 0x58, 0x64, 0x5f, 0x14, 0xa3, 0x4a, 0xcb, 0x9b, 0xbe, 0x22, 0x49, 0xca, 0x84, 0x70, 0xb4, 0xda, 0x9a, 0xed, 0x36, 0xd2, 0xec, 0x62, 0x75, 0x28, 0x7d, 0xac, 0x3d, 0x1, 0x5e, 0x3d, 0xf7, 0xa1, 0x2f, 0xd1, 0xc6, 0xcb, 0x96, 0xa5, 0x86},
-		Seqnum:     16,
+		PublicKey:       [ed25519.PublicKeySize]byte{0x9b, 0xbe, 0x22, 0x49, 0xca, 0x84, 0x70, 0xb4, 0xda, 0x9a, 0xed, 0x36, 0xd2, 0xec, 0x62, 0x75, 0x28, 0x7d, 0xac, 0x3d, 0x1, 0x5e, 0x3d, 0xf7, 0xa1, 0x2f, 0xd1, 0xc6, 0xcb, 0x96, 0xa5, 0x86},
+		PrivateKey:      [ed25519.PrivateKeySize]byte{0xf6, 0x4, 0x2e, 0x29, 0xbe, 0x99, 0xde, 0x68, 0xfc, 0x1b, 0x41, 0x58, 0xe0, 0xc9, 0xab, 0xc6, 0x81, 0xa5, 0x2a, 0x79, 0x76, 0x5a, 0xae, 0x59, 0x79, 0x58, 0x64, 0x5f, 0x14, 0xa3, 0x4a, 0xcb, 0x9b, 0xbe, 0x22, 0x49, 0xca, 0x84, 0x70, 0xb4, 0xda, 0x9a, 0xed, 0x36, 0xd2, 0xec, 0x62, 0x75, 0x28, 0x7d, 0xac, 0x3d, 0x1, 0x5e, 0x3d, 0xf7, 0xa1, 0x2f, 0xd1, 0xc6, 0xcb, 0x96, 0xa5, 0x86},
+		Seqnum:          16,
+		TunnelPublicKey: "flerp",
 	}
 )
 
@@ -38,15 +64,70 @@ type fakeNetwork struct {
 	SendMcastUDPArgs
 	SendUDPArgs
 	MulticastPort int
+	multicastOn   []string // Every interface multicast on
+	err           error    // Returned instead of sending, if set
 }
 
 func (fakeNet *fakeNetwork) SendUDP(addr *net.UDPAddr, s string) error {
+	if fakeNet.err != nil {
+		return fakeNet.err
+	}
 	fakeNet.SendUDPArgs = SendUDPArgs{addr, s}
 	return nil
 }
 
 func (fakeNet *fakeNetwork) SendMulticastUDP(iface *net.Interface, s string) error {
+	if fakeNet.err != nil {
+		return fakeNet.err
+	}
 	fakeNet.SendMcastUDPArgs = SendMcastUDPArgs{iface, s}
+	fakeNet.multicastOn = append(fakeNet.multicastOn, iface.Name)
+	return nil
+}
+
+type fakePaymentBackend struct {
+	settled []*types.VoucherMessage
+}
+
+func (fakeBackend *fakePaymentBackend) Settle(voucher *types.VoucherMessage) error {
+	fakeBackend.settled = append(fakeBackend.settled, voucher)
+	return nil
+}
+
+type fakeStore struct {
+	reserved uint64
+	retired  [][ed25519.PublicKeySize]byte
+	sent     map[[ed25519.PublicKeySize]byte]uint64
+	err      error
+}
+
+func (store *fakeStore) ReserveSeqnum(seqnum uint64) error {
+	if store.err != nil {
+		return store.err
+	}
+	store.reserved = seqnum
+	return nil
+}
+
+func (store *fakeStore) RetireKey(publicKey [ed25519.PublicKeySize]byte) error {
+	if store.err != nil {
+		return store.err
+	}
+	store.retired = append(store.retired, publicKey)
+	return nil
+}
+
+func (store *fakeStore) RecordSent(
+	publicKey [ed25519.PublicKeySize]byte,
+	sent uint64,
+) error {
+	if store.err != nil {
+		return store.err
+	}
+	if store.sent == nil {
+		store.sent = map[[ed25519.PublicKeySize]byte]uint64{}
+	}
+	store.sent[publicKey] = sent
 	return nil
 }
 
@@ -63,14 +144,18 @@ func createNodes() (
 		MulticastPort: 8481,
 	}
 	node1 = &NeighborAPI{
-		Neighbors: map[[ed25519.PublicKeySize]byte]*types.Neighbor{},
-		Account:   account1,
-		Network:   fakeNet1,
+		Neighbors:       map[[ed25519.PublicKeySize]byte]*types.Neighbor{},
+		Account:         account1,
+		Ledger:          ledger.New(nil),
+		Network:         fakeNet1,
+		FirstTunnelPort: 51820,
 	}
 	node2 = &NeighborAPI{
-		Neighbors: map[[ed25519.PublicKeySize]byte]*types.Neighbor{},
-		Account:   account2,
-		Network:   fakeNet2,
+		Neighbors:       map[[ed25519.PublicKeySize]byte]*types.Neighbor{},
+		Account:         account2,
+		Ledger:          ledger.New(nil),
+		Network:         fakeNet2,
+		FirstTunnelPort: 51820,
 	}
 
 	return
@@ -79,21 +164,21 @@ func createNodes() (
 func TestHelloMsg(t *testing.T) {
 	node1, fakeNet1, node2, fakeNet2 := createNodes()
 
-	err := node1.SendHelloMsg(iface, false)
+	err := node1.SendHelloMsg(iface)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	helloMessage := fakeNet1.SendMcastUDPArgs.string
 
-	err = node2.Handlers([]byte(helloMessage), iface)
+	err = node2.Handlers([]byte(helloMessage), iface, addr1)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	helloConfirmMessage := fakeNet2.SendMcastUDPArgs.string
+	helloConfirmMessage := fakeNet2.SendUDPArgs.string
 
-	err = node1.Handlers([]byte(helloConfirmMessage), iface)
+	err = node1.Handlers([]byte(helloConfirmMessage), iface, addr2)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -105,57 +190,2204 @@ func TestHelloMsg(t *testing.T) {
 	if node2.Neighbors[node1.Account.PublicKey] == nil {
 		t.Fatal("node2.Neighbors[node1.Account.PublicKey] == nil")
 	}
+
+	if !node1.Neighbors[node2.Account.PublicKey].Confirmed {
+		t.Fatal("node2 not confirmed by node1")
+	}
+
+	// node2 only knows that node1 can reach it, not the other way around
+	if node2.Neighbors[node1.Account.PublicKey].Confirmed {
+		t.Fatal("node1 confirmed by node2 without a hello from node2")
+	}
 }
 
-func TestBadSeqnum(t *testing.T) {
-	node1, fakeNet1, node2, _ := createNodes()
+func TestDirectedMsgsUnicast(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
 
-	err := node1.SendHelloMsg(iface, false)
+	err := node1.SendHelloMsg(iface)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	helloMessage := fakeNet1.SendMcastUDPArgs.string
+	err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fakeNet2.SendMcastUDPArgs.string != "" {
+		t.Fatal("hello confirm multicast")
+	}
+	if fakeNet2.SendUDPArgs.UDPAddr != addr1 {
+		t.Fatal("hello confirm sent to wrong address: ", fakeNet2.SendUDPArgs.UDPAddr)
+	}
 
-	err = node2.Handlers([]byte(helloMessage), iface)
+	err = node1.Handlers([]byte(fakeNet2.SendUDPArgs.string), iface, addr2)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// Now we decrement the seqnum and do it again
+	if node1.Neighbors[node2.Account.PublicKey].Address != addr2 {
+		t.Fatal("node2 address not recorded")
+	}
 
-	node1.Account.Seqnum = node1.Account.Seqnum - 1
-	err = node1.SendHelloMsg(iface, false)
+	err = node1.SendVoucherMsg(node2.Account.PublicKey, iface, 100)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	helloMessage = fakeNet1.SendMcastUDPArgs.string
+	if fakeNet1.SendUDPArgs.UDPAddr != addr2 {
+		t.Fatal("voucher sent to wrong address: ", fakeNet1.SendUDPArgs.UDPAddr)
+	}
+}
+
+func TestHelloConfirmStaleNonce(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
+
+	err := node1.SendHelloMsg(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	helloConfirmMessage := fakeNet2.SendUDPArgs.string
+
+	// A new hello has a new nonce, which the old confirm doesn't echo
+	err = node1.SendHelloMsg(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	err = node2.Handlers([]byte(helloMessage), iface)
+	err = node1.Handlers([]byte(helloConfirmMessage), iface, addr2)
 	if err == nil {
-		t.Fatal("no sequence number error returned")
+		t.Fatal("no nonce error returned")
+	}
+
+	if node1.Neighbors[node2.Account.PublicKey].Confirmed {
+		t.Fatal("node2 confirmed with a stale nonce")
 	}
 }
 
-func TestBadSignature(t *testing.T) {
-	node1, fakeNet1, node2, _ := createNodes()
+func TestHelloConfirmPerInterface(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
+	iface2 := &net.Interface{Name: "bar0"}
+	addr2OnIface2 := &net.UDPAddr{IP: addr2.IP, Port: addr2.Port, Zone: "bar0"}
 
-	err := node1.SendHelloMsg(iface, false)
+	err := node1.SendHelloMsg(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
 	if err != nil {
 		t.Fatal(err)
 	}
+	confirm := fakeNet2.SendUDPArgs.string
 
-	msg := fakeNet1.SendMcastUDPArgs.string
+	// A hello on another interface doesn't make the first one stale
+	err = node1.SendHelloMsg(iface2)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	// Mess with the signature
-	msg = msg[:len(msg)-4] + "2" + msg[len(msg)-3:]
+	err = node1.Handlers([]byte(confirm), iface, addr2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !node1.Neighbors[node2.Account.PublicKey].Confirmed {
+		t.Fatal("confirm of the hello on the first interface rejected")
+	}
 
-	err = node2.Handlers([]byte(msg), iface)
+	// But a confirm only counts on the interface its hello went out on
+	node1.Neighbors[node2.Account.PublicKey].Confirmed = false
+	err = node2.SendHelloMsg(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface2, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node1.Handlers([]byte(fakeNet2.SendUDPArgs.string), iface, addr2OnIface2)
 	if err == nil {
-		t.Fatal("no signature error")
+		t.Fatal("confirm accepted on another interface")
 	}
-	if err.Error() != "signature not valid" {
-		t.Fatal("wrong error: ", err.Error())
+}
+
+func TestHelloConfirmZeroNonce(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
+
+	err := node1.SendHelloMsg(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// As far as node1 knows it hasn't sent a hello yet, after a restart
+	// say, so there is nothing to confirm
+	node1.helloNonces = nil
+	err = node2.sendHelloConfirmMsg(iface, node1.Account.PublicKey, [types.NonceSize]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node1.Handlers([]byte(fakeNet2.SendUDPArgs.string), iface, addr2)
+	if err == nil {
+		t.Fatal("confirm of a zero nonce accepted")
+	}
+	if node1.Neighbors[node2.Account.PublicKey].Confirmed {
+		t.Fatal("node2 confirmed without a hello")
+	}
+}
+
+func TestHelloConfirmForOtherNode(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
+
+	err := node1.SendHelloMsg(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// node3 overhears the confirm node2 sent to node1, it is not for it
+	publicKey3, privateKey3, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node3, _, _, _ := createNodes()
+	node3.Account = &types.Account{
+		PublicKey:  *publicKey3,
+		PrivateKey: *privateKey3,
+	}
+
+	err = node3.Handlers([]byte(fakeNet2.SendUDPArgs.string), iface, addr2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(node3.Neighbors) != 0 {
+		t.Fatal("confirm for another node accepted")
+	}
+}
+
+// confirmNodes has node1 and node2 confirm each other with hellos.
+func confirmNodes(
+	t *testing.T,
+	node1 *NeighborAPI,
+	fakeNet1 *fakeNetwork,
+	node2 *NeighborAPI,
+	fakeNet2 *fakeNetwork,
+) {
+	for _, pair := range []struct {
+		from, to         *NeighborAPI
+		fromNet, toNet   *fakeNetwork
+		fromAddr, toAddr *net.UDPAddr
+	}{
+		{node1, node2, fakeNet1, fakeNet2, addr1, addr2},
+		{node2, node1, fakeNet2, fakeNet1, addr2, addr1},
+	} {
+		err := pair.from.SendHelloMsg(iface)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = pair.to.Handlers([]byte(pair.fromNet.SendMcastUDPArgs.string), iface, pair.fromAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = pair.from.Handlers([]byte(pair.toNet.SendUDPArgs.string), iface, pair.toAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTunnelMsg(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
+	confirmNodes(t, node1, fakeNet1, node2, fakeNet2)
+
+	err := node1.SendTunnelMsg(node2.Account.PublicKey, iface, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.Handlers([]byte(fakeNet1.SendUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel := node2.Neighbors[node1.Account.PublicKey].Tunnel
+	if tunnel.PublicKey != "derp" || tunnel.Endpoint != "[fe80::1%foo0]:51820" {
+		t.Fatalf("node1 tunnel incorrect: %+v", tunnel)
+	}
+
+	err = node1.Handlers([]byte(fakeNet2.SendUDPArgs.string), iface, addr2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel = node1.Neighbors[node2.Account.PublicKey].Tunnel
+	if tunnel.PublicKey != "flerp" || tunnel.Endpoint != "[fe80::2%foo0]:51820" {
+		t.Fatalf("node2 tunnel incorrect: %+v", tunnel)
+	}
+}
+
+func TestSealedMsgs(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
+	node1.Seal = true
+	node2.Seal = true
+	confirmNodes(t, node1, fakeNet1, node2, fakeNet2)
+
+	if !strings.HasPrefix(fakeNet1.SendUDPArgs.string, "scrooge_sealed ") {
+		t.Fatal("hello confirm not sealed: " + fakeNet1.SendUDPArgs.string)
+	}
+
+	err := node1.SendTunnelMsg(node2.Account.PublicKey, iface, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed := fakeNet1.SendUDPArgs.string
+	if !strings.HasPrefix(sealed, "scrooge_sealed ") ||
+		strings.Contains(sealed, "derp") {
+		t.Fatal("tunnel message not sealed: " + sealed)
+	}
+
+	err = node2.Handlers([]byte(sealed), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel := node2.Neighbors[node1.Account.PublicKey].Tunnel
+	if tunnel.PublicKey != "derp" {
+		t.Fatalf("node1 tunnel incorrect: %+v", tunnel)
+	}
+
+	err = node1.Handlers([]byte(fakeNet2.SendUDPArgs.string), iface, addr2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel = node1.Neighbors[node2.Account.PublicKey].Tunnel
+	if tunnel.PublicKey != "flerp" {
+		t.Fatalf("node2 tunnel incorrect: %+v", tunnel)
+	}
+}
+
+func TestSealedMsgResealed(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
+	confirmNodes(t, node1, fakeNet1, node2, fakeNet2)
+
+	err := node1.SendTunnelMsg(node2.Account.PublicKey, iface, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone else seals the tunnel message of node1 to node2 as their own
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := serialization.FmtSealedMsg(
+		types.SealedMessage{
+			MessageMetadata: types.MessageMetadata{
+				SourcePublicKey:      *publicKey,
+				DestinationPublicKey: node2.Account.PublicKey,
+				Seqnum:               1,
+			},
+			Inner: fakeNet1.SendUDPArgs.string,
+		},
+		*privateKey,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.Handlers([]byte(s), iface, addr1)
+	if err == nil {
+		t.Fatal("no error for resealed message")
+	}
+	if node2.Neighbors[node1.Account.PublicKey].Tunnel.PublicKey != "" {
+		t.Fatal("resealed tunnel message accepted")
+	}
+}
+
+type fakeTunnels struct {
+	keys        int
+	created     map[string]string
+	removed     []string
+	privateKeys map[string]string
+	replaced    []string
+	err         error
+	keysErr     error // Returned by the next NewKeys only
+}
+
+func (tunnels *fakeTunnels) NewKeys() (string, string, error) {
+	if err := tunnels.keysErr; err != nil {
+		tunnels.keysErr = nil
+		return "", "", err
+	}
+	tunnels.keys++
+	return fmt.Sprintf("pub%v", tunnels.keys),
+		fmt.Sprintf("priv%v", tunnels.keys),
+		nil
+}
+
+func (tunnels *fakeTunnels) CreateTunnel(
+	tunnel *types.Tunnel,
+	privateKey string,
+) error {
+	if tunnels.err != nil {
+		return tunnels.err
+	}
+	if tunnels.created == nil {
+		tunnels.created = map[string]string{}
+	}
+	tunnels.created[tunnel.VirtualInterface.Name] = privateKey
+	return nil
+}
+
+func (tunnels *fakeTunnels) SetPrivateKey(
+	virtualInterface string,
+	privateKey string,
+) error {
+	if tunnels.err != nil {
+		return tunnels.err
+	}
+	if tunnels.privateKeys == nil {
+		tunnels.privateKeys = map[string]string{}
+	}
+	tunnels.privateKeys[virtualInterface] = privateKey
+	return nil
+}
+
+func (tunnels *fakeTunnels) RemoveTunnel(virtualInterface string) error {
+	if tunnels.err != nil {
+		return tunnels.err
+	}
+	tunnels.removed = append(tunnels.removed, virtualInterface)
+	return nil
+}
+
+func (tunnels *fakeTunnels) ReplacePeer(
+	tunnel *types.Tunnel,
+	oldPublicKey string,
+) error {
+	tunnels.replaced = append(tunnels.replaced, oldPublicKey+" "+tunnel.PublicKey)
+	return nil
+}
+
+func TestTunnelKeyRotation(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
+	tunnels1 := &fakeTunnels{}
+	tunnels2 := &fakeTunnels{keys: 100}
+	node1.Tunnels = tunnels1
+	node2.Tunnels = tunnels2
+	node1.TunnelKeyLifetime = time.Hour
+	node2.TunnelKeyLifetime = time.Hour
+	confirmNodes(t, node1, fakeNet1, node2, fakeNet2)
+
+	err := node1.SendTunnelMsg(node2.Account.PublicKey, iface, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.Handlers([]byte(fakeNet1.SendUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node1.Handlers([]byte(fakeNet2.SendUDPArgs.string), iface, addr2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each tunnel has keys of its own instead of the account's
+	tunnel1 := &node1.Neighbors[node2.Account.PublicKey].Tunnel
+	tunnel2 := &node2.Neighbors[node1.Account.PublicKey].Tunnel
+	if tunnel1.LocalPublicKey != "pub1" || tunnel2.PublicKey != "pub1" {
+		t.Fatalf("node1 tunnel keys incorrect: %+v %+v", tunnel1, tunnel2)
+	}
+	if tunnel2.LocalPublicKey != "pub101" || tunnel1.PublicKey != "pub101" {
+		t.Fatalf("node2 tunnel keys incorrect: %+v %+v", tunnel2, tunnel1)
+	}
+
+	// Both ends set their tunnel up with their own private key
+	name1 := tunnel1.VirtualInterface.Name
+	name2 := tunnel2.VirtualInterface.Name
+	if name1 == "" || tunnels1.created[name1] != "priv1" {
+		t.Fatalf("node1 tunnel not created: %q %v", name1, tunnels1.created)
+	}
+	if name2 == "" || tunnels2.created[name2] != "priv101" {
+		t.Fatalf("node2 tunnel not created: %q %v", name2, tunnels2.created)
+	}
+
+	// Nothing to rotate yet
+	err = node1.RotateTunnelKeys([]*net.Interface{iface})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunnel1.NextPublicKey != "" {
+		t.Fatal("rotated keys that are not old yet")
+	}
+
+	tunnel1.LocalKeyCreated = time.Now().Add(-2 * time.Hour)
+	err = node1.RotateTunnelKeys([]*net.Interface{iface})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunnel1.NextPublicKey != "pub2" || tunnel1.LocalPublicKey != "pub1" {
+		t.Fatalf("rotation not started: %+v", tunnel1)
+	}
+
+	err = node2.Handlers([]byte(fakeNet1.SendUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnels2.replaced) != 1 || tunnels2.replaced[0] != "pub1 pub2" {
+		t.Fatal("node2 did not replace its peer: ", tunnels2.replaced)
+	}
+
+	// node1 only switches its private key once node2 has confirmed
+	if len(tunnels1.privateKeys) != 0 {
+		t.Fatal("private key switched before confirm")
+	}
+
+	// If the new key can't be set, node1 keeps both until the next confirm
+	confirm := fakeNet2.SendUDPArgs.string
+	tunnels1.err = errors.New("wg failed")
+	err = node1.Handlers([]byte(confirm), iface, addr2)
+	if err == nil {
+		t.Fatal("no error when the private key could not be set")
+	}
+	if tunnel1.NextPrivateKey != "priv2" || tunnel1.LocalPrivateKey != "priv1" {
+		t.Fatalf("keys changed although the switch failed: %+v", tunnel1)
+	}
+	tunnels1.err = nil
+
+	err = node2.SendTunnelMsg(node1.Account.PublicKey, iface, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node1.Handlers([]byte(fakeNet2.SendUDPArgs.string), iface, addr2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunnels1.privateKeys[name1] != "priv2" {
+		t.Fatal("node1 did not switch its private key: ", tunnels1.privateKeys)
+	}
+	if tunnel1.LocalPublicKey != "pub2" || tunnel1.NextPublicKey != "" ||
+		time.Since(tunnel1.LocalKeyCreated) > time.Minute {
+		t.Fatalf("rotation not finished: %+v", tunnel1)
+	}
+	if len(tunnels1.replaced) != 0 {
+		t.Fatal("node1 replaced a peer that did not change: ", tunnels1.replaced)
+	}
+}
+
+func TestTunnelKeyRotationBothEnds(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
+	tunnels1 := &fakeTunnels{}
+	tunnels2 := &fakeTunnels{keys: 100}
+	node1.Tunnels = tunnels1
+	node2.Tunnels = tunnels2
+	node1.TunnelKeyLifetime = time.Hour
+	node2.TunnelKeyLifetime = time.Hour
+	confirmNodes(t, node1, fakeNet1, node2, fakeNet2)
+
+	err := node1.SendTunnelMsg(node2.Account.PublicKey, iface, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node2.Handlers([]byte(fakeNet1.SendUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node1.Handlers([]byte(fakeNet2.SendUDPArgs.string), iface, addr2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A confirm of node1's old key, arriving late
+	err = node1.SendTunnelMsg(node2.Account.PublicKey, iface, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node2.Handlers([]byte(fakeNet1.SendUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := fakeNet2.SendUDPArgs.string
+
+	tunnel1 := &node1.Neighbors[node2.Account.PublicKey].Tunnel
+	tunnel2 := &node2.Neighbors[node1.Account.PublicKey].Tunnel
+	tunnel1.LocalKeyCreated = time.Now().Add(-2 * time.Hour)
+	tunnel2.LocalKeyCreated = time.Now().Add(-2 * time.Hour)
+
+	err = node1.RotateTunnelKeys([]*net.Interface{iface})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node2.RotateTunnelKeys([]*net.Interface{iface})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunnel1.NextPublicKey != "pub2" || tunnel2.NextPublicKey != "pub102" {
+		t.Fatalf("rotation not started: %+v %+v", tunnel1, tunnel2)
+	}
+
+	err = node1.Handlers([]byte(stale), iface, addr2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunnel1.NextPublicKey != "pub2" || len(tunnels1.privateKeys) != 0 {
+		t.Fatalf("node1 switched keys on a confirm of its old key: %+v", tunnel1)
+	}
+
+	// node2 confirms node1's new key with its own new key, so both switch
+	err = node2.Handlers([]byte(fakeNet1.SendUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunnels2.privateKeys[tunnel2.VirtualInterface.Name] != "priv102" ||
+		tunnel2.LocalPublicKey != "pub102" || tunnel2.PublicKey != "pub2" {
+		t.Fatalf("node2 did not switch after confirming: %+v", tunnel2)
+	}
+
+	err = node1.Handlers([]byte(fakeNet2.SendUDPArgs.string), iface, addr2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunnels1.privateKeys[tunnel1.VirtualInterface.Name] != "priv2" ||
+		tunnel1.LocalPublicKey != "pub2" || tunnel1.PublicKey != "pub102" {
+		t.Fatalf("node1 did not switch after the confirm: %+v", tunnel1)
+	}
+}
+
+func TestRestoreTunnels(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
+	tunnels := &fakeTunnels{}
+	node1.Tunnels = tunnels
+	confirmNodes(t, node1, fakeNet1, node2, fakeNet2)
+
+	// Restored without its private keys
+	neighbor := node1.Neighbors[node2.Account.PublicKey]
+	neighbor.Tunnel.PublicKey = "flerp"
+	neighbor.Tunnel.ListenPort = 4500
+	neighbor.Tunnel.LocalPublicKey = "old"
+	neighbor.Tunnel.NextPublicKey = "next"
+
+	err := node1.RestoreTunnels([]*net.Interface{iface})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tunnels.created["scrooge4500"] != "priv1" {
+		t.Fatal("tunnel not created with new keys: ", tunnels.created)
+	}
+	if neighbor.Tunnel.LocalPublicKey != "pub1" || neighbor.Tunnel.NextPublicKey != "" {
+		t.Fatalf("tunnel keys incorrect: %+v", neighbor.Tunnel)
+	}
+
+	err = node2.Handlers([]byte(fakeNet1.SendUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node2.Neighbors[node1.Account.PublicKey].Tunnel.PublicKey != "pub1" {
+		t.Fatal("neighbor not told about the tunnel")
+	}
+
+	// A neighbor we have no address for could be on any interface
+	neighbor.Address = nil
+	neighbor.Tunnel.VirtualInterface.Name = ""
+	fakeNet1.multicastOn = nil
+	iface2 := &net.Interface{Name: "foo1"}
+
+	err = node1.RestoreTunnels([]*net.Interface{iface, iface2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(fakeNet1.multicastOn, " ") != "foo0 foo1" {
+		t.Fatal("tunnel message not sent on every interface: ", fakeNet1.multicastOn)
+	}
+}
+
+func TestRebuildTunnel(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
+	tunnels1 := &fakeTunnels{}
+	node1.Tunnels = tunnels1
+	node2.Tunnels = &fakeTunnels{keys: 100}
+	confirmNodes(t, node1, fakeNet1, node2, fakeNet2)
+
+	neighbor := node1.Neighbors[node2.Account.PublicKey]
+	neighbor.Tunnel.PublicKey = "flerp"
+	neighbor.Tunnel.ListenPort = 4500
+	neighbor.Tunnel.VirtualInterface.Name = "scrooge4500"
+
+	err := node1.RebuildTunnel(node2.Account.PublicKey, iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnels1.removed) != 1 || tunnels1.removed[0] != "scrooge4500" {
+		t.Fatal("tunnel not taken down: ", tunnels1.removed)
+	}
+
+	err = node2.Handlers([]byte(fakeNet1.SendUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node1.Handlers([]byte(fakeNet2.SendUDPArgs.string), iface, addr2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := tunnels1.created["scrooge4500"]; !ok || neighbor.Tunnel.PublicKey != "pub101" {
+		t.Fatalf("tunnel not set up again: %v %+v", tunnels1.created, neighbor.Tunnel)
+	}
+}
+
+func TestTunnelKeyRotationKeysFail(t *testing.T) {
+	node1, _, node2, _ := createNodes()
+	tunnels := &fakeTunnels{keysErr: errors.New("no entropy")}
+	node1.Tunnels = tunnels
+	node1.TunnelKeyLifetime = time.Hour
+
+	for _, publicKey := range [][ed25519.PublicKeySize]byte{node2.Account.PublicKey, {1}} {
+		neighbor := &types.Neighbor{PublicKey: publicKey, Confirmed: true}
+		neighbor.Tunnel.LocalPublicKey = "old"
+		neighbor.Tunnel.LocalPrivateKey = "old"
+		node1.Neighbors[publicKey] = neighbor
+	}
+
+	// One neighbor failing doesn't hold up the others
+	err := node1.RotateTunnelKeys([]*net.Interface{iface})
+	if err == nil {
+		t.Fatal("no error when new keys could not be made")
+	}
+
+	rotating := 0
+	for _, neighbor := range node1.Neighbors {
+		if neighbor.Tunnel.NextPublicKey != "" {
+			rotating++
+		}
+	}
+	if rotating != 1 {
+		t.Fatal("wrong number of tunnels rotating: ", rotating)
+	}
+}
+
+func TestTunnelEndpointMismatch(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
+	confirmNodes(t, node1, fakeNet1, node2, fakeNet2)
+
+	tunnelMsg := func() string {
+		node1.Account.Seqnum++
+		s, err := serialization.FmtTunnelMsg(types.TunnelMessage{
+			MessageMetadata: types.MessageMetadata{
+				SourcePublicKey:      node1.Account.PublicKey,
+				DestinationPublicKey: node2.Account.PublicKey,
+				Seqnum:               node1.Account.Seqnum,
+			},
+			TunnelPublicKey: "derp",
+			TunnelEndpoint:  "[2001:db8::1]:51820",
+			Confirm:         true,
+		}, node1.Account.PrivateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	// Warn by default, but build the tunnel to where the message came from
+	err := node2.Handlers([]byte(tunnelMsg()), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel := node2.Neighbors[node1.Account.PublicKey].Tunnel
+	if tunnel.Endpoint != "[fe80::1%foo0]:51820" {
+		t.Fatal("endpoint not taken from source: ", tunnel.Endpoint)
+	}
+
+	node2.EndpointPolicy = EndpointReject
+	node2.Neighbors[node1.Account.PublicKey].Tunnel.Endpoint = ""
+
+	err = node2.Handlers([]byte(tunnelMsg()), iface, addr1)
+	if err == nil {
+		t.Fatal("no error for mismatched endpoint")
+	}
+
+	if node2.Neighbors[node1.Account.PublicKey].Tunnel.Endpoint != "" {
+		t.Fatal("mismatched endpoint accepted")
+	}
+}
+
+func TestTunnelCertificate(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
+
+	authorityPublicKey, authorityPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node2.Authority = &certificate.Authority{PublicKey: *authorityPublicKey}
+
+	confirmNodes(t, node1, fakeNet1, node2, fakeNet2)
+
+	err = node1.SendTunnelMsg(node2.Account.PublicKey, iface, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.Handlers([]byte(fakeNet1.SendUDPArgs.string), iface, addr1)
+	if err == nil {
+		t.Fatal("tunnel accepted without a certificate")
+	}
+
+	// node2 won't ask for a tunnel itself either
+	err = node2.SendTunnelMsg(node1.Account.PublicKey, iface, false)
+	if err == nil {
+		t.Fatal("tunnel requested without a certificate")
+	}
+
+	cert := certificate.Issue(
+		node1.Account.PublicKey,
+		time.Now().Add(time.Hour),
+		nil,
+		*authorityPrivateKey,
+	)
+	node1.Account.Certificate = cert.String()
+	defer func() { node1.Account.Certificate = "" }()
+
+	// node2 gets the certificate with node1's next hello
+	confirmNodes(t, node1, fakeNet1, node2, fakeNet2)
+
+	tunnels := &fakeTunnels{}
+	node2.Tunnels = tunnels
+
+	err = node1.SendTunnelMsg(node2.Account.PublicKey, iface, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.Handlers([]byte(fakeNet1.SendUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.CheckCertificates()
+	if err != nil || len(tunnels.removed) != 0 {
+		t.Fatal("tunnel with a valid certificate taken down: ", err, tunnels.removed)
+	}
+
+	// Revoking the certificate takes the tunnel down
+	crl := certificate.IssueCRL(
+		time.Now(),
+		[][ed25519.PublicKeySize]byte{node1.Account.PublicKey},
+		*authorityPrivateKey,
+	)
+	err = node2.Authority.(*certificate.Authority).UpdateCRL(crl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.CheckCertificates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := node2.Neighbors[node1.Account.PublicKey].Tunnel
+	if len(tunnels.removed) != 1 || tunnel.VirtualInterface.Name != "" || tunnel.PublicKey != "" {
+		t.Fatalf("tunnel with a revoked certificate still up: %v %+v", tunnels.removed, tunnel)
+	}
+}
+
+func TestTunnelEndpoint(t *testing.T) {
+	node1, _, _, _ := createNodes()
+
+	tests := []struct {
+		advertised string
+		source     *net.UDPAddr
+		endpoint   string
+	}{
+		{":51820", addr1, "[fe80::1%foo0]:51820"},
+		{"[fe80::1]:51820", addr1, "[fe80::1%foo0]:51820"},
+		{"[::]:51820", addr1, "[fe80::1%foo0]:51820"},
+		{":51820", &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Zone: "foo0"}, "192.0.2.1:51820"},
+		{"192.0.2.1:51820", &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Zone: "foo0"}, "192.0.2.1:51820"},
+		{":0", addr1, ""},
+		{"51820", addr1, ""},
+	}
+
+	for _, test := range tests {
+		endpoint, err := node1.tunnelEndpoint(test.advertised, iface, test.source)
+		if test.endpoint == "" {
+			if err == nil {
+				t.Errorf("%v: no error", test.advertised)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.advertised, err)
+		}
+		if endpoint != test.endpoint {
+			t.Errorf("%v: endpoint %v, should be %v", test.advertised, endpoint, test.endpoint)
+		}
+	}
+}
+
+func TestTunnelMsgUnconfirmed(t *testing.T) {
+	node1, _, node2, _ := createNodes()
+
+	node1.Neighbors[node2.Account.PublicKey] = &types.Neighbor{
+		PublicKey: node2.Account.PublicKey,
+	}
+
+	err := node1.SendTunnelMsg(node2.Account.PublicKey, iface, false)
+	if err == nil || err.Error() != "neighbor not confirmed" {
+		t.Fatal("tunnel message sent to unconfirmed neighbor: ", err)
+	}
+}
+
+func TestTunnelMaxPrice(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
+	node1.Account.Price = 50
+	node2.MaxPrice = 10
+	confirmNodes(t, node1, fakeNet1, node2, fakeNet2)
+
+	err := node1.SendTunnelMsg(node2.Account.PublicKey, iface, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.Handlers([]byte(fakeNet1.SendUDPArgs.string), iface, addr1)
+	if err == nil || err.Error() != "tunnel price above our maximum" {
+		t.Fatal("tunnel with a price above the maximum accepted: ", err)
+	}
+	if node2.Neighbors[node1.Account.PublicKey].Tunnel.PublicKey != "" {
+		t.Fatal("tunnel set up")
+	}
+}
+
+func TestBadSeqnum(t *testing.T) {
+	node1, fakeNet1, node2, _ := createNodes()
+
+	err := node1.SendHelloMsg(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	helloMessage := fakeNet1.SendMcastUDPArgs.string
+
+	err = node2.Handlers([]byte(helloMessage), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Now we decrement the seqnum and do it again
+
+	node1.Account.Seqnum = node1.Account.Seqnum - 1
+	err = node1.SendHelloMsg(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	helloMessage = fakeNet1.SendMcastUDPArgs.string
+
+	err = node2.Handlers([]byte(helloMessage), iface, addr1)
+	if err == nil {
+		t.Fatal("no sequence number error returned")
+	}
+}
+
+func TestReorderedStreams(t *testing.T) {
+	node1, fakeNet1, node2, _ := createNodes()
+
+	node1.Neighbors[node2.Account.PublicKey] = &types.Neighbor{
+		PublicKey: node2.Account.PublicKey,
+	}
+	node2.Neighbors[node1.Account.PublicKey] = &types.Neighbor{
+		PublicKey: node1.Account.PublicKey,
+		Confirmed: true,
+	}
+
+	err := node1.SendHelloMsg(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	helloMessage := fakeNet1.SendMcastUDPArgs.string
+
+	err = node1.SendVoucherMsg(node2.Account.PublicKey, iface, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	voucherMessage := fakeNet1.SendMcastUDPArgs.string
+
+	// The voucher overtakes the hello
+	err = node2.Handlers([]byte(voucherMessage), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.Handlers([]byte(helloMessage), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.Handlers([]byte(helloMessage), iface, addr1)
+	if err == nil {
+		t.Fatal("replayed hello accepted")
+	}
+}
+
+func TestReplayAfterWindowsLost(t *testing.T) {
+	node1, fakeNet1, node2, _ := createNodes()
+	node2.PaymentBackend = &fakePaymentBackend{}
+
+	node1.Neighbors[node2.Account.PublicKey] = &types.Neighbor{
+		PublicKey: node2.Account.PublicKey,
+	}
+	node2.Neighbors[node1.Account.PublicKey] = &types.Neighbor{
+		PublicKey: node1.Account.PublicKey,
+		Confirmed: true,
+	}
+
+	err := node1.SendHelloMsg(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := fakeNet1.SendMcastUDPArgs.string
+	err = node2.Handlers([]byte(hello), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node1.SendVoucherMsg(node2.Account.PublicKey, iface, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	voucher := fakeNet1.SendMcastUDPArgs.string
+	err = node2.Handlers([]byte(voucher), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Loaded from a state file from before there were windows
+	delete(node2.windows, node1.Account.PublicKey)
+	err = node2.Handlers([]byte(hello), iface, addr1)
+	if err == nil {
+		t.Fatal("hello replayed to a neighbor without windows")
+	}
+
+	// Kicked and let back in
+	err = node2.RemoveNeighbor(node1.Account.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node2.kicked[node1.Account.PublicKey] = kicked{
+		seqnum: node2.kicked[node1.Account.PublicKey].seqnum,
+	}
+
+	err = node2.Handlers([]byte(voucher), iface, addr1)
+	if err == nil {
+		t.Fatal("voucher replayed to a neighbor that was kicked")
+	}
+	if node2.Neighbors[node1.Account.PublicKey] != nil {
+		t.Fatal("replay brought a kicked neighbor back")
+	}
+
+	err = node1.SendHelloMsg(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSeqnumReservation(t *testing.T) {
+	node1, fakeNet1, _, _ := createNodes()
+	store := &fakeStore{}
+	node1.Store = store
+
+	err := node1.SendHelloMsg(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if store.reserved != node1.Account.Seqnum {
+		t.Fatal("seqnum sent without reservation")
+	}
+
+	sent := fakeNet1.SendMcastUDPArgs.string
+	seqnum := node1.Account.Seqnum
+	store.err = errors.New("disk full")
+
+	err = node1.SendHelloMsg(iface)
+	if err == nil {
+		t.Fatal("no reservation error returned")
+	}
+
+	if node1.Account.Seqnum != seqnum || fakeNet1.SendMcastUDPArgs.string != sent {
+		t.Fatal("message sent without reservation")
+	}
+}
+
+func TestTimeSeqnumMode(t *testing.T) {
+	node1, fakeNet1, node2, _ := createNodes()
+
+	account := *node1.Account
+	account.SeqnumMode = string(replay.Time)
+	account.Seqnum = 0
+	node1.Account = &account
+	node2.ClockSkew = 30 * time.Second
+
+	err := node1.SendHelloMsg(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if node1.Account.Seqnum < uint64(time.Now().Add(-time.Minute).UnixNano()) {
+		t.Fatal("seqnum is not a timestamp: ", node1.Account.Seqnum)
+	}
+
+	err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if node2.Neighbors[node1.Account.PublicKey].SeqnumMode != string(replay.Time) {
+		t.Fatal("seqnum mode not recorded")
+	}
+
+	// Without a clock skew window every timestamp is too far off
+	node2.Neighbors = map[[ed25519.PublicKeySize]byte]*types.Neighbor{}
+	node2.ClockSkew = 0
+
+	err = node1.SendHelloMsg(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+	if err == nil {
+		t.Fatal("no clock skew error returned")
+	}
+}
+
+func TestSeqnumModeToCounter(t *testing.T) {
+	starts := map[replay.Mode]uint64{
+		replay.Time:  0,
+		replay.Epoch: uint64(time.Now().Unix()) << 32,
+	}
+
+	for mode, start := range starts {
+		node1, fakeNet1, node2, _ := createNodes()
+		store := &fakeStore{}
+		node1.Store = store
+		node2.ClockSkew = 30 * time.Second
+
+		account := *node1.Account
+		account.SeqnumMode = string(mode)
+		account.Seqnum = start
+		node1.Account = &account
+
+		err := node1.SendHelloMsg(iface)
+		if err != nil {
+			t.Fatal(mode, err)
+		}
+		err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+		if err != nil {
+			t.Fatal(mode, err)
+		}
+
+		if store.reserved != node1.Account.Seqnum {
+			t.Fatal(mode, " seqnum sent without reservation")
+		}
+
+		// Restart in counter mode from what the store reserved
+		err = replay.CheckResume(replay.Counter, store.reserved, time.Now(), node2.ClockSkew)
+		if err != nil {
+			t.Fatal(mode, err)
+		}
+		account.SeqnumMode = string(replay.Counter)
+		account.Seqnum = store.reserved
+
+		err = node1.SendHelloMsg(iface)
+		if err != nil {
+			t.Fatal(mode, err)
+		}
+		err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+		if err != nil {
+			t.Fatal(mode, " counter seqnums rejected after ", mode, ": ", err)
+		}
+	}
+}
+
+func TestSeqnumModeNotAccepted(t *testing.T) {
+	node1, fakeNet1, node2, _ := createNodes()
+	node2.AcceptedSeqnumModes = []replay.Mode{replay.Time, replay.Epoch}
+
+	err := node1.SendHelloMsg(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+	if err == nil {
+		t.Fatal("no seqnum mode error returned")
+	}
+
+	if node2.Neighbors[node1.Account.PublicKey] != nil {
+		t.Fatal("neighbor added with a seqnum mode that is not accepted")
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	node1, fakeNet1, node2, _ := createNodes()
+	node2.SourceLimit = ratelimit.New(1, 2)
+
+	for i := 0; i < 3; i++ {
+		err := node1.SendHelloMsg(iface)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if node2.SourceLimit.Dropped() != 1 {
+		t.Fatal("wrong number of drops by source: ", node2.SourceLimit.Dropped())
+	}
+
+	// A key is limited per address, so someone else claiming it can't use
+	// up its limit
+	node2.SourceLimit = nil
+	node2.KeyLimit = ratelimit.New(1, 1)
+
+	for _, source := range []*net.UDPAddr{addr1, addr1, addr2} {
+		err := node1.SendHelloMsg(iface)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, source)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if node2.KeyLimit.Dropped() != 1 {
+		t.Fatal("wrong number of drops by key: ", node2.KeyLimit.Dropped())
+	}
+}
+
+func TestConfirmLimit(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
+	node2.ConfirmLimit = ratelimit.New(1, 1)
+
+	for i := 0; i < 2; i++ {
+		err := node1.SendHelloMsg(iface)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fakeNet2.SendUDPArgs = SendUDPArgs{}
+		err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if fakeNet2.SendUDPArgs.string != "" {
+		t.Fatal("hello confirmed over the limit")
+	}
+	if node2.ConfirmLimit.Dropped() != 1 {
+		t.Fatal("wrong number of dropped confirms: ", node2.ConfirmLimit.Dropped())
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
+
+	var err error
+	policy := admission.Policy{
+		Deny: map[[ed25519.PublicKeySize]byte]bool{
+			node1.Account.PublicKey: true,
+		},
+	}
+	node2.Admission, err = admission.New(policy, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node1.SendHelloMsg(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+	if err == nil {
+		t.Fatal("no error for denied key")
+	}
+
+	if len(node2.Neighbors) != 0 || fakeNet2.SendUDPArgs.string != "" {
+		t.Fatal("denied key became a neighbor")
+	}
+}
+
+func TestAdmissionReloaded(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
+	tunnels := &fakeTunnels{}
+	node2.Tunnels = tunnels
+
+	neighborAdmission, err := admission.New(admission.Policy{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node2.Admission = neighborAdmission
+	confirmNodes(t, node1, fakeNet1, node2, fakeNet2)
+
+	err = node1.SendTunnelMsg(node2.Account.PublicKey, iface, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node2.Handlers([]byte(fakeNet1.SendUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	neighborAdmission.Reload(admission.Policy{
+		Deny: map[[ed25519.PublicKeySize]byte]bool{
+			node1.Account.PublicKey: true,
+		},
+	})
+	err = node2.CheckAdmission()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel := node2.Neighbors[node1.Account.PublicKey].Tunnel
+	if len(tunnels.removed) != 1 || tunnel.VirtualInterface.Name != "" || tunnel.PublicKey != "" {
+		t.Fatalf("tunnel with denied neighbor still up: %v %+v", tunnels.removed, tunnel)
+	}
+}
+
+func TestPinAfterConfirm(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
+
+	var err error
+	node2.Admission, err = admission.New(admission.Policy{Pin: admission.PinAddress}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pins := node2.Admission.(*admission.Admission)
+
+	// Someone else relays node1's hello first
+	err = node1.SendHelloMsg(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := fakeNet1.SendMcastUDPArgs.string
+	addr3 := &net.UDPAddr{IP: net.ParseIP("fe80::3"), Port: 8481, Zone: "foo0"}
+
+	err = node2.Handlers([]byte(hello), iface, addr3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins.Pins()) != 0 {
+		t.Fatal("key pinned by an unconfirmed hello: ", pins.Pins())
+	}
+
+	// A replay is rejected before it can do anything
+	err = node2.Handlers([]byte(hello), iface, addr1)
+	if err == nil {
+		t.Fatal("replayed hello accepted")
+	}
+
+	confirmNodes(t, node1, fakeNet1, node2, fakeNet2)
+
+	pin, ok := pins.Pins()[base64.StdEncoding.EncodeToString(node1.Account.PublicKey[:])]
+	if !ok || pin.Address != "fe80::1" {
+		t.Fatalf("key not pinned where it was confirmed: %+v", pins.Pins())
+	}
+}
+
+func TestMaxNeighborsConfirmed(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
+
+	var err error
+	node2.Admission, err = admission.New(admission.Policy{MaxNeighbors: 1}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unconfirmed neighbors don't count
+	other := [ed25519.PublicKeySize]byte{1}
+	node2.Neighbors[other] = &types.Neighbor{PublicKey: other}
+	confirmNodes(t, node1, fakeNet1, node2, fakeNet2)
+	if !node2.Neighbors[node1.Account.PublicKey].Confirmed {
+		t.Fatal("neighbor not confirmed under the cap")
+	}
+
+	// Confirmed ones do
+	delete(node2.Neighbors, node1.Account.PublicKey)
+	node2.Neighbors[other].Confirmed = true
+
+	err = node1.SendHelloMsg(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+	if err == nil || node2.Neighbors[node1.Account.PublicKey] != nil {
+		t.Fatal("neighbor added over the cap")
+	}
+}
+
+func TestEvictUnconfirmed(t *testing.T) {
+	node1, fakeNet1, node2, _ := createNodes()
+
+	now := time.Now()
+	for i := 0; i < MaxUnconfirmed; i++ {
+		publicKey := [ed25519.PublicKeySize]byte{byte(i), byte(i >> 8), 1}
+		node2.Neighbors[publicKey] = &types.Neighbor{
+			PublicKey: publicKey,
+			LastSeen:  now.Add(time.Duration(i) * time.Second),
+		}
+	}
+	// Neighbors we have a channel with are kept however old they are
+	paying := [ed25519.PublicKeySize]byte{2}
+	node2.Neighbors[paying] = &types.Neighbor{PublicKey: paying}
+	node2.Neighbors[paying].Channel.Received = 10
+
+	err := node1.SendHelloMsg(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(node2.Neighbors) != MaxUnconfirmed+1 ||
+		node2.Neighbors[[ed25519.PublicKeySize]byte{0, 0, 1}] != nil ||
+		node2.Neighbors[paying] == nil ||
+		node2.Neighbors[node1.Account.PublicKey] == nil {
+		t.Fatal("wrong neighbor evicted")
+	}
+}
+
+func TestBadSignature(t *testing.T) {
+	node1, fakeNet1, node2, _ := createNodes()
+
+	err := node1.SendHelloMsg(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := fakeNet1.SendMcastUDPArgs.string
+
+	// Mess with the signature
+	msg = msg[:len(msg)-4] + "2" + msg[len(msg)-3:]
+
+	err = node2.Handlers([]byte(msg), iface, addr1)
+	if err == nil {
+		t.Fatal("no signature error")
+	}
+	if err.Error() != "signature not valid" {
+		t.Fatal("wrong error: ", err.Error())
+	}
+}
+
+func TestVoucherMsg(t *testing.T) {
+	node1, fakeNet1, node2, _ := createNodes()
+	backend := &fakePaymentBackend{}
+	node2.PaymentBackend = backend
+
+	node1.Neighbors[node2.Account.PublicKey] = &types.Neighbor{
+		PublicKey: node2.Account.PublicKey,
+	}
+	node2.Neighbors[node1.Account.PublicKey] = &types.Neighbor{
+		PublicKey: node1.Account.PublicKey,
+		Confirmed: true,
+	}
+
+	for _, amount := range []uint64{100, 50} {
+		err := node1.SendVoucherMsg(node2.Account.PublicKey, iface, amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	channel := node2.Neighbors[node1.Account.PublicKey].Channel
+	if channel.Received != 150 {
+		t.Fatal("channel.Received incorrect: ", channel.Received)
+	}
+
+	balance := node2.Ledger.Balance(node1.Account.PublicKey)
+	if balance.Received != 150 {
+		t.Fatal("balance.Received incorrect: ", balance.Received)
+	}
+
+	err := node2.SettleChannels()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(backend.settled) != 1 || backend.settled[0].Amount != 150 {
+		t.Fatalf("wrong settlement: %+v", backend.settled)
+	}
+
+	channel = node2.Neighbors[node1.Account.PublicKey].Channel
+	if channel.Settled != 150 || channel.Closed {
+		t.Fatalf("channel state incorrect: %+v", channel)
+	}
+
+	// Nothing new to redeem
+	err = node2.SettleChannels()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(backend.settled) != 1 {
+		t.Fatal("settled the same voucher twice")
+	}
+}
+
+func TestVoucherNotSent(t *testing.T) {
+	node1, fakeNet1, node2, _ := createNodes()
+
+	node1.Neighbors[node2.Account.PublicKey] = &types.Neighbor{
+		PublicKey: node2.Account.PublicKey,
+	}
+	node2.Neighbors[node1.Account.PublicKey] = &types.Neighbor{
+		PublicKey: node1.Account.PublicKey,
+		Confirmed: true,
+	}
+	channel := &node1.Neighbors[node2.Account.PublicKey].Channel
+
+	// A voucher that didn't go out isn't paid
+	fakeNet1.err = errors.New("network unreachable")
+	err := node1.SendVoucherMsg(node2.Account.PublicKey, iface, 100)
+	if err == nil {
+		t.Fatal("no error when the voucher could not be sent")
+	}
+	if channel.Sent != 0 {
+		t.Fatal("unsent voucher counted: ", channel.Sent)
+	}
+	fakeNet1.err = nil
+
+	err = node1.SendVoucherMsg(node2.Account.PublicKey, iface, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node2.Neighbors[node1.Account.PublicKey].Channel.Received != 100 {
+		t.Fatal("paid twice: ", node2.Neighbors[node1.Account.PublicKey].Channel.Received)
+	}
+
+	err = node1.SendVoucherMsg(node2.Account.PublicKey, iface, math.MaxUint64)
+	if err == nil || channel.Sent != 100 {
+		t.Fatal("voucher amount overflowed: ", channel.Sent)
+	}
+
+	channel.Closed = true
+	err = node1.SendVoucherMsg(node2.Account.PublicKey, iface, 100)
+	if err == nil || channel.Sent != 100 {
+		t.Fatal("paid on a closed channel: ", channel.Sent)
+	}
+}
+
+func TestVoucherUnconfirmed(t *testing.T) {
+	node1, fakeNet1, node2, _ := createNodes()
+
+	node1.Neighbors[node2.Account.PublicKey] = &types.Neighbor{
+		PublicKey: node2.Account.PublicKey,
+	}
+
+	err := node1.SendVoucherMsg(node2.Account.PublicKey, iface, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+	if err == nil || err.Error() != "neighbor not confirmed" {
+		t.Fatal("voucher from unconfirmed neighbor accepted: ", err)
+	}
+
+	// Nothing keeps the neighbor from being evicted
+	if node2.Neighbors[node1.Account.PublicKey].Channel.Received != 0 {
+		t.Fatal("channel opened with unconfirmed neighbor")
+	}
+}
+
+func TestVoucherRecorded(t *testing.T) {
+	node1, fakeNet1, node2, _ := createNodes()
+	store := &fakeStore{}
+	node1.Store = store
+
+	node1.Neighbors[node2.Account.PublicKey] = &types.Neighbor{
+		PublicKey: node2.Account.PublicKey,
+	}
+
+	err := node1.SendVoucherMsg(node2.Account.PublicKey, iface, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.sent[node2.Account.PublicKey] != 100 {
+		t.Fatal("voucher not recorded: ", store.sent)
+	}
+
+	// Nothing goes out unless it was recorded
+	fakeNet1.SendMcastUDPArgs.string = ""
+	store.err = errors.New("disk full")
+	err = node1.SendVoucherMsg(node2.Account.PublicKey, iface, 100)
+	if err == nil {
+		t.Fatal("no error when the voucher could not be recorded")
+	}
+	if fakeNet1.SendMcastUDPArgs.string != "" {
+		t.Fatal("unrecorded voucher sent")
+	}
+	if node1.Neighbors[node2.Account.PublicKey].Channel.Sent != 100 {
+		t.Fatal("unrecorded voucher counted")
+	}
+}
+
+func TestVoucherDecreased(t *testing.T) {
+	node1, fakeNet1, node2, _ := createNodes()
+	backend := &fakePaymentBackend{}
+	node2.PaymentBackend = backend
+
+	node1.Neighbors[node2.Account.PublicKey] = &types.Neighbor{
+		PublicKey: node2.Account.PublicKey,
+	}
+	node2.Neighbors[node1.Account.PublicKey] = &types.Neighbor{
+		PublicKey: node1.Account.PublicKey,
+		Confirmed: true,
+	}
+
+	err := node1.SendVoucherMsg(node2.Account.PublicKey, iface, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Now node1 tries to roll the channel back
+	node1.Neighbors[node2.Account.PublicKey].Channel.Sent = 0
+	err = node1.SendVoucherMsg(node2.Account.PublicKey, iface, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+	if err == nil {
+		t.Fatal("no voucher error returned")
+	}
+
+	if len(backend.settled) != 1 || backend.settled[0].Amount != 100 {
+		t.Fatalf("wrong settlement: %+v", backend.settled)
+	}
+
+	if !node2.Neighbors[node1.Account.PublicKey].Channel.Closed {
+		t.Fatal("channel not closed")
+	}
+
+	err = node1.SendVoucherMsg(node2.Account.PublicKey, iface, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+	if err == nil || err.Error() != "payment channel closed" {
+		t.Fatal("voucher accepted on closed channel: ", err)
+	}
+}
+
+func TestVoucherReordered(t *testing.T) {
+	node1, fakeNet1, node2, _ := createNodes()
+	backend := &fakePaymentBackend{}
+	node2.PaymentBackend = backend
+
+	node1.Neighbors[node2.Account.PublicKey] = &types.Neighbor{
+		PublicKey: node2.Account.PublicKey,
+	}
+	node2.Neighbors[node1.Account.PublicKey] = &types.Neighbor{
+		PublicKey: node1.Account.PublicKey,
+		Confirmed: true,
+	}
+
+	var vouchers []string
+	for _, amount := range []uint64{100, 50} {
+		err := node1.SendVoucherMsg(node2.Account.PublicKey, iface, amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vouchers = append(vouchers, fakeNet1.SendMcastUDPArgs.string)
+	}
+
+	// The older voucher arrives last, and is out of date rather than a
+	// dispute
+	for _, i := range []int{1, 0} {
+		err := node2.Handlers([]byte(vouchers[i]), iface, addr1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	channel := node2.Neighbors[node1.Account.PublicKey].Channel
+	if channel.Closed || channel.Received != 150 {
+		t.Fatalf("channel state incorrect: %+v", channel)
+	}
+	if len(backend.settled) != 0 {
+		t.Fatalf("settled a healthy channel: %+v", backend.settled)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
+	// Rotating changes the account, which the other tests share
+	account := *account1
+	node1.Account = &account
+	oldPublicKey := account.PublicKey
+	oldPrivateKey := account.PrivateKey
+
+	store := &fakeStore{}
+	node2.Store = store
+
+	confirmNodes(t, node1, fakeNet1, node2, fakeNet2)
+
+	err := node1.SendTunnelMsg(node2.Account.PublicKey, iface, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.Handlers([]byte(fakeNet1.SendUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.Ledger.Record(oldPublicKey, ledger.UsageBilled, 500, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newPublicKey, newPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node1.RotateKey([]*net.Interface{iface}, *newPublicKey, *newPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if node1.Account.PublicKey != *newPublicKey {
+		t.Fatal("node1 still using its old key")
+	}
+
+	rotation := fakeNet1.SendUDPArgs.string
+	err = node2.Handlers([]byte(rotation), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if node2.Neighbors[oldPublicKey] != nil {
+		t.Fatal("neighbor record for old key not removed")
+	}
+
+	neighbor := node2.Neighbors[*newPublicKey]
+	if neighbor == nil || neighbor.PublicKey != *newPublicKey {
+		t.Fatal("neighbor record not moved to new key")
+	}
+	if neighbor.Tunnel.PublicKey != "derp" || !neighbor.Confirmed {
+		t.Fatalf("neighbor record incorrect: %+v", neighbor)
+	}
+	if node2.windows[oldPublicKey] != nil || node2.windows[*newPublicKey]["rotate"] == nil {
+		t.Fatal("anti-replay windows not moved to new key")
+	}
+
+	if node2.Ledger.Balance(*newPublicKey).Billed != 500 ||
+		node2.Ledger.Balance(oldPublicKey).Billed != 0 {
+		t.Fatal("balance not moved to new key")
+	}
+
+	if len(store.retired) != 1 || store.retired[0] != oldPublicKey {
+		t.Fatal("old key not stored as retired: ", store.retired)
+	}
+
+	// The new key carries on as the same neighbor
+	err = node1.SendTunnelMsg(node2.Account.PublicKey, iface, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.Handlers([]byte(fakeNet1.SendUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The old key is never accepted again, even in a new hello
+	hello := types.HelloMessage{
+		MessageMetadata: types.MessageMetadata{
+			SourcePublicKey: oldPublicKey,
+			Seqnum:          1000,
+		},
+		SeqnumMode: "counter",
+	}
+	s, err := serialization.FmtHelloMsg(hello, oldPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.Handlers([]byte(s), iface, addr1)
+	if err == nil {
+		t.Fatal("no error for hello from retired key")
+	}
+	if node2.Neighbors[oldPublicKey] != nil {
+		t.Fatal("retired key added back as a neighbor")
+	}
+
+	// Nor is the rotation replayed
+	err = node2.Handlers([]byte(rotation), iface, addr1)
+	if err == nil {
+		t.Fatal("no error for replayed key rotation")
+	}
+}
+
+func TestKeyRotationPin(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
+	account := *account1
+	node1.Account = &account
+	oldPublicKey := account.PublicKey
+
+	var err error
+	node2.Admission, err = admission.New(admission.Policy{Pin: admission.PinAddress}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pins := node2.Admission.(*admission.Admission)
+
+	confirmNodes(t, node1, fakeNet1, node2, fakeNet2)
+
+	newPublicKey, newPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node1.RotateKey([]*net.Interface{iface}, *newPublicKey, *newPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotation := fakeNet1.SendUDPArgs.string
+
+	// Only from where the old key is pinned
+	addr3 := &net.UDPAddr{IP: net.ParseIP("fe80::3"), Port: 8481, Zone: "foo0"}
+	err = node2.Handlers([]byte(rotation), iface, addr3)
+	if err == nil {
+		t.Fatal("rotation accepted from where the old key isn't pinned")
+	}
+
+	err = node2.Handlers([]byte(rotation), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pinned := pins.Pins()
+	if _, ok := pinned[base64.StdEncoding.EncodeToString(oldPublicKey[:])]; ok {
+		t.Fatal("old key still pinned: ", pinned)
+	}
+	pin, ok := pinned[base64.StdEncoding.EncodeToString(newPublicKey[:])]
+	if !ok || pin.Address != "fe80::1" {
+		t.Fatalf("pin not moved to the new key: %+v", pinned)
+	}
+}
+
+func TestKeyRotationCertificate(t *testing.T) {
+	node1, _, _, _ := createNodes()
+	account := *account1
+	node1.Account = &account
+
+	_, authorityPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newPublicKey, newPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		publicKey [ed25519.PublicKeySize]byte
+		kept      bool
+	}{
+		{*newPublicKey, true},
+		{account.PublicKey, false},
+	} {
+		node1.Account.PublicKey = account1.PublicKey
+		node1.Account.PrivateKey = account1.PrivateKey
+		cert := certificate.Issue(test.publicKey, time.Now().Add(time.Hour), nil, *authorityPrivateKey)
+		node1.Account.Certificate = cert.String()
+
+		err = node1.RotateKey([]*net.Interface{iface}, *newPublicKey, *newPrivateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if (node1.Account.Certificate != "") != test.kept {
+			t.Fatalf("certificate kept is %v, should be %v", node1.Account.Certificate != "", test.kept)
+		}
+	}
+}
+
+func TestKeyRotationStoreFails(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
+	account := *account1
+	node1.Account = &account
+	oldPublicKey := account.PublicKey
+
+	confirmNodes(t, node1, fakeNet1, node2, fakeNet2)
+	node2.Store = &fakeStore{err: errors.New("disk full")}
+
+	newPublicKey, newPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node1.RotateKey([]*net.Interface{iface}, *newPublicKey, *newPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.Handlers([]byte(fakeNet1.SendUDPArgs.string), iface, addr1)
+	if err == nil {
+		t.Fatal("no error when the old key could not be retired")
+	}
+
+	if node2.Neighbors[oldPublicKey] == nil || node2.Neighbors[*newPublicKey] != nil {
+		t.Fatal("neighbor moved without retiring the old key")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestKeyRotationJournalFails(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
+	account := *account1
+	node1.Account = &account
+	oldPublicKey := account.PublicKey
+
+	confirmNodes(t, node1, fakeNet1, node2, fakeNet2)
+
+	err := node2.Ledger.Record(oldPublicKey, ledger.UsageBilled, 500, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	node2.Ledger.Journal = failingWriter{}
+
+	newPublicKey, newPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node1.RotateKey([]*net.Interface{iface}, *newPublicKey, *newPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.Handlers([]byte(fakeNet1.SendUDPArgs.string), iface, addr1)
+	if err == nil {
+		t.Fatal("no error when the rotation could not be journaled")
+	}
+
+	// The neighbor and its balance still move together
+	if node2.Neighbors[oldPublicKey] != nil || node2.Neighbors[*newPublicKey] == nil {
+		t.Fatal("neighbor not moved with its balance")
+	}
+	if node2.Ledger.Balance(*newPublicKey).Billed != 500 {
+		t.Fatal("balance not moved with the neighbor")
+	}
+}
+
+func TestRemoveNeighbor(t *testing.T) {
+	node1, fakeNet1, node2, _ := createNodes()
+
+	err := node1.SendHelloMsg(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	neighbor := node2.ListNeighbors()[0]
+	if time.Since(neighbor.LastSeen) > time.Minute {
+		t.Fatal("last seen not set: ", neighbor.LastSeen)
+	}
+
+	tunnels := &fakeTunnels{}
+	node2.Tunnels = tunnels
+	node2.Neighbors[node1.Account.PublicKey].Tunnel.VirtualInterface.Name = "scrooge51820"
+
+	err = node2.RemoveNeighbor(node1.Account.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(node2.ListNeighbors()) != 0 {
+		t.Fatal("neighbor not removed")
+	}
+	if len(tunnels.removed) != 1 || tunnels.removed[0] != "scrooge51820" {
+		t.Fatal("tunnel not taken down: ", tunnels.removed)
+	}
+
+	err = node2.RemoveNeighbor(node1.Account.PublicKey)
+	if err == nil {
+		t.Fatal("no error removing an unknown neighbor")
+	}
+
+	// It is refused for a while
+	err = node1.SendHelloMsg(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+	if err == nil || len(node2.ListNeighbors()) != 0 {
+		t.Fatal("kicked neighbor came straight back")
+	}
+
+	kicked := node2.kicked[node1.Account.PublicKey]
+	kicked.until = time.Now()
+	node2.kicked[node1.Account.PublicKey] = kicked
+
+	err = node1.SendHelloMsg(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(node2.ListNeighbors()) != 1 {
+		t.Fatal("neighbor not let back in")
+	}
+}
+
+func TestRemoveNeighborChannel(t *testing.T) {
+	node1, fakeNet1, node2, _ := createNodes()
+	backend := &fakePaymentBackend{}
+	node2.PaymentBackend = backend
+
+	node1.Neighbors[node2.Account.PublicKey] = &types.Neighbor{
+		PublicKey: node2.Account.PublicKey,
+	}
+	node2.Neighbors[node1.Account.PublicKey] = &types.Neighbor{
+		PublicKey: node1.Account.PublicKey,
+		Confirmed: true,
+	}
+
+	err := node1.SendVoucherMsg(node2.Account.PublicKey, iface, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	voucher := fakeNet1.SendMcastUDPArgs.string
+	err = node2.Handlers([]byte(voucher), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node2.RemoveNeighbor(node1.Account.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.settled) != 1 || backend.settled[0].Amount != 100 {
+		t.Fatalf("channel not settled on removal: %+v", backend.settled)
+	}
+
+	// Kept across a restart
+	removed := node2.RemovedNeighbors()
+	node2.kicked = nil
+	for _, neighbor := range removed {
+		node2.RestoreRemoved(neighbor)
+	}
+
+	err = node1.SendHelloMsg(iface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node2.Neighbors[node1.Account.PublicKey].Confirmed = true
+
+	err = node2.Handlers([]byte(voucher), iface, addr1)
+	if err == nil {
+		t.Fatal("voucher replayed after the neighbor came back")
+	}
+
+	// The next voucher carries on from the old channel
+	err = node1.SendVoucherMsg(node2.Account.PublicKey, iface, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channel := node2.Neighbors[node1.Account.PublicKey].Channel
+	if channel.Received != 150 || channel.Settled != 100 || channel.Closed {
+		t.Fatalf("channel state incorrect: %+v", channel)
+	}
+	if node2.Ledger.Balance(node1.Account.PublicKey).Received != 150 {
+		t.Fatal("payments credited twice: ", node2.Ledger.Balance(node1.Account.PublicKey))
+	}
+}
+
+type fakeMetrics map[string]float64
+
+func (metrics fakeMetrics) Add(name string, value float64, labels ...string) {
+	metrics[strings.Join(append([]string{name}, labels...), " ")] += value
+}
+
+func TestMetrics(t *testing.T) {
+	node1, fakeNet1, node2, _ := createNodes()
+	metrics1, metrics2 := fakeMetrics{}, fakeMetrics{}
+	node1.Metrics = metrics1
+	node2.Metrics = metrics2
+
+	node1.Neighbors[node2.Account.PublicKey] = &types.Neighbor{
+		PublicKey: node2.Account.PublicKey,
+	}
+	node2.Neighbors[node1.Account.PublicKey] = &types.Neighbor{
+		PublicKey: node1.Account.PublicKey,
+		Confirmed: true,
+	}
+
+	for _, amount := range []uint64{100, 50} {
+		err := node1.SendVoucherMsg(node2.Account.PublicKey, iface, amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Replayed
+	node2.Handlers([]byte(fakeNet1.SendMcastUDPArgs.string), iface, addr1)
+
+	msg := fakeNet1.SendMcastUDPArgs.string
+	msg = msg[:len(msg)-4] + "2" + msg[len(msg)-3:]
+	node2.Handlers([]byte(msg), iface, addr1)
+
+	node2.Handlers([]byte("nonsense"), iface, addr1)
+
+	for _, test := range []struct {
+		metrics fakeMetrics
+		series  string
+		value   float64
+	}{
+		{metrics1, "scrooge_messages_sent_total type scrooge_voucher", 2},
+		{metrics1, "scrooge_payments_sent_total", 2},
+		{metrics1, "scrooge_payments_sent_amount_total", 150},
+		{metrics2, "scrooge_messages_received_total type scrooge_voucher", 4},
+		{metrics2, "scrooge_messages_received_total type unknown", 1},
+		{metrics2, "scrooge_payments_received_total", 2},
+		{metrics2, "scrooge_payments_received_amount_total", 150},
+		{metrics2, "scrooge_replay_rejections_total stream voucher", 1},
+		{metrics2, "scrooge_signature_failures_total", 1},
+	} {
+		if test.metrics[test.series] != test.value {
+			t.Errorf("%v is %v, should be %v", test.series, test.metrics[test.series], test.value)
+		}
+	}
+}
+
+type fakeEvents []events.Event
+
+func (self *fakeEvents) Publish(event events.Event) {
+	*self = append(*self, event)
+}
+
+func TestEvents(t *testing.T) {
+	node1, fakeNet1, node2, fakeNet2 := createNodes()
+	published := &fakeEvents{}
+	node1.Events = published
+	node1.Tunnels = &fakeTunnels{}
+
+	confirmNodes(t, node1, fakeNet1, node2, fakeNet2)
+
+	err := node1.SendTunnelMsg(node2.Account.PublicKey, iface, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node2.Handlers([]byte(fakeNet1.SendUDPArgs.string), iface, addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node1.Handlers([]byte(fakeNet2.SendUDPArgs.string), iface, addr2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node1.SendVoucherMsg(node2.Account.PublicKey, iface, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = node1.RemoveNeighbor(node2.Account.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []events.Event{
+		{Type: events.NeighborAdded},
+		{Type: events.NeighborConfirmed},
+		{Type: events.TunnelUp, Endpoint: "[fe80::2%foo0]:51820"},
+		{Type: events.PaymentSent, Amount: 100},
+		{Type: events.NeighborRemoved},
+	}
+	if len(*published) != len(expected) {
+		t.Fatalf("wrong events: %+v", *published)
+	}
+	for i, event := range *published {
+		expected[i].Neighbor = base64.StdEncoding.EncodeToString(node2.Account.PublicKey[:])
+		if event != expected[i] {
+			t.Errorf("event %v is %+v, should be %+v", i, event, expected[i])
+		}
 	}
 }
@@ -1,82 +1,311 @@
 package network
 
 import (
-	"log"
+	"context"
+	"errors"
 	"net"
+	"strconv"
+	"sync"
 )
 
+// MaxMessageSize is the largest message we can receive. Anything longer is
+// truncated and will fail to parse.
+const MaxMessageSize = 1500
+
+var buffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, MaxMessageSize)
+		return &b
+	},
+}
+
+// Transport is how messages get to every neighbor on an interface.
+type Transport string
+
+const (
+	// IPv6 multicasts to ff02::1, the link-local all nodes group.
+	IPv6 Transport = "ipv6"
+	// IPv4Multicast multicasts to 224.0.0.1, the all hosts group, for links
+	// with IPv6 disabled.
+	IPv4Multicast Transport = "ipv4-multicast"
+	// IPv4Broadcast broadcasts to the subnet of the interface's IPv4 address,
+	// for links that don't pass multicast either.
+	IPv4Broadcast Transport = "ipv4-broadcast"
+)
+
+func ParseTransport(s string) (Transport, error) {
+	switch Transport(s) {
+	case IPv6, IPv4Multicast, IPv4Broadcast:
+		return Transport(s), nil
+	}
+	return "", errors.New("unknown transport: " + s)
+}
+
+// Network owns one socket per interface, bound to MulticastPort. The same
+// socket receives multicast (or broadcast) and unicast messages and sends
+// everything we send on that interface.
 type Network struct {
 	MulticastPort int
+	Transports    map[string]Transport // By interface name, IPv6 if not set
+	// Metrics, if set, counts the packets and bytes on every interface
+	Metrics interface {
+		Add(name string, value float64, labels ...string)
+	}
+	links  map[string]*link
+	closed bool
+	mutex  sync.Mutex
 }
 
-// McastListen listens on the multicast UDP address on a given interface.
-func (self *Network) McastListen(
+type link struct {
+	conn *net.UDPConn
+	all  *net.UDPAddr // Where messages for every neighbor go
+}
+
+func (self *Network) transport(iface *net.Interface) Transport {
+	transport, ok := self.Transports[iface.Name]
+	if !ok {
+		return IPv6
+	}
+	return transport
+}
+
+// Open opens the socket for iface, if it isn't open already. Sending and
+// listening open it as needed, but opening it first surfaces errors early.
+func (self *Network) Open(iface *net.Interface) error {
+	_, err := self.link(iface)
+	return err
+}
+
+func (self *Network) link(iface *net.Interface) (*link, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.closed {
+		return nil, errors.New("network closed")
+	}
+
+	l := self.links[iface.Name]
+	if l != nil {
+		return l, nil
+	}
+
+	l, err := self.open(iface, self.transport(iface))
+	if err != nil {
+		return nil, err
+	}
+
+	if self.links == nil {
+		self.links = map[string]*link{}
+	}
+	self.links[iface.Name] = l
+
+	return l, nil
+}
+
+func (self *Network) open(
 	iface *net.Interface,
-	handlers func([]byte, *net.Interface) error,
-	cb func(error),
-) error {
-	conn, err := net.ListenMulticastUDP(
-		"udp6",
-		iface,
-		&net.UDPAddr{
-			IP:   net.ParseIP("ff02::1"),
+	transport Transport,
+) (*link, error) {
+	l := &link{
+		all: &net.UDPAddr{
 			Port: self.MulticastPort,
-			Zone: iface.Name,
 		},
+	}
+
+	var err error
+	switch transport {
+	case IPv6:
+		l.all.IP = net.ParseIP("ff02::1")
+		l.all.Zone = iface.Name
+		l.conn, err = net.ListenMulticastUDP("udp6", iface, l.all)
+	case IPv4Multicast:
+		l.all.IP = net.IPv4allsys
+		l.conn, err = net.ListenMulticastUDP("udp4", iface, l.all)
+	case IPv4Broadcast:
+		l.all.IP, err = broadcastAddr(iface)
+		if err != nil {
+			return nil, err
+		}
+		l.conn, err = listenBroadcast(self.MulticastPort)
+	default:
+		return nil, errors.New("unknown transport: " + string(transport))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = setSockopts(l.conn, iface, transport)
+	if err != nil {
+		l.conn.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// broadcastAddr returns the broadcast address of the subnet of the first
+// IPv4 address on iface.
+func broadcastAddr(iface *net.Interface) (net.IP, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil {
+			continue
+		}
+
+		return subnetBroadcast(ipnet), nil
+	}
+
+	return nil, errors.New("no IPv4 address on " + iface.Name)
+}
+
+func subnetBroadcast(ipnet *net.IPNet) net.IP {
+	ip := ipnet.IP.To4()
+	mask := ipnet.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range ip {
+		broadcast[i] = ip[i] | ^mask[i]
+	}
+	return broadcast
+}
+
+func listenBroadcast(port int) (*net.UDPConn, error) {
+	config := net.ListenConfig{
+		Control: reuseAddr,
+	}
+
+	conn, err := config.ListenPacket(
+		context.Background(),
+		"udp4",
+		":"+strconv.Itoa(port),
 	)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// Close closes every socket. Listeners return and sends fail from then on.
+func (self *Network) Close() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.closed = true
+
+	var err error
+	for name, l := range self.links {
+		closeErr := l.conn.Close()
+		if err == nil {
+			err = closeErr
+		}
+		delete(self.links, name)
+	}
+	return err
+}
+
+// McastListen receives messages on a given interface until the network is
+// closed. The handlers are given the address of the sender, and must not
+// keep the message after they return.
+func (self *Network) McastListen(
+	iface *net.Interface,
+	handlers func([]byte, *net.Interface, *net.UDPAddr) error,
+	cb func(error),
+) error {
+	l, err := self.link(iface)
 	if err != nil {
 		return err
 	}
 
 	for {
-		var b = make([]byte, 1500)
-		offset, _, err := conn.ReadFromUDP(b)
+		b := buffers.Get().(*[]byte)
+		offset, addr, err := l.conn.ReadFromUDP(*b)
 
+		if errors.Is(err, net.ErrClosed) {
+			buffers.Put(b)
+			return nil
+		}
 		if err != nil {
+			buffers.Put(b)
+			self.count("scrooge_network_errors_total", 1, "interface", iface.Name, "op", "receive")
 			cb(err)
 			continue
 		}
-		cb(handlers(b[:offset], iface))
-	}
 
-	return nil
+		self.count("scrooge_packets_received_total", 1, "interface", iface.Name)
+		self.count("scrooge_received_bytes_total", float64(offset), "interface", iface.Name)
+
+		// Neighbors send from their own socket, which is bound to the same
+		// port as ours, but make sure replies go to the port they listen on.
+		// The socket only sees messages that came in on iface, so that is
+		// the zone, even for IPv4 addresses, which don't carry one.
+		source := &net.UDPAddr{
+			IP:   addr.IP,
+			Port: self.MulticastPort,
+			Zone: iface.Name,
+		}
+		cb(handlers((*b)[:offset], iface, source))
+		buffers.Put(b)
+	}
 }
 
+// SendUDP sends s to addr from the socket of the interface in addr's zone.
 func (self *Network) SendUDP(
 	addr *net.UDPAddr,
 	s string,
 ) error {
-	conn, err := net.DialUDP(
-		"udp6",
-		nil,
-		addr,
-	)
+	if addr.Zone == "" {
+		return errors.New("no interface to send to " + addr.String())
+	}
+
+	iface, err := net.InterfaceByName(addr.Zone)
 	if err != nil {
 		return err
 	}
 
-	defer conn.Close()
-
-	_, err = conn.Write([]byte(s))
+	l, err := self.link(iface)
 	if err != nil {
 		return err
 	}
 
-	log.Println("sent: " + s)
-	return nil
+	_, err = l.conn.WriteToUDP([]byte(s), addr)
+	self.countSent(iface, s, err)
+	return err
 }
 
+// SendMulticastUDP sends s to every neighbor on iface.
 func (self *Network) SendMulticastUDP(
 	iface *net.Interface,
 	s string,
 ) error {
-	err := self.SendUDP(&net.UDPAddr{
-		IP:   net.ParseIP("ff02::1"),
-		Port: self.MulticastPort,
-		Zone: iface.Name,
-	}, s)
+	l, err := self.link(iface)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	_, err = l.conn.WriteToUDP([]byte(s), l.all)
+	self.countSent(iface, s, err)
+	return err
+}
+
+func (self *Network) countSent(iface *net.Interface, s string, err error) {
+	if err != nil {
+		self.count("scrooge_network_errors_total", 1, "interface", iface.Name, "op", "send")
+		return
+	}
+	self.count("scrooge_packets_sent_total", 1, "interface", iface.Name)
+	self.count("scrooge_sent_bytes_total", float64(len(s)), "interface", iface.Name)
+}
+
+func (self *Network) count(name string, value float64, labels ...string) {
+	if self.Metrics != nil {
+		self.Metrics.Add(name, value, labels...)
+	}
 }
@@ -0,0 +1,260 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+var transports = []Transport{IPv6, IPv4Multicast, IPv4Broadcast}
+
+// testInterface returns an interface that can use transport and an address
+// of ours on it, or skips the test if there isn't one.
+func testInterface(
+	t *testing.T,
+	transport Transport,
+) (*net.Interface, *net.UDPAddr) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range ifaces {
+		iface := &ifaces[i]
+		if iface.Flags&net.FlagUp == 0 ||
+			iface.Flags&net.FlagLoopback != 0 ||
+			iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+
+			ipv4 := ipnet.IP.To4() != nil
+			if transport == IPv6 && (ipv4 || !ipnet.IP.IsLinkLocalUnicast()) ||
+				transport != IPv6 && !ipv4 {
+				continue
+			}
+
+			return iface, &net.UDPAddr{
+				IP:   ipnet.IP,
+				Port: 48481,
+				Zone: iface.Name,
+			}
+		}
+	}
+
+	t.Skip("no interface for ", transport)
+	return nil, nil
+}
+
+type received struct {
+	msg    string
+	source *net.UDPAddr
+}
+
+func listen(t *testing.T, network *Network, iface *net.Interface) chan received {
+	ch := make(chan received, 1)
+	go network.McastListen(
+		iface,
+		func(b []byte, iface *net.Interface, source *net.UDPAddr) error {
+			ch <- received{string(b), source}
+			return nil
+		},
+		func(err error) {
+			if err != nil {
+				t.Error(err)
+			}
+		},
+	)
+	return ch
+}
+
+func receive(t *testing.T, ch chan received) received {
+	select {
+	case r := <-ch:
+		return r
+	case <-time.After(2 * time.Second):
+		t.Fatal("nothing received")
+	}
+	return received{}
+}
+
+func TestParseTransport(t *testing.T) {
+	transport, err := ParseTransport("ipv4-broadcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport != IPv4Broadcast {
+		t.Fatal("wrong transport: ", transport)
+	}
+
+	_, err = ParseTransport("ipx")
+	if err == nil {
+		t.Fatal("no error for unknown transport")
+	}
+}
+
+func TestSubnetBroadcast(t *testing.T) {
+	tests := []struct {
+		cidr      string
+		broadcast string
+	}{
+		{"192.0.2.2/24", "192.0.2.255"},
+		{"10.1.2.3/8", "10.255.255.255"},
+		{"172.16.5.4/30", "172.16.5.7"},
+	}
+
+	for _, test := range tests {
+		ip, ipnet, err := net.ParseCIDR(test.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ipnet.IP = ip
+
+		broadcast := subnetBroadcast(ipnet)
+		if !broadcast.Equal(net.ParseIP(test.broadcast)) {
+			t.Errorf("%v: broadcast %v, should be %v", test.cidr, broadcast, test.broadcast)
+		}
+	}
+}
+
+func TestMcastListen(t *testing.T) {
+	for _, transport := range transports {
+		transport := transport
+		t.Run(string(transport), func(t *testing.T) {
+			iface, _ := testInterface(t, transport)
+
+			receiver := &Network{
+				MulticastPort: 48481,
+				Transports:    map[string]Transport{iface.Name: transport},
+			}
+
+			defer receiver.Close()
+
+			err := receiver.Open(iface)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ch := listen(t, receiver, iface)
+
+			// Our own sockets don't loop multicast back, so send from a plain
+			// one, on another port like an old neighbor that dials per message
+			all := receiver.links[iface.Name].all
+			network := "udp6"
+			if all.IP.To4() != nil {
+				network = "udp4"
+			}
+
+			conn, err := net.ListenUDP(network, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			_, err = conn.WriteToUDP([]byte("scrooge_hello"), all)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := receive(t, ch)
+			if r.msg != "scrooge_hello" {
+				t.Fatal("wrong message: ", r.msg)
+			}
+			if r.source.Port != 48481 || r.source.Zone != iface.Name {
+				t.Fatal("wrong source: ", r.source)
+			}
+		})
+	}
+}
+
+func TestSendUDP(t *testing.T) {
+	for _, transport := range transports {
+		transport := transport
+		t.Run(string(transport), func(t *testing.T) {
+			iface, addr := testInterface(t, transport)
+
+			receiver := &Network{
+				MulticastPort: 48481,
+				Transports:    map[string]Transport{iface.Name: transport},
+			}
+
+			defer receiver.Close()
+
+			err := receiver.Open(iface)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ch := listen(t, receiver, iface)
+
+			sender := &Network{
+				MulticastPort: 48482,
+				Transports:    map[string]Transport{iface.Name: transport},
+			}
+			defer sender.Close()
+
+			for _, msg := range []string{"scrooge_tunnel", "scrooge_voucher"} {
+				err = sender.SendUDP(addr, msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				r := receive(t, ch)
+				if r.msg != msg {
+					t.Fatal("wrong message: ", r.msg)
+				}
+				if !r.source.IP.Equal(addr.IP) {
+					t.Fatal("wrong source: ", r.source)
+				}
+			}
+
+			if len(sender.links) != 1 {
+				t.Fatal("socket not reused: ", len(sender.links))
+			}
+		})
+	}
+}
+
+func TestClose(t *testing.T) {
+	iface, _ := testInterface(t, IPv6)
+
+	network := &Network{MulticastPort: 48481}
+
+	done := make(chan error)
+	go func() {
+		done <- network.McastListen(
+			iface,
+			func([]byte, *net.Interface, *net.UDPAddr) error { return nil },
+			func(error) {},
+		)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	err := network.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("listener still running after Close")
+	}
+
+	err = network.SendMulticastUDP(iface, "scrooge_hello")
+	if err == nil {
+		t.Fatal("no error sending on closed network")
+	}
+}
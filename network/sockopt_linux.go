@@ -0,0 +1,84 @@
+//go:build linux
+
+package network
+
+import (
+	"net"
+	"syscall"
+)
+
+// setSockopts ties conn to iface, so that it only sees packets that came in
+// on iface, even though every interface's socket is bound to the same port.
+// Our messages are only meant for neighbors on the link, so they are sent
+// with a hop limit of 1.
+func setSockopts(
+	conn *net.UDPConn,
+	iface *net.Interface,
+	transport Transport,
+) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var options []struct {
+		level, name, value int
+	}
+	switch transport {
+	case IPv6:
+		options = []struct {
+			level, name, value int
+		}{
+			{syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, iface.Index},
+			{syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, 1},
+			{syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, 1},
+		}
+	case IPv4Multicast:
+		options = []struct {
+			level, name, value int
+		}{
+			{syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, 1},
+			{syscall.IPPROTO_IP, syscall.IP_TTL, 1},
+		}
+	case IPv4Broadcast:
+		options = []struct {
+			level, name, value int
+		}{
+			{syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1},
+			{syscall.IPPROTO_IP, syscall.IP_TTL, 1},
+		}
+	}
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface.Name)
+		if sockErr == nil && transport == IPv4Multicast {
+			sockErr = syscall.SetsockoptIPMreqn(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, &syscall.IPMreqn{
+				Ifindex: int32(iface.Index),
+			})
+		}
+		for _, option := range options {
+			if sockErr != nil {
+				return
+			}
+			sockErr = syscall.SetsockoptInt(int(fd), option.level, option.name, option.value)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// reuseAddr lets the broadcast sockets of several interfaces bind the same
+// port. Multicast sockets get this from the net package already.
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package network
+
+import (
+	"net"
+	"syscall"
+)
+
+// setSockopts does nothing outside of Linux. Every destination we send to
+// carries the interface as its zone, which picks the interface instead.
+func setSockopts(
+	conn *net.UDPConn,
+	iface *net.Interface,
+	transport Transport,
+) error {
+	return nil
+}
+
+// reuseAddr does nothing outside of Linux, so only one interface can use
+// IPv4 broadcast there.
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	return nil
+}
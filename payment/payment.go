@@ -0,0 +1,24 @@
+package payment
+
+import (
+	"encoding/base64"
+
+	"github.com/incentivized-mesh-infrastructure/scrooge/logging"
+	"github.com/incentivized-mesh-infrastructure/scrooge/types"
+)
+
+var logger = logging.Logger("payment")
+
+// LogBackend stands in for a real payment network. It accepts every
+// settlement and only logs the voucher that would have been redeemed.
+type LogBackend struct{}
+
+func (self *LogBackend) Settle(voucher *types.VoucherMessage) error {
+	logger.Info(
+		"settled voucher",
+		"neighbor", base64.StdEncoding.EncodeToString(voucher.SourcePublicKey[:]),
+		"amount", voucher.Amount,
+		"seqnum", voucher.Seqnum,
+	)
+	return nil
+}
@@ -0,0 +1,137 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultMaxKeys is how many buckets a Limiter keeps if MaxKeys isn't set.
+const DefaultMaxKeys = 10000
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter keeps a token bucket for every key, like a source address or a
+// public key. Every bucket starts full with Burst tokens, and gets Rate
+// tokens back every second. A message is allowed if it can take a token.
+type Limiter struct {
+	Rate    float64 // Tokens per second, no limit if 0
+	Burst   float64 // Most tokens a bucket holds
+	MaxKeys int     // Most buckets kept at once, so spoofed keys can't use up our memory
+	buckets map[string]*bucket
+	dropped uint64
+	pruned  time.Time
+	mutex   sync.Mutex
+}
+
+func New(rate float64, burst float64) *Limiter {
+	return &Limiter{
+		Rate:  rate,
+		Burst: burst,
+	}
+}
+
+// Allow takes a token from the bucket for key, and returns false if there
+// wasn't one.
+func (self *Limiter) Allow(key string, now time.Time) bool {
+	if self == nil {
+		return true
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.Rate == 0 {
+		return true
+	}
+
+	if self.buckets == nil {
+		self.buckets = map[string]*bucket{}
+	}
+
+	b := self.buckets[key]
+	if b == nil {
+		// Pruning goes through every bucket, so a flood of new keys can
+		// only make us do it once a second
+		if len(self.buckets) >= self.maxKeys() && now.Sub(self.pruned) >= time.Second {
+			self.prune(now)
+			self.pruned = now
+		}
+		// Every bucket is still in use, so new keys have to wait
+		if len(self.buckets) >= self.maxKeys() {
+			self.dropped++
+			return false
+		}
+
+		b = &bucket{
+			tokens: self.Burst,
+			last:   now,
+		}
+		self.buckets[key] = b
+	}
+
+	b.tokens = self.refill(b, now)
+	b.last = now
+
+	if b.tokens < 1 {
+		self.dropped++
+		return false
+	}
+
+	b.tokens = b.tokens - 1
+	return true
+}
+
+// SetRate changes Rate and Burst while the limiter is in use. Buckets keep
+// their tokens, up to the new burst.
+func (self *Limiter) SetRate(rate float64, burst float64) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.Rate = rate
+	self.Burst = burst
+	for _, b := range self.buckets {
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+}
+
+// Dropped returns how many messages Allow has turned away.
+func (self *Limiter) Dropped() uint64 {
+	if self == nil {
+		return 0
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.dropped
+}
+
+func (self *Limiter) maxKeys() int {
+	if self.MaxKeys == 0 {
+		return DefaultMaxKeys
+	}
+	return self.MaxKeys
+}
+
+func (self *Limiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*self.Rate
+	if tokens > self.Burst {
+		return self.Burst
+	}
+	return tokens
+}
+
+// prune forgets buckets that have filled up again, since a new bucket would
+// be the same.
+func (self *Limiter) prune(now time.Time) {
+	for key, b := range self.buckets {
+		if self.refill(b, now) >= self.Burst {
+			delete(self.buckets, key)
+		}
+	}
+}
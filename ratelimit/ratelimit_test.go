@@ -0,0 +1,117 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+var now = time.Date(2018, 1, 11, 0, 0, 0, 0, time.UTC)
+
+func TestAllow(t *testing.T) {
+	limiter := New(2, 3)
+	at := now
+
+	tests := []struct {
+		name    string
+		key     string
+		elapsed time.Duration
+		allowed bool
+	}{
+		{"burst 1", "a", 0, true},
+		{"burst 2", "a", 0, true},
+		{"burst 3", "a", 0, true},
+		{"burst used up", "a", 0, false},
+		{"other key", "b", 0, true},
+		{"half a token back", "a", 250 * time.Millisecond, false},
+		{"a whole token back", "a", 250 * time.Millisecond, true},
+		{"no more than burst", "a", time.Hour, true},
+		{"no more than burst 2", "a", 0, true},
+		{"no more than burst 3", "a", 0, true},
+		{"no more than burst 4", "a", 0, false},
+	}
+
+	for _, test := range tests {
+		at = at.Add(test.elapsed)
+		if limiter.Allow(test.key, at) != test.allowed {
+			t.Errorf("%v: should be %v", test.name, test.allowed)
+		}
+	}
+
+	if limiter.Dropped() != 3 {
+		t.Fatal("wrong number of drops: ", limiter.Dropped())
+	}
+}
+
+func TestAllowUnlimited(t *testing.T) {
+	var limiter *Limiter
+	for i := 0; i < 100; i++ {
+		if !limiter.Allow("a", now) {
+			t.Fatal("nil limiter dropped a message")
+		}
+	}
+
+	limiter = New(0, 0)
+	for i := 0; i < 100; i++ {
+		if !limiter.Allow("a", now) {
+			t.Fatal("limiter without a rate dropped a message")
+		}
+	}
+}
+
+func TestSetRate(t *testing.T) {
+	limiter := New(1, 3)
+	limiter.Allow("a", now)
+
+	limiter.SetRate(1, 1)
+	if !limiter.Allow("a", now) {
+		t.Fatal("token dropped")
+	}
+	if limiter.Allow("a", now) {
+		t.Fatal("bucket kept more than the new burst")
+	}
+
+	limiter.SetRate(0, 0)
+	if !limiter.Allow("a", now) {
+		t.Fatal("limit not lifted")
+	}
+}
+
+func TestMaxKeys(t *testing.T) {
+	limiter := New(1, 1)
+	limiter.MaxKeys = 2
+
+	if !limiter.Allow("a", now) || !limiter.Allow("b", now) {
+		t.Fatal("new keys dropped")
+	}
+
+	// Both buckets are empty, so neither can be forgotten
+	if limiter.Allow("c", now) {
+		t.Fatal("more than MaxKeys buckets")
+	}
+
+	// Once they have filled up again they make room for new keys
+	if !limiter.Allow("c", now.Add(time.Second)) {
+		t.Fatal("full buckets not pruned")
+	}
+	if len(limiter.buckets) != 1 {
+		t.Fatal("wrong number of buckets: ", len(limiter.buckets))
+	}
+}
+
+func TestPruneOncePerSecond(t *testing.T) {
+	limiter := New(10, 1)
+	limiter.MaxKeys = 1
+
+	if !limiter.Allow("a", now) || limiter.Allow("b", now) {
+		t.Fatal("wrong result under MaxKeys")
+	}
+
+	// "a" has filled up again, but we only just pruned
+	if limiter.Allow("b", now.Add(500*time.Millisecond)) {
+		t.Fatal("pruned twice in a second")
+	}
+
+	if !limiter.Allow("b", now.Add(time.Second)) {
+		t.Fatal("not pruned after a second")
+	}
+}
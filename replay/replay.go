@@ -0,0 +1,194 @@
+package replay
+
+import (
+	"errors"
+	"time"
+)
+
+// Mode is how a node picks its seqnums. Every node announces its mode in its
+// hellos, and neighbors check its seqnums accordingly.
+type Mode string
+
+const (
+	// Counter seqnums count up from 1. They have to be stored to survive a
+	// restart, or neighbors will reject everything we send.
+	Counter Mode = "counter"
+	// Time seqnums are unix nanoseconds. They keep going up across restarts
+	// as long as the clock does, and neighbors reject seqnums too far from
+	// their own clock, so a neighbor that lost its state can't be replayed
+	// old messages.
+	Time Mode = "time"
+	// Epoch seqnums hold the unix time the node started in the high 32 bits
+	// and a counter in the low 32 bits. Comparing them as numbers compares
+	// the epoch first and the counter second.
+	Epoch Mode = "epoch"
+)
+
+func ParseMode(s string) (Mode, error) {
+	switch Mode(s) {
+	case Counter, Time, Epoch:
+		return Mode(s), nil
+	}
+	return "", errors.New("unknown seqnum mode: " + s)
+}
+
+// EpochStart returns the seqnum to start from in Epoch mode. It waits for
+// the next full second, so that two runs can never share an epoch.
+func EpochStart() uint64 {
+	now := time.Now()
+	next := now.Truncate(time.Second).Add(time.Second)
+	time.Sleep(next.Sub(now))
+
+	return uint64(next.Unix()) << 32
+}
+
+// Next returns the seqnum that follows last.
+func Next(mode Mode, last uint64, now time.Time) uint64 {
+	if mode == Time && uint64(now.UnixNano()) > last {
+		return uint64(now.UnixNano())
+	}
+	return last + 1
+}
+
+// WindowSize is how far behind the highest counter or epoch seqnum a
+// message may arrive and still be accepted.
+const WindowSize = 64
+
+// Window is an anti-replay window like the one IPsec uses (RFC 4303). It
+// accepts every seqnum once, even when messages arrive out of order, as long
+// as they are not too far behind the highest one seen.
+type Window struct {
+	Highest uint64
+	Bitmap  uint64   // Bit n is set once Highest-n has been seen
+	Recent  []uint64 // Time seqnums seen within the clock skew window
+	// Floor is the highest seqnum seen before the window was started, on
+	// any stream. Nothing at or below it is accepted, since the window
+	// can't tell whether it was seen.
+	Floor uint64
+}
+
+// Update returns an error if a neighbor using mode should not have sent
+// seqnum, and marks seqnum as seen otherwise.
+func (self *Window) Update(
+	mode Mode,
+	seqnum uint64,
+	now time.Time,
+	skew time.Duration,
+) error {
+	if seqnum == 0 || seqnum <= self.Floor {
+		return errors.New("sequence number too low")
+	}
+
+	err := CheckClock(mode, seqnum, now, skew)
+	if err != nil {
+		return err
+	}
+
+	// Time seqnums are nanoseconds apart, so a bitmap can't cover any
+	// useful window. The clock skew check bounds how many we remember.
+	if mode == Time {
+		return self.updateRecent(seqnum, now, skew)
+	}
+	return self.updateBitmap(seqnum)
+}
+
+func (self *Window) updateBitmap(seqnum uint64) error {
+	if seqnum > self.Highest {
+		shift := seqnum - self.Highest
+		if shift >= WindowSize {
+			self.Bitmap = 0
+		} else {
+			self.Bitmap = self.Bitmap << shift
+		}
+		self.Bitmap = self.Bitmap | 1
+		self.Highest = seqnum
+		return nil
+	}
+
+	if self.Highest-seqnum >= WindowSize {
+		return errors.New("sequence number too low")
+	}
+
+	bit := uint64(1) << (self.Highest - seqnum)
+	if self.Bitmap&bit != 0 {
+		return errors.New("sequence number already seen")
+	}
+
+	self.Bitmap = self.Bitmap | bit
+	return nil
+}
+
+func (self *Window) updateRecent(
+	seqnum uint64,
+	now time.Time,
+	skew time.Duration,
+) error {
+	for _, seen := range self.Recent {
+		if seen == seqnum {
+			return errors.New("sequence number already seen")
+		}
+	}
+
+	cutoff := uint64(now.Add(-skew).UnixNano())
+	recent := make([]uint64, 0, len(self.Recent)+1)
+	for _, seen := range self.Recent {
+		if seen >= cutoff {
+			recent = append(recent, seen)
+		}
+	}
+	self.Recent = append(recent, seqnum)
+
+	if seqnum > self.Highest {
+		self.Highest = seqnum
+	}
+	return nil
+}
+
+// CheckResume returns an error if a node that has already used seqnums up
+// to reserved, in any mode, can't carry on above them in mode. Counter
+// seqnums carry on from reserved. Time seqnums would have to stay above
+// reserved, and after epoch seqnums that is far ahead of the clock, where
+// every neighbor would reject them. Epoch seqnums start at the next second,
+// which is below reserved if the clock has gone back.
+func CheckResume(
+	mode Mode,
+	reserved uint64,
+	now time.Time,
+	skew time.Duration,
+) error {
+	switch mode {
+	case Time:
+		if reserved > uint64(now.Add(skew).UnixNano()) {
+			return errors.New("seqnums already used are ahead of the clock, keep the epoch or counter seqnum mode")
+		}
+	case Epoch:
+		if uint64(now.Unix()+1)<<32 <= reserved {
+			return errors.New("seqnums already used are from a later epoch, keep the counter seqnum mode or fix the clock")
+		}
+	}
+	return nil
+}
+
+// CheckClock returns an error if seqnum is too far off our clock for a
+// neighbor using mode.
+func CheckClock(
+	mode Mode,
+	seqnum uint64,
+	now time.Time,
+	skew time.Duration,
+) error {
+	switch mode {
+	case Time:
+		sent := time.Unix(0, int64(seqnum))
+		if sent.Before(now.Add(-skew)) || sent.After(now.Add(skew)) {
+			return errors.New("sequence number outside of clock skew window")
+		}
+	case Epoch:
+		started := time.Unix(int64(seqnum>>32), 0)
+		if started.After(now.Add(skew)) {
+			return errors.New("sequence number epoch in the future")
+		}
+	}
+
+	return nil
+}
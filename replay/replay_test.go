@@ -0,0 +1,193 @@
+package replay
+
+import (
+	"testing"
+	"time"
+)
+
+var now = time.Date(2018, 1, 11, 0, 0, 0, 0, time.UTC)
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		name string
+		mode Mode
+		last uint64
+		next uint64
+	}{
+		{"counter", Counter, 16, 17},
+		{"time", Time, 16, uint64(now.UnixNano())},
+		{"time with clock behind", Time, uint64(now.UnixNano()) + 5, uint64(now.UnixNano()) + 6},
+		{"epoch", Epoch, uint64(now.Unix())<<32 | 16, uint64(now.Unix())<<32 | 17},
+	}
+
+	for _, test := range tests {
+		next := Next(test.mode, test.last, now)
+		if next != test.next {
+			t.Errorf("%v: next %v, should be %v", test.name, next, test.next)
+		}
+	}
+}
+
+func TestCheckClock(t *testing.T) {
+	epoch := uint64(now.Unix()) << 32
+	skew := 30 * time.Second
+
+	tests := []struct {
+		name   string
+		mode   Mode
+		seqnum uint64
+		valid  bool
+	}{
+		{"counter", Counter, 17, true},
+		{"time", Time, uint64(now.Add(-10 * time.Second).UnixNano()), true},
+		{"time too old", Time, uint64(now.Add(-time.Minute).UnixNano()), false},
+		{"time in the future", Time, uint64(now.Add(time.Minute).UnixNano()), false},
+		{"epoch", Epoch, epoch | 1, true},
+		{"epoch in the future", Epoch, (epoch + 3600<<32) | 1, false},
+	}
+
+	for _, test := range tests {
+		err := CheckClock(test.mode, test.seqnum, now, skew)
+		if (err == nil) != test.valid {
+			t.Errorf("%v: wrong result: %v", test.name, err)
+		}
+	}
+}
+
+func TestWindow(t *testing.T) {
+	epoch := uint64(now.Unix()) << 32
+	second := uint64(time.Second)
+	nowNano := uint64(now.UnixNano())
+	skew := 30 * time.Second
+
+	tests := []struct {
+		name    string
+		mode    Mode
+		seqnums []uint64
+		valid   []bool
+	}{
+		{"in order", Counter, []uint64{1, 2, 3}, []bool{true, true, true}},
+		{"zero", Counter, []uint64{0}, []bool{false}},
+		{"reordered", Counter, []uint64{2, 1, 3}, []bool{true, true, true}},
+		{"gaps", Counter, []uint64{1, 10, 5, 70}, []bool{true, true, true, true}},
+		{"duplicate", Counter, []uint64{1, 2, 1}, []bool{true, true, false}},
+		{"duplicate of highest", Counter, []uint64{1, 2, 2}, []bool{true, true, false}},
+		{"edge of window", Counter, []uint64{100, 37, 36}, []bool{true, true, false}},
+		{"window moved past", Counter, []uint64{5, 100, 6}, []bool{true, true, false}},
+		{"epoch after restart", Epoch, []uint64{epoch | 500, (epoch + 1<<32) | 1, epoch | 501}, []bool{true, true, false}},
+		{"time reordered", Time, []uint64{nowNano, nowNano - second, nowNano + second}, []bool{true, true, true}},
+		{"time duplicate", Time, []uint64{nowNano - second, nowNano, nowNano - second}, []bool{true, true, false}},
+		{"time too old", Time, []uint64{nowNano - 40*second}, []bool{false}},
+	}
+
+	for _, test := range tests {
+		window := &Window{}
+		for i, seqnum := range test.seqnums {
+			err := window.Update(test.mode, seqnum, now, skew)
+			if (err == nil) != test.valid[i] {
+				t.Errorf("%v: wrong result for seqnum %v: %v", test.name, seqnum, err)
+			}
+		}
+	}
+}
+
+func TestWindowFloor(t *testing.T) {
+	skew := 30 * time.Second
+	nowNano := uint64(now.UnixNano())
+
+	for _, mode := range []Mode{Counter, Time} {
+		floor := uint64(100)
+		if mode == Time {
+			floor = nowNano
+		}
+		window := &Window{Floor: floor}
+
+		for _, seqnum := range []uint64{floor - 1, floor} {
+			err := window.Update(mode, seqnum, now, skew)
+			if err == nil {
+				t.Errorf("%v: seqnum %v at or below the floor accepted", mode, seqnum)
+			}
+		}
+
+		err := window.Update(mode, floor+1, now, skew)
+		if err != nil {
+			t.Errorf("%v: seqnum above the floor rejected: %v", mode, err)
+		}
+	}
+}
+
+func TestWindowForgetsOldTimes(t *testing.T) {
+	window := &Window{}
+	skew := 30 * time.Second
+
+	for i := 0; i < 10; i++ {
+		sent := now.Add(time.Duration(i) * 10 * time.Second)
+		err := window.Update(Time, uint64(sent.UnixNano()), sent, skew)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(window.Recent) > 4 {
+		t.Fatal("old time seqnums not forgotten: ", len(window.Recent))
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	mode, err := ParseMode("epoch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode != Epoch {
+		t.Fatal("wrong mode: ", mode)
+	}
+
+	_, err = ParseMode("lamport")
+	if err == nil {
+		t.Fatal("no error for unknown mode")
+	}
+}
+
+func TestCheckResume(t *testing.T) {
+	epoch := uint64(now.Unix())<<32 + 5
+	skew := 30 * time.Second
+
+	err := CheckResume(Time, epoch, now, skew)
+	if err == nil {
+		t.Fatal("time seqnums accepted after epoch seqnums")
+	}
+
+	for _, mode := range []Mode{Counter, Epoch} {
+		err = CheckResume(mode, epoch, now, skew)
+		if err != nil {
+			t.Fatal(mode, err)
+		}
+	}
+
+	err = CheckResume(Time, uint64(now.Add(skew/2).UnixNano()), now, skew)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CheckResume(Time, 0, now, skew)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Counter seqnums carry on above time seqnums, epoch ones only once
+	// the clock has caught up
+	timeSeqnum := uint64(now.UnixNano())
+	err = CheckResume(Counter, timeSeqnum, now, skew)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CheckResume(Epoch, timeSeqnum, now, skew)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	later := uint64(now.Add(time.Hour).Unix()) << 32
+	err = CheckResume(Epoch, later, now, skew)
+	if err == nil {
+		t.Fatal("epoch seqnums accepted below ones already used")
+	}
+}
@@ -0,0 +1,832 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/agl/ed25519"
+	"github.com/incentivized-mesh-infrastructure/scrooge/admission"
+	"github.com/incentivized-mesh-infrastructure/scrooge/certificate"
+	"github.com/incentivized-mesh-infrastructure/scrooge/config"
+	"github.com/incentivized-mesh-infrastructure/scrooge/events"
+	"github.com/incentivized-mesh-infrastructure/scrooge/keystore"
+	"github.com/incentivized-mesh-infrastructure/scrooge/ledger"
+	"github.com/incentivized-mesh-infrastructure/scrooge/logging"
+	"github.com/incentivized-mesh-infrastructure/scrooge/managementAPI"
+	"github.com/incentivized-mesh-infrastructure/scrooge/metrics"
+	"github.com/incentivized-mesh-infrastructure/scrooge/neighborAPI"
+	"github.com/incentivized-mesh-infrastructure/scrooge/network"
+	"github.com/incentivized-mesh-infrastructure/scrooge/payment"
+	"github.com/incentivized-mesh-infrastructure/scrooge/ratelimit"
+	"github.com/incentivized-mesh-infrastructure/scrooge/replay"
+	"github.com/incentivized-mesh-infrastructure/scrooge/scheduler"
+	"github.com/incentivized-mesh-infrastructure/scrooge/store"
+	"github.com/incentivized-mesh-infrastructure/scrooge/throttle"
+	"github.com/incentivized-mesh-infrastructure/scrooge/types"
+	"github.com/incentivized-mesh-infrastructure/scrooge/wireguard"
+)
+
+var logger = logging.Logger("node")
+
+const runUsage = `Usage: scrooge run [flags]
+
+Runs the node: finds neighbors on the interfaces, sets tunnels up with them
+and pays and bills them for traffic. Every flag can also be set in the
+config file, under the same name.
+
+Flags:
+`
+
+// runCommand runs the node until it is stopped with SIGINT or SIGTERM.
+func runCommand(args []string) error {
+	settings := config.Default()
+	flags := flag.NewFlagSet("scrooge run", flag.ExitOnError)
+	settings.Flags(flags)
+	configFile := flags.String("config", "", "TOML file with the settings, read again on SIGHUP. Flags given on the command line win over it")
+	rotateIdentity := flags.Bool("rotateIdentity", false, "Rotate to the next-identity key at startup, telling every neighbor in the state file")
+	setUsage(flags, runUsage)
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		return errors.New("run takes no arguments, only flags")
+	}
+
+	if *configFile != "" {
+		loaded, err := loadConfig(*configFile, flags)
+		if err != nil {
+			return err
+		}
+		settings = loaded
+	} else {
+		err := settings.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(settings.Interfaces) == 0 {
+		return errors.New("no interfaces, set -interface or add an [[interface]] to the config file")
+	}
+
+	passphrase, err := keystore.Passphrase(settings.Keys.PassphraseFile)
+	if err != nil {
+		return err
+	}
+	keys := keystore.New(settings.Keys.Keystore, passphrase)
+
+	var ifaces []*net.Interface
+	transports := map[string]network.Transport{}
+	for _, ifaceSettings := range settings.Interfaces {
+		iface, err := net.InterfaceByName(ifaceSettings.Name)
+		if err != nil {
+			return err
+		}
+		ifaces = append(ifaces, iface)
+
+		transports[iface.Name], err = network.ParseTransport(settings.InterfaceTransport(ifaceSettings))
+		if err != nil {
+			return err
+		}
+	}
+
+	mode, err := replay.ParseMode(settings.Seqnum.Mode)
+	if err != nil {
+		return err
+	}
+
+	privKey, err := loadIdentity(keys, keystore.Identity)
+	if err != nil {
+		return err
+	}
+
+	var newPrivKey *[ed25519.PrivateKeySize]byte
+	if *rotateIdentity {
+		// We can only make the new key stick if we are the ones keeping it
+		if !keys.FromFile(keystore.Identity) {
+			return errors.New(
+				"-rotateIdentity needs the identity key in the keystore, " +
+					"not in a credential or the environment")
+		}
+
+		newPrivKey, err = loadIdentity(keys, keystore.NextIdentity)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Without a shared tunnel key every tunnel gets keys of its own
+	tunnelPrivateKey, err := keys.Load(keystore.Tunnel)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var tunnelPublicKey string
+	if tunnelPrivateKey != "" {
+		tunnelPublicKey, err = wireguard.PublicKey(tunnelPrivateKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	var journal io.Writer
+	if settings.Pricing.LedgerJournal != "" {
+		file, err := os.OpenFile(settings.Pricing.LedgerJournal, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		journal = file
+	}
+
+	ledger := ledger.New(journal)
+
+	// We reserve seqnums in blocks, whatever the mode, so after a restart we
+	// carry on from the end of the last block and never reuse one.
+	stateStore, err := store.Open(settings.StateFile, 1000)
+	if err != nil {
+		return err
+	}
+	state := stateStore.State()
+
+	err = replay.CheckResume(
+		mode,
+		state.SeqnumReserved,
+		time.Now(),
+		time.Duration(settings.Seqnum.ClockSkew),
+	)
+	if err != nil {
+		return err
+	}
+
+	seqnum := state.SeqnumReserved
+	if mode == replay.Epoch {
+		seqnum = replay.EpochStart()
+	}
+
+	for _, record := range state.Balances {
+		balance := record.Balance
+		ledger.Balances[record.PublicKey] = &balance
+	}
+
+	// The policy is set with the other settings that can change
+	neighborAdmission, err := admission.New(admission.Policy{}, settings.Admission.PinFile)
+	if err != nil {
+		return err
+	}
+
+	var authority *certificate.Authority
+	if settings.Certificates.AuthorityPublicKey != "" {
+		b, err := base64.StdEncoding.DecodeString(settings.Certificates.AuthorityPublicKey)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return errors.New("bad authority public key")
+		}
+		authority = &certificate.Authority{
+			PublicKey: types.BytesToPublicKey(b),
+		}
+	}
+
+	var cert string
+	if settings.Certificates.Certificate != "" {
+		b, err := ioutil.ReadFile(settings.Certificates.Certificate)
+		if err != nil {
+			return err
+		}
+
+		parsed, err := certificate.Parse(string(b))
+		if err != nil {
+			return err
+		}
+		cert = parsed.String()
+	}
+
+	network := network.Network{
+		MulticastPort: settings.Port,
+		Transports:    transports,
+	}
+
+	bus := events.New()
+
+	// Tunnel state lives in the kernel, so everything that sets tunnels up
+	// or looks at them shares this
+	tunnels := wireguard.Tunnels{}
+
+	neighborAPI := neighborAPI.NeighborAPI{
+		Neighbors: map[[ed25519.PublicKeySize]byte]*types.Neighbor{},
+		Network:   &network,
+		Ledger:    ledger,
+		Account: &types.Account{
+			PublicKey:        publicKeyOf(privKey),
+			PrivateKey:       *privKey,
+			TunnelPublicKey:  tunnelPublicKey,
+			TunnelPrivateKey: tunnelPrivateKey,
+			Seqnum:           seqnum,
+			SeqnumMode:       string(mode),
+			Certificate:      cert,
+		},
+		PaymentBackend: &payment.LogBackend{},
+		Store:          stateStore,
+		Admission:      neighborAdmission,
+		Tunnels:        tunnels,
+		Events:         bus,
+		SourceLimit:    ratelimit.New(0, 0),
+		KeyLimit:       ratelimit.New(0, 0),
+		ConfirmLimit:   ratelimit.New(0, 0),
+	}
+
+	// A nil *Authority in the interface would not be nil
+	if authority != nil {
+		neighborAPI.Authority = authority
+	}
+
+	// Tunnel interfaces don't survive a reboot, so they are all created
+	// again once we are up
+	for i := range state.Neighbors {
+		neighbor := state.Neighbors[i]
+		neighbor.Tunnel.VirtualInterface = net.Interface{}
+		neighborAPI.Neighbors[neighbor.PublicKey] = &neighbor
+	}
+
+	for _, neighbor := range state.Removed {
+		neighborAPI.RestoreRemoved(neighbor)
+	}
+
+	for _, record := range state.Windows {
+		neighborAPI.RestoreWindows(record.PublicKey, record.Windows)
+	}
+
+	neighborAPI.Retired = map[[ed25519.PublicKeySize]byte]bool{}
+	for _, publicKey := range state.RetiredKeys {
+		neighborAPI.Retired[publicKey] = true
+	}
+
+	scheduler := scheduler.Scheduler{
+		NeighborAPI: &neighborAPI,
+		Ledger:      ledger,
+		Interfaces:  ifaces,
+		Usage:       wireguard.Transfer,
+	}
+
+	throttlePolicy := &reloadablePolicy{}
+
+	// applySettings sets everything that can change while we run. It is
+	// called again on SIGHUP. Everything is read and checked before
+	// anything is changed, so settings with a problem change nothing.
+	applySettings := func(settings *config.Config) error {
+		admissionPolicy, err := loadAdmissionPolicy(settings)
+		if err != nil {
+			return err
+		}
+
+		acceptedModes, endpointPolicy, err := parseNeighborSettings(settings)
+		if err != nil {
+			return err
+		}
+
+		logOptions, err := settings.LogOptions()
+		if err != nil {
+			return err
+		}
+
+		crl, err := readCRL(authority, settings.Certificates.CRL)
+		if err != nil {
+			return errors.New("CRL: " + err.Error())
+		}
+
+		neighborAdmission.Reload(admissionPolicy)
+
+		// Tunnels with neighbors the new policy keeps out come down now
+		err = neighborAPI.CheckAdmission()
+		if err != nil {
+			logger.Warn("taking tunnels down failed", "err", err)
+		}
+
+		rateLimits := settings.RateLimits
+		neighborAPI.SourceLimit.SetRate(rateLimits.SourceRate, rateLimits.SourceBurst)
+		neighborAPI.KeyLimit.SetRate(rateLimits.KeyRate, rateLimits.KeyBurst)
+		neighborAPI.ConfirmLimit.SetRate(rateLimits.ConfirmRate, rateLimits.ConfirmBurst)
+
+		neighborAPI.Update(func() {
+			neighborAPI.Account.Price = settings.Pricing.Price
+			neighborAPI.MaxPrice = settings.Pricing.MaxPrice
+			neighborAPI.AcceptedSeqnumModes = acceptedModes
+			neighborAPI.ClockSkew = time.Duration(settings.Seqnum.ClockSkew)
+			neighborAPI.EndpointPolicy = endpointPolicy
+			neighborAPI.FirstTunnelPort = settings.Tunnels.FirstPort
+			neighborAPI.Seal = settings.SealMessages
+			neighborAPI.TunnelKeyLifetime = time.Duration(settings.Tunnels.KeyLifetime)
+		})
+
+		scheduler.Update(func() {
+			scheduler.Price = settings.Pricing.Price
+			scheduler.MaxPrice = settings.Pricing.MaxPrice
+			scheduler.PaymentThreshold = settings.Pricing.PaymentThreshold
+			scheduler.PaymentInterval = time.Duration(settings.Pricing.PaymentInterval)
+			scheduler.NeighborCap = settings.Pricing.NeighborSpendingCap
+			scheduler.GlobalCap = settings.Pricing.GlobalSpendingCap
+			scheduler.CapPeriod = time.Duration(settings.Pricing.SpendingCapPeriod)
+		})
+
+		throttlePolicy.Set(settings.ThrottlePolicy())
+		logging.Configure(os.Stderr, logOptions)
+
+		if crl != nil {
+			// Nothing else updates the CRL, so it is still newer than ours
+			err = authority.UpdateCRL(crl)
+			if err != nil {
+				logger.Error("updating the CRL failed", "err", err)
+			}
+
+			// Tunnels with neighbors the new CRL revokes come down now
+			err = neighborAPI.CheckCertificates()
+			if err != nil {
+				logger.Warn("taking tunnels down failed", "err", err)
+			}
+		}
+		return nil
+	}
+
+	err = applySettings(settings)
+	if err != nil {
+		return err
+	}
+
+	saveState := func() {
+		err := stateStore.Save(
+			neighborAPI.ListNeighbors(),
+			neighborAPI.RemovedNeighbors(),
+			neighborAPI.ListWindows(),
+			ledger.AllBalances(),
+		)
+		if err != nil {
+			logger.Error("saving state failed", "file", settings.StateFile, "err", err)
+		}
+	}
+
+	go func() {
+		for range time.Tick(time.Duration(settings.StateSaveInterval)) {
+			saveState()
+		}
+	}()
+
+	if settings.MetricsAddress != "" {
+		exported := metrics.New()
+		network.Metrics = exported
+		neighborAPI.Metrics = exported
+		wireguard.Metrics = exported
+		exported.OnScrape(collectMetrics(&neighborAPI, ledger, throttlePolicy, tunnels))
+
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", exported)
+			err := http.ListenAndServe(settings.MetricsAddress, mux)
+			logger.Error("metrics stopped", "address", settings.MetricsAddress, "err", err)
+			os.Exit(1)
+		}()
+	}
+
+	management := &managementAPI.Server{
+		NeighborAPI: &neighborAPI,
+		Ledger:      ledger,
+		Payments:    &scheduler,
+		Throttle:    throttlePolicy,
+		Tunnels:     tunnels,
+		Events:      bus,
+		Interfaces:  ifaces,
+	}
+	if settings.ManagementSocket != "" {
+		go func() {
+			err := management.Listen(settings.ManagementSocket)
+			if err != nil {
+				logger.Error("management API stopped", "socket", settings.ManagementSocket, "err", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		management.Close()
+		network.Close()
+		saveState()
+		os.Exit(0)
+	}()
+
+	// Without a config file SIGHUP still reads the key lists and the CRL
+	// again
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			reloaded := settings
+			if *configFile != "" {
+				var err error
+				reloaded, err = loadConfig(*configFile, flags)
+				if err != nil {
+					logger.Error("not reloading settings", "file", *configFile, "err", err)
+					continue
+				}
+			}
+
+			err := applySettings(reloaded)
+			if err != nil {
+				logger.Error("not reloading settings", "err", err)
+			} else {
+				logger.Info("reloaded settings")
+			}
+
+			restart := config.RestartNeeded(settings, reloaded)
+			if len(restart) > 0 {
+				logger.Warn("these settings only change on a restart", "settings", strings.Join(restart, ", "))
+			}
+		}
+	}()
+
+	// A bad packet from one neighbor shouldn't take the node down. The
+	// neighbor API logs the messages it drops, with who sent them, so only
+	// errors reading from the socket are left to log here.
+	handlers := func(b []byte, iface *net.Interface, source *net.UDPAddr) error {
+		neighborAPI.Handlers(b, iface, source)
+		return nil
+	}
+
+	for _, iface := range ifaces {
+		err = network.Open(iface)
+		if err != nil {
+			return err
+		}
+
+		name := iface.Name
+		go network.McastListen(
+			iface,
+			handlers,
+			func(err error) {
+				if err != nil {
+					logger.Warn("receiving failed", "interface", name, "err", err)
+				}
+			},
+		)
+	}
+
+	// The new key is saved as the identity key before any neighbor hears of
+	// it, so we can't be restarted with a key they have retired. Neighbors
+	// that miss the rotation only know us by the old key, and will meet the
+	// new one as a new neighbor.
+	if newPrivKey != nil {
+		newPublicKey := publicKeyOf(newPrivKey)
+		err = promoteNextIdentity(keys)
+		if err != nil {
+			return err
+		}
+
+		err = neighborAPI.RotateKey(ifaces, newPublicKey, *newPrivKey)
+		if err != nil {
+			logger.Warn("not every neighbor was told about the new key", "err", err)
+		}
+		logger.Info(
+			"rotated to the next identity key, which is now the identity key",
+			"publicKey", base64.StdEncoding.EncodeToString(newPublicKey[:]),
+		)
+	}
+
+	sendHellos := func() error {
+		for _, iface := range ifaces {
+			err := neighborAPI.SendHelloMsg(iface)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err = sendHellos()
+	if err != nil {
+		return err
+	}
+
+	err = neighborAPI.RestoreTunnels(ifaces)
+	if err != nil {
+		logger.Warn("not every tunnel could be restored", "err", err)
+	}
+
+	// Every hello carries a new nonce, and neighbors only count as
+	// confirmed once they have echoed one of them.
+	go func() {
+		for range time.Tick(time.Duration(settings.HelloInterval)) {
+			err := sendHellos()
+			if err != nil {
+				logger.Warn("sending hellos failed", "err", err)
+			}
+		}
+	}()
+
+	// Rotations the neighbor hasn't confirmed yet are retried every time
+	go func() {
+		for range time.Tick(time.Minute) {
+			err := neighborAPI.RotateTunnelKeys(ifaces)
+			if err != nil {
+				logger.Warn("rotating tunnel keys failed", "err", err)
+			}
+		}
+	}()
+
+	// Certificates expire while their tunnels are up
+	if authority != nil {
+		go func() {
+			for range time.Tick(time.Minute) {
+				err := neighborAPI.CheckCertificates()
+				if err != nil {
+					logger.Warn("taking tunnels down failed", "err", err)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		var dropped [3]uint64
+		for range time.Tick(time.Minute) {
+			now := [3]uint64{
+				neighborAPI.SourceLimit.Dropped(),
+				neighborAPI.KeyLimit.Dropped(),
+				neighborAPI.ConfirmLimit.Dropped(),
+			}
+			if now != dropped {
+				logger.Info(
+					"rate limited",
+					"bySource", now[0],
+					"byPublicKey", now[1],
+					"helloConfirms", now[2],
+				)
+				dropped = now
+			}
+		}
+	}()
+
+	go scheduler.Run(time.Duration(settings.Pricing.MeterInterval))
+
+	// Debt crossing a throttle threshold is logged and published as the
+	// neighbor's balance crossing it
+	go func() {
+		throttleLogger := logging.Logger("throttle")
+		levels := map[[ed25519.PublicKeySize]byte]throttle.Level{}
+		for now := range time.Tick(time.Duration(settings.Pricing.MeterInterval)) {
+			for _, neighbor := range neighborAPI.ListNeighbors() {
+				decision := throttlePolicy.Decide(ledger.Balance(neighbor.PublicKey), now)
+				if decision.Level != levels[neighbor.PublicKey] {
+					throttleLogger.Info(
+						"throttle level changed",
+						"neighbor", base64.StdEncoding.EncodeToString(neighbor.PublicKey[:]),
+						"level", decision.Level.String(),
+						"debt", decision.Debt,
+						"effectiveDebt", decision.EffectiveDebt,
+						"reason", decision.Reason,
+					)
+					bus.Publish(events.Event{
+						Type:     events.BalanceThreshold,
+						Time:     now,
+						Neighbor: base64.StdEncoding.EncodeToString(neighbor.PublicKey[:]),
+						Debt:     decision.Debt,
+						Level:    decision.Level.String(),
+					})
+					levels[neighbor.PublicKey] = decision.Level
+				}
+			}
+		}
+	}()
+
+	for range time.Tick(time.Duration(settings.Pricing.SettlementInterval)) {
+		err = neighborAPI.SettleChannels()
+		if err != nil {
+			logger.Warn("settling payment channels failed", "err", err)
+		}
+	}
+
+	return nil
+}
+
+// reloadablePolicy is the throttle policy, which SIGHUP can replace while
+// it is in use.
+type reloadablePolicy struct {
+	policy throttle.Policy
+	mutex  sync.Mutex
+}
+
+func (self *reloadablePolicy) Set(policy throttle.Policy) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.policy = policy
+}
+
+func (self *reloadablePolicy) Decide(
+	balance types.Balance,
+	now time.Time,
+) throttle.Decision {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.policy.Decide(balance, now)
+}
+
+// collectMetrics returns a collector for the metrics that are read from the
+// neighbors and the ledger rather than counted as things happen.
+func collectMetrics(
+	neighbors *neighborAPI.NeighborAPI,
+	ledger *ledger.Ledger,
+	throttlePolicy *reloadablePolicy,
+	tunnels wireguard.Tunnels,
+) func(*metrics.Metrics) {
+	return func(exported *metrics.Metrics) {
+		now := time.Now()
+
+		exported.Reset("scrooge_neighbor_debt")
+		exported.Reset("scrooge_neighbor_throttle_level")
+
+		var confirmed, tunnelsUp int
+		list := neighbors.ListNeighbors()
+		for _, neighbor := range list {
+			if neighbor.Confirmed {
+				confirmed++
+			}
+			if neighbor.Tunnel.VirtualInterface.Name != "" &&
+				tunnels.Up(neighbor.Tunnel.VirtualInterface.Name) {
+				tunnelsUp++
+			}
+
+			publicKey := base64.StdEncoding.EncodeToString(neighbor.PublicKey[:])
+			balance := ledger.Balance(neighbor.PublicKey)
+			exported.Set("scrooge_neighbor_debt", float64(balance.Debt()), "neighbor", publicKey)
+			exported.Set(
+				"scrooge_neighbor_throttle_level",
+				float64(throttlePolicy.Decide(balance, now).Level),
+				"neighbor", publicKey,
+			)
+		}
+
+		exported.Set("scrooge_neighbors", float64(len(list)))
+		exported.Set("scrooge_neighbors_confirmed", float64(confirmed))
+		exported.Set("scrooge_tunnels_up", float64(tunnelsUp))
+
+		exported.Set("scrooge_rate_limited_total", float64(neighbors.SourceLimit.Dropped()), "limit", "source")
+		exported.Set("scrooge_rate_limited_total", float64(neighbors.KeyLimit.Dropped()), "limit", "key")
+		exported.Set("scrooge_rate_limited_total", float64(neighbors.ConfirmLimit.Dropped()), "limit", "confirm")
+	}
+}
+
+// loadConfig reads the config file at path, with the settings set in
+// commandLine over it.
+func loadConfig(path string, commandLine *flag.FlagSet) (*config.Config, error) {
+	settings, err := config.Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	settings.Flags(flags)
+
+	commandLine.Visit(func(f *flag.Flag) {
+		if err == nil && flags.Lookup(f.Name) != nil {
+			err = flags.Set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return settings, settings.Validate()
+}
+
+// loadAdmissionPolicy reads the key lists the admission settings name.
+func loadAdmissionPolicy(settings *config.Config) (admission.Policy, error) {
+	pinMode, err := admission.ParsePinMode(settings.Admission.PinNeighbors)
+	if err != nil {
+		return admission.Policy{}, err
+	}
+
+	policy := admission.Policy{
+		Pin:          pinMode,
+		MaxNeighbors: settings.Admission.MaxNeighbors,
+	}
+
+	if settings.Admission.Allowlist != "" {
+		policy.Allow, err = admission.LoadKeys(settings.Admission.Allowlist)
+		if err != nil {
+			return policy, err
+		}
+	}
+	if settings.Admission.Denylist != "" {
+		policy.Deny, err = admission.LoadKeys(settings.Admission.Denylist)
+		if err != nil {
+			return policy, err
+		}
+	}
+	return policy, nil
+}
+
+// parseNeighborSettings returns the seqnum modes we accept and the tunnel
+// endpoint policy.
+func parseNeighborSettings(
+	settings *config.Config,
+) ([]replay.Mode, neighborAPI.EndpointPolicy, error) {
+	var acceptedModes []replay.Mode
+	for _, s := range settings.Seqnum.AcceptedModes {
+		accepted, err := replay.ParseMode(s)
+		if err != nil {
+			return nil, "", err
+		}
+		acceptedModes = append(acceptedModes, accepted)
+	}
+
+	endpointPolicy, err := neighborAPI.ParseEndpointPolicy(settings.Tunnels.EndpointPolicy)
+	if err != nil {
+		return nil, "", err
+	}
+	return acceptedModes, endpointPolicy, nil
+}
+
+// readCRL reads the CRL in crlFile and checks that authority would take
+// it, if both are set. Otherwise there is no CRL and no error.
+func readCRL(
+	authority *certificate.Authority,
+	crlFile string,
+) (*certificate.CRL, error) {
+	if authority == nil || crlFile == "" {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadFile(crlFile)
+	if err != nil {
+		return nil, err
+	}
+
+	crl, err := certificate.ParseCRL(string(b))
+	if err != nil {
+		return nil, err
+	}
+
+	err = authority.CheckCRL(crl)
+	if err != nil {
+		return nil, err
+	}
+	return crl, nil
+}
+
+func loadIdentity(
+	keys *keystore.Keystore,
+	name string,
+) (*[ed25519.PrivateKeySize]byte, error) {
+	key, err := keys.Load(name)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(b) != ed25519.PrivateKeySize {
+		return nil, errors.New("bad " + name + " key")
+	}
+
+	privateKey := types.BytesToPrivateKey(b)
+	return &privateKey, nil
+}
+
+// publicKeyOf returns the public key that is the second half of an ed25519
+// private key.
+func publicKeyOf(
+	privateKey *[ed25519.PrivateKeySize]byte,
+) [ed25519.PublicKeySize]byte {
+	return types.BytesToPublicKey(privateKey[ed25519.PrivateKeySize-ed25519.PublicKeySize:])
+}
+
+// promoteNextIdentity makes the next identity key the identity key in the
+// keystore, before neighbors are told about it. A next identity key given
+// in the environment or as a credential is left for whoever set it to
+// remove.
+func promoteNextIdentity(keys *keystore.Keystore) error {
+	key, err := keys.Load(keystore.NextIdentity)
+	if err != nil {
+		return err
+	}
+
+	err = keys.Store(keystore.Identity, key)
+	if err != nil {
+		return err
+	}
+
+	if !keys.FromFile(keystore.NextIdentity) {
+		logger.Warn("the next identity key is not in the keystore, remove it from where it was given")
+		return nil
+	}
+	return keys.Remove(keystore.NextIdentity)
+}
@@ -0,0 +1,304 @@
+package scheduler
+
+import (
+	"encoding/base64"
+	"errors"
+	"math"
+	"math/bits"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/agl/ed25519"
+	"github.com/incentivized-mesh-infrastructure/scrooge/ledger"
+	"github.com/incentivized-mesh-infrastructure/scrooge/logging"
+	"github.com/incentivized-mesh-infrastructure/scrooge/types"
+)
+
+var logger = logging.Logger("scheduler")
+
+// Scheduler meters the traffic on every neighbor tunnel, bills neighbors for
+// what they route through us and pays them for what we route through them.
+type Scheduler struct {
+	NeighborAPI interface {
+		ListNeighbors() []types.Neighbor
+		SendVoucherMsg([ed25519.PublicKeySize]byte, *net.Interface, uint64) error
+	}
+	Ledger     *ledger.Ledger
+	Interfaces []*net.Interface
+	Usage      func(virtualInterface string) (rx uint64, tx uint64, err error)
+
+	Price            uint64        // What we charge per byte received on a tunnel
+	MaxPrice         uint64        // Most we pay a neighbor per byte, whatever it asks, 0 for no cap
+	PaymentThreshold uint64        // Pay a neighbor as soon as we owe it this much
+	PaymentInterval  time.Duration // Pay whatever we owe a neighbor at least this often
+	NeighborCap      uint64        // Most we pay a single neighbor per CapPeriod, 0 for no cap
+	GlobalCap        uint64        // Most we pay all neighbors together per CapPeriod, 0 for no cap
+	CapPeriod        time.Duration
+
+	tunnels     map[string]*tunnelState                // By virtual interface
+	spentBy     map[[ed25519.PublicKeySize]byte]uint64 // What each neighbor was paid this period
+	spent       uint64
+	periodStart time.Time
+	mutex       sync.Mutex
+}
+
+type tunnelState struct {
+	publicKey [ed25519.PublicKeySize]byte // The neighbor the tunnel was with
+	rx        uint64
+	tx        uint64
+	owed      uint64
+	lastPaid  time.Time
+}
+
+// Run meters and pays every interval. It never returns.
+func (self *Scheduler) Run(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		self.Tick(now)
+	}
+}
+
+// Tick reads the usage of every tunnel and sends the payments that have come
+// due. Problems with one neighbor are logged and do not hold up the others.
+func (self *Scheduler) Tick(now time.Time) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.tunnels == nil {
+		self.tunnels = map[string]*tunnelState{}
+	}
+
+	self.startPeriod(now)
+	self.moveSpent()
+
+	for _, neighbor := range self.NeighborAPI.ListNeighbors() {
+		if neighbor.Tunnel.VirtualInterface.Name == "" {
+			continue
+		}
+
+		err := self.tick(neighbor, now)
+		if err != nil {
+			logger.Warn(
+				"metering failed",
+				"neighbor", base64.StdEncoding.EncodeToString(neighbor.PublicKey[:]),
+				"interface", neighbor.Tunnel.VirtualInterface.Name,
+				"err", err,
+			)
+		}
+	}
+}
+
+// Pay sends a neighbor a voucher for amount on top of what it is paid for
+// routing our traffic, if that fits in what is left of the spending caps.
+// It counts toward the caps like any other payment, and is taken off what
+// we owe the neighbor, so that it isn't paid for the same traffic again.
+func (self *Scheduler) Pay(
+	publicKey [ed25519.PublicKeySize]byte,
+	iface *net.Interface,
+	amount uint64,
+	now time.Time,
+) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.startPeriod(now)
+	self.moveSpent()
+
+	if self.NeighborCap != 0 && left(self.NeighborCap, self.spentBy[publicKey]) < amount {
+		return errors.New("payment over the neighbor spending cap")
+	}
+	if self.GlobalCap != 0 && left(self.GlobalCap, self.spent) < amount {
+		return errors.New("payment over the global spending cap")
+	}
+
+	err := self.NeighborAPI.SendVoucherMsg(publicKey, iface, amount)
+	if err != nil {
+		return err
+	}
+
+	for _, state := range self.tunnels {
+		if state.publicKey != publicKey {
+			continue
+		}
+		if amount < state.owed {
+			state.owed = state.owed - amount
+		} else {
+			state.owed = 0
+		}
+		state.lastPaid = now
+	}
+	self.spentBy[publicKey] = add(self.spentBy[publicKey], amount)
+	self.spent = add(self.spent, amount)
+
+	return self.Ledger.Record(publicKey, ledger.PaymentSent, amount, now)
+}
+
+// startPeriod starts a new spending cap period once the last one is over.
+func (self *Scheduler) startPeriod(now time.Time) {
+	if !self.periodStart.IsZero() && now.Sub(self.periodStart) < self.CapPeriod {
+		return
+	}
+
+	self.periodStart = now
+	self.spent = 0
+	self.spentBy = map[[ed25519.PublicKeySize]byte]uint64{}
+}
+
+// moveSpent moves what neighbors that rotated their key were paid this
+// period to their new key, so that rotating doesn't get them past their cap.
+func (self *Scheduler) moveSpent() {
+	for publicKey, spent := range self.spentBy {
+		newKey, moved := self.Ledger.MovedTo(publicKey)
+		if !moved {
+			continue
+		}
+		self.spentBy[newKey] = add(self.spentBy[newKey], spent)
+		delete(self.spentBy, publicKey)
+	}
+}
+
+// Update runs update between ticks, so that it can change the settings of a
+// running scheduler.
+func (self *Scheduler) Update(update func()) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	update()
+}
+
+func (self *Scheduler) tick(neighbor types.Neighbor, now time.Time) error {
+	rx, tx, err := self.Usage(neighbor.Tunnel.VirtualInterface.Name)
+	if err != nil {
+		return err
+	}
+
+	// The first reading is only where we start counting from. The counters
+	// outlive us, so what they had before was billed and paid by whoever ran
+	// before a restart. Interface names are used again once a tunnel is
+	// gone, and a neighbor that takes one over starts over with nothing
+	// owed. A neighbor that only rotated its key keeps what it is owed, so
+	// that we still pay for what it routed.
+	state := self.tunnels[neighbor.Tunnel.VirtualInterface.Name]
+	if state != nil && state.publicKey != neighbor.PublicKey {
+		movedTo, moved := self.Ledger.MovedTo(state.publicKey)
+		if moved && movedTo == neighbor.PublicKey {
+			state.publicKey = neighbor.PublicKey
+		} else {
+			state = nil
+		}
+	}
+	if state == nil {
+		self.tunnels[neighbor.Tunnel.VirtualInterface.Name] = &tunnelState{
+			publicKey: neighbor.PublicKey,
+			rx:        rx,
+			tx:        tx,
+			lastPaid:  now,
+		}
+		return nil
+	}
+
+	// The counters start over when a tunnel is recreated
+	if rx < state.rx || tx < state.tx {
+		state.rx = 0
+		state.tx = 0
+	}
+
+	rxDelta := rx - state.rx
+	txDelta := tx - state.tx
+	state.rx = rx
+	state.tx = tx
+
+	if rxDelta > 0 && self.Price > 0 {
+		err = self.Ledger.Record(
+			neighbor.PublicKey,
+			ledger.UsageBilled,
+			mul(rxDelta, self.Price),
+			now,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	price := neighbor.BillingDetails.Price
+	if self.MaxPrice != 0 && price > self.MaxPrice {
+		price = self.MaxPrice
+	}
+	state.owed = add(state.owed, mul(txDelta, price))
+
+	if state.owed == 0 ||
+		(state.owed < self.PaymentThreshold &&
+			now.Sub(state.lastPaid) < self.PaymentInterval) {
+		return nil
+	}
+
+	amount := state.owed
+	spent := self.spentBy[neighbor.PublicKey]
+	if self.NeighborCap != 0 && left(self.NeighborCap, spent) < amount {
+		amount = left(self.NeighborCap, spent)
+	}
+	if self.GlobalCap != 0 && left(self.GlobalCap, self.spent) < amount {
+		amount = left(self.GlobalCap, self.spent)
+	}
+	if amount == 0 {
+		logger.Info(
+			"spending cap reached, not paying",
+			"neighbor", base64.StdEncoding.EncodeToString(neighbor.PublicKey[:]),
+			"owed", state.owed,
+		)
+		return nil
+	}
+
+	err = self.NeighborAPI.SendVoucherMsg(neighbor.PublicKey, self.interfaceOf(neighbor), amount)
+	if err != nil {
+		return err
+	}
+
+	state.owed = state.owed - amount
+	state.lastPaid = now
+	self.spentBy[neighbor.PublicKey] = spent + amount
+	self.spent = self.spent + amount
+
+	return self.Ledger.Record(neighbor.PublicKey, ledger.PaymentSent, amount, now)
+}
+
+// interfaceOf returns the interface the neighbor's messages come in on,
+// which vouchers to it are only sent on if we don't have its address.
+func (self *Scheduler) interfaceOf(neighbor types.Neighbor) *net.Interface {
+	for _, iface := range self.Interfaces {
+		if neighbor.Address != nil && neighbor.Address.Zone == iface.Name {
+			return iface
+		}
+	}
+	if len(self.Interfaces) == 0 {
+		return nil
+	}
+	return self.Interfaces[0]
+}
+
+// add returns a+b, or the most a uint64 holds if that overflows.
+func add(a uint64, b uint64) uint64 {
+	sum, carry := bits.Add64(a, b, 0)
+	if carry != 0 {
+		return math.MaxUint64
+	}
+	return sum
+}
+
+// mul returns a*b, or the most a uint64 holds if that overflows.
+func mul(a uint64, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	if hi != 0 {
+		return math.MaxUint64
+	}
+	return lo
+}
+
+// left is what is left of a spending cap, which may have been lowered below
+// what was spent already.
+func left(cap uint64, spent uint64) uint64 {
+	if spent >= cap {
+		return 0
+	}
+	return cap - spent
+}
@@ -0,0 +1,357 @@
+package scheduler
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/agl/ed25519"
+	"github.com/incentivized-mesh-infrastructure/scrooge/ledger"
+	"github.com/incentivized-mesh-infrastructure/scrooge/types"
+)
+
+var (
+	iface = &net.Interface{
+		Name: "foo0",
+	}
+	pubkey1 = [ed25519.PublicKeySize]byte{44, 176, 80, 246, 247, 71, 5, 229, 108, 111, 158, 77, 18, 116, 98, 28, 84, 59, 215, 93, 182, 34, 240, 5, 147, 229, 211, 253, 44, 221, 237, 85}
+	pubkey2 = [ed25519.PublicKeySize]byte{175, 110, 12, 95, 82, 169, 239, 109, 41, 163, 183, 93, 77, 197, 35, 41, 35, 203, 94, 200, 216, 6, 41, 129, 170, 12, 8, 97, 211, 28, 123, 162}
+	now     = time.Date(2018, 1, 11, 0, 0, 0, 0, time.UTC)
+)
+
+type transfer struct {
+	rx uint64
+	tx uint64
+}
+
+type fakeNeighborAPI struct {
+	neighbors []types.Neighbor
+	paid      map[[ed25519.PublicKeySize]byte]uint64
+	paidOn    map[[ed25519.PublicKeySize]byte]string
+}
+
+func (fakeAPI *fakeNeighborAPI) ListNeighbors() []types.Neighbor {
+	return fakeAPI.neighbors
+}
+
+func (fakeAPI *fakeNeighborAPI) SendVoucherMsg(
+	publicKey [ed25519.PublicKeySize]byte,
+	iface *net.Interface,
+	amount uint64,
+) error {
+	fakeAPI.paid[publicKey] = fakeAPI.paid[publicKey] + amount
+	fakeAPI.paidOn[publicKey] = iface.Name
+	return nil
+}
+
+func createScheduler() (*Scheduler, *fakeNeighborAPI, map[string]transfer) {
+	neighbor1 := types.Neighbor{PublicKey: pubkey1}
+	neighbor1.BillingDetails.Price = 2
+	neighbor1.Tunnel.VirtualInterface.Name = "wg1"
+
+	neighbor2 := types.Neighbor{PublicKey: pubkey2}
+	neighbor2.BillingDetails.Price = 1
+	neighbor2.Tunnel.VirtualInterface.Name = "wg2"
+
+	fakeAPI := &fakeNeighborAPI{
+		neighbors: []types.Neighbor{neighbor1, neighbor2},
+		paid:      map[[ed25519.PublicKeySize]byte]uint64{},
+		paidOn:    map[[ed25519.PublicKeySize]byte]string{},
+	}
+
+	usage := map[string]transfer{}
+
+	scheduler := &Scheduler{
+		NeighborAPI: fakeAPI,
+		Ledger:      ledger.New(nil),
+		Interfaces:  []*net.Interface{iface},
+		Usage: func(virtualInterface string) (uint64, uint64, error) {
+			return usage[virtualInterface].rx, usage[virtualInterface].tx, nil
+		},
+		Price:            3,
+		PaymentThreshold: 500,
+		PaymentInterval:  time.Hour,
+		CapPeriod:        24 * time.Hour,
+	}
+
+	// Start counting from nothing
+	scheduler.Tick(now.Add(-time.Minute))
+
+	return scheduler, fakeAPI, usage
+}
+
+func TestPaymentThreshold(t *testing.T) {
+	scheduler, fakeAPI, usage := createScheduler()
+
+	usage["wg1"] = transfer{tx: 100}
+	scheduler.Tick(now)
+
+	if fakeAPI.paid[pubkey1] != 0 {
+		t.Fatal("paid before reaching the threshold: ", fakeAPI.paid[pubkey1])
+	}
+
+	usage["wg1"] = transfer{tx: 300}
+	scheduler.Tick(now.Add(time.Minute))
+
+	if fakeAPI.paid[pubkey1] != 600 {
+		t.Fatal("wrong payment: ", fakeAPI.paid[pubkey1])
+	}
+
+	if scheduler.Ledger.Balance(pubkey1).Paid != 600 {
+		t.Fatal("payment not recorded in the ledger")
+	}
+}
+
+func TestPaymentInterval(t *testing.T) {
+	scheduler, fakeAPI, usage := createScheduler()
+
+	usage["wg2"] = transfer{tx: 100}
+	scheduler.Tick(now)
+	scheduler.Tick(now.Add(time.Hour))
+
+	if fakeAPI.paid[pubkey2] != 100 {
+		t.Fatal("wrong payment: ", fakeAPI.paid[pubkey2])
+	}
+}
+
+func TestTunnelRecreated(t *testing.T) {
+	scheduler, fakeAPI, usage := createScheduler()
+
+	usage["wg1"] = transfer{tx: 200}
+	scheduler.Tick(now)
+
+	// The counters start over from a lower value
+	usage["wg1"] = transfer{tx: 100}
+	scheduler.Tick(now.Add(time.Minute))
+
+	if fakeAPI.paid[pubkey1] != 600 {
+		t.Fatal("wrong payment: ", fakeAPI.paid[pubkey1])
+	}
+}
+
+func TestSpendingCaps(t *testing.T) {
+	scheduler, fakeAPI, usage := createScheduler()
+	scheduler.NeighborCap = 800
+	scheduler.GlobalCap = 1000
+
+	usage["wg1"] = transfer{tx: 500}
+	usage["wg2"] = transfer{tx: 600}
+	scheduler.Tick(now)
+
+	if fakeAPI.paid[pubkey1] != 800 {
+		t.Fatal("neighbor cap not enforced: ", fakeAPI.paid[pubkey1])
+	}
+
+	if fakeAPI.paid[pubkey1]+fakeAPI.paid[pubkey2] != 1000 {
+		t.Fatal("global cap not enforced: ", fakeAPI.paid[pubkey1]+fakeAPI.paid[pubkey2])
+	}
+
+	// Everything still owed is paid once the caps reset
+	scheduler.Tick(now.Add(24 * time.Hour))
+
+	if fakeAPI.paid[pubkey1] != 1000 || fakeAPI.paid[pubkey2] != 600 {
+		t.Fatal("wrong payments after cap reset: ", fakeAPI.paid)
+	}
+}
+
+func TestSpendingCapLowered(t *testing.T) {
+	scheduler, fakeAPI, usage := createScheduler()
+	scheduler.NeighborCap = 800
+
+	usage["wg1"] = transfer{tx: 500}
+	scheduler.Tick(now)
+
+	scheduler.Update(func() {
+		scheduler.NeighborCap = 500
+	})
+
+	usage["wg1"] = transfer{tx: 1000}
+	scheduler.Tick(now.Add(time.Hour))
+
+	if fakeAPI.paid[pubkey1] != 800 {
+		t.Fatal("paid over the lowered cap: ", fakeAPI.paid[pubkey1])
+	}
+}
+
+func TestBilling(t *testing.T) {
+	scheduler, _, usage := createScheduler()
+
+	usage["wg1"] = transfer{rx: 100}
+	scheduler.Tick(now)
+
+	balance := scheduler.Ledger.Balance(pubkey1)
+	if balance.Billed != 300 {
+		t.Fatal("balance.Billed incorrect: ", balance.Billed)
+	}
+	if !balance.DebtSince.Equal(now) {
+		t.Fatal("balance.DebtSince incorrect: ", balance.DebtSince)
+	}
+}
+
+func TestFirstReadingIsBaseline(t *testing.T) {
+	scheduler, fakeAPI, usage := createScheduler()
+	scheduler.tunnels = nil
+
+	// What the counters had before a restart isn't billed or paid again
+	usage["wg1"] = transfer{rx: 1000, tx: 1000}
+	scheduler.Tick(now)
+
+	if fakeAPI.paid[pubkey1] != 0 || scheduler.Ledger.Balance(pubkey1).Billed != 0 {
+		t.Fatal("usage from before the first reading counted")
+	}
+
+	usage["wg1"] = transfer{rx: 1100, tx: 1300}
+	scheduler.Tick(now.Add(time.Minute))
+
+	if fakeAPI.paid[pubkey1] != 600 {
+		t.Fatal("wrong payment: ", fakeAPI.paid[pubkey1])
+	}
+	if scheduler.Ledger.Balance(pubkey1).Billed != 300 {
+		t.Fatal("wrong bill: ", scheduler.Ledger.Balance(pubkey1).Billed)
+	}
+}
+
+func TestMaxPrice(t *testing.T) {
+	scheduler, fakeAPI, usage := createScheduler()
+	scheduler.MaxPrice = 1
+
+	usage["wg1"] = transfer{tx: 600}
+	scheduler.Tick(now)
+
+	if fakeAPI.paid[pubkey1] != 600 {
+		t.Fatal("paid more than the maximum price: ", fakeAPI.paid[pubkey1])
+	}
+}
+
+func TestOwedOverflow(t *testing.T) {
+	scheduler, fakeAPI, usage := createScheduler()
+	fakeAPI.neighbors[0].BillingDetails.Price = math.MaxUint64
+
+	usage["wg1"] = transfer{tx: 2}
+	scheduler.Tick(now)
+
+	if fakeAPI.paid[pubkey1] != math.MaxUint64 {
+		t.Fatal("amount owed overflowed: ", fakeAPI.paid[pubkey1])
+	}
+}
+
+func TestInterfaceTakenOver(t *testing.T) {
+	scheduler, fakeAPI, usage := createScheduler()
+
+	usage["wg1"] = transfer{tx: 100}
+	scheduler.Tick(now)
+
+	// wg1 now belongs to another neighbor, which owes nothing yet
+	fakeAPI.neighbors[0].PublicKey = pubkey2
+	fakeAPI.neighbors = fakeAPI.neighbors[:1]
+	usage["wg1"] = transfer{tx: 300}
+	scheduler.Tick(now.Add(time.Minute))
+
+	if fakeAPI.paid[pubkey1] != 0 || fakeAPI.paid[pubkey2] != 0 {
+		t.Fatal("paid what the old neighbor was owed: ", fakeAPI.paid)
+	}
+
+	usage["wg1"] = transfer{tx: 400}
+	scheduler.Tick(now.Add(2 * time.Minute))
+
+	if fakeAPI.paid[pubkey2] != 0 {
+		t.Fatal("paid before reaching the threshold: ", fakeAPI.paid[pubkey2])
+	}
+
+	// A neighbor that only rotated its key keeps what it is owed and what
+	// was spent on it, so the cap still holds
+	scheduler, fakeAPI, usage = createScheduler()
+	scheduler.NeighborCap = 500
+
+	usage["wg1"] = transfer{tx: 300}
+	scheduler.Tick(now)
+	if fakeAPI.paid[pubkey1] != 500 {
+		t.Fatal("cap not applied: ", fakeAPI.paid[pubkey1])
+	}
+
+	pubkey3 := [ed25519.PublicKeySize]byte{3}
+	err := scheduler.Ledger.Move(pubkey1, pubkey3, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeAPI.neighbors[0].PublicKey = pubkey3
+
+	usage["wg1"] = transfer{tx: 400}
+	scheduler.Tick(now.Add(2 * time.Hour))
+
+	if fakeAPI.paid[pubkey3] != 0 {
+		t.Fatal("rotating the key got past the cap: ", fakeAPI.paid[pubkey3])
+	}
+	if owed := scheduler.tunnels["wg1"].owed; owed != 300 {
+		t.Fatal("owed not carried over the rotation: ", owed)
+	}
+}
+
+func TestPay(t *testing.T) {
+	scheduler, fakeAPI, usage := createScheduler()
+	scheduler.NeighborCap = 400
+
+	usage["wg1"] = transfer{tx: 100}
+	scheduler.Tick(now)
+
+	err := scheduler.Pay(pubkey1, iface, 150, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fakeAPI.paid[pubkey1] != 150 || scheduler.Ledger.Balance(pubkey1).Paid != 150 {
+		t.Fatal("payment not sent and recorded: ", fakeAPI.paid[pubkey1])
+	}
+
+	// What is owed for the traffic was paid for already
+	if owed := scheduler.tunnels["wg1"].owed; owed != 50 {
+		t.Fatal("payment not taken off what is owed: ", owed)
+	}
+
+	err = scheduler.Pay(pubkey1, iface, 300, now)
+	if err == nil {
+		t.Fatal("payment over the neighbor cap not refused")
+	}
+	if fakeAPI.paid[pubkey1] != 150 {
+		t.Fatal("payment over the neighbor cap sent: ", fakeAPI.paid[pubkey1])
+	}
+}
+
+func TestPayNoTunnel(t *testing.T) {
+	scheduler, fakeAPI, _ := createScheduler()
+	scheduler.NeighborCap = 400
+
+	// Never metered, so there is no tunnel state to count the spend on
+	for i := 0; i < 2; i++ {
+		err := scheduler.Pay(pubkey2, iface, 200, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := scheduler.Pay(pubkey2, iface, 200, now)
+	if err == nil {
+		t.Fatal("payment over the neighbor cap not refused")
+	}
+	if fakeAPI.paid[pubkey2] != 400 {
+		t.Fatal("payment over the neighbor cap sent: ", fakeAPI.paid[pubkey2])
+	}
+}
+
+func TestPaymentInterface(t *testing.T) {
+	scheduler, fakeAPI, usage := createScheduler()
+	iface1 := &net.Interface{Name: "foo1"}
+	scheduler.Interfaces = append(scheduler.Interfaces, iface1)
+	fakeAPI.neighbors[0].Address = &net.UDPAddr{IP: net.ParseIP("fe80::1"), Zone: "foo1"}
+
+	usage["wg1"] = transfer{tx: 300}
+	usage["wg2"] = transfer{tx: 600}
+	scheduler.Tick(now)
+
+	if fakeAPI.paidOn[pubkey1] != "foo1" {
+		t.Fatal("not paid on the neighbor's interface: ", fakeAPI.paidOn[pubkey1])
+	}
+	if fakeAPI.paidOn[pubkey2] != "foo0" {
+		t.Fatal("not paid on the first interface: ", fakeAPI.paidOn[pubkey2])
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/incentivized-mesh-infrastructure/scrooge/events"
+	"github.com/incentivized-mesh-infrastructure/scrooge/managementClient"
+	"github.com/incentivized-mesh-infrastructure/scrooge/types"
+)
+
+const usage = `Usage: scroogectl [flags] <command> [arguments]
+
+Commands:
+  status                     our account and a summary of our neighbors
+  neighbors                  every neighbor
+  tunnels                    the tunnel with every neighbor
+  balances                   what every neighbor owes us and we have paid it
+  throttle                   how hard every neighbor is throttled
+  keys                       our public keys and the keys of every tunnel
+  hello                      send a hello on every interface now
+  tunnel <publicKey>         set the tunnel with a neighbor up again, both ends
+  kick <publicKey>           take a neighbor's tunnel down and forget it
+  pay <publicKey> <amount>   send a neighbor a voucher for amount, within the
+                             spending caps and taken off what we owe it
+  credit <publicKey> <amount>
+                             let a neighbor off amount of its debt, or take
+                             back credit if amount is negative
+  events [type...]           print events as they happen, of every type or
+                             only those given, until interrupted
+
+Flags:
+`
+
+func main() {
+	socket := flag.String("socket", "/run/scrooge.sock", "Management socket of the scrooge to talk to")
+	jsonOutput := flag.Bool("json", false, "Print JSON instead of tables")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	client := managementClient.New(*socket)
+	err := run(client, flag.Args(), *jsonOutput, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "scroogectl:", err)
+		os.Exit(1)
+	}
+}
+
+func run(
+	client *managementClient.Client,
+	args []string,
+	jsonOutput bool,
+	out io.Writer,
+) error {
+	command := args[0]
+	args = args[1:]
+
+	switch command {
+	case "status", "neighbors", "tunnels", "balances", "throttle", "keys":
+		if len(args) != 0 {
+			return errors.New(command + " takes no arguments")
+		}
+	case "hello":
+		if len(args) != 0 {
+			return errors.New("hello takes no arguments")
+		}
+		return client.SendHello()
+	case "tunnel", "kick":
+		if len(args) != 1 {
+			return errors.New("usage: scroogectl " + command + " <publicKey>")
+		}
+		if command == "tunnel" {
+			return client.RebuildTunnel(args[0])
+		}
+		return client.Kick(args[0])
+	case "pay":
+		if len(args) != 2 {
+			return errors.New("usage: scroogectl pay <publicKey> <amount>")
+		}
+		amount, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return errors.New("bad amount: " + args[1])
+		}
+		return client.Pay(args[0], amount)
+	case "credit":
+		if len(args) != 2 {
+			return errors.New("usage: scroogectl credit <publicKey> <amount>")
+		}
+		amount, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return errors.New("bad amount: " + args[1])
+		}
+		return client.AdjustCredit(args[0], amount)
+	case "events":
+		return streamEvents(client, args, jsonOutput, out)
+	default:
+		return errors.New("unknown command: " + command)
+	}
+
+	neighbors, err := client.Neighbors()
+	if err != nil {
+		return err
+	}
+
+	var table [][]string
+	var result interface{}
+	switch command {
+	case "status":
+		account, err := client.Account()
+		if err != nil {
+			return err
+		}
+		result, table = status(account, neighbors)
+	case "neighbors":
+		result, table = neighborTable(neighbors)
+	case "tunnels":
+		result, table = tunnelTable(neighbors)
+	case "balances":
+		result, table = balanceTable(neighbors)
+	case "throttle":
+		result, table = throttleTable(neighbors)
+	case "keys":
+		account, err := client.Account()
+		if err != nil {
+			return err
+		}
+		result, table = keyTable(account, neighbors)
+	}
+
+	if jsonOutput {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+	return printTable(out, table)
+}
+
+// streamEvents prints every event as a line of its own, as it comes.
+func streamEvents(
+	client *managementClient.Client,
+	eventTypes []string,
+	jsonOutput bool,
+	out io.Writer,
+) error {
+	encoder := json.NewEncoder(out)
+	return client.Events(eventTypes, func(event events.Event) error {
+		if jsonOutput {
+			return encoder.Encode(event)
+		}
+		_, err := fmt.Fprintln(out, formatEvent(event))
+		return err
+	})
+}
+
+func formatEvent(event events.Event) string {
+	line := event.Time.Format(time.RFC3339) + " " + string(event.Type)
+	if event.Neighbor != "" {
+		line = line + " " + event.Neighbor
+	}
+
+	// Only the details the type has are set
+	details := []struct {
+		name  string
+		value interface{}
+	}{
+		{"new key", event.NewPublicKey},
+		{"endpoint", event.Endpoint},
+		{"amount", event.Amount},
+		{"level", event.Level},
+		{"debt", event.Debt},
+		{"dropped", event.Dropped},
+	}
+	for _, detail := range details {
+		value := fmt.Sprint(detail.value)
+		if value != "" && value != "0" {
+			line = line + " " + detail.name + ": " + value
+		}
+	}
+	return line
+}
+
+func printTable(out io.Writer, table [][]string) error {
+	writer := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	for _, row := range table {
+		for i, cell := range row {
+			if i > 0 {
+				fmt.Fprint(writer, "\t")
+			}
+			fmt.Fprint(writer, cell)
+		}
+		fmt.Fprintln(writer)
+	}
+	return writer.Flush()
+}
+
+type statusResult struct {
+	Account   *types.AccountStatus
+	Neighbors int
+	Confirmed int
+	TunnelsUp int
+	Owed      int64 // Everything neighbors owe us
+	Paid      uint64
+	Received  uint64
+}
+
+func status(
+	account *types.AccountStatus,
+	neighbors []types.NeighborStatus,
+) (statusResult, [][]string) {
+	result := statusResult{
+		Account:   account,
+		Neighbors: len(neighbors),
+	}
+	for _, neighbor := range neighbors {
+		if neighbor.Confirmed {
+			result.Confirmed++
+		}
+		if neighbor.Tunnel.Up {
+			result.TunnelsUp++
+		}
+		if neighbor.Debt > 0 {
+			result.Owed = result.Owed + neighbor.Debt
+		}
+		result.Paid = result.Paid + neighbor.Balance.Paid
+		result.Received = result.Received + neighbor.Balance.Received
+	}
+
+	return result, [][]string{
+		{"public key:", account.PublicKey},
+		{"seqnum:", seqnum(account.Seqnum, account.SeqnumMode)},
+		{"price:", fmt.Sprint(account.Price)},
+		{"neighbors:", fmt.Sprintf("%v, %v confirmed", result.Neighbors, result.Confirmed)},
+		{"tunnels up:", fmt.Sprint(result.TunnelsUp)},
+		{"owed to us:", fmt.Sprint(result.Owed)},
+		{"paid:", fmt.Sprint(result.Paid)},
+		{"received:", fmt.Sprint(result.Received)},
+	}
+}
+
+func neighborTable(neighbors []types.NeighborStatus) ([]types.NeighborStatus, [][]string) {
+	if neighbors == nil {
+		neighbors = []types.NeighborStatus{}
+	}
+
+	table := [][]string{{"PUBLIC KEY", "ADDRESS", "CONFIRMED", "SEQNUM", "LAST SEEN", "PRICE"}}
+	for _, neighbor := range neighbors {
+		table = append(table, []string{
+			neighbor.PublicKey,
+			orNone(neighbor.Address),
+			yesNo(neighbor.Confirmed),
+			seqnum(neighbor.Seqnum, neighbor.SeqnumMode),
+			ago(neighbor.LastSeen),
+			fmt.Sprint(neighbor.Price),
+		})
+	}
+	return neighbors, table
+}
+
+type tunnelResult struct {
+	PublicKey string
+	types.TunnelStatus
+}
+
+func tunnelTable(neighbors []types.NeighborStatus) ([]tunnelResult, [][]string) {
+	result := []tunnelResult{}
+	table := [][]string{{"PUBLIC KEY", "UP", "INTERFACE", "ENDPOINT", "LISTEN PORT", "ROTATING"}}
+	for _, neighbor := range neighbors {
+		tunnel := neighbor.Tunnel
+		result = append(result, tunnelResult{neighbor.PublicKey, tunnel})
+		table = append(table, []string{
+			neighbor.PublicKey,
+			yesNo(tunnel.Up),
+			orNone(tunnel.VirtualInterface),
+			orNone(tunnel.Endpoint),
+			port(tunnel.ListenPort),
+			yesNo(tunnel.Rotating),
+		})
+	}
+	return result, table
+}
+
+type balanceResult struct {
+	PublicKey string
+	types.Balance
+	Debt int64
+}
+
+func balanceTable(neighbors []types.NeighborStatus) ([]balanceResult, [][]string) {
+	result := []balanceResult{}
+	table := [][]string{{"PUBLIC KEY", "BILLED", "RECEIVED", "PAID", "CREDIT", "DEBT", "DEBT SINCE"}}
+	for _, neighbor := range neighbors {
+		balance := neighbor.Balance
+		result = append(result, balanceResult{neighbor.PublicKey, balance, neighbor.Debt})
+		table = append(table, []string{
+			neighbor.PublicKey,
+			fmt.Sprint(balance.Billed),
+			fmt.Sprint(balance.Received),
+			fmt.Sprint(balance.Paid),
+			fmt.Sprint(balance.Credit),
+			fmt.Sprint(neighbor.Debt),
+			ago(balance.DebtSince),
+		})
+	}
+	return result, table
+}
+
+type throttleResult struct {
+	PublicKey string
+	Debt      int64
+	types.ThrottleStatus
+}
+
+func throttleTable(neighbors []types.NeighborStatus) ([]throttleResult, [][]string) {
+	result := []throttleResult{}
+	table := [][]string{{"PUBLIC KEY", "LEVEL", "DEBT", "EFFECTIVE DEBT", "REASON"}}
+	for _, neighbor := range neighbors {
+		throttle := neighbor.Throttle
+		result = append(result, throttleResult{neighbor.PublicKey, neighbor.Debt, throttle})
+		table = append(table, []string{
+			neighbor.PublicKey,
+			throttle.Level,
+			fmt.Sprint(neighbor.Debt),
+			fmt.Sprint(throttle.EffectiveDebt),
+			throttle.Reason,
+		})
+	}
+	return result, table
+}
+
+type keyResult struct {
+	PublicKey       string
+	TunnelPublicKey string // Shared by every tunnel, if they don't have keys of their own
+	Certificate     string
+	Tunnels         []tunnelKeyResult
+}
+
+type tunnelKeyResult struct {
+	Neighbor       string
+	LocalPublicKey string
+	PeerPublicKey  string
+	Created        time.Time
+	Rotating       bool
+}
+
+func keyTable(
+	account *types.AccountStatus,
+	neighbors []types.NeighborStatus,
+) (keyResult, [][]string) {
+	result := keyResult{
+		PublicKey:       account.PublicKey,
+		TunnelPublicKey: account.TunnelPublicKey,
+		Certificate:     account.Certificate,
+		Tunnels:         []tunnelKeyResult{},
+	}
+
+	table := [][]string{
+		{"identity:", account.PublicKey},
+		{"tunnel:", orNone(account.TunnelPublicKey)},
+		{"certificate:", yesNo(account.Certificate != "")},
+		{},
+		{"NEIGHBOR", "OUR TUNNEL KEY", "CREATED", "ROTATING", "NEIGHBOR TUNNEL KEY"},
+	}
+	for _, neighbor := range neighbors {
+		tunnel := neighbor.Tunnel
+		result.Tunnels = append(result.Tunnels, tunnelKeyResult{
+			Neighbor:       neighbor.PublicKey,
+			LocalPublicKey: tunnel.LocalPublicKey,
+			PeerPublicKey:  tunnel.PublicKey,
+			Created:        tunnel.KeyCreated,
+			Rotating:       tunnel.Rotating,
+		})
+		table = append(table, []string{
+			neighbor.PublicKey,
+			orNone(tunnel.LocalPublicKey),
+			ago(tunnel.KeyCreated),
+			yesNo(tunnel.Rotating),
+			orNone(tunnel.PublicKey),
+		})
+	}
+	return result, table
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func seqnum(seqnum uint64, mode string) string {
+	if mode == "" {
+		return fmt.Sprint(seqnum)
+	}
+	return fmt.Sprintf("%v (%v)", seqnum, mode)
+}
+
+func port(p int) string {
+	if p == 0 {
+		return "-"
+	}
+	return strconv.Itoa(p)
+}
+
+// ago is how long ago t was, to the second.
+func ago(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return time.Since(t).Round(time.Second).String() + " ago"
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agl/ed25519"
+	"github.com/incentivized-mesh-infrastructure/scrooge/events"
+	"github.com/incentivized-mesh-infrastructure/scrooge/ledger"
+	"github.com/incentivized-mesh-infrastructure/scrooge/managementAPI"
+	"github.com/incentivized-mesh-infrastructure/scrooge/managementClient"
+	"github.com/incentivized-mesh-infrastructure/scrooge/scheduler"
+	"github.com/incentivized-mesh-infrastructure/scrooge/throttle"
+	"github.com/incentivized-mesh-infrastructure/scrooge/types"
+)
+
+var (
+	pubkey1 = [ed25519.PublicKeySize]byte{44, 176, 80, 246, 247, 71, 5, 229, 108, 111, 158, 77, 18, 116, 98, 28, 84, 59, 215, 93, 182, 34, 240, 5, 147, 229, 211, 253, 44, 221, 237, 85}
+	b64key1 = "LLBQ9vdHBeVsb55NEnRiHFQ71122IvAFk+XT/Szd7VU="
+)
+
+type fakeNeighborAPI struct {
+	neighbors []types.Neighbor
+	paid      uint64
+}
+
+func (self *fakeNeighborAPI) ListNeighbors() []types.Neighbor {
+	return self.neighbors
+}
+
+func (self *fakeNeighborAPI) AccountInfo() types.Account {
+	return types.Account{PublicKey: pubkey1, Seqnum: 12, SeqnumMode: "counter"}
+}
+
+func (self *fakeNeighborAPI) SendHelloMsg(*net.Interface) error {
+	return nil
+}
+
+func (self *fakeNeighborAPI) RebuildTunnel([ed25519.PublicKeySize]byte, *net.Interface) error {
+	return nil
+}
+
+func (self *fakeNeighborAPI) RemoveNeighbor([ed25519.PublicKeySize]byte) error {
+	self.neighbors = nil
+	return nil
+}
+
+func (self *fakeNeighborAPI) SendVoucherMsg(
+	publicKey [ed25519.PublicKeySize]byte,
+	iface *net.Interface,
+	amount uint64,
+) error {
+	self.paid = self.paid + amount
+	return nil
+}
+
+func serve(t *testing.T) (*managementClient.Client, *fakeNeighborAPI, *ledger.Ledger) {
+	dir, err := ioutil.TempDir("", "scroogectl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	fakeAPI := &fakeNeighborAPI{
+		neighbors: []types.Neighbor{{
+			PublicKey: pubkey1,
+			Confirmed: true,
+			Seqnum:    9,
+			LastSeen:  time.Now(),
+			Tunnel: types.Tunnel{
+				ListenPort:       51820,
+				VirtualInterface: net.Interface{Name: "wg0"},
+			},
+		}},
+	}
+	l := ledger.New(nil)
+
+	server := &managementAPI.Server{
+		NeighborAPI: fakeAPI,
+		Ledger:      l,
+		Payments:    &scheduler.Scheduler{NeighborAPI: fakeAPI, Ledger: l},
+		Throttle:    &throttle.Policy{SoftDebt: 50, HardDebt: 100},
+		Interfaces:  []*net.Interface{{Name: "eth0"}},
+	}
+
+	path := filepath.Join(dir, "scrooge.sock")
+	go server.Listen(path)
+	t.Cleanup(func() { server.Close() })
+
+	for i := 0; i < 100; i++ {
+		_, err = os.Stat(path)
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return managementClient.New(path), fakeAPI, l
+}
+
+func TestTables(t *testing.T) {
+	client, _, l := serve(t)
+	l.Record(pubkey1, ledger.UsageBilled, 120, time.Now())
+
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{"status", []string{"public key:", b64key1, "12 (counter)", "1, 1 confirmed", "owed to us:  120"}},
+		{"neighbors", []string{"PUBLIC KEY", b64key1, "yes        9 "}},
+		{"tunnels", []string{"LISTEN PORT", "wg0", "51820"}},
+		{"balances", []string{"BILLED", "120"}},
+		{"throttle", []string{"REASON", "hard", "reached hard cutoff debt of 100"}},
+		{"keys", []string{"identity:", "OUR TUNNEL KEY"}},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		err := run(client, []string{test.command}, false, &out)
+		if err != nil {
+			t.Fatal(test.command, ": ", err)
+		}
+
+		for _, want := range test.want {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("%v: %q not in\n%v", test.command, want, out.String())
+			}
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	client, _, l := serve(t)
+	l.Record(pubkey1, ledger.UsageBilled, 120, time.Now())
+
+	var out bytes.Buffer
+	err := run(client, []string{"balances"}, true, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var balances []balanceResult
+	err = json.Unmarshal(out.Bytes(), &balances)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(balances) != 1 || balances[0].PublicKey != b64key1 || balances[0].Debt != 120 {
+		t.Fatalf("wrong balances: %+v", balances)
+	}
+}
+
+func TestActions(t *testing.T) {
+	client, fakeAPI, l := serve(t)
+
+	var out bytes.Buffer
+	err := run(client, []string{"pay", b64key1, "30"}, false, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fakeAPI.paid != 30 || l.Balance(pubkey1).Paid != 30 {
+		t.Fatal("payment not sent: ", fakeAPI.paid)
+	}
+
+	err = run(client, []string{"credit", b64key1, "10"}, false, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Balance(pubkey1).Credit != 10 {
+		t.Fatal("credit not given: ", l.Balance(pubkey1))
+	}
+
+	for _, args := range [][]string{
+		{"pay", b64key1},
+		{"pay", b64key1, "-3"},
+		{"credit", b64key1, "lots"},
+		{"neighbors", "extra"},
+		{"dance"},
+	} {
+		err = run(client, args, false, &out)
+		if err == nil {
+			t.Errorf("%v: no error", args)
+		}
+	}
+}
+
+func TestFormatEvent(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		event events.Event
+		want  string
+	}{
+		{
+			events.Event{Type: events.PaymentReceived, Time: at, Neighbor: b64key1, Amount: 25},
+			"2024-05-01T12:00:00Z payment_received " + b64key1 + " amount: 25",
+		},
+		{
+			events.Event{Type: events.BalanceThreshold, Time: at, Neighbor: b64key1, Level: "soft", Debt: -3},
+			"2024-05-01T12:00:00Z balance_threshold " + b64key1 + " level: soft debt: -3",
+		},
+		{
+			events.Event{Type: events.Overflow, Time: at, Dropped: 4},
+			"2024-05-01T12:00:00Z overflow dropped: 4",
+		},
+	}
+
+	for _, test := range tests {
+		got := formatEvent(test.event)
+		if got != test.want {
+			t.Errorf("got %q, should be %q", got, test.want)
+		}
+	}
+}
@@ -1,19 +1,21 @@
 package serialization
 
 import (
+	"crypto/rand"
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"log"
 	"strings"
 
 	"strconv"
 
 	"github.com/agl/ed25519"
+	"github.com/agl/ed25519/extra25519"
 	"github.com/incentivized-mesh-infrastructure/scrooge/types"
+	"golang.org/x/crypto/nacl/box"
 )
 
-// scrooge_hello[_confirm] <SourcePublicKey> <seqnum> <signature>
+// scrooge_hello[_confirm] <sourcePublicKey> <destinationPublicKey> <seqnum mode> <nonce> [<certificate>] <seqnum> <signature>
 func FmtHelloMsg(
 	msg types.HelloMessage,
 	privateKey [ed25519.PrivateKeySize]byte,
@@ -27,35 +29,59 @@ func FmtHelloMsg(
 	}
 
 	s := fmt.Sprintf(
-		"%v %v %v %v",
+		"%v %v %v %v %v",
 		msgType,
 		base64.StdEncoding.EncodeToString(msg.SourcePublicKey[:]),
 		base64.StdEncoding.EncodeToString(msg.DestinationPublicKey[:]),
-		msg.Seqnum,
+		msg.SeqnumMode,
+		base64.StdEncoding.EncodeToString(msg.Nonce[:]),
 	)
 
+	if msg.Certificate != "" {
+		s = s + " " + msg.Certificate
+	}
+
+	s = s + " " + strconv.FormatUint(msg.Seqnum, 10)
+
 	sig := ed25519.Sign(&privateKey, []byte(s))
 
 	return s + " " + base64.StdEncoding.EncodeToString(sig[:]), nil
 }
 
 func ParseHelloMsg(msg []string, confirm bool) (*types.HelloMessage, error) {
+	if len(msg) != 7 && len(msg) != 8 {
+		return nil, errors.New("malformed hello message")
+	}
+
 	messageMetadata, err := verifyMessage(msg)
 	if err != nil {
 		return nil, err
 	}
 
+	nonce, err := base64.StdEncoding.DecodeString(msg[4])
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != types.NonceSize {
+		return nil, errors.New("malformed hello nonce")
+	}
+
 	h := &types.HelloMessage{
 		MessageMetadata: *messageMetadata,
+		SeqnumMode:      msg[3],
 		Confirm:         confirm,
 	}
+	copy(h.Nonce[:], nonce)
 
-	log.Printf("parsed HelloMessage: %+v\n", h)
+	if len(msg) == 8 {
+		h.Certificate = msg[5]
+	}
 
 	return h, nil
 }
 
-// scrooge_tunnel[_confirm] <sourcePublicKey> <destinationPublicKey> <tunnel publicKey> <tunnel endpoint> <seq num> <signature>
+// scrooge_tunnel <sourcePublicKey> <destinationPublicKey> <tunnel publicKey> <tunnel endpoint> <price> <seq num> <signature>
+// scrooge_tunnel_confirm <sourcePublicKey> <destinationPublicKey> <tunnel publicKey> <tunnel endpoint> <price> <confirmed tunnel publicKey> <seq num> <signature>
 func FmtTunnelMsg(
 	msg types.TunnelMessage,
 	privateKey [ed25519.PrivateKeySize]byte,
@@ -75,32 +101,302 @@ func FmtTunnelMsg(
 		base64.StdEncoding.EncodeToString(msg.DestinationPublicKey[:]),
 		msg.TunnelPublicKey,
 		msg.TunnelEndpoint,
-		msg.Seqnum,
+		msg.Price,
 	)
 
+	if msg.Confirm {
+		s = s + " " + msg.ConfirmedPublicKey
+	}
+
+	s = s + " " + strconv.FormatUint(msg.Seqnum, 10)
+
 	sig := ed25519.Sign(&privateKey, []byte(s))
 
 	return s + " " + base64.StdEncoding.EncodeToString(sig[:]), nil
 }
 
 func ParseTunnelMsg(msg []string, confirm bool) (*types.TunnelMessage, error) {
+	if (!confirm && len(msg) != 8) || (confirm && len(msg) != 9) {
+		return nil, errors.New("malformed tunnel message")
+	}
+
 	messageMetadata, err := verifyMessage(msg)
 	if err != nil {
 		return nil, err
 	}
 
+	price, err := strconv.ParseUint(msg[5], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
 	m := &types.TunnelMessage{
 		MessageMetadata: *messageMetadata,
 		TunnelPublicKey: msg[3],
 		TunnelEndpoint:  msg[4],
+		Price:           price,
 		Confirm:         confirm,
 	}
 
-	log.Printf("parsed TunnelMessage: %+v\n", m)
+	if confirm {
+		m.ConfirmedPublicKey = msg[6]
+	}
+
+	return m, nil
+}
+
+// scrooge_voucher <sourcePublicKey> <destinationPublicKey> <amount> <seqnum> <signature>
+func FmtVoucherMsg(
+	msg types.VoucherMessage,
+	privateKey [ed25519.PrivateKeySize]byte,
+) (string, error) {
+	s := fmt.Sprintf(
+		"%v %v %v %v %v",
+		"scrooge_voucher",
+		base64.StdEncoding.EncodeToString(msg.SourcePublicKey[:]),
+		base64.StdEncoding.EncodeToString(msg.DestinationPublicKey[:]),
+		msg.Amount,
+		msg.Seqnum,
+	)
+
+	sig := ed25519.Sign(&privateKey, []byte(s))
+
+	return s + " " + base64.StdEncoding.EncodeToString(sig[:]), nil
+}
+
+func ParseVoucherMsg(msg []string) (*types.VoucherMessage, error) {
+	if len(msg) != 6 {
+		return nil, errors.New("malformed voucher message")
+	}
+
+	messageMetadata, err := verifyMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	amount, err := strconv.ParseUint(msg[3], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &types.VoucherMessage{
+		MessageMetadata: *messageMetadata,
+		Amount:          amount,
+	}
+
+	return v, nil
+}
+
+// scrooge_rotate <old publicKey> <destinationPublicKey> <new publicKey> <new key signature> <seqnum> <signature>
+//
+// The new key signs the message without either signature, and the old key
+// signs all of it, so each key vouches for the other.
+func FmtKeyRotationMsg(
+	msg types.KeyRotationMessage,
+	oldPrivateKey [ed25519.PrivateKeySize]byte,
+	newPrivateKey [ed25519.PrivateKeySize]byte,
+) (string, error) {
+	newSig := ed25519.Sign(&newPrivateKey, []byte(keyRotationSigned(
+		msg.SourcePublicKey,
+		msg.DestinationPublicKey,
+		msg.NewPublicKey,
+		strconv.FormatUint(msg.Seqnum, 10),
+	)))
+
+	s := fmt.Sprintf(
+		"%v %v %v %v %v %v",
+		"scrooge_rotate",
+		base64.StdEncoding.EncodeToString(msg.SourcePublicKey[:]),
+		base64.StdEncoding.EncodeToString(msg.DestinationPublicKey[:]),
+		base64.StdEncoding.EncodeToString(msg.NewPublicKey[:]),
+		base64.StdEncoding.EncodeToString(newSig[:]),
+		msg.Seqnum,
+	)
+
+	sig := ed25519.Sign(&oldPrivateKey, []byte(s))
+
+	return s + " " + base64.StdEncoding.EncodeToString(sig[:]), nil
+}
+
+func ParseKeyRotationMsg(msg []string) (*types.KeyRotationMessage, error) {
+	if len(msg) != 7 {
+		return nil, errors.New("malformed key rotation message")
+	}
+
+	messageMetadata, err := verifyMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	npk, err := base64.StdEncoding.DecodeString(msg[3])
+	if err != nil {
+		return nil, err
+	}
+	if len(npk) != ed25519.PublicKeySize {
+		return nil, errors.New("malformed new public key")
+	}
+	newPublicKey := types.BytesToPublicKey(npk)
+
+	nsig, err := base64.StdEncoding.DecodeString(msg[4])
+	if err != nil {
+		return nil, err
+	}
+	newSignature := types.BytesToSignature(nsig)
+
+	if !ed25519.Verify(
+		&newPublicKey,
+		[]byte(keyRotationSigned(
+			messageMetadata.SourcePublicKey,
+			messageMetadata.DestinationPublicKey,
+			newPublicKey,
+			msg[5],
+		)),
+		&newSignature,
+	) {
+		return nil, errors.New("new key signature not valid")
+	}
+
+	r := &types.KeyRotationMessage{
+		MessageMetadata: *messageMetadata,
+		NewPublicKey:    newPublicKey,
+		NewSignature:    newSignature,
+	}
+
+	return r, nil
+}
+
+// keyRotationSigned is what the new key signs in a key rotation message.
+func keyRotationSigned(
+	oldPublicKey [ed25519.PublicKeySize]byte,
+	destinationPublicKey [ed25519.PublicKeySize]byte,
+	newPublicKey [ed25519.PublicKeySize]byte,
+	seqnum string,
+) string {
+	return fmt.Sprintf(
+		"%v %v %v %v %v",
+		"scrooge_rotate",
+		base64.StdEncoding.EncodeToString(oldPublicKey[:]),
+		base64.StdEncoding.EncodeToString(destinationPublicKey[:]),
+		base64.StdEncoding.EncodeToString(newPublicKey[:]),
+		seqnum,
+	)
+}
+
+// scrooge_sealed <sourcePublicKey> <destinationPublicKey> <sealed message> <seqnum> <signature>
+//
+// The sealed message is a random nonce followed by the inner message, boxed
+// with the X25519 keys that go with the ed25519 keys of source and
+// destination. The outer signature still covers everything, so anyone can
+// check who sent it, but only the destination can read it.
+func FmtSealedMsg(
+	msg types.SealedMessage,
+	privateKey [ed25519.PrivateKeySize]byte,
+) (string, error) {
+	var curvePrivateKey, curvePublicKey [32]byte
+	extra25519.PrivateKeyToCurve25519(&curvePrivateKey, &privateKey)
+	if !extra25519.PublicKeyToCurve25519(
+		&curvePublicKey,
+		&msg.DestinationPublicKey,
+	) {
+		return "", errors.New("destination public key not valid")
+	}
+
+	var nonce [24]byte
+	_, err := rand.Read(nonce[:])
+	if err != nil {
+		return "", err
+	}
+
+	sealed := box.Seal(
+		nonce[:],
+		[]byte(msg.Inner),
+		&nonce,
+		&curvePublicKey,
+		&curvePrivateKey,
+	)
+
+	s := fmt.Sprintf(
+		"%v %v %v %v %v",
+		"scrooge_sealed",
+		base64.StdEncoding.EncodeToString(msg.SourcePublicKey[:]),
+		base64.StdEncoding.EncodeToString(msg.DestinationPublicKey[:]),
+		base64.StdEncoding.EncodeToString(sealed),
+		msg.Seqnum,
+	)
+
+	sig := ed25519.Sign(&privateKey, []byte(s))
+
+	return s + " " + base64.StdEncoding.EncodeToString(sig[:]), nil
+}
+
+// ParseSealedMsg checks the signature of a sealed message and opens it with
+// privateKey, which has to belong to the destination.
+func ParseSealedMsg(
+	msg []string,
+	privateKey [ed25519.PrivateKeySize]byte,
+) (*types.SealedMessage, error) {
+	if len(msg) != 6 {
+		return nil, errors.New("malformed sealed message")
+	}
+
+	messageMetadata, err := verifyMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(msg[3])
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < 24+box.Overhead {
+		return nil, errors.New("malformed sealed message")
+	}
+
+	var curvePrivateKey, curvePublicKey [32]byte
+	extra25519.PrivateKeyToCurve25519(&curvePrivateKey, &privateKey)
+	if !extra25519.PublicKeyToCurve25519(
+		&curvePublicKey,
+		&messageMetadata.SourcePublicKey,
+	) {
+		return nil, errors.New("source public key not valid")
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], sealed[:24])
+
+	inner, ok := box.Open(
+		nil,
+		sealed[24:],
+		&nonce,
+		&curvePublicKey,
+		&curvePrivateKey,
+	)
+	if !ok {
+		return nil, errors.New("sealed message could not be opened")
+	}
+
+	m := &types.SealedMessage{
+		MessageMetadata: *messageMetadata,
+		Inner:           string(inner),
+	}
 
 	return m, nil
 }
 
+// ErrSignature is returned for messages whose signature is not valid.
+var ErrSignature = errors.New("signature not valid")
+
+// VerifyMsg checks the signature of a message of any type, without parsing
+// the rest of it.
+func VerifyMsg(msg []string) (*types.MessageMetadata, error) {
+	// Every message has a type, both public keys, a seqnum and a signature
+	if len(msg) < 5 || !strings.HasPrefix(msg[0], "scrooge_") {
+		return nil, errors.New("not a scrooge message")
+	}
+
+	return verifyMessage(msg)
+}
+
 func verifyMessage(msg []string) (*types.MessageMetadata, error) {
 	sig, err := base64.StdEncoding.DecodeString(msg[len(msg)-1])
 	if err != nil {
@@ -123,7 +419,7 @@ func verifyMessage(msg []string) (*types.MessageMetadata, error) {
 	msgWithOutSig := strings.Join(msg[:len(msg)-1], " ")
 
 	if !ed25519.Verify(&sourcePublicKey, []byte(msgWithOutSig), &signature) {
-		return nil, errors.New("signature not valid")
+		return nil, ErrSignature
 	}
 
 	seqnum, err := strconv.ParseUint(msg[len(msg)-2], 10, 64)
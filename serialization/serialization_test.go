@@ -1,6 +1,7 @@
 package serialization
 
 import (
+	"crypto/rand"
 	"testing"
 
 	"strings"
@@ -14,17 +15,22 @@ var (
 	privkey1                    = &[ed25519.PrivateKeySize]byte{112, 69, 149, 144, 72, 233, 25, 188, 124, 215, 67, 200, 213, 237, 133, 127, 215, 253, 230, 134, 26, 202, 25, 214, 36, 19, 233, 87, 212, 169, 119, 226, 44, 176, 80, 246, 247, 71, 5, 229, 108, 111, 158, 77, 18, 116, 98, 28, 84, 59, 215, 93, 182, 34, 240, 5, 147, 229, 211, 253, 44, 221, 237, 85}
 	pubkey2                     = &[ed25519.PublicKeySize]byte{175, 110, 12, 95, 82, 169, 239, 109, 41, 163, 183, 93, 77, 197, 35, 41, 35, 203, 94, 200, 216, 6, 41, 129, 170, 12, 8, 97, 211, 28, 123, 162}
 	privkey2                    = &[ed25519.PrivateKeySize]byte{13, 170, 251, 93, 50, 201, 207, 72, 224, 172, 35, 48, 16, 245, 116, 20, 88, 33, 155, 12, 226, 126, 59, 36, 184, 111, 95, 87, 156, 104, 140, 243, 175, 110, 12, 95, 82, 169, 239, 109, 41, 163, 183, 93, 77, 197, 35, 41, 35, 203, 94, 200, 216, 6, 41, 129, 170, 12, 8, 97, 211, 28, 123}
-	helloMessage                = "scrooge_hello LLBQ9vdHBeVsb55NEnRiHFQ71122IvAFk+XT/Szd7VU= AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA= 12 pTzFklgbgNzu3YE2QzZplNlBdPJ7hcFZikhlFLsfbxwKFodwiXxvbtcvsrXEMQ3fUy0x0tMMyAGhXZIMpAbaDA=="
-	helloConfirmMessage         = "scrooge_hello_confirm LLBQ9vdHBeVsb55NEnRiHFQ71122IvAFk+XT/Szd7VU= AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA= 12 X4uoX9n1JyJbAKj2znT6wERkvJbWbR2yI3+m2okUax34oMy7lwNKx5jaeSxdiAufP+tnRJrs02E9Gad+VKJUAQ=="
-	tunnelMessage               = "scrooge_tunnel LLBQ9vdHBeVsb55NEnRiHFQ71122IvAFk+XT/Szd7VU= r24MX1Kp720po7ddTcUjKSPLXsjYBimBqgwIYdMce6I= flerp 3.3.3.3:8000 12 kaklnXMRGqs/9GCh8D0TWlYRjIMXNSugJQYuHolfa0ERsHbLpstCUs6kzXISwb6TX2E/ultWHjkDd1vkK6BrBA=="
-	tunnelConfirmMessage        = "scrooge_tunnel_confirm LLBQ9vdHBeVsb55NEnRiHFQ71122IvAFk+XT/Szd7VU= r24MX1Kp720po7ddTcUjKSPLXsjYBimBqgwIYdMce6I= flerp 3.3.3.3:8000 12 nKOU7/fQLFgWffp6VQ0H2WKz68L8NFXy7CW9ku8zy7BJqGpmTnjaeJiomBkPpwo/6nmPIL69sAIW8iOv6vqvDw=="
+	helloMessage                = "scrooge_hello LLBQ9vdHBeVsb55NEnRiHFQ71122IvAFk+XT/Szd7VU= AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA= counter AQIDBAUGBwgJCgsMDQ4PEA== 12 uvOCUOlMnDbK41nwZ4FaTwTOeuSl/O+9sUC0NHLggRzxSpv3yLyVeijIKJ5nWO2KQL+uQEjFaKiKCKfbYbW+Bw=="
+	helloConfirmMessage         = "scrooge_hello_confirm LLBQ9vdHBeVsb55NEnRiHFQ71122IvAFk+XT/Szd7VU= AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA= counter AQIDBAUGBwgJCgsMDQ4PEA== 12 Cx401JyiDR0NxfD9AZlBqUUJ72aQTSWG0gd8xMkWQ4l67sZ7ydqIyXbCRjWtw5Ukh//IClmYFyw/tq0YNqg4AA=="
+	tunnelMessage               = "scrooge_tunnel LLBQ9vdHBeVsb55NEnRiHFQ71122IvAFk+XT/Szd7VU= r24MX1Kp720po7ddTcUjKSPLXsjYBimBqgwIYdMce6I= flerp 3.3.3.3:8000 50 12 6esYdaZkTsN4H79lxvlZPxZLtDGYUmioK+AtqVhg5ahBO2k4k/rQdM01I3z8Aw5QtR2Gr2hzhsj/TJzZY54NAQ=="
+	tunnelConfirmMessage        = "scrooge_tunnel_confirm LLBQ9vdHBeVsb55NEnRiHFQ71122IvAFk+XT/Szd7VU= r24MX1Kp720po7ddTcUjKSPLXsjYBimBqgwIYdMce6I= flerp 3.3.3.3:8000 50 derp 12 SMRNHiBTZ080kjg8pxphXxOdWjzz7gjkH0pBsV1Ty/2pPHJ53/GyARhMdWVSNGlSYMBaZC4/fZCiBdSEhGAwBw=="
+	voucherMessage              = "scrooge_voucher LLBQ9vdHBeVsb55NEnRiHFQ71122IvAFk+XT/Szd7VU= r24MX1Kp720po7ddTcUjKSPLXsjYBimBqgwIYdMce6I= 1000 12 /WNwEbGUmKD7RdEty5WwV9qfgv9BdP92gVDkmGQmXQhIUtiSY2naIGizJ0Hb0ATv7uJ9yXkOreLJHuI48Q1BCA=="
 	iface1                      = "eth0"
 	seqnum1              uint64 = 12
 	seqnum2              uint64 = 22
+	seqnumMode1                 = "counter"
+	nonce1                      = [types.NonceSize]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
 	tunnelEndpoint1             = "2.2.2.2:8000"
 	tunnelPubkey1               = "derp"
 	tunnelEndpoint2             = "3.3.3.3:8000"
 	tunnelPubkey2               = "flerp"
+	tunnelPrice2         uint64 = 50
+	voucherAmount1       uint64 = 1000
 )
 
 func TestFmtHello(t *testing.T) {
@@ -47,7 +53,9 @@ func testFmtHello(t *testing.T, confirm bool) {
 			Seqnum:          acct.Seqnum,
 			SourcePublicKey: acct.PublicKey,
 		},
-		Confirm: confirm,
+		SeqnumMode: seqnumMode1,
+		Nonce:      nonce1,
+		Confirm:    confirm,
 	}
 
 	s, err := FmtHelloMsg(msg, acct.PrivateKey)
@@ -92,6 +100,12 @@ func testParseHello(t *testing.T, confirm bool) {
 	if msg.SourcePublicKey != *pubkey1 {
 		t.Fatal("msg.PublicKey incorrect")
 	}
+	if msg.Nonce != nonce1 {
+		t.Fatal("msg.Nonce incorrect", msg.Nonce)
+	}
+	if msg.SeqnumMode != seqnumMode1 {
+		t.Fatal("msg.SeqnumMode incorrect", msg.SeqnumMode)
+	}
 	if msg.Seqnum != seqnum1 {
 		t.Fatal("msg.Seqnum incorrect")
 	}
@@ -102,9 +116,9 @@ func testParseHello(t *testing.T, confirm bool) {
 	var sig [ed25519.SignatureSize]byte
 
 	if confirm {
-		sig = [ed25519.SignatureSize]byte{0x5f, 0x8b, 0xa8, 0x5f, 0xd9, 0xf5, 0x27, 0x22, 0x5b, 0x0, 0xa8, 0xf6, 0xce, 0x74, 0xfa, 0xc0, 0x44, 0x64, 0xbc, 0x96, 0xd6, 0x6d, 0x1d, 0xb2, 0x23, 0x7f, 0xa6, 0xda, 0x89, 0x14, 0x6b, 0x1d, 0xf8, 0xa0, 0xcc, 0xbb, 0x97, 0x3, 0x4a, 0xc7, 0x98, 0xda, 0x79, 0x2c, 0x5d, 0x88, 0xb, 0x9f, 0x3f, 0xeb, 0x67, 0x44, 0x9a, 0xec, 0xd3, 0x61, 0x3d, 0x19, 0xa7, 0x7e, 0x54, 0xa2, 0x54, 0x1}
+		sig = [ed25519.SignatureSize]byte{0xb, 0x1e, 0x34, 0xd4, 0x9c, 0xa2, 0xd, 0x1d, 0xd, 0xc5, 0xf0, 0xfd, 0x1, 0x99, 0x41, 0xa9, 0x45, 0x9, 0xef, 0x66, 0x90, 0x4d, 0x25, 0x86, 0xd2, 0x7, 0x7c, 0xc4, 0xc9, 0x16, 0x43, 0x89, 0x7a, 0xee, 0xc6, 0x7b, 0xc9, 0xda, 0x88, 0xc9, 0x76, 0xc2, 0x46, 0x35, 0xad, 0xc3, 0x95, 0x24, 0x87, 0xff, 0xc8, 0xa, 0x59, 0x98, 0x17, 0x2c, 0x3f, 0xb6, 0xad, 0x18, 0x36, 0xa8, 0x38, 0x0}
 	} else {
-		sig = [ed25519.SignatureSize]byte{0xa5, 0x3c, 0xc5, 0x92, 0x58, 0x1b, 0x80, 0xdc, 0xee, 0xdd, 0x81, 0x36, 0x43, 0x36, 0x69, 0x94, 0xd9, 0x41, 0x74, 0xf2, 0x7b, 0x85, 0xc1, 0x59, 0x8a, 0x48, 0x65, 0x14, 0xbb, 0x1f, 0x6f, 0x1c, 0xa, 0x16, 0x87, 0x70, 0x89, 0x7c, 0x6f, 0x6e, 0xd7, 0x2f, 0xb2, 0xb5, 0xc4, 0x31, 0xd, 0xdf, 0x53, 0x2d, 0x31, 0xd2, 0xd3, 0xc, 0xc8, 0x1, 0xa1, 0x5d, 0x92, 0xc, 0xa4, 0x6, 0xda, 0xc}
+		sig = [ed25519.SignatureSize]byte{0xba, 0xf3, 0x82, 0x50, 0xe9, 0x4c, 0x9c, 0x36, 0xca, 0xe3, 0x59, 0xf0, 0x67, 0x81, 0x5a, 0x4f, 0x4, 0xce, 0x7a, 0xe4, 0xa5, 0xfc, 0xef, 0xbd, 0xb1, 0x40, 0xb4, 0x34, 0x72, 0xe0, 0x81, 0x1c, 0xf1, 0x4a, 0x9b, 0xf7, 0xc8, 0xbc, 0x95, 0x7a, 0x28, 0xc8, 0x28, 0x9e, 0x67, 0x58, 0xed, 0x8a, 0x40, 0xbf, 0xae, 0x40, 0x48, 0xc5, 0x68, 0xa8, 0x8a, 0x8, 0xa7, 0xdb, 0x61, 0xb5, 0xbe, 0x7}
 	}
 
 	if msg.Signature != sig {
@@ -112,6 +126,32 @@ func testParseHello(t *testing.T, confirm bool) {
 	}
 }
 
+func TestHelloCertificate(t *testing.T) {
+	msg := types.HelloMessage{
+		MessageMetadata: types.MessageMetadata{
+			Seqnum:          seqnum1,
+			SourcePublicKey: *pubkey1,
+		},
+		SeqnumMode:  seqnumMode1,
+		Nonce:       nonce1,
+		Certificate: "c2Nyb29nZV9jZXJ0aWZpY2F0ZQ==",
+	}
+
+	s, err := FmtHelloMsg(msg, *privkey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseHelloMsg(strings.Split(s, " "), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.Certificate != msg.Certificate || parsed.Seqnum != seqnum1 {
+		t.Fatalf("hello incorrect: %+v", parsed)
+	}
+}
+
 func TestFmtTunnel(t *testing.T) {
 	testFmtTunnel(t, false)
 }
@@ -143,8 +183,12 @@ func testFmtTunnel(t *testing.T, confirm bool) {
 		},
 		TunnelEndpoint:  neighbor.Tunnel.Endpoint,
 		TunnelPublicKey: neighbor.Tunnel.PublicKey,
+		Price:           tunnelPrice2,
 		Confirm:         confirm,
 	}
+	if confirm {
+		msg.ConfirmedPublicKey = tunnelPubkey1
+	}
 
 	s, err := FmtTunnelMsg(msg, acct.PrivateKey)
 	if err != nil {
@@ -194,6 +238,12 @@ func testParseTunnel(t *testing.T, confirm bool) {
 	if msg.TunnelPublicKey != tunnelPubkey2 {
 		t.Fatal("msg.TunnelPublicKey incorrect", msg.TunnelPublicKey)
 	}
+	if msg.Price != tunnelPrice2 {
+		t.Fatal("msg.Price incorrect", msg.Price)
+	}
+	if confirm && msg.ConfirmedPublicKey != tunnelPubkey1 {
+		t.Fatal("msg.ConfirmedPublicKey incorrect", msg.ConfirmedPublicKey)
+	}
 	if msg.Seqnum != seqnum1 {
 		t.Fatal("msg.Seqnum incorrect")
 	}
@@ -204,12 +254,217 @@ func testParseTunnel(t *testing.T, confirm bool) {
 	var sig [ed25519.SignatureSize]byte
 
 	if confirm {
-		sig = [ed25519.SignatureSize]byte{0x9c, 0xa3, 0x94, 0xef, 0xf7, 0xd0, 0x2c, 0x58, 0x16, 0x7d, 0xfa, 0x7a, 0x55, 0xd, 0x7, 0xd9, 0x62, 0xb3, 0xeb, 0xc2, 0xfc, 0x34, 0x55, 0xf2, 0xec, 0x25, 0xbd, 0x92, 0xef, 0x33, 0xcb, 0xb0, 0x49, 0xa8, 0x6a, 0x66, 0x4e, 0x78, 0xda, 0x78, 0x98, 0xa8, 0x98, 0x19, 0xf, 0xa7, 0xa, 0x3f, 0xea, 0x79, 0x8f, 0x20, 0xbe, 0xbd, 0xb0, 0x2, 0x16, 0xf2, 0x23, 0xaf, 0xea, 0xfa, 0xaf, 0xf}
+		sig = [ed25519.SignatureSize]byte{0x48, 0xc4, 0x4d, 0x1e, 0x20, 0x53, 0x67, 0x4f, 0x34, 0x92, 0x38, 0x3c, 0xa7, 0x1a, 0x61, 0x5f, 0x13, 0x9d, 0x5a, 0x3c, 0xf3, 0xee, 0x8, 0xe4, 0x1f, 0x4a, 0x41, 0xb1, 0x5d, 0x53, 0xcb, 0xfd, 0xa9, 0x3c, 0x72, 0x79, 0xdf, 0xf1, 0xb2, 0x1, 0x18, 0x4c, 0x75, 0x65, 0x52, 0x34, 0x69, 0x52, 0x60, 0xc0, 0x5a, 0x64, 0x2e, 0x3f, 0x7d, 0x90, 0xa2, 0x5, 0xd4, 0x84, 0x84, 0x60, 0x30, 0x7}
 	} else {
-		sig = [ed25519.SignatureSize]byte{0x91, 0xa9, 0x25, 0x9d, 0x73, 0x11, 0x1a, 0xab, 0x3f, 0xf4, 0x60, 0xa1, 0xf0, 0x3d, 0x13, 0x5a, 0x56, 0x11, 0x8c, 0x83, 0x17, 0x35, 0x2b, 0xa0, 0x25, 0x6, 0x2e, 0x1e, 0x89, 0x5f, 0x6b, 0x41, 0x11, 0xb0, 0x76, 0xcb, 0xa6, 0xcb, 0x42, 0x52, 0xce, 0xa4, 0xcd, 0x72, 0x12, 0xc1, 0xbe, 0x93, 0x5f, 0x61, 0x3f, 0xba, 0x5b, 0x56, 0x1e, 0x39, 0x3, 0x77, 0x5b, 0xe4, 0x2b, 0xa0, 0x6b, 0x4}
+		sig = [ed25519.SignatureSize]byte{0xe9, 0xeb, 0x18, 0x75, 0xa6, 0x64, 0x4e, 0xc3, 0x78, 0x1f, 0xbf, 0x65, 0xc6, 0xf9, 0x59, 0x3f, 0x16, 0x4b, 0xb4, 0x31, 0x98, 0x52, 0x68, 0xa8, 0x2b, 0xe0, 0x2d, 0xa9, 0x58, 0x60, 0xe5, 0xa8, 0x41, 0x3b, 0x69, 0x38, 0x93, 0xfa, 0xd0, 0x74, 0xcd, 0x35, 0x23, 0x7c, 0xfc, 0x3, 0xe, 0x50, 0xb5, 0x1d, 0x86, 0xaf, 0x68, 0x73, 0x86, 0xc8, 0xff, 0x4c, 0x9c, 0xd9, 0x63, 0x9e, 0xd, 0x1}
 	}
 
 	if msg.Signature != sig {
 		t.Fatalf("msg.Signature incorrect: %#v SHOULD BE %#v", msg.Signature, sig)
 	}
 }
+
+func TestFmtVoucher(t *testing.T) {
+	msg := types.VoucherMessage{
+		MessageMetadata: types.MessageMetadata{
+			SourcePublicKey:      *pubkey1,
+			DestinationPublicKey: *pubkey2,
+			Seqnum:               seqnum1,
+		},
+		Amount: voucherAmount1,
+	}
+
+	s, err := FmtVoucherMsg(msg, *privkey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s != voucherMessage {
+		t.Fatal("Message format incorrect: " + s)
+	}
+}
+
+func TestParseVoucher(t *testing.T) {
+	msg, err := ParseVoucherMsg(strings.Split(voucherMessage, " "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.SourcePublicKey != *pubkey1 {
+		t.Fatal("msg.SourcePublicKey incorrect")
+	}
+	if msg.DestinationPublicKey != *pubkey2 {
+		t.Fatal("msg.DestinationPublicKey incorrect")
+	}
+	if msg.Amount != voucherAmount1 {
+		t.Fatal("msg.Amount incorrect", msg.Amount)
+	}
+	if msg.Seqnum != seqnum1 {
+		t.Fatal("msg.Seqnum incorrect")
+	}
+}
+
+func TestParseVoucherMalformed(t *testing.T) {
+	_, err := ParseVoucherMsg(strings.Split(helloMessage, " "))
+	if err == nil {
+		t.Fatal("no error for malformed voucher")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	newPublicKey, newPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := types.KeyRotationMessage{
+		MessageMetadata: types.MessageMetadata{
+			SourcePublicKey:      *pubkey1,
+			DestinationPublicKey: *pubkey2,
+			Seqnum:               seqnum1,
+		},
+		NewPublicKey: *newPublicKey,
+	}
+
+	s, err := FmtKeyRotationMsg(msg, *privkey1, *newPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotation, err := ParseKeyRotationMsg(strings.Split(s, " "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotation.SourcePublicKey != *pubkey1 {
+		t.Fatal("rotation.SourcePublicKey incorrect")
+	}
+	if rotation.DestinationPublicKey != *pubkey2 {
+		t.Fatal("rotation.DestinationPublicKey incorrect")
+	}
+	if rotation.NewPublicKey != *newPublicKey {
+		t.Fatal("rotation.NewPublicKey incorrect")
+	}
+	if rotation.Seqnum != seqnum1 {
+		t.Fatal("rotation.Seqnum incorrect")
+	}
+}
+
+func TestKeyRotationWithoutNewKey(t *testing.T) {
+	newPublicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Signed by the old key twice, claiming a new key it doesn't hold
+	msg := types.KeyRotationMessage{
+		MessageMetadata: types.MessageMetadata{
+			SourcePublicKey:      *pubkey1,
+			DestinationPublicKey: *pubkey2,
+			Seqnum:               seqnum1,
+		},
+		NewPublicKey: *newPublicKey,
+	}
+
+	s, err := FmtKeyRotationMsg(msg, *privkey1, *privkey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ParseKeyRotationMsg(strings.Split(s, " "))
+	if err == nil {
+		t.Fatal("no error for key rotation not signed by the new key")
+	}
+}
+
+func TestSealed(t *testing.T) {
+	msg := types.SealedMessage{
+		MessageMetadata: types.MessageMetadata{
+			SourcePublicKey:      *pubkey1,
+			DestinationPublicKey: *pubkey2,
+			Seqnum:               seqnum1,
+		},
+		Inner: tunnelMessage,
+	}
+
+	s, err := FmtSealedMsg(msg, *privkey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(s, tunnelPubkey2) {
+		t.Fatal("sealed message readable: " + s)
+	}
+
+	sealed, err := ParseSealedMsg(strings.Split(s, " "), *privkey2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed.SourcePublicKey != *pubkey1 {
+		t.Fatal("sealed.SourcePublicKey incorrect")
+	}
+	if sealed.Seqnum != seqnum1 {
+		t.Fatal("sealed.Seqnum incorrect")
+	}
+	if sealed.Inner != tunnelMessage {
+		t.Fatal("sealed.Inner incorrect: " + sealed.Inner)
+	}
+
+	// Nobody but the destination can open it
+	_, err = ParseSealedMsg(strings.Split(s, " "), *privkey1)
+	if err == nil {
+		t.Fatal("sealed message opened by the sender")
+	}
+}
+
+func TestSealedTampered(t *testing.T) {
+	msg := types.SealedMessage{
+		MessageMetadata: types.MessageMetadata{
+			SourcePublicKey:      *pubkey1,
+			DestinationPublicKey: *pubkey2,
+			Seqnum:               seqnum1,
+		},
+		Inner: voucherMessage,
+	}
+
+	s, err := FmtSealedMsg(msg, *privkey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := strings.Split(s, " ")
+	flipped := "A"
+	if fields[3][10] == 'A' {
+		flipped = "B"
+	}
+	fields[3] = fields[3][:10] + flipped + fields[3][11:]
+
+	_, err = ParseSealedMsg(fields, *privkey2)
+	if err == nil {
+		t.Fatal("no error for tampered sealed message")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	for _, s := range []string{helloMessage, tunnelConfirmMessage, voucherMessage} {
+		msg, err := VerifyMsg(strings.Split(s, " "))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.SourcePublicKey != *pubkey1 {
+			t.Fatal("msg.SourcePublicKey incorrect")
+		}
+		if msg.Seqnum != seqnum1 {
+			t.Fatal("msg.Seqnum incorrect")
+		}
+	}
+
+	tampered := strings.Replace(voucherMessage, " 1000 ", " 9000 ", 1)
+	_, err := VerifyMsg(strings.Split(tampered, " "))
+	if err == nil {
+		t.Fatal("no error for tampered message")
+	}
+
+	_, err = VerifyMsg(strings.Split("hello there", " "))
+	if err == nil {
+		t.Fatal("no error for something that is not a message")
+	}
+}
@@ -0,0 +1,251 @@
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/agl/ed25519"
+	"github.com/incentivized-mesh-infrastructure/scrooge/replay"
+	"github.com/incentivized-mesh-infrastructure/scrooge/types"
+)
+
+// State is everything that has to survive a restart.
+type State struct {
+	SeqnumReserved uint64 // Any of our seqnums up to this one may have been sent already
+	Neighbors      []types.Neighbor
+	Removed        []types.Neighbor // Removed neighbors, kept for their seqnum and payment channel
+	Windows        []WindowsRecord  // Anti-replay windows of the neighbors
+	Balances       []BalanceRecord
+	RetiredKeys    [][ed25519.PublicKeySize]byte // Keys neighbors have rotated away from
+}
+
+type WindowsRecord struct {
+	PublicKey [ed25519.PublicKeySize]byte
+	Windows   map[string]*replay.Window // By message stream
+}
+
+type BalanceRecord struct {
+	PublicKey [ed25519.PublicKeySize]byte
+	types.Balance
+}
+
+// Store keeps State in a JSON file. The file is replaced atomically on every
+// write, so a crash leaves either the old or the new state behind.
+type Store struct {
+	Path        string
+	SeqnumBlock uint64 // How many seqnums to reserve with each write
+	state       State
+	mutex       sync.Mutex
+}
+
+// Open loads the state file at path, starting with an empty state if it
+// does not exist yet.
+func Open(path string, seqnumBlock uint64) (*Store, error) {
+	store := &Store{
+		Path:        path,
+		SeqnumBlock: seqnumBlock,
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, os.MkdirAll(filepath.Dir(path), 0700)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &store.state)
+	if err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// State returns the state as it was when the store was opened or last saved.
+func (self *Store) State() State {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.state
+}
+
+// ReserveSeqnum makes sure seqnum is covered by a reservation on disk before
+// it is sent. When it isn't, a whole new block is reserved so that we only
+// write once every SeqnumBlock messages. After a restart we carry on from
+// the end of the last reservation.
+func (self *Store) ReserveSeqnum(seqnum uint64) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if seqnum <= self.state.SeqnumReserved {
+		return nil
+	}
+
+	reserved := self.state.SeqnumReserved
+	self.state.SeqnumReserved = seqnum + self.SeqnumBlock - 1
+
+	err := self.write()
+	if err != nil {
+		self.state.SeqnumReserved = reserved
+		return err
+	}
+	return nil
+}
+
+// RetireKey adds a key a neighbor has rotated away from to the state, and
+// writes it out straight away so that the key is never accepted again, even
+// after a crash.
+func (self *Store) RetireKey(publicKey [ed25519.PublicKeySize]byte) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for _, retired := range self.state.RetiredKeys {
+		if retired == publicKey {
+			return nil
+		}
+	}
+
+	self.state.RetiredKeys = append(self.state.RetiredKeys, publicKey)
+
+	err := self.write()
+	if err != nil {
+		self.state.RetiredKeys = self.state.RetiredKeys[:len(self.state.RetiredKeys)-1]
+		return err
+	}
+	return nil
+}
+
+// RecordSent writes out the cumulative amount we have paid a neighbor
+// straight away, before the voucher for it is sent. After a crash we carry
+// on from there, and never sign a voucher for less than one the neighbor
+// already has.
+func (self *Store) RecordSent(
+	publicKey [ed25519.PublicKeySize]byte,
+	sent uint64,
+) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for i := range self.state.Neighbors {
+		neighbor := &self.state.Neighbors[i]
+		if neighbor.PublicKey != publicKey {
+			continue
+		}
+
+		old := neighbor.Channel.Sent
+		neighbor.Channel.Sent = sent
+		err := self.write()
+		if err != nil {
+			neighbor.Channel.Sent = old
+			return err
+		}
+		return nil
+	}
+
+	// A neighbor that hasn't been saved yet
+	neighbor := types.Neighbor{PublicKey: publicKey}
+	neighbor.Channel.Sent = sent
+	self.state.Neighbors = append(self.state.Neighbors, neighbor)
+
+	err := self.write()
+	if err != nil {
+		self.state.Neighbors = self.state.Neighbors[:len(self.state.Neighbors)-1]
+		return err
+	}
+	return nil
+}
+
+// Save writes out neighbors, removed neighbors, their anti-replay windows
+// and balances. Neighbors may have been listed before a voucher was
+// recorded, or removed since, so what we have paid each of them never goes
+// back below the recorded amount.
+func (self *Store) Save(
+	neighbors []types.Neighbor,
+	removed []types.Neighbor,
+	windows map[[ed25519.PublicKeySize]byte]map[string]*replay.Window,
+	balances map[[ed25519.PublicKeySize]byte]types.Balance,
+) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	sent := make(map[[ed25519.PublicKeySize]byte]uint64, len(self.state.Neighbors))
+	for _, saved := range [][]types.Neighbor{self.state.Neighbors, self.state.Removed} {
+		for _, neighbor := range saved {
+			if neighbor.Channel.Sent > sent[neighbor.PublicKey] {
+				sent[neighbor.PublicKey] = neighbor.Channel.Sent
+			}
+		}
+	}
+	withSent := func(neighbors []types.Neighbor) []types.Neighbor {
+		saved := make([]types.Neighbor, len(neighbors))
+		for i, neighbor := range neighbors {
+			if neighbor.Channel.Sent < sent[neighbor.PublicKey] {
+				neighbor.Channel.Sent = sent[neighbor.PublicKey]
+			}
+			saved[i] = neighbor
+		}
+		return saved
+	}
+
+	self.state.Neighbors = withSent(neighbors)
+	self.state.Removed = withSent(removed)
+	self.state.Windows = make([]WindowsRecord, 0, len(windows))
+	for publicKey, neighborWindows := range windows {
+		self.state.Windows = append(self.state.Windows, WindowsRecord{
+			PublicKey: publicKey,
+			Windows:   neighborWindows,
+		})
+	}
+	self.state.Balances = make([]BalanceRecord, 0, len(balances))
+	for publicKey, balance := range balances {
+		self.state.Balances = append(self.state.Balances, BalanceRecord{
+			PublicKey: publicKey,
+			Balance:   balance,
+		})
+	}
+
+	return self.write()
+}
+
+func (self *Store) write() error {
+	b, err := json.Marshal(self.state)
+	if err != nil {
+		return err
+	}
+
+	tmp := self.Path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(b)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, self.Path)
+	if err != nil {
+		return err
+	}
+
+	// Make sure the rename itself is on disk
+	dir, err := os.Open(filepath.Dir(self.Path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
@@ -0,0 +1,240 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agl/ed25519"
+	"github.com/incentivized-mesh-infrastructure/scrooge/replay"
+	"github.com/incentivized-mesh-infrastructure/scrooge/types"
+)
+
+var (
+	pubkey1 = [ed25519.PublicKeySize]byte{44, 176, 80, 246, 247, 71, 5, 229, 108, 111, 158, 77, 18, 116, 98, 28, 84, 59, 215, 93, 182, 34, 240, 5, 147, 229, 211, 253, 44, 221, 237, 85}
+	now     = time.Date(2018, 1, 11, 0, 0, 0, 0, time.UTC)
+)
+
+func tempPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "scrooge-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "state", "state.json")
+}
+
+func TestReserveSeqnum(t *testing.T) {
+	path := tempPath(t)
+	defer os.RemoveAll(filepath.Dir(filepath.Dir(path)))
+
+	store, err := Open(path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for seqnum := uint64(1); seqnum <= 150; seqnum++ {
+		err = store.ReserveSeqnum(seqnum)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Simulate a crash by opening the file again
+	store, err = Open(path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if store.State().SeqnumReserved != 200 {
+		t.Fatal("SeqnumReserved incorrect: ", store.State().SeqnumReserved)
+	}
+}
+
+func TestSave(t *testing.T) {
+	path := tempPath(t)
+	defer os.RemoveAll(filepath.Dir(filepath.Dir(path)))
+
+	store, err := Open(path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	neighbor := types.Neighbor{
+		PublicKey: pubkey1,
+		Seqnum:    42,
+	}
+	neighbor.Tunnel.PublicKey = "flerp"
+	neighbor.Tunnel.ListenPort = 4500
+	neighbor.Channel.Received = 300
+	neighbor.Tunnel.LocalPublicKey = "derp"
+	neighbor.Tunnel.LocalPrivateKey = "secret"
+	neighbor.Tunnel.NextPrivateKey = "secret"
+
+	err = store.Save(
+		[]types.Neighbor{neighbor},
+		nil,
+		map[[ed25519.PublicKeySize]byte]map[string]*replay.Window{
+			pubkey1: {"hello": {Floor: 40, Recent: []uint64{42}}},
+		},
+		map[[ed25519.PublicKeySize]byte]types.Balance{
+			pubkey1: {Billed: 500, Received: 300, DebtSince: now},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = Open(path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := store.State()
+	if len(state.Neighbors) != 1 {
+		t.Fatal("wrong number of neighbors: ", len(state.Neighbors))
+	}
+	if state.Neighbors[0].PublicKey != pubkey1 ||
+		state.Neighbors[0].Seqnum != 42 ||
+		state.Neighbors[0].Tunnel.ListenPort != 4500 ||
+		state.Neighbors[0].Channel.Received != 300 {
+		t.Fatalf("neighbor incorrect: %+v", state.Neighbors[0])
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "secret") {
+		t.Fatal("tunnel private keys written to the state file")
+	}
+
+	if len(state.Windows) != 1 ||
+		state.Windows[0].PublicKey != pubkey1 ||
+		state.Windows[0].Windows["hello"].Floor != 40 ||
+		len(state.Windows[0].Windows["hello"].Recent) != 1 {
+		t.Fatalf("windows incorrect: %+v", state.Windows)
+	}
+
+	if len(state.Balances) != 1 ||
+		state.Balances[0].PublicKey != pubkey1 ||
+		state.Balances[0].Billed != 500 ||
+		!state.Balances[0].DebtSince.Equal(now) {
+		t.Fatalf("balances incorrect: %+v", state.Balances)
+	}
+}
+
+func TestRetireKey(t *testing.T) {
+	path := tempPath(t)
+	defer os.RemoveAll(filepath.Dir(filepath.Dir(path)))
+
+	store, err := Open(path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = store.RetireKey(pubkey1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Saving neighbors and balances keeps the retired keys
+	err = store.Save(nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = Open(path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	retired := store.State().RetiredKeys
+	if len(retired) != 1 || retired[0] != pubkey1 {
+		t.Fatalf("retired keys incorrect: %v", retired)
+	}
+}
+
+func TestRecordSent(t *testing.T) {
+	path := tempPath(t)
+	defer os.RemoveAll(filepath.Dir(filepath.Dir(path)))
+
+	store, err := Open(path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Recorded before the neighbor was ever saved
+	err = store.RecordSent(pubkey1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Neighbors listed before the next voucher was recorded
+	neighbor := types.Neighbor{PublicKey: pubkey1, Seqnum: 42}
+	neighbor.Channel.Sent = 100
+	err = store.RecordSent(pubkey1, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Save([]types.Neighbor{neighbor}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = Open(path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	neighbors := store.State().Neighbors
+	if len(neighbors) != 1 ||
+		neighbors[0].Seqnum != 42 ||
+		neighbors[0].Channel.Sent != 200 {
+		t.Fatalf("neighbors incorrect: %+v", neighbors)
+	}
+
+	// Removed since, with a channel listed before the last voucher
+	neighbor.Channel.Received = 300
+	err = store.Save(nil, []types.Neighbor{neighbor}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = Open(path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := store.State()
+	if len(state.Neighbors) != 0 ||
+		len(state.Removed) != 1 ||
+		state.Removed[0].Channel.Sent != 200 ||
+		state.Removed[0].Channel.Received != 300 {
+		t.Fatalf("removed neighbors incorrect: %+v", state.Removed)
+	}
+}
+
+func TestOpenCorrupt(t *testing.T) {
+	path := tempPath(t)
+	defer os.RemoveAll(filepath.Dir(filepath.Dir(path)))
+
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(path, []byte("{\"SeqnumRes"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Open(path, 100)
+	if err == nil {
+		t.Fatal("no error for corrupt state file")
+	}
+}
@@ -21,12 +21,10 @@ node1.icmd(["ip", "link"])
 # node1.icmd(["netcat", "-l",  "4444"])
 
 node1.icmd([
-    "./scrooge",
-    "-interface", "eth0",
-    "-publicKey", "LLBQ9vdHBeVsb55NEnRiHFQ71122IvAFk+XT/Szd7VU=",
-    "-privateKey", "cEWVkEjpGbx810PI1e2Ff9f95oYayhnWJBPpV9Spd+IssFD290cF5Wxvnk0SdGIcVDvXXbYi8AWT5dP9LN3tVQ==",
-    "-tunnelPublicKey", "cRwjM2IXh/NM1Ebjg2lCr4pjTYeI83MI0WBl7zLH3Uk=",
-    "-tunnelPrivateKey", "oBWilMRpFOHdfUjPINgc7DnGMuPUItP7mg6MKhu78FI="
+    "env",
+    "SCROOGE_IDENTITY_KEY=cEWVkEjpGbx810PI1e2Ff9f95oYayhnWJBPpV9Spd+IssFD290cF5Wxvnk0SdGIcVDvXXbYi8AWT5dP9LN3tVQ==",
+    "./scrooge", "run",
+    "-interface", "eth0"
 ])
 
 session.shutdown()
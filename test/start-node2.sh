@@ -1,14 +1,8 @@
 #!bash
 
-./scrooge \
--interface eth0 \
--publicKey Mb/gfAOEv8vHpwQoXmgU7wNE2Xpn5wa7gWxdsu2EXMo= \
--privateKey 1cbEVvM7bhhcoqP9p9tr8dk0MGbfY3toS8VzoLnEdFkxv+B8A4S/y8enBCheaBTvA0TZemfnBruBbF2y7YRcyg== \
--tunnelPublicKey HZB8BT0LToT2W+HsVQG5hlXSbaphC193uwLkv7rwJVA= \
--tunnelPrivateKey nK9CDsU+AAK2TXMnJx1vg8/Nkpzk2zCWs/dOMEvICpwdkHwFPQtOhPZb4exVAbmGVdJtqmELX3e7AuS/uvAlUA==
+SCROOGE_IDENTITY_KEY=1cbEVvM7bhhcoqP9p9tr8dk0MGbfY3toS8VzoLnEdFkxv+B8A4S/y8enBCheaBTvA0TZemfnBruBbF2y7YRcyg== \
+./scrooge run \
+-interface eth0
 
 
 # scrooge pubkey: Mb/gfAOEv8vHpwQoXmgU7wNE2Xpn5wa7gWxdsu2EXMo=
-# scrooge privkey: 1cbEVvM7bhhcoqP9p9tr8dk0MGbfY3toS8VzoLnEdFkxv+B8A4S/y8enBCheaBTvA0TZemfnBruBbF2y7YRcyg==
-# wireguard pubkey: HZB8BT0LToT2W+HsVQG5hlXSbaphC193uwLkv7rwJVA=
-# wireguard privkey: nK9CDsU+AAK2TXMnJx1vg8/Nkpzk2zCWs/dOMEvICpwdkHwFPQtOhPZb4exVAbmGVdJtqmELX3e7AuS/uvAlUA==
@@ -0,0 +1,130 @@
+package throttle
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"time"
+
+	"github.com/incentivized-mesh-infrastructure/scrooge/types"
+)
+
+type Level int
+
+const (
+	None Level = iota // Full speed
+	Soft              // Slowed down
+	Hard              // Cut off
+)
+
+func (self Level) String() string {
+	switch self {
+	case None:
+		return "none"
+	case Soft:
+		return "soft"
+	case Hard:
+		return "hard"
+	}
+	return fmt.Sprintf("Level(%d)", int(self))
+}
+
+// Policy decides how hard to throttle a neighbor based on how much it owes
+// us. Debts are in the same unit as the ledger.
+type Policy struct {
+	FreeCredit      uint64        // Debt a neighbor may run up without any consequence
+	GracePeriod     time.Duration // How long a neighbor may owe more than FreeCredit before it is throttled
+	SoftDebt        uint64        // Debt at which a neighbor is slowed down
+	HardDebt        uint64        // Debt at which a neighbor is cut off
+	ForgivenessRate uint64        // Debt forgiven per hour a neighbor has owed us
+}
+
+// Decision is the outcome of a Policy for one neighbor, with the reason it
+// was reached.
+type Decision struct {
+	Level         Level
+	Debt          int64 // What the neighbor owes according to the ledger
+	EffectiveDebt int64 // Debt minus what has been forgiven
+	Reason        string
+}
+
+func (self Decision) String() string {
+	return fmt.Sprintf(
+		"%v (debt %v, %v after forgiveness): %v",
+		self.Level,
+		self.Debt,
+		self.EffectiveDebt,
+		self.Reason,
+	)
+}
+
+func (self *Policy) Validate() error {
+	if self.SoftDebt < self.FreeCredit {
+		return errors.New("soft throttle debt is below the free credit")
+	}
+	if self.HardDebt < self.SoftDebt {
+		return errors.New("hard cutoff debt is below the soft throttle debt")
+	}
+	return nil
+}
+
+func (self *Policy) Decide(balance types.Balance, now time.Time) Decision {
+	decision := Decision{
+		Debt:          balance.Debt(),
+		EffectiveDebt: balance.Debt(),
+	}
+
+	if decision.Debt <= 0 {
+		decision.Reason = "nothing owed"
+		return decision
+	}
+
+	owingFor := now.Sub(balance.DebtSince)
+
+	forgiven := self.forgiven(owingFor)
+	if forgiven >= uint64(decision.Debt) {
+		decision.EffectiveDebt = 0
+	} else {
+		decision.EffectiveDebt = decision.Debt - int64(forgiven)
+	}
+
+	// Thresholds are compared as they are, since casting those above
+	// MaxInt64 would wrap around. The debt can't be negative by now.
+	effectiveDebt := uint64(decision.EffectiveDebt)
+
+	switch {
+	case effectiveDebt <= self.FreeCredit:
+		decision.Reason = fmt.Sprintf("within free credit of %v", self.FreeCredit)
+	case owingFor < self.GracePeriod:
+		decision.Reason = fmt.Sprintf(
+			"in grace period for another %v",
+			self.GracePeriod-owingFor,
+		)
+	case effectiveDebt >= self.HardDebt:
+		decision.Level = Hard
+		decision.Reason = fmt.Sprintf("reached hard cutoff debt of %v", self.HardDebt)
+	case effectiveDebt >= self.SoftDebt:
+		decision.Level = Soft
+		decision.Reason = fmt.Sprintf("reached soft throttle debt of %v", self.SoftDebt)
+	default:
+		decision.Reason = fmt.Sprintf("below soft throttle debt of %v", self.SoftDebt)
+	}
+
+	return decision
+}
+
+// forgiven returns how much debt is forgiven after owing for owingFor,
+// saturating instead of overflowing.
+func (self *Policy) forgiven(owingFor time.Duration) uint64 {
+	if owingFor <= 0 {
+		return 0
+	}
+
+	hi, lo := bits.Mul64(self.ForgivenessRate, uint64(owingFor/time.Second))
+	if hi >= 3600 {
+		return math.MaxUint64
+	}
+	forgiven, _ := bits.Div64(hi, lo, 3600)
+	return forgiven
+}
@@ -0,0 +1,173 @@
+package throttle
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/incentivized-mesh-infrastructure/scrooge/types"
+)
+
+var (
+	now    = time.Date(2018, 1, 11, 0, 0, 0, 0, time.UTC)
+	policy = &Policy{
+		FreeCredit:      100,
+		GracePeriod:     time.Hour,
+		SoftDebt:        1000,
+		HardDebt:        5000,
+		ForgivenessRate: 60,
+	}
+)
+
+func TestDecide(t *testing.T) {
+	tests := []struct {
+		name          string
+		balance       types.Balance
+		level         Level
+		effectiveDebt int64
+	}{
+		{
+			name:    "paid in advance",
+			balance: types.Balance{Billed: 100, Received: 200},
+			level:   None,
+		},
+		{
+			name:          "within free credit",
+			balance:       types.Balance{Billed: 100, DebtSince: now.Add(-2 * time.Hour)},
+			level:         None,
+			effectiveDebt: 0,
+		},
+		{
+			name:          "in grace period",
+			balance:       types.Balance{Billed: 10000, DebtSince: now.Add(-30 * time.Minute)},
+			level:         None,
+			effectiveDebt: 9970,
+		},
+		{
+			name:          "below soft throttle debt",
+			balance:       types.Balance{Billed: 900, DebtSince: now.Add(-2 * time.Hour)},
+			level:         None,
+			effectiveDebt: 780,
+		},
+		{
+			name:          "soft throttle",
+			balance:       types.Balance{Billed: 2000, Received: 500, DebtSince: now.Add(-2 * time.Hour)},
+			level:         Soft,
+			effectiveDebt: 1380,
+		},
+		{
+			name:          "forgiven down to soft throttle",
+			balance:       types.Balance{Billed: 5100, DebtSince: now.Add(-2 * time.Hour)},
+			level:         Soft,
+			effectiveDebt: 4980,
+		},
+		{
+			name:          "hard cutoff",
+			balance:       types.Balance{Billed: 6000, DebtSince: now.Add(-2 * time.Hour)},
+			level:         Hard,
+			effectiveDebt: 5880,
+		},
+		{
+			name:          "forgiven entirely",
+			balance:       types.Balance{Billed: 6000, DebtSince: now.Add(-200 * time.Hour)},
+			level:         None,
+			effectiveDebt: 0,
+		},
+	}
+
+	for _, test := range tests {
+		decision := policy.Decide(test.balance, now)
+		if decision.Level != test.level {
+			t.Errorf("%v: level %v, should be %v (%v)", test.name, decision.Level, test.level, decision)
+		}
+		if decision.Debt > 0 && decision.EffectiveDebt != test.effectiveDebt {
+			t.Errorf("%v: effective debt %v, should be %v", test.name, decision.EffectiveDebt, test.effectiveDebt)
+		}
+		if decision.Reason == "" {
+			t.Errorf("%v: no reason given", test.name)
+		}
+	}
+}
+
+func TestForgivenessOverflow(t *testing.T) {
+	policy := Policy{
+		FreeCredit:      500,
+		GracePeriod:     time.Hour,
+		SoftDebt:        1000,
+		HardDebt:        5000,
+		ForgivenessRate: math.MaxUint64,
+	}
+
+	tests := []struct {
+		name          string
+		balance       types.Balance
+		level         Level
+		effectiveDebt int64
+	}{
+		{
+			name:    "owing since the zero time",
+			balance: types.Balance{Billed: 6000},
+			level:   None,
+		},
+		{
+			name:    "owing for a long time",
+			balance: types.Balance{Billed: 6000, DebtSince: now.Add(-200 * time.Hour)},
+			level:   None,
+		},
+		{
+			name:          "owing from the future",
+			balance:       types.Balance{Billed: 6000, DebtSince: now.Add(time.Hour)},
+			level:         None,
+			effectiveDebt: 6000,
+		},
+	}
+
+	for _, test := range tests {
+		decision := policy.Decide(test.balance, now)
+		if decision.Level != test.level {
+			t.Errorf("%v: level %v, should be %v (%v)", test.name, decision.Level, test.level, decision)
+		}
+		if decision.EffectiveDebt != test.effectiveDebt {
+			t.Errorf("%v: effective debt %v, should be %v", test.name, decision.EffectiveDebt, test.effectiveDebt)
+		}
+	}
+}
+
+func TestHugeThresholds(t *testing.T) {
+	// Above MaxInt64, where casting them to a debt would wrap around
+	policy := Policy{
+		FreeCredit: math.MaxInt64 + 1,
+		SoftDebt:   math.MaxUint64,
+		HardDebt:   math.MaxUint64,
+	}
+
+	decision := policy.Decide(types.Balance{Billed: 6000}, now)
+	if decision.Level != None {
+		t.Fatal("throttled within free credit: ", decision)
+	}
+
+	policy.FreeCredit = 0
+	decision = policy.Decide(types.Balance{Billed: 6000}, now)
+	if decision.Level != None {
+		t.Fatal("throttled below soft throttle debt: ", decision)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		valid  bool
+	}{
+		{"valid", *policy, true},
+		{"soft below free credit", Policy{FreeCredit: 100, SoftDebt: 50, HardDebt: 200}, false},
+		{"hard below soft", Policy{SoftDebt: 500, HardDebt: 200}, false},
+	}
+
+	for _, test := range tests {
+		err := test.policy.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("%v: wrong validation result: %v", test.name, err)
+		}
+	}
+}
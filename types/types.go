@@ -1,7 +1,13 @@
 package types
 
-import "net"
-import "github.com/agl/ed25519"
+import (
+	"math"
+	"math/bits"
+	"net"
+	"time"
+
+	"github.com/agl/ed25519"
+)
 
 // Internal types
 
@@ -9,18 +15,28 @@ type Account struct {
 	PublicKey  [ed25519.PublicKeySize]byte
 	PrivateKey [ed25519.PrivateKeySize]byte
 	Seqnum     uint64
+	SeqnumMode string // How we pick seqnums, announced in our hellos
+	Price      uint64 // What we charge neighbors per byte they route through us
 	// TunnelAddresses  map[string]net.UDPAddr
 	TunnelPublicKey  string
 	TunnelPrivateKey string
+	Certificate      string // Encoded authority certificate sent in our hellos, if we have one
 }
 
 type Neighbor struct {
 	PublicKey      [ed25519.PublicKeySize]byte
-	Seqnum         uint64
+	Seqnum         uint64 // Highest seqnum seen from the neighbor on any stream
+	SeqnumMode     string
+	Confirmed      bool         // Whether the neighbor has echoed the nonce of one of our hellos
+	LastSeen       time.Time    // When we last accepted a message from the neighbor
+	Address        *net.UDPAddr // Link-local address the neighbor's messages come from
+	Certificate    string       // Authority certificate from the neighbor's hellos, if it sent one
 	BillingDetails struct {
 		PaymentAddress string
+		Price          uint64 // Advertised price per byte routed through the neighbor
 	}
 	Tunnel
+	Channel PaymentChannel
 }
 
 type Tunnel struct {
@@ -28,6 +44,58 @@ type Tunnel struct {
 	ListenPort       int           // Every tunnel needs to listen on a different port
 	Endpoint         string        // This is the tunnel endpoint on the Neighbor
 	VirtualInterface net.Interface // virtual interface created by the tunnel
+	// Our keys for this tunnel alone, when tunnels don't share the account's.
+	// The private keys are never written to the state file, so the tunnel
+	// gets new keys after a restart.
+	LocalPublicKey  string
+	LocalPrivateKey string `json:"-"`
+	LocalKeyCreated time.Time
+	// Keys we are rotating to, until the neighbor confirms it has them
+	NextPublicKey  string
+	NextPrivateKey string `json:"-"`
+}
+
+// PaymentChannel holds the state of the off-chain payment channel with a
+// neighbor. Amounts are cumulative over the lifetime of the channel, so only
+// the latest voucher in each direction matters.
+type PaymentChannel struct {
+	Sent        uint64          // Cumulative amount we have signed over to the neighbor
+	Received    uint64          // Cumulative amount the neighbor has signed over to us
+	Voucher     *VoucherMessage // Latest voucher received, redeemed on settlement
+	Settled     uint64          // Amount of Received already redeemed through the payment backend
+	LastSettled time.Time
+	Closed      bool
+}
+
+// Balance sums up what has been billed and paid between us and a neighbor.
+type Balance struct {
+	Paid      uint64    // Total we have paid the neighbor
+	Received  uint64    // Total the neighbor has paid us
+	Billed    uint64    // Total we have charged the neighbor for routing its traffic
+	Credit    uint64    // Debt an operator has let the neighbor off
+	DebtSince time.Time // When the neighbor started owing us, zero if it owes nothing
+}
+
+// Debt is how much the neighbor owes us. It is negative if the neighbor has
+// paid in advance. Amounts beyond what an int64 holds stop at the largest
+// debt or credit instead of wrapping around.
+func (self Balance) Debt() int64 {
+	settled, carry := bits.Add64(self.Received, self.Credit, 0)
+	if carry != 0 {
+		settled = math.MaxUint64
+	}
+
+	if self.Billed >= settled {
+		if self.Billed-settled > math.MaxInt64 {
+			return math.MaxInt64
+		}
+		return int64(self.Billed - settled)
+	}
+
+	if settled-self.Billed > math.MaxInt64 {
+		return -math.MaxInt64
+	}
+	return -int64(settled - self.Billed)
 }
 
 // Message types
@@ -38,16 +106,119 @@ type MessageMetadata struct {
 	Signature            [ed25519.SignatureSize]byte
 }
 
+// NonceSize is the size of the random nonce in a hello, which the confirm
+// has to echo.
+const NonceSize = 16
+
 type HelloMessage struct {
 	MessageMetadata
-	Confirm bool
+	SeqnumMode  string
+	Nonce       [NonceSize]byte
+	Certificate string // Encoded authority certificate of the sender, if it has one
+	Confirm     bool
 }
 
 type TunnelMessage struct {
 	MessageMetadata
+	TunnelPublicKey    string
+	TunnelEndpoint     string
+	Price              uint64
+	ConfirmedPublicKey string // In confirms, the tunnel public key of the message being confirmed
+	Confirm            bool
+}
+
+type VoucherMessage struct {
+	MessageMetadata
+	Amount uint64 // Cumulative amount paid to the destination on this channel
+}
+
+// KeyRotationMessage moves a node from its old identity key, the source, to
+// a new one. It is signed by both.
+type KeyRotationMessage struct {
+	MessageMetadata
+	NewPublicKey [ed25519.PublicKeySize]byte
+	NewSignature [ed25519.SignatureSize]byte // Signature of the new key
+}
+
+// SealedMessage carries another signed message, encrypted so that only the
+// destination can read it.
+type SealedMessage struct {
+	MessageMetadata
+	Inner string // The complete inner message, signature included
+}
+
+// Management API types
+
+// NeighborStatus is what the management API shows of a neighbor. Keys are
+// base64 encoded.
+type NeighborStatus struct {
+	PublicKey  string
+	Address    string
+	Seqnum     uint64
+	SeqnumMode string
+	Confirmed  bool
+	LastSeen   time.Time
+	Price      uint64 // What the neighbor charges us per byte
+	Tunnel     TunnelStatus
+	Balance    Balance
+	Debt       int64
+	Throttle   ThrottleStatus
+	Channel    ChannelStatus
+}
+
+type TunnelStatus struct {
+	Up               bool
+	VirtualInterface string
+	PublicKey        string // The neighbor's
+	LocalPublicKey   string // Ours, if the tunnel has keys of its own
+	Endpoint         string
+	ListenPort       int
+	KeyCreated       time.Time // When LocalPublicKey was made
+	Rotating         bool      // Waiting for the neighbor to confirm new keys
+}
+
+// ThrottleStatus is how hard the throttle policy holds a neighbor back.
+type ThrottleStatus struct {
+	Level         string // none, soft or hard
+	EffectiveDebt int64  // Debt minus what has been forgiven
+	Reason        string
+}
+
+type ChannelStatus struct {
+	Sent     uint64
+	Received uint64
+	Settled  uint64
+	Closed   bool
+}
+
+// AccountStatus is what the management API shows of our account, which is
+// everything but the private keys.
+type AccountStatus struct {
+	PublicKey       string
 	TunnelPublicKey string
-	TunnelEndpoint  string
-	Confirm         bool
+	Seqnum          uint64
+	SeqnumMode      string
+	Price           uint64
+	Certificate     string
+	Neighbors       int
+}
+
+// NeighborRequest names the neighbor a management action is for.
+type NeighborRequest struct {
+	PublicKey string
+}
+
+// CreditRequest lets a neighbor off Amount of its debt, or takes back
+// credit given before if Amount is negative.
+type CreditRequest struct {
+	PublicKey string
+	Amount    int64
+}
+
+// PaymentRequest pays a neighbor Amount with a voucher.
+type PaymentRequest struct {
+	PublicKey string
+	Amount    uint64
 }
 
 // Utils
@@ -1,7 +1,10 @@
 package wireguard
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"regexp"
@@ -12,25 +15,56 @@ import (
 
 	"bytes"
 
-	"fmt"
-
+	"github.com/incentivized-mesh-infrastructure/scrooge/logging"
 	"github.com/incentivized-mesh-infrastructure/scrooge/types"
+	"golang.org/x/crypto/curve25519"
 )
 
-func Genkeys() (string, string, error) {
-	privkey, err := exec.Command("wg", "genkey").Output()
+var logger = logging.Logger("wireguard")
+
+// Metrics, if set, counts the commands run, and keeps the bytes on every
+// tunnel as of the last time Transfer read them. It is set once, before
+// any tunnel is touched.
+var Metrics interface {
+	Add(name string, value float64, labels ...string)
+	Set(name string, value float64, labels ...string)
+}
+
+// NewKeys makes a new WireGuard key pair without needing wg, like
+// `wg genkey` and `wg pubkey` would.
+func NewKeys() (string, string, error) {
+	var privateKey [32]byte
+	_, err := rand.Read(privateKey[:])
 	if err != nil {
 		return "", "", err
 	}
 
-	cmd := exec.Command("wg", "pubkey")
-	cmd.Stdin = bytes.NewReader(privkey)
-	pubkey, err := cmd.Output()
+	// Clamp it the way `wg genkey` does
+	privateKey[0] &= 248
+	privateKey[31] = (privateKey[31] & 127) | 64
+
+	encoded := base64.StdEncoding.EncodeToString(privateKey[:])
+	publicKey, err := PublicKey(encoded)
 	if err != nil {
 		return "", "", err
 	}
 
-	return string(pubkey), string(privkey), nil
+	return publicKey, encoded, nil
+}
+
+// PublicKey returns the public key of a base64 encoded WireGuard private key.
+func PublicKey(privateKey string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil || len(b) != curve25519.ScalarSize {
+		return "", errors.New("bad WireGuard private key")
+	}
+
+	publicKey, err := curve25519.X25519(b, curve25519.Basepoint)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(publicKey), nil
 }
 
 func execCommand(command string, args ...string) ([]byte, error) {
@@ -39,14 +73,26 @@ func execCommand(command string, args ...string) ([]byte, error) {
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 	err := cmd.Run()
+	if Metrics != nil {
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		Metrics.Add("scrooge_wireguard_commands_total", 1, "command", command, "result", result)
+	}
 	if err != nil {
-		fmt.Println("REAL ERR", err)
 		var message string
 		if stderr.Len() == 0 {
 			message = stdout.String()
 		} else {
 			message = stderr.String()
 		}
+		logger.Debug(
+			"command failed",
+			"command", command+" "+strings.Join(args, " "),
+			"err", err,
+			"output", message,
+		)
 		return nil, errors.New(
 			"command `" + command + " " +
 				strings.Join(args, " ") + "` failed. " + message)
@@ -55,45 +101,38 @@ func execCommand(command string, args ...string) ([]byte, error) {
 	return stdout.Bytes(), nil
 }
 
+// CreateTunnel sets up a tunnel interface with tunnelPrivateKey, listening
+// on the tunnel's port, with the tunnel's peer. An interface left over with
+// the same name is replaced.
 func CreateTunnel(
 	tunnel *types.Tunnel,
 	tunnelPrivateKey string,
 ) error {
 	_, err := execCommand("ip", "link", "add", "dev", tunnel.VirtualInterface.Name, "type", "wireguard")
 	if err != nil {
-		if regexp.MustCompile(`File exists`).MatchString(err.Error()) {
-			_, err := execCommand("ip", "link", "del", tunnel.VirtualInterface.Name)
-			if err != nil {
-				return err
-			}
-		} else {
+		if !regexp.MustCompile(`File exists`).MatchString(err.Error()) {
 			return err
 		}
-	}
-
-	privateKeyFile, err := ioutil.TempFile("", "example")
-	if err != nil {
-		return err
-	}
-
-	defer os.Remove(privateKeyFile.Name()) // clean up
-
-	privateKeyFile.Chmod(0700)
-	privateKeyFile.Chown(0, 0)
 
-	_, err = privateKeyFile.Write([]byte(tunnelPrivateKey))
-	if err != nil {
-		return err
+		_, err = execCommand("ip", "link", "del", tunnel.VirtualInterface.Name)
+		if err != nil {
+			return err
+		}
+		_, err = execCommand("ip", "link", "add", "dev", tunnel.VirtualInterface.Name, "type", "wireguard")
+		if err != nil {
+			return err
+		}
 	}
 
-	err = privateKeyFile.Close()
+	privateKeyFile, err := writeKeyFile(tunnelPrivateKey)
 	if err != nil {
 		return err
 	}
+	defer os.Remove(privateKeyFile)
 
 	_, err = execCommand("wg", "set", tunnel.VirtualInterface.Name,
 		"listen-port", strconv.FormatUint(uint64(tunnel.ListenPort), 10),
-		"private-key", privateKeyFile.Name(),
+		"private-key", privateKeyFile,
 		"peer", tunnel.PublicKey,
 		"allowed-ips", "0.0.0.0",
 		"endpoint", tunnel.Endpoint)
@@ -106,7 +145,7 @@ func CreateTunnel(
 		return err
 	}
 
-	out, err := exec.Command("wg", "showconf", tunnel.VirtualInterface.Name).Output()
+	out, err := execCommand("wg", "showconf", tunnel.VirtualInterface.Name)
 	if err != nil {
 		return err
 	}
@@ -124,6 +163,144 @@ func CreateTunnel(
 	return nil
 }
 
+// Tunnels sets tunnels up and takes them down, and changes the keys of
+// tunnels that are up without taking them down.
+type Tunnels struct{}
+
+func (self Tunnels) NewKeys() (string, string, error) {
+	return NewKeys()
+}
+
+func (self Tunnels) CreateTunnel(
+	tunnel *types.Tunnel,
+	privateKey string,
+) error {
+	return CreateTunnel(tunnel, privateKey)
+}
+
+// SetPrivateKey replaces our private key on a tunnel interface. Its peer and
+// listen port stay as they are.
+func (self Tunnels) SetPrivateKey(
+	virtualInterface string,
+	privateKey string,
+) error {
+	privateKeyFile, err := writeKeyFile(privateKey)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(privateKeyFile)
+
+	_, err = execCommand("wg", "set", virtualInterface,
+		"private-key", privateKeyFile)
+	return err
+}
+
+// ReplacePeer swaps the peer with oldPublicKey on a tunnel for one with the
+// tunnel's current public key. Both happen in one `wg set`, so the tunnel is
+// never without a peer.
+func (self Tunnels) ReplacePeer(
+	tunnel *types.Tunnel,
+	oldPublicKey string,
+) error {
+	_, err := execCommand("wg", "set", tunnel.VirtualInterface.Name,
+		"peer", tunnel.PublicKey,
+		"allowed-ips", "0.0.0.0",
+		"endpoint", tunnel.Endpoint,
+		"peer", oldPublicKey,
+		"remove")
+	return err
+}
+
+// RemoveTunnel deletes a tunnel interface. One that is gone already is
+// not an error.
+func (self Tunnels) RemoveTunnel(virtualInterface string) error {
+	_, err := execCommand("ip", "link", "del", virtualInterface)
+	if err != nil && regexp.MustCompile(`Cannot find device`).MatchString(err.Error()) {
+		return nil
+	}
+	return err
+}
+
+// Up returns whether a tunnel interface exists and is up.
+func (self Tunnels) Up(virtualInterface string) bool {
+	iface, err := net.InterfaceByName(virtualInterface)
+	return err == nil && iface.Flags&net.FlagUp != 0
+}
+
+// writeKeyFile writes a private key to a file only root can read, for wg to
+// read it from. The caller removes it.
+func writeKeyFile(privateKey string) (string, error) {
+	file, err := ioutil.TempFile("", "scrooge-key")
+	if err != nil {
+		return "", err
+	}
+
+	err = file.Chmod(0600)
+	if err == nil {
+		_, err = file.Write([]byte(privateKey))
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	return file.Name(), nil
+}
+
+// Transfer returns the bytes received and sent on a tunnel interface.
+func Transfer(virtualInterface string) (uint64, uint64, error) {
+	out, err := execCommand("wg", "show", virtualInterface, "transfer")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rx, tx, err := ParseTransfer(string(out))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if Metrics != nil {
+		Metrics.Set("scrooge_tunnel_received_bytes_total", float64(rx), "interface", virtualInterface)
+		Metrics.Set("scrooge_tunnel_sent_bytes_total", float64(tx), "interface", virtualInterface)
+	}
+	return rx, tx, nil
+}
+
+// ParseTransfer parses the output of `wg show <interface> transfer`, which
+// has one "<peer publicKey>\t<rx bytes>\t<tx bytes>" line per peer.
+func ParseTransfer(s string) (uint64, uint64, error) {
+	var rx, tx uint64
+
+	for _, line := range strings.Split(strings.TrimSpace(s), "\n") {
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return 0, 0, errors.New("could not parse transfer: " + line)
+		}
+
+		peerRx, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		peerTx, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		rx = rx + peerRx
+		tx = tx + peerTx
+	}
+
+	return rx, tx, nil
+}
+
 type WireguardConfig struct {
 	PrivateKey string
 	ListenPort int
@@ -71,3 +71,61 @@ AllowedIPs = 10.192.122.3/32, 10.192.124.1/24`
 
 	fmt.Println(config.Peer.AllowedIPs[0])
 }
+
+func TestParseTransfer(t *testing.T) {
+	rx, tx, err := ParseTransfer("xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=\t2048\t1024\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rx != 2048 || tx != 1024 {
+		t.Fatal("transfer incorrect: ", rx, tx)
+	}
+
+	rx, tx, err = ParseTransfer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rx != 0 || tx != 0 {
+		t.Fatal("transfer of tunnel without peers incorrect: ", rx, tx)
+	}
+}
+
+func TestPublicKey(t *testing.T) {
+	publicKey, err := PublicKey(account1.TunnelPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if publicKey != account1.TunnelPublicKey {
+		t.Fatal("public key incorrect: ", publicKey)
+	}
+
+	_, err = PublicKey("derp")
+	if err == nil {
+		t.Fatal("no error for bad private key")
+	}
+}
+
+func TestNewKeys(t *testing.T) {
+	publicKey, privateKey, err := NewKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	derived, err := PublicKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if derived != publicKey {
+		t.Fatal("public key does not match private key")
+	}
+
+	otherPublicKey, _, err := NewKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherPublicKey == publicKey {
+		t.Fatal("same keys twice")
+	}
+}